@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -9,9 +11,15 @@ import (
 	"net/url"
 	"path"
 	"strconv"
+	"time"
+
+	"github.com/NYTimes/gziphandler"
 
 	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/health"
 	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/reports"
 )
 
 var (
@@ -20,27 +28,89 @@ var (
 	// errCodes is a mapping from known errors to HTTP status codes
 	errCodes = map[error]int{
 		models.ErrNotFound:         http.StatusNotFound,
+		models.ErrUnsupported:      http.StatusNotImplemented,
 		models.ErrInvalidRouteType: http.StatusBadRequest,
 		errBadRequest:              http.StatusBadRequest,
+		reports.ErrBadGroupBy:      http.StatusBadRequest,
+	}
+
+	// errNames is a mapping from HTTP status codes to the code we
+	// return in an errorResponse
+	errNames = map[int]string{
+		http.StatusBadRequest:          "bad_request",
+		http.StatusNotFound:            "not_found",
+		http.StatusInternalServerError: "internal_error",
+		http.StatusNotImplemented:      "not_implemented",
 	}
 
+	// apiPrefixes are the paths that API endpoints are served under. The
+	// unversioned prefix is an alias for v1 for older clients.
+	apiPrefixes = []string{"/api/v1/", "/api/"}
+
 	staticPaths = []string{"js", "css", "img"}
 )
 
+// errorResponse is the body of every API error
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// errorBody describes an error. Code is a short value for programs to
+// check and Message is a description for people.
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// paramError is a validation error for a single request parameter
+type paramError struct {
+	param  string
+	val    string
+	reason string
+}
+
+func (e paramError) Error() string {
+	return fmt.Sprintf("%s: %q %s", e.param, e.val, e.reason)
+}
+
 func NewHandler() http.Handler {
 	mux := http.NewServeMux()
 
-	// Get stop / route / trip info close to here
-	mux.HandleFunc("/api/here", getHere)
+	for _, prefix := range apiPrefixes {
+		// Get stop / route / trip info close to here
+		mux.HandleFunc(prefix+"here", jsonHandler(getHere))
+
+		// Get routes that should be preloaded
+		//mux.HandleFunc(prefix+"routes", getRoutes)
+
+		// Get a single route by agency_id / route_id
+		mux.HandleFunc(prefix+"route", jsonHandler(getRoute))
 
-	// Get routes that should be preloaded
-	//mux.HandleFunc("/api/routes", getRoutes)
+		// Get a single trip by agency_id / route_id / trip_id
+		mux.HandleFunc(prefix+"trip", jsonHandler(getTrip))
 
-	// Get a single route by agency_id / route_id
-	mux.HandleFunc("/api/route", getRoute)
+		// Stream stops and live departures as Server-Sent Events
+		mux.HandleFunc(prefix+"stream", jsonHandler(getStream))
 
-	// Get a single trip by agency_id / route_id / trip_id
-	mux.HandleFunc("/api/trip", getTrip)
+		// On-time performance of archived live departures
+		mux.HandleFunc(prefix+"reports/otp", jsonHandler(getOTPReport))
+	}
+
+	// Describe the API
+	mux.HandleFunc("/api/v1/openapi.json", jsonHandler(getOpenAPI))
+
+	// Vector tiles of stops and routes
+	mux.HandleFunc("/tiles/", getTile)
+
+	// PNG maps of a single trip or stop, used as link previews
+	mux.HandleFunc("/map/trip.png", getTripMap)
+	mux.HandleFunc("/map/stop.png", getStopMap)
+
+	// Our live data as GTFS-realtime and SIRI feeds
+	mux.HandleFunc("/gtfs-rt/trip-updates.pb", getTripUpdates)
+	mux.HandleFunc("/gtfs-rt/vehicle-positions.pb", getVehiclePositions)
+	mux.HandleFunc("/siri/vehicle-monitoring.json", jsonHandler(getVehicleMonitoring))
+	mux.HandleFunc("/siri/stop-monitoring.json", jsonHandler(getStopMonitoring))
 
 	// Add specific handlers for each static directory. These will
 	// be served directly.
@@ -55,13 +125,52 @@ func NewHandler() http.Handler {
 	// timestamp and also to possibly allow different caching treatment.
 	mux.HandleFunc("/", getIndex)
 
+	// Server-rendered pages for a single stop or route, and the
+	// sitemaps that list them
+	mux.HandleFunc("/stop/", getStopPage)
+	mux.HandleFunc("/route/", getRoutePage)
+	mux.HandleFunc("/sitemap.xml", getSitemapIndex)
+	mux.HandleFunc("/sitemap/", getSitemap)
+
 	mux.HandleFunc("/robots.txt", getRobots)
 
+	// Whether we're alive and ready for requests
+	health.Handle(mux)
+
 	return mux
 }
 
-func getRobots(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "User-Agent: *\nDisallow: /api/\n")
+// Serve listens for HTTP connections on addr and serves the API, pushing
+// updates to streams when busprecache has new data. It blocks until there
+// is an error or ctx is done, when it waits for requests to finish and
+// ends any streams.
+func Serve(ctx context.Context, addr string) error {
+	handler := NewHandler()
+
+	// Streams are flushed after each event, so they can't be gzipped
+	withgz := http.NewServeMux()
+	withgz.Handle("/", gziphandler.GzipHandler(handler))
+	withgz.Handle("/api/stream", handler)
+	withgz.Handle("/api/v1/stream", handler)
+
+	srv := &http.Server{Addr: addr, Handler: withgz}
+
+	// Streams don't finish on their own, so we end them when we stop
+	// and clients reconnect to another server
+	srv.RegisterOnShutdown(stopStreams)
+
+	// Push to streams when busprecache has new data
+	go ListenUpdates()
+
+	if conf.API.HereIndex {
+		go KeepHereIndex()
+	}
+
+	if conf.API.MaxDataAge > 0 {
+		health.Add("data", checkData)
+	}
+
+	return etc.Serve(ctx, srv)
 }
 
 func getIndex(w http.ResponseWriter, r *http.Request) {
@@ -97,22 +206,32 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 
 	indexTemplate.Execute(w, map[string]interface{}{
 		"BuildTimestamp": conf.API.BuildTimestamp,
+		"OpenGraph":      indexOpenGraph(r),
 	})
 }
 
-func floatOrDie(val string) (f float64, err error) {
+// jsonHandler sets the content type of API responses. Handlers that
+// send something else can override it.
+func jsonHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		h(w, r)
+	}
+}
+
+func floatOrDie(name, val string) (f float64, err error) {
 
 	f, err = strconv.ParseFloat(val, 64)
 	if err != nil {
-		log.Println("bad float value", val, err)
-		err = errBadRequest
+		log.Println("bad float value", name, val, err)
+		err = paramError{name, val, "is not a number"}
 		return
 	}
 
 	return
 }
 
-func boolOrDie(val string) (b bool, err error) {
+func boolOrDie(name, val string) (b bool, err error) {
 
 	if len(val) < 1 {
 		b = false
@@ -121,8 +240,34 @@ func boolOrDie(val string) (b bool, err error) {
 
 	b, err = strconv.ParseBool(val)
 	if err != nil {
-		log.Println("bad bool value", val, err)
-		err = errBadRequest
+		log.Println("bad bool value", name, val, err)
+		err = paramError{name, val, "is not true or false"}
+		return
+	}
+
+	return
+}
+
+// minutesOrDie parses val as a number of minutes. If val is empty, def
+// is returned. Values that are negative or greater than max are rejected.
+func minutesOrDie(name, val string, def, max time.Duration) (d time.Duration, err error) {
+
+	if len(val) < 1 {
+		d = def
+		return
+	}
+
+	mins, err := strconv.Atoi(val)
+	if err != nil {
+		log.Println("bad minutes value", name, val, err)
+		err = paramError{name, val, "is not a whole number of minutes"}
+		return
+	}
+
+	d = time.Duration(mins) * time.Minute
+	if d < 0 || d > max {
+		log.Println("minutes value out of range", name, val, max)
+		err = paramError{name, val, fmt.Sprintf("must be between 0 and %.0f", max.Minutes())}
 		return
 	}
 
@@ -130,12 +275,34 @@ func boolOrDie(val string) (b bool, err error) {
 }
 
 // apiErr writes an appropriate response to w given the incoming error
-// by looking at the errCodes map
+// by looking at the errCodes map. The body is an errorResponse. Only
+// messages of known errors are sent, anything else is an internal error.
 func apiErr(w http.ResponseWriter, err error) {
+	var resp errorResponse
+
 	code, ok := errCodes[err]
 	if !ok {
 		code = http.StatusInternalServerError
 	}
 
+	switch v := err.(type) {
+	case paramError:
+		code = http.StatusBadRequest
+		resp.Error = errorBody{Code: "invalid_parameter", Message: v.Error()}
+
+	default:
+		resp.Error = errorBody{Code: errNames[code], Message: http.StatusText(code)}
+		if ok {
+			resp.Error.Message = err.Error()
+		}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("can't marshal error to json", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
+	w.Write(b)
 }
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
@@ -26,10 +28,31 @@ var (
 	bloomM uint = 4314
 	bloomK uint = 10
 
-	minFirstDepartureTime = time.Duration(2) * time.Hour
+	// defaultLookahead is how far past now we look for departures when
+	// the request doesn't specify lookahead_mins
+	defaultLookahead = time.Duration(3) * time.Hour
+
+	// maxLookahead is the widest window a request can ask for
+	maxLookahead = time.Duration(24) * time.Hour
+
+	// defaultFirstDeparture is how soon the first departure at a stop
+	// must be for us to get its trip when the request doesn't specify
+	// first_departure_mins
+	defaultFirstDeparture = time.Duration(2) * time.Hour
+
+	// maxRadius is the largest radius in meters a request can search
+	maxRadius = 10000.0
+
+	// maxPolygonArea is the largest polygon in square meters a request
+	// can search, which is the same as the largest radius
+	maxPolygonArea = math.Pi * maxRadius * maxRadius
+
+	// maxPolygonVertices is the most points a polygon can have
+	maxPolygonVertices = 1000
 )
 
-// hereResponse is the value returned by getHere
+// hereResponse is the value returned by getHere. It's documented as
+// HereResponse in openAPIDoc.
 type hereResponse struct {
 	Stops  []*models.Stop     `json:"stops"`
 	Routes []*models.Route    `json:"routes"`
@@ -37,6 +60,123 @@ type hereResponse struct {
 	Filter *bloom.BloomFilter `json:"filter"`
 }
 
+// hereParams are the values from a request that determine which stops
+// and departures we look for
+type hereParams struct {
+	lat        float64
+	lon        float64
+	area       models.HereArea
+	routeTypes []int
+	lookahead  time.Duration
+}
+
+// readHereParams reads the search area and filters of a request
+func readHereParams(r *http.Request) (hp hereParams, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		log.Println("can't parse form", err)
+		err = errBadRequest
+		return
+	}
+
+	// Stops and routes may be requested by ID, in which case we
+	// don't need any other area
+	hp.area.StopIDs = r.Form["stop_id"]
+	hp.area.RouteIDs = r.Form["route_id"]
+	idsOnly := (len(hp.area.StopIDs) > 0 || len(hp.area.RouteIDs) > 0) &&
+		len(r.FormValue("polygon")) < 1 &&
+		len(r.FormValue("radius")) < 1 &&
+		len(r.FormValue("sw_lat")) < 1
+
+	if !idsOnly || len(r.FormValue("lat")) > 0 {
+		hp.lat, err = floatOrDie("lat", r.FormValue("lat"))
+		if err != nil {
+			return
+		}
+
+		hp.lon, err = floatOrDie("lon", r.FormValue("lon"))
+		if err != nil {
+			return
+		}
+	}
+
+	// The search area is a polygon, a radius around lat/lon or a box
+	switch {
+	case idsOnly:
+		// There's nothing else to read
+
+	case len(r.FormValue("polygon")) > 0:
+		var p models.Polygon
+		p, err = models.ParsePolygon(r.FormValue("polygon"))
+		if err != nil {
+			log.Println("bad polygon value", err)
+			err = paramError{"polygon", r.FormValue("polygon"), err.Error()}
+			return
+		}
+
+		if p.Vertices > maxPolygonVertices || p.Area > maxPolygonArea {
+			log.Println("polygon too big", p.Vertices, p.Area)
+			err = paramError{"polygon", r.FormValue("polygon"), fmt.Sprintf("must have at most %d points and %.0f square meters", maxPolygonVertices, maxPolygonArea)}
+			return
+		}
+
+		hp.area.Polygon = p.WKT
+
+	case len(r.FormValue("radius")) > 0:
+		hp.area.Radius, err = floatOrDie("radius", r.FormValue("radius"))
+		if err != nil {
+			return
+		}
+
+		if hp.area.Radius <= 0 || hp.area.Radius > maxRadius {
+			log.Println("radius out of range", hp.area.Radius)
+			err = paramError{"radius", r.FormValue("radius"), fmt.Sprintf("must be greater than 0 and at most %.0f", maxRadius)}
+			return
+		}
+
+	default:
+		hp.area.SWLat, err = floatOrDie("sw_lat", r.FormValue("sw_lat"))
+		if err != nil {
+			return
+		}
+
+		hp.area.SWLon, err = floatOrDie("sw_lon", r.FormValue("sw_lon"))
+		if err != nil {
+			return
+		}
+
+		hp.area.NELat, err = floatOrDie("ne_lat", r.FormValue("ne_lat"))
+		if err != nil {
+			return
+		}
+
+		hp.area.NELon, err = floatOrDie("ne_lon", r.FormValue("ne_lon"))
+		if err != nil {
+			return
+		}
+	}
+
+	hp.lookahead, err = minutesOrDie("lookahead_mins", r.FormValue("lookahead_mins"), defaultLookahead, maxLookahead)
+	if err != nil {
+		return
+	}
+
+	for _, v := range r.Form["route_type"] {
+		var intv int
+
+		intv, err = strconv.Atoi(v)
+		if err != nil {
+			log.Println("bad route_type value", v, err)
+			err = paramError{"route_type", v, "is not a route type number"}
+			return
+		}
+
+		hp.routeTypes = append(hp.routeTypes, intv)
+	}
+
+	return
+}
+
 func getHere(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var resp hereResponse
@@ -47,57 +187,39 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 		now, err = time.ParseInLocation("2006-01-02 15:04:05", r.FormValue("now"), time.Local)
 		if err != nil {
 			log.Println("can't parse time", err)
-			apiErr(w, errBadRequest)
+			apiErr(w, paramError{"now", r.FormValue("now"), "is not like 2006-01-02 15:04:05"})
 			return
 		}
 	} else {
-		now = time.Now()
+		now = etc.Now()
 	}
 
 	// Read values incoming from http request
-	lat, err := floatOrDie(r.FormValue("lat"))
+	hp, err := readHereParams(r)
 	if err != nil {
 		apiErr(w, err)
 		return
 	}
 
-	lon, err := floatOrDie(r.FormValue("lon"))
+	includeRoutes, err := boolOrDie("routes", r.FormValue("routes"))
 	if err != nil {
 		apiErr(w, err)
 		return
 	}
 
-	SWLat, err := floatOrDie(r.FormValue("sw_lat"))
+	includeTrips, err := boolOrDie("trips", r.FormValue("trips"))
 	if err != nil {
 		apiErr(w, err)
 		return
 	}
 
-	SWLon, err := floatOrDie(r.FormValue("sw_lon"))
+	firstDeparture, err := minutesOrDie("first_departure_mins", r.FormValue("first_departure_mins"), defaultFirstDeparture, maxLookahead)
 	if err != nil {
 		apiErr(w, err)
 		return
 	}
 
-	NELat, err := floatOrDie(r.FormValue("ne_lat"))
-	if err != nil {
-		apiErr(w, err)
-		return
-	}
-
-	NELon, err := floatOrDie(r.FormValue("ne_lon"))
-	if err != nil {
-		apiErr(w, err)
-		return
-	}
-
-	includeRoutes, err := boolOrDie(r.FormValue("routes"))
-	if err != nil {
-		apiErr(w, err)
-		return
-	}
-
-	includeTrips, err := boolOrDie(r.FormValue("trips"))
+	geoJSON, err := wantGeoJSON(r)
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -106,16 +228,6 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 	// Initialize or read incoming bloom filter
 	filter := r.FormValue("filter")
 
-	var routeTypes []int
-	for _, v := range r.Form["route_type"] {
-		intv, err := strconv.Atoi(v)
-		if err != nil {
-			apiErr(w, errBadRequest)
-		}
-
-		routeTypes = append(routeTypes, intv)
-	}
-
 	if len(filter) < 1 {
 		// If there is no filter, then create a new one
 		resp.Filter = bloom.New(bloomM, bloomK)
@@ -126,28 +238,13 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 		err = json.Unmarshal([]byte(filter), resp.Filter)
 		if err != nil {
 			log.Println("can't read incoming bloom filter JSON", err)
-			apiErr(w, errBadRequest)
+			apiErr(w, paramError{"filter", filter, "is not a bloom filter from a previous response"})
 			return
 		}
 	}
 
-	tx, err := etc.DBConn.Beginx()
-	if err != nil {
-		log.Println("can't create transaction", err)
-		apiErr(w, err)
-		return
-	}
-
-	_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL READ COMMITTED READ ONLY")
-	if err != nil {
-		log.Println("can't set iso level", err)
-		apiErr(w, err)
-		return
-	}
-	defer tx.Commit()
-
 	hq, err := models.NewHereQuery(
-		lat, lon, SWLat, SWLon, NELat, NELon, routeTypes, now,
+		hp.lat, hp.lon, hp.area, hp.routeTypes, now, hp.lookahead,
 	)
 	if err != nil {
 		log.Println("can't create here query", err)
@@ -155,7 +252,9 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stops, stopRoutes, err := models.GetHereResults(tx, hq)
+	// With the here index loaded, hq and its results don't use the
+	// database
+	stops, stopRoutes, err := models.GetHereResults(etc.DBConn, hq)
 	if err != nil {
 		log.Println("can't get here results", err)
 		apiErr(w, err)
@@ -243,7 +342,7 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		if now.Add(minFirstDepartureTime).Before(stop.Departures[0].Time) {
+		if now.Add(firstDeparture).Before(stop.Departures[0].Time) {
 			continue
 		}
 
@@ -321,6 +420,26 @@ func getHere(w http.ResponseWriter, r *http.Request) {
 		resp.Trips = append(resp.Trips, tripReq.Trip)
 	}
 
+	if geoJSON {
+		fc := newFeatureCollection()
+		for _, stop := range resp.Stops {
+			fc.addStop(stop)
+		}
+		for _, route := range resp.Routes {
+			fc.addRoute(route)
+		}
+		routeByID := map[string]*models.Route{}
+		for _, route := range routes {
+			routeByID[route.UniqueID] = route
+		}
+		for _, trip := range resp.Trips {
+			fc.addTrip(trip, routeByID[trip.AgencyID+"|"+trip.RouteID])
+		}
+
+		writeGeoJSON(w, fc)
+		return
+	}
+
 	b, err := json.Marshal(resp)
 	if err != nil {
 		log.Println("can't marshal to json", err)
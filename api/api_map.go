@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"image/color"
+	"log"
+	"net/http"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+	"github.com/brnstz/bus/internal/staticmap"
+)
+
+const (
+	// mapWidth and mapHeight are the size of map images, which is the
+	// size recommended for OpenGraph images
+	mapWidth  = 1200
+	mapHeight = 630
+
+	// stopMapMeters is how much of the area around a stop is shown and
+	// stopRouteMeters is how close a route's stop must be to be drawn
+	stopMapMeters   = 1200.0
+	stopRouteMeters = 400.0
+)
+
+var (
+	white     = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	darkGray  = color.RGBA{0x33, 0x33, 0x33, 0xFF}
+	lightGray = color.RGBA{0xAA, 0xAA, 0xAA, 0xFF}
+)
+
+// routeColor returns the color to draw route with. White routes would
+// not be visible on the map background, so they are drawn gray.
+func routeColor(route *models.Route) color.RGBA {
+	if route == nil {
+		return darkGray
+	}
+
+	c := staticmap.ParseColor(route.Color, darkGray)
+	if c == white {
+		return darkGray
+	}
+
+	return c
+}
+
+// addShape adds a line through the shape's points to m
+func addShape(m *staticmap.Map, shapes []*models.Shape, c color.RGBA, width float64) {
+	var lats, lons []float64
+
+	for _, s := range shapes {
+		if !s.Lat.Valid || !s.Lon.Valid {
+			continue
+		}
+		lats = append(lats, s.Lat.Float64)
+		lons = append(lons, s.Lon.Float64)
+	}
+
+	m.AddLine(lats, lons, c, width)
+}
+
+// writePNG writes m as the response
+func writePNG(w http.ResponseWriter, m *staticmap.Map, maxAge string) {
+	var buf bytes.Buffer
+
+	err := m.Encode(&buf)
+	if err != nil {
+		log.Println("can't encode png", err)
+		apiErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age="+maxAge)
+	w.Write(buf.Bytes())
+}
+
+// getTripMap draws a trip's shape, its stops and the live vehicles on its
+// route
+func getTripMap(w http.ResponseWriter, r *http.Request) {
+	agencyID := r.FormValue("agency_id")
+	routeID := r.FormValue("route_id")
+	tripID := r.FormValue("trip_id")
+	fallbackTripID := r.FormValue("fallback_trip_id")
+
+	trip, err := models.ReallyGetTrip(etc.DBConn, agencyID, routeID, tripID, fallbackTripID, true)
+	if err != nil {
+		log.Println("can't get trip", err)
+		apiErr(w, err)
+		return
+	}
+
+	// Route info is optional, so continue without it on error
+	route, err := models.GetRoute(etc.DBConn, trip.AgencyID, trip.RouteID)
+	if err != nil {
+		log.Println("can't get route for trip", err)
+		route = nil
+	}
+	c := routeColor(route)
+
+	m := staticmap.New(mapWidth, mapHeight)
+
+	addShape(m, trip.ShapePoints, c, 8)
+
+	for _, stop := range trip.Stops {
+		if stop.Lat.Valid && stop.Lon.Valid {
+			m.AddPoint(stop.Lat.Float64, stop.Lon.Float64, white, c, 7)
+		}
+	}
+
+	// Live vehicles are for the whole route and direction, so we can use
+	// any stop of the trip to get them
+	if route != nil && len(trip.Stops) > 0 {
+		partner, err := partners.Find(*route)
+		if err == nil && partner.IsLive() {
+			_, vehicles, err := partner.Live(
+				trip.AgencyID, trip.RouteID, trip.Stops[0].StopID, trip.DirectionID,
+			)
+			if err != nil {
+				log.Println("can't get live vehicles for trip", err)
+			}
+
+			for _, v := range vehicles {
+				m.AddPoint(v.Lat, v.Lon, c, darkGray, 14)
+			}
+		}
+	}
+
+	writePNG(w, m, "60")
+}
+
+// getStopMap draws a stop and the routes that are nearby
+func getStopMap(w http.ResponseWriter, r *http.Request) {
+	agencyID := r.FormValue("agency_id")
+	stopID := r.FormValue("stop_id")
+
+	stops, err := models.GetStops(etc.DBConn, agencyID, stopID)
+	if err != nil {
+		log.Println("can't get stops", err)
+		apiErr(w, err)
+		return
+	}
+
+	stop := stops[0]
+	if !stop.Lat.Valid || !stop.Lon.Valid {
+		apiErr(w, models.ErrNotFound)
+		return
+	}
+	lat, lon := stop.Lat.Float64, stop.Lon.Float64
+
+	routes, err := models.GetNearbyRoutes(etc.DBConn, lat, lon, stopRouteMeters)
+	if err != nil {
+		log.Println("can't get nearby routes", err)
+		apiErr(w, err)
+		return
+	}
+
+	m := staticmap.New(mapWidth, mapHeight)
+	m.Center(lat, lon, stopMapMeters)
+
+	// Draw the routes that serve this stop on top of other nearby routes
+	serves := map[string]bool{}
+	for _, s := range stops {
+		serves[s.RouteID] = true
+	}
+
+	for _, top := range []bool{false, true} {
+		for _, route := range routes {
+			if (route.AgencyID == agencyID && serves[route.RouteID]) != top {
+				continue
+			}
+
+			c, width := lightGray, 4.0
+			if top {
+				c, width = routeColor(route), 8.0
+			}
+
+			shapes, err := models.GetSavedRouteShapes(etc.DBConn, route.AgencyID, route.RouteID)
+			if err != nil {
+				log.Println("can't get route shapes", err)
+				continue
+			}
+
+			for _, rs := range shapes {
+				addShape(m, rs.Shapes, c, width)
+			}
+		}
+	}
+
+	m.AddPoint(lat, lon, white, darkGray, 16)
+
+	writePNG(w, m, "3600")
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/brnstz/bus/internal/partners/transit_realtime"
+	"github.com/brnstz/bus/realtime"
+)
+
+// writeFeed writes a GTFS-realtime feed as the response
+func writeFeed(w http.ResponseWriter, fm *transit_realtime.FeedMessage) {
+	b, err := proto.Marshal(fm)
+	if err != nil {
+		log.Println("can't marshal feed", err)
+		apiErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+}
+
+// writeSiri writes a SIRI response as JSON
+func writeSiri(w http.ResponseWriter, resp *realtime.Siri) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("can't marshal siri response", err)
+		apiErr(w, err)
+		return
+	}
+
+	w.Write(b)
+}
+
+// getTripUpdates is a GTFS-realtime feed of trip updates, for a single
+// agency if agency_id is given
+func getTripUpdates(w http.ResponseWriter, r *http.Request) {
+	s, err := realtime.Get()
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	writeFeed(w, s.TripUpdatesFeed(r.FormValue("agency_id")))
+}
+
+// getVehiclePositions is a GTFS-realtime feed of vehicle positions, for a
+// single agency if agency_id is given
+func getVehiclePositions(w http.ResponseWriter, r *http.Request) {
+	s, err := realtime.Get()
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	writeFeed(w, s.VehiclePositionsFeed(r.FormValue("agency_id")))
+}
+
+// getVehicleMonitoring is a SIRI VehicleMonitoring response, for a single
+// line if LineRef is given
+func getVehicleMonitoring(w http.ResponseWriter, r *http.Request) {
+	s, err := realtime.Get()
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	writeSiri(w, s.VehicleMonitoring(r.FormValue("LineRef")))
+}
+
+// getStopMonitoring is a SIRI StopMonitoring response for the stop
+// MonitoringRef
+func getStopMonitoring(w http.ResponseWriter, r *http.Request) {
+	monitoringRef := r.FormValue("MonitoringRef")
+	if len(monitoringRef) < 1 {
+		apiErr(w, paramError{"MonitoringRef", monitoringRef, "is required"})
+		return
+	}
+
+	s, err := realtime.Get()
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	writeSiri(w, s.StopMonitoring(monitoringRef))
+}
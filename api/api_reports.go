@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/reports"
+)
+
+// maxReportDays is the longest range a report request can ask for
+const maxReportDays = 31
+
+// otpResponse is the value returned by getOTPReport. It's documented as
+// OTPResponse in openAPIDoc.
+type otpResponse struct {
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Results []*reports.OTP `json:"results"`
+}
+
+// getOTPReport returns the on-time performance and headway regularity of
+// an agency's archived departures, worst first
+func getOTPReport(w http.ResponseWriter, r *http.Request) {
+	agencyID := r.FormValue("agency_id")
+	if len(agencyID) < 1 {
+		apiErr(w, paramError{"agency_id", agencyID, "is required"})
+		return
+	}
+
+	for _, name := range []string{"start", "end"} {
+		val := r.FormValue(name)
+		if len(val) < 1 {
+			continue
+		}
+
+		_, err := time.Parse("2006-01-02", val)
+		if err != nil {
+			apiErr(w, paramError{name, val, "is not a date like 2016-06-12"})
+			return
+		}
+	}
+
+	start, end, err := reports.ParseDates(r.FormValue("start"), r.FormValue("end"))
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+	if !end.After(start) || end.After(start.AddDate(0, 0, maxReportDays)) {
+		apiErr(w, paramError{"end", r.FormValue("end"), fmt.Sprintf("must be within %d days after start", maxReportDays)})
+		return
+	}
+
+	var groupBy []string
+	if len(r.FormValue("group_by")) > 0 {
+		groupBy = strings.Split(r.FormValue("group_by"), ",")
+	}
+
+	results, err := reports.GetOTP(etc.DBConn, reports.Params{
+		AgencyID: agencyID,
+		RouteID:  r.FormValue("route_id"),
+		Start:    start,
+		End:      end,
+		GroupBy:  groupBy,
+		Early:    reports.DefaultEarly,
+		Late:     reports.DefaultLate,
+	})
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	resp := otpResponse{Start: start, End: end, Results: results}
+	if resp.Results == nil {
+		resp.Results = []*reports.OTP{}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("can't marshal to json", err)
+		apiErr(w, err)
+		return
+	}
+
+	w.Write(b)
+}
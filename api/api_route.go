@@ -13,6 +13,12 @@ func getRoute(w http.ResponseWriter, r *http.Request) {
 	agencyID := r.FormValue("agency_id")
 	routeID := r.FormValue("route_id")
 
+	geoJSON, err := wantGeoJSON(r)
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
 	route, err := models.GetRoute(etc.DBConn, agencyID, routeID)
 	if err != nil {
 		log.Println("can't get route", err)
@@ -28,6 +34,13 @@ func getRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if geoJSON {
+		fc := newFeatureCollection()
+		fc.addRoute(route)
+		writeGeoJSON(w, fc)
+		return
+	}
+
 	b, err := json.Marshal(route)
 	if err != nil {
 		log.Println("can't marshal route to json", err)
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/fuse"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+)
+
+var (
+	errNoStreaming = errors.New("streaming not supported")
+
+	// streamMinInterval is the shortest time between pushes to a
+	// single stream, so that many updates at once are sent together
+	streamMinInterval = time.Duration(5) * time.Second
+
+	// streamRefresh is how often we push to a stream even if there are
+	// no updates, so that scheduled departures stay current
+	streamRefresh = time.Duration(60) * time.Second
+
+	// streamPing is how often we send a comment to keep idle
+	// connections open
+	streamPing = time.Duration(30) * time.Second
+
+	// updateRetry is how long we wait to subscribe again after losing
+	// our cache subscription
+	updateRetry = time.Duration(5) * time.Second
+
+	streams = &streamHub{subs: map[*stream]bool{}}
+
+	// streamsStopped is closed by stopStreams
+	streamsStopped     = make(chan bool)
+	streamsStoppedOnce sync.Once
+)
+
+// stopStreams ends every stream, including any that are started later
+func stopStreams() {
+	streamsStoppedOnce.Do(func() {
+		close(streamsStopped)
+	})
+}
+
+// stream is a single client subscribed to updates
+type stream struct {
+	// keys are the partner cache keys that affect this stream. They are
+	// only used while holding the hub's lock.
+	keys map[string]bool
+
+	// notify gets a value when any of keys is updated. It's buffered
+	// so that many updates result in a single push.
+	notify chan bool
+}
+
+// streamHub fans out updates from the cache to each stream
+type streamHub struct {
+	sync.Mutex
+	subs map[*stream]bool
+}
+
+func (h *streamHub) add(s *stream) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.subs[s] = true
+}
+
+func (h *streamHub) remove(s *stream) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subs, s)
+}
+
+func (h *streamHub) setKeys(s *stream, keys map[string]bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	s.keys = keys
+}
+
+// publish notifies every stream that is affected by key k
+func (h *streamHub) publish(k string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for s := range h.subs {
+		if !s.keys[k] {
+			continue
+		}
+
+		select {
+		case s.notify <- true:
+		default:
+			// There's already a pending notification
+		}
+	}
+}
+
+// ListenUpdates subscribes to the channel where busprecache publishes
+// the keys of new partner data and notifies any affected streams. It
+// runs forever and is started by Serve.
+func ListenUpdates() {
+	for {
+		err := etc.Cache.Subscribe(conf.Cache.RedisUpdateChannel, streams.publish)
+		log.Println("lost cache update subscription", err)
+		time.Sleep(updateRetry)
+	}
+}
+
+// streamResponse is the data of each event sent by getStream. It's
+// documented as StreamResponse in openAPIDoc.
+type streamResponse struct {
+	Stops []*models.Stop `json:"stops"`
+}
+
+// getStream sends Server-Sent Events with the stops and live
+// departures for an area, which is requested with the same values as
+// getHere. An event is sent when we connect and again whenever
+// busprecache saves new data for any of the stops' routes.
+func getStream(w http.ResponseWriter, r *http.Request) {
+	var lastPush time.Time
+
+	// delayed fires when we can push an update that arrived too soon
+	// after the last push. It's nil when there isn't one waiting.
+	var delayed <-chan time.Time
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("response writer can't flush")
+		apiErr(w, errNoStreaming)
+		return
+	}
+
+	hp, err := readHereParams(r)
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	s := &stream{notify: make(chan bool, 1)}
+	streams.add(s)
+	defer streams.remove(s)
+
+	refresh := time.NewTicker(streamRefresh)
+	defer refresh.Stop()
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+
+	push := true
+	for {
+		if push {
+			stops, keys, err := liveStops(hp, etc.Now())
+			if err != nil {
+				log.Println("can't get stops for stream", err)
+				return
+			}
+
+			streams.setKeys(s, keys)
+
+			b, err := json.Marshal(streamResponse{Stops: stops})
+			if err != nil {
+				log.Println("can't marshal to json", err)
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "event: stops\ndata: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+			lastPush = time.Now()
+			push = false
+			delayed = nil
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-streamsStopped:
+			return
+
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-refresh.C:
+			push = true
+
+		case <-s.notify:
+			// Wait for more updates to arrive if we've pushed recently,
+			// while still pinging and noticing when we're done
+			wait := streamMinInterval - time.Now().Sub(lastPush)
+			if wait <= 0 {
+				push = true
+			} else if delayed == nil {
+				delayed = time.After(wait)
+			}
+
+		case <-delayed:
+			push = true
+		}
+	}
+}
+
+// liveStops returns the stops for these params with any live departures
+// and vehicles, along with the partner cache keys of their routes
+func liveStops(hp hereParams, now time.Time) (stops []*models.Stop, keys map[string]bool, err error) {
+	keys = map[string]bool{}
+
+	tx, err := etc.DBConn.Beginx()
+	if err != nil {
+		log.Println("can't create transaction", err)
+		return
+	}
+	defer tx.Commit()
+
+	_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL READ COMMITTED READ ONLY")
+	if err != nil {
+		log.Println("can't set iso level", err)
+		return
+	}
+
+	hq, err := models.NewHereQuery(
+		hp.lat, hp.lon, hp.area, hp.routeTypes, now, hp.lookahead,
+	)
+	if err != nil {
+		log.Println("can't create here query", err)
+		return
+	}
+
+	stops, stopRoutes, err := models.GetHereResults(tx, hq)
+	if err != nil {
+		log.Println("can't get here results", err)
+		return
+	}
+
+	respch := make(chan error, len(stops))
+	count := 0
+
+	for _, s := range stops {
+		partner, perr := partners.Find(*stopRoutes[s.UniqueID])
+		if perr != nil {
+			continue
+		}
+
+		k := partner.Key(s.AgencyID, s.RouteID, s.DirectionID)
+		if len(k) > 0 {
+			keys[k] = true
+		}
+
+		fuse.StopChan <- &fuse.StopReq{
+			Stop:     s,
+			Partner:  partner,
+			Response: respch,
+		}
+		count++
+	}
+
+	for i := 0; i < count; i++ {
+		lerr := <-respch
+		if lerr != nil {
+			log.Println(lerr)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// getTile serves a Mapbox Vector Tile at /tiles/{z}/{x}/{y}.mvt with a
+// routes layer and a stops layer
+func getTile(w http.ResponseWriter, r *http.Request) {
+	var z, x, y int
+
+	_, err := fmt.Sscanf(r.URL.Path, "/tiles/%d/%d/%d.mvt", &z, &x, &y)
+	if err != nil || r.URL.Path != fmt.Sprintf("/tiles/%d/%d/%d.mvt", z, x, y) {
+		apiErr(w, models.ErrNotFound)
+		return
+	}
+
+	tile, err := models.NewTile(z, x, y)
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
+	// Cached tiles are keyed by the version that busloader increments
+	// after each load. If there is no version yet, use zero.
+	version, err := etc.Cache.Get(models.TileVersionKey)
+	if err != nil {
+		version = []byte("0")
+	}
+	key := fmt.Sprintf("tile|%s|%d|%d|%d", version, z, x, y)
+
+	b, err := etc.Cache.Get(key)
+	if err != nil {
+		b, err = tile.Get(etc.DBConn)
+		if err != nil {
+			log.Println("can't get tile", err)
+			apiErr(w, err)
+			return
+		}
+
+		etc.Cache.Set(key, b, time.Duration(conf.API.TileTTL)*time.Second)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(b)
+}
@@ -15,6 +15,12 @@ func getTrip(w http.ResponseWriter, r *http.Request) {
 	tripID := r.FormValue("trip_id")
 	fallbackTripID := r.FormValue("fallback_trip_id")
 
+	geoJSON, err := wantGeoJSON(r)
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+
 	trip, err := models.ReallyGetTrip(etc.DBConn, agencyID, routeID, tripID, fallbackTripID, true)
 	if err != nil {
 		log.Println("can't get trip", err)
@@ -22,6 +28,20 @@ func getTrip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if geoJSON {
+		// Route info is optional, so continue without it on error
+		route, err := models.GetRoute(etc.DBConn, trip.AgencyID, trip.RouteID)
+		if err != nil {
+			log.Println("can't get route for trip", err)
+			route = nil
+		}
+
+		fc := newFeatureCollection()
+		fc.addTrip(trip, route)
+		writeGeoJSON(w, fc)
+		return
+	}
+
 	b, err := json.Marshal(trip)
 	if err != nil {
 		log.Println("can't marshal to json", err)
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/brnstz/bus/internal/models"
+)
+
+// GeoJSON types, see: https://tools.ietf.org/html/rfc7946
+
+type featureCollection struct {
+	Type     string     `json:"type"`
+	Features []*feature `json:"features"`
+}
+
+type feature struct {
+	Type       string                 `json:"type"`
+	Geometry   geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func newFeatureCollection() *featureCollection {
+	return &featureCollection{Type: "FeatureCollection", Features: []*feature{}}
+}
+
+// wantGeoJSON returns true if the request asks for format=geojson
+func wantGeoJSON(r *http.Request) (bool, error) {
+	switch r.FormValue("format") {
+	case "", "json":
+		return false, nil
+	case "geojson":
+		return true, nil
+	default:
+		return false, paramError{"format", r.FormValue("format"), "must be json or geojson"}
+	}
+}
+
+// point adds a Point feature at lat, lon
+func (fc *featureCollection) point(lat, lon float64, props map[string]interface{}) {
+	fc.Features = append(fc.Features, &feature{
+		Type:       "Feature",
+		Geometry:   geometry{Type: "Point", Coordinates: []float64{lon, lat}},
+		Properties: props,
+	})
+}
+
+// lineString adds a LineString feature of shapes, skipping any points
+// without a location. Lines with less than two points are ignored.
+func (fc *featureCollection) lineString(shapes []*models.Shape, props map[string]interface{}) {
+	coords := [][]float64{}
+
+	for _, s := range shapes {
+		if !s.Lat.Valid || !s.Lon.Valid {
+			continue
+		}
+		coords = append(coords, []float64{s.Lon.Float64, s.Lat.Float64})
+	}
+
+	if len(coords) < 2 {
+		return
+	}
+
+	fc.Features = append(fc.Features, &feature{
+		Type:       "Feature",
+		Geometry:   geometry{Type: "LineString", Coordinates: coords},
+		Properties: props,
+	})
+}
+
+// routeProps returns the properties that describe a route
+func routeProps(route *models.Route) map[string]interface{} {
+	return map[string]interface{}{
+		"agency_id":        route.AgencyID,
+		"route_id":         route.RouteID,
+		"route_type":       route.Type,
+		"route_type_name":  route.TypeName,
+		"route_color":      route.Color,
+		"route_text_color": route.TextColor,
+		"route_short_name": route.ShortName,
+		"route_long_name":  route.LongName,
+	}
+}
+
+// stopProps returns the properties that describe a stop, including its
+// route info when it's known
+func stopProps(stop *models.Stop) map[string]interface{} {
+	props := map[string]interface{}{
+		"kind":          "stop",
+		"agency_id":     stop.AgencyID,
+		"route_id":      stop.RouteID,
+		"stop_id":       stop.StopID,
+		"stop_name":     stop.Name,
+		"direction_id":  stop.DirectionID,
+		"headsign":      stop.Headsign,
+		"trip_headsign": stop.TripHeadsign,
+	}
+
+	if len(stop.RouteColor) > 0 {
+		props["route_type"] = stop.RouteType
+		props["route_type_name"] = stop.RouteTypeName
+		props["route_color"] = stop.RouteColor
+		props["route_text_color"] = stop.RouteTextColor
+		props["route_short_name"] = stop.RouteShortName
+		props["route_long_name"] = stop.RouteLongName
+	}
+
+	if len(stop.Departures) > 0 {
+		props["departures"] = stop.Departures
+	}
+
+	return props
+}
+
+// addRoute adds a LineString for each of the route's shapes
+func (fc *featureCollection) addRoute(route *models.Route) {
+	for _, rs := range route.RouteShapes {
+		props := routeProps(route)
+		props["kind"] = "route"
+		props["headsign"] = rs.Headsign
+		props["direction_id"] = rs.DirectionID
+		props["shape_id"] = rs.ShapeID
+
+		fc.lineString(rs.Shapes, props)
+	}
+}
+
+// addStop adds a Point for the stop and each of its vehicles
+func (fc *featureCollection) addStop(stop *models.Stop) {
+	if stop.Lat.Valid && stop.Lon.Valid {
+		fc.point(stop.Lat.Float64, stop.Lon.Float64, stopProps(stop))
+	}
+
+	for _, v := range stop.Vehicles {
+		props := map[string]interface{}{
+			"kind":             "vehicle",
+			"agency_id":        stop.AgencyID,
+			"route_id":         stop.RouteID,
+			"direction_id":     stop.DirectionID,
+			"route_color":      stop.RouteColor,
+			"route_text_color": stop.RouteTextColor,
+			"route_short_name": stop.RouteShortName,
+			"route_long_name":  stop.RouteLongName,
+			"live":             v.Live,
+			"occupancy":        v.Occupancy,
+		}
+
+		fc.point(v.Lat, v.Lon, props)
+	}
+}
+
+// addTrip adds a LineString of the trip's shape and a Point for each of
+// its stops. If route is not nil, its info is added to the properties.
+func (fc *featureCollection) addTrip(trip *models.Trip, route *models.Route) {
+	props := map[string]interface{}{}
+	if route != nil {
+		props = routeProps(route)
+	}
+	props["kind"] = "trip"
+	props["agency_id"] = trip.AgencyID
+	props["route_id"] = trip.RouteID
+	props["trip_id"] = trip.TripID
+	props["service_id"] = trip.ServiceID
+	props["shape_id"] = trip.ShapeID
+	props["headsign"] = trip.Headsign
+	props["direction_id"] = trip.DirectionID
+
+	fc.lineString(trip.ShapePoints, props)
+
+	for _, stop := range trip.Stops {
+		if !stop.Lat.Valid || !stop.Lon.Valid {
+			continue
+		}
+
+		sprops := stopProps(stop)
+		sprops["seq"] = stop.Seq
+		sprops["trip_id"] = trip.TripID
+		if route != nil {
+			for k, v := range routeProps(route) {
+				sprops[k] = v
+			}
+		}
+
+		fc.point(stop.Lat.Float64, stop.Lon.Float64, sprops)
+	}
+}
+
+// writeGeoJSON writes fc as the response
+func writeGeoJSON(w http.ResponseWriter, fc *featureCollection) {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		log.Println("can't marshal to geojson", err)
+		apiErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(b)
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+var errNoLoad = errors.New("busloader hasn't finished a load")
+
+// checkData fails if busloader hasn't rebuilt the here tables within
+// conf.API.MaxDataAge seconds. It's added to /readyz by Serve.
+func checkData() error {
+	loadedAt, err := models.GetHereLoadedAt(etc.DBConn)
+	if err != nil {
+		return err
+	}
+	if loadedAt.IsZero() {
+		return errNoLoad
+	}
+
+	maxAge := time.Duration(conf.API.MaxDataAge) * time.Second
+	if time.Now().Sub(loadedAt) > maxAge {
+		return fmt.Errorf("last load was at %v, more than %v ago", loadedAt, maxAge)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// hereIndexCheck is how often we check if busloader has loaded new data
+var hereIndexCheck = time.Duration(60) * time.Second
+
+// KeepHereIndex loads the in-memory here index and loads it again
+// whenever busloader finishes rebuilding the here tables, which it
+// records in the database. It runs forever and is started by Serve when
+// conf.API.HereIndex is true. Until the index is loaded, here requests
+// use the database.
+func KeepHereIndex() {
+	var (
+		loaded   bool
+		loadedAt time.Time
+	)
+
+	for {
+		// Check before loading, so that a rebuild that finishes while
+		// we're loading is loaded next time
+		t, err := models.GetHereLoadedAt(etc.DBConn)
+		if err != nil {
+			log.Println("can't get here loaded at", err)
+		}
+
+		// If we can't get the time, only load the index when we
+		// don't have one yet
+		changed := err == nil && !t.Equal(loadedAt)
+
+		if !loaded || changed {
+			err = models.LoadHereIndex(etc.DBConn)
+			if err == nil {
+				loaded = true
+				loadedAt = t
+			}
+		}
+
+		time.Sleep(hereIndexCheck)
+	}
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// openAPIDoc describes the v1 API. It should be updated along with any
+// change to the request parameters or response types of an endpoint.
+const openAPIDoc = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "bus",
+    "description": "Scheduled and live departures, routes and trips for transit agencies in the New York City area",
+    "version": "1.0.0"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "paths": {
+    "/here": {
+      "get": {
+        "summary": "Get stops near a location with their next departures",
+        "description": "The search area is a polygon, a radius around lat/lon, a box, or a list of stop and route IDs, in that order of preference.",
+        "parameters": [
+          {"name": "lat", "in": "query", "description": "Latitude that results are sorted by distance from. Required unless only IDs are given.", "schema": {"type": "number"}},
+          {"name": "lon", "in": "query", "description": "Longitude that results are sorted by distance from. Required unless only IDs are given.", "schema": {"type": "number"}},
+          {"name": "sw_lat", "in": "query", "description": "Southwest latitude of the box to search", "schema": {"type": "number"}},
+          {"name": "sw_lon", "in": "query", "description": "Southwest longitude of the box to search", "schema": {"type": "number"}},
+          {"name": "ne_lat", "in": "query", "description": "Northeast latitude of the box to search", "schema": {"type": "number"}},
+          {"name": "ne_lon", "in": "query", "description": "Northeast longitude of the box to search", "schema": {"type": "number"}},
+          {"name": "radius", "in": "query", "description": "Search this many meters around lat/lon instead of a box", "schema": {"type": "number", "minimum": 0, "maximum": 10000, "exclusiveMinimum": true}},
+          {"name": "polygon", "in": "query", "description": "Search inside this GeoJSON or WKT Polygon or MultiPolygon instead of a box. It can have at most 1000 points and 314159265 square meters, the same as the largest radius.", "schema": {"type": "string"}},
+          {"name": "stop_id", "in": "query", "description": "Only include these stops, like agency_id|stop_id", "schema": {"type": "array", "items": {"type": "string"}}, "explode": true},
+          {"name": "route_id", "in": "query", "description": "Only include these routes, like agency_id|route_id", "schema": {"type": "array", "items": {"type": "string"}}, "explode": true},
+          {"name": "route_type", "in": "query", "description": "Only include these GTFS route types", "schema": {"type": "array", "items": {"type": "integer"}}, "explode": true},
+          {"name": "now", "in": "query", "description": "Local time to search from, like 2006-01-02 15:04:05. Defaults to the current time.", "schema": {"type": "string"}},
+          {"name": "lookahead_mins", "in": "query", "description": "Include departures this many minutes after now", "schema": {"type": "integer", "minimum": 0, "maximum": 1440, "default": 180}},
+          {"name": "first_departure_mins", "in": "query", "description": "Only include a stop's trip if its first departure is within this many minutes", "schema": {"type": "integer", "minimum": 0, "maximum": 1440, "default": 120}},
+          {"name": "routes", "in": "query", "description": "Include routes not already in the filter", "schema": {"type": "boolean", "default": false}},
+          {"name": "trips", "in": "query", "description": "Include the first trip of each live stop not already in the filter", "schema": {"type": "boolean", "default": false}},
+          {"name": "filter", "in": "query", "description": "The filter from a previous response", "schema": {"type": "string"}},
+          {"name": "format", "in": "query", "description": "json (the default) or geojson for a GeoJSON FeatureCollection", "schema": {"type": "string", "enum": ["json", "geojson"], "default": "json"}}
+        ],
+        "responses": {
+          "200": {"description": "Stops and optionally routes and trips", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HereResponse"}}, "application/geo+json": {"schema": {"$ref": "#/components/schemas/FeatureCollection"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stream": {
+      "get": {
+        "summary": "Stream stops near a location as Server-Sent Events",
+        "description": "Accepts the same area parameters as /here. Each stops event has the data of a StreamResponse and is sent when connecting and whenever there is new live data for the stops' routes.",
+        "responses": {
+          "200": {"description": "An event stream", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/StreamResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/route": {
+      "get": {
+        "summary": "Get a single route with its shapes",
+        "parameters": [
+          {"name": "agency_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "route_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "format", "in": "query", "description": "json (the default) or geojson for a GeoJSON FeatureCollection", "schema": {"type": "string", "enum": ["json", "geojson"], "default": "json"}}
+        ],
+        "responses": {
+          "200": {"description": "The route", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Route"}}, "application/geo+json": {"schema": {"$ref": "#/components/schemas/FeatureCollection"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/trip": {
+      "get": {
+        "summary": "Get a single trip with its stops and shape",
+        "parameters": [
+          {"name": "agency_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "route_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "trip_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "fallback_trip_id", "in": "query", "description": "A scheduled trip to use if trip_id can't be found", "schema": {"type": "string"}},
+          {"name": "format", "in": "query", "description": "json (the default) or geojson for a GeoJSON FeatureCollection", "schema": {"type": "string", "enum": ["json", "geojson"], "default": "json"}}
+        ],
+        "responses": {
+          "200": {"description": "The trip", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Trip"}}, "application/geo+json": {"schema": {"$ref": "#/components/schemas/FeatureCollection"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/reports/otp": {
+      "get": {
+        "summary": "Get the on-time performance and headway regularity of archived live departures",
+        "description": "Departures are only available when busprecache archives to the database. A departure is on time from 1 minute early to 5 minutes late. Results are sorted worst first.",
+        "parameters": [
+          {"name": "agency_id", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "route_id", "in": "query", "description": "Only include this route", "schema": {"type": "string"}},
+          {"name": "start", "in": "query", "description": "First day, like 2016-06-12. Defaults to yesterday.", "schema": {"type": "string", "format": "date"}},
+          {"name": "end", "in": "query", "description": "Last day, at most 31 days after start. Defaults to start.", "schema": {"type": "string", "format": "date"}},
+          {"name": "group_by", "in": "query", "description": "Comma-separated list of route, direction, stop and hour", "schema": {"type": "string", "default": "route,direction,stop,hour"}}
+        ],
+        "responses": {
+          "200": {"description": "The report", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/OTPResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "responses": {
+      "Error": {"description": "An error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}}
+    },
+    "schemas": {
+      "ErrorResponse": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "properties": {
+              "code": {"type": "string", "enum": ["bad_request", "invalid_parameter", "not_found", "internal_error", "not_implemented"]},
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "HereResponse": {
+        "type": "object",
+        "properties": {
+          "stops": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}},
+          "routes": {"type": "array", "items": {"$ref": "#/components/schemas/Route"}},
+          "trips": {"type": "array", "items": {"$ref": "#/components/schemas/Trip"}},
+          "filter": {"type": "object", "description": "A bloom filter of the routes and trips the client has. Send it back as the filter parameter."}
+        }
+      },
+      "StreamResponse": {
+        "type": "object",
+        "properties": {
+          "stops": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}}
+        }
+      },
+      "Stop": {
+        "type": "object",
+        "properties": {
+          "stop_id": {"type": "string"},
+          "route_id": {"type": "string"},
+          "agency_id": {"type": "string"},
+          "direction_id": {"type": "integer"},
+          "stop_name": {"type": "string"},
+          "unique_id": {"type": "string"},
+          "headsign": {"type": "string"},
+          "lat": {"type": "number", "nullable": true},
+          "lon": {"type": "number", "nullable": true},
+          "route_type": {"type": "integer"},
+          "route_type_name": {"type": "string"},
+          "route_color": {"type": "string"},
+          "route_text_color": {"type": "string"},
+          "route_short_name": {"type": "string"},
+          "route_long_name": {"type": "string"},
+          "display_name": {"type": "string"},
+          "route_and_headsign": {"type": "string"},
+          "just_headsign": {"type": "string"},
+          "group_extra_key": {"type": "string"},
+          "trip_headsign": {"type": "string"},
+          "seq": {"type": "integer"},
+          "fallback_trip_id": {"type": "string"},
+          "dist": {"type": "number"},
+          "departures": {"type": "array", "items": {"$ref": "#/components/schemas/Departure"}},
+          "vehicles": {"type": "array", "items": {"$ref": "#/components/schemas/Vehicle"}}
+        }
+      },
+      "Departure": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "trip_id": {"type": "string"},
+          "service_id": {"type": "string"},
+          "live": {"type": "boolean"},
+          "compass_dir": {"type": "number", "description": "Direction in degrees to the next stop"},
+          "stops_from_call": {"type": "integer", "nullable": true, "description": "How many stops away the live vehicle is"},
+          "distance_from_call": {"type": "number", "nullable": true, "description": "How many meters away the live vehicle is"},
+          "presentable_distance": {"type": "string", "nullable": true, "description": "How far away the live vehicle is for riders, like approaching or 1 stop away"},
+          "occupancy": {"type": "string", "nullable": true, "enum": ["empty", "many_seats_available", "few_seats_available", "standing_room_only", "crushed_standing_room_only", "full", "not_accepting_passengers", null], "description": "How crowded the live vehicle is, when the partner provides it"}
+        }
+      },
+      "Vehicle": {
+        "type": "object",
+        "properties": {
+          "lat": {"type": "number"},
+          "lon": {"type": "number"},
+          "live": {"type": "boolean"},
+          "occupancy": {"type": "string", "nullable": true, "enum": ["empty", "many_seats_available", "few_seats_available", "standing_room_only", "crushed_standing_room_only", "full", "not_accepting_passengers", null], "description": "How crowded the vehicle is, when the partner provides it"}
+        }
+      },
+      "Route": {
+        "type": "object",
+        "properties": {
+          "route_id": {"type": "string"},
+          "agency_id": {"type": "string"},
+          "route_type": {"type": "integer"},
+          "route_type_name": {"type": "string"},
+          "route_color": {"type": "string"},
+          "route_text_color": {"type": "string"},
+          "route_short_name": {"type": "string"},
+          "route_long_name": {"type": "string"},
+          "unique_id": {"type": "string"},
+          "route_shapes": {"type": "array", "items": {"$ref": "#/components/schemas/RouteShape"}}
+        }
+      },
+      "RouteShape": {
+        "type": "object",
+        "properties": {
+          "agency_id": {"type": "string"},
+          "route_id": {"type": "string"},
+          "headsign": {"type": "string"},
+          "direction_id": {"type": "integer"},
+          "shape_id": {"type": "string"},
+          "shapes": {"type": "array", "items": {"$ref": "#/components/schemas/Point"}}
+        }
+      },
+      "Trip": {
+        "type": "object",
+        "properties": {
+          "agency_id": {"type": "string"},
+          "route_id": {"type": "string"},
+          "trip_id": {"type": "string"},
+          "unique_id": {"type": "string"},
+          "service_id": {"type": "string"},
+          "shape_id": {"type": "string"},
+          "headsign": {"type": "string"},
+          "direction_id": {"type": "integer"},
+          "shape_points": {"type": "array", "items": {"$ref": "#/components/schemas/Point"}},
+          "stops": {"type": "array", "items": {"$ref": "#/components/schemas/Stop"}}
+        }
+      },
+      "OTPResponse": {
+        "type": "object",
+        "properties": {
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "results": {"type": "array", "items": {"$ref": "#/components/schemas/OTP"}}
+        }
+      },
+      "OTP": {
+        "type": "object",
+        "description": "Values that results aren't grouped by are null",
+        "properties": {
+          "agency_id": {"type": "string"},
+          "route_id": {"type": "string", "nullable": true},
+          "direction_id": {"type": "integer", "nullable": true},
+          "stop_id": {"type": "string", "nullable": true},
+          "hour": {"type": "integer", "nullable": true, "description": "Hour of the day of the scheduled departures"},
+          "departures": {"type": "integer", "description": "Number of departures observed"},
+          "on_time_pct": {"type": "number"},
+          "avg_delay": {"type": "number", "description": "Average seconds late, negative when early"},
+          "excess_wait": {"type": "number", "nullable": true, "description": "Seconds of excess wait time compared to scheduled headways"}
+        }
+      },
+      "FeatureCollection": {
+        "type": "object",
+        "description": "GeoJSON with LineString features for route and trip shapes and Point features for stops and vehicles. The kind property of each feature is route, trip, stop or vehicle.",
+        "properties": {
+          "type": {"type": "string", "enum": ["FeatureCollection"]},
+          "features": {"type": "array", "items": {"type": "object"}}
+        }
+      },
+      "Point": {
+        "type": "object",
+        "properties": {
+          "lat": {"type": "number", "nullable": true},
+          "lon": {"type": "number", "nullable": true}
+        }
+      }
+    }
+  }
+}
+`
+
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, openAPIDoc)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+const (
+	defaultTitle       = "Token"
+	defaultDescription = "Mobile web app for discovering public transit in New York City. Get live departures from MTA subways, buses, Metro-North, Long Island Rail Road, NJ Transit and more."
+	defaultImage       = "/img/token_sample_small.png"
+)
+
+// openGraph is the preview that's shown when a link to the site is
+// shared, see: http://ogp.me/
+type openGraph struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+
+	// Card is the type of Twitter card, either "summary" or
+	// "summary_large_image"
+	Card string
+}
+
+// indexOpenGraph returns the preview for the index page. Links to a stop
+// like /?agency_id=MTA+NYCT&stop_id=G22N or to a trip like
+// /?agency_id=MTA+NYCT&route_id=G&trip_id=... get a map of the stop or
+// trip. Anything else gets the default preview.
+func indexOpenGraph(r *http.Request) openGraph {
+	og := openGraph{
+		URL:         conf.API.BaseURL,
+		Title:       defaultTitle,
+		Description: defaultDescription,
+		Image:       conf.API.BaseURL + defaultImage,
+		Card:        "summary",
+	}
+
+	agencyID := r.FormValue("agency_id")
+	if len(agencyID) < 1 {
+		return og
+	}
+
+	var err error
+	switch {
+	case len(r.FormValue("trip_id")) > 0:
+		err = tripOpenGraph(&og, agencyID, r.FormValue("route_id"), r.FormValue("trip_id"))
+	case len(r.FormValue("stop_id")) > 0:
+		var stops []*models.Stop
+		stops, err = models.GetStops(etc.DBConn, agencyID, r.FormValue("stop_id"))
+		if err == nil {
+			stopOpenGraph(&og, stops)
+		}
+	}
+	if err != nil {
+		log.Println("can't create preview, using default", err)
+	}
+
+	return og
+}
+
+// stopOpenGraph sets og to a preview of a stop, given its values from
+// models.GetStops
+func stopOpenGraph(og *openGraph, stops []*models.Stop) {
+	agencyID, stopID := stops[0].AgencyID, stops[0].StopID
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, s := range stops {
+		if !seen[s.DisplayName] {
+			seen[s.DisplayName] = true
+			names = append(names, s.DisplayName)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("agency_id", agencyID)
+	params.Set("stop_id", stopID)
+
+	og.URL = conf.API.BaseURL + stopPath(agencyID, stopID)
+	og.Title = stops[0].Name
+	og.Description = fmt.Sprintf("Live departures from %s for %s",
+		stops[0].Name, strings.Join(names, ", "),
+	)
+	og.Image = conf.API.BaseURL + "/map/stop.png?" + params.Encode()
+	og.Card = "summary_large_image"
+}
+
+// routeOpenGraph sets og to a preview of the route
+func routeOpenGraph(og *openGraph, route *models.Route) {
+	og.URL = conf.API.BaseURL + routePath(route.AgencyID, route.RouteID)
+	og.Title = routeName(route)
+	og.Description = fmt.Sprintf("Stops and live departures for the %s %s",
+		routeName(route), route.TypeName,
+	)
+	og.Image = conf.API.BaseURL + defaultImage
+	og.Card = "summary"
+}
+
+// routeName returns the name riders know a route by
+func routeName(route *models.Route) string {
+	for _, name := range []string{route.ShortName, route.LongName} {
+		if len(name) > 0 {
+			return name
+		}
+	}
+
+	return route.RouteID
+}
+
+// tripOpenGraph sets og to a preview of the trip
+func tripOpenGraph(og *openGraph, agencyID, routeID, tripID string) error {
+	trip, err := models.ReallyGetTrip(etc.DBConn, agencyID, routeID, tripID, "", false)
+	if err != nil {
+		return err
+	}
+
+	route, err := models.GetRoute(etc.DBConn, trip.AgencyID, trip.RouteID)
+	if err != nil {
+		return err
+	}
+
+	name := routeName(route)
+
+	params := url.Values{}
+	params.Set("agency_id", trip.AgencyID)
+	params.Set("route_id", trip.RouteID)
+	params.Set("trip_id", trip.TripID)
+
+	og.URL = conf.API.BaseURL + "/?" + params.Encode()
+	og.Title = fmt.Sprintf("%s to %s", name, trip.Headsign)
+	og.Description = fmt.Sprintf("Follow this %s %s trip to %s live",
+		name, route.TypeName, trip.Headsign,
+	)
+	og.Image = conf.API.BaseURL + "/map/trip.png?" + params.Encode()
+	og.Card = "summary_large_image"
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// pageTemplates are the server-rendered pages for a single stop or
+// route. They work without JavaScript and link to each other so that
+// they can be crawled.
+var pageTemplates = template.Must(template.New("pages").Funcs(template.FuncMap{
+	"stopPath":  stopPath,
+	"routePath": routePath,
+	"clock": func(t time.Time) string {
+		return t.Format("3:04 PM")
+	},
+}).Parse(pagesHTML))
+
+const pagesHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <title>{{.OpenGraph.Title}} - Token</title>
+        <meta charset="utf-8">
+        <meta name="viewport" content="initial-scale=1.0 width=device-width"/>
+        <meta name="description" content="{{.OpenGraph.Description}}">
+        <link rel="canonical" href="{{.OpenGraph.URL}}">
+
+        <meta property="og:url" content="{{.OpenGraph.URL}}">
+        <meta property="og:title" content="{{.OpenGraph.Title}}">
+        <meta property="og:site_name" content="Token">
+        <meta property="og:image" content="{{.OpenGraph.Image}}">
+        <meta property="og:description" content="{{.OpenGraph.Description}}">
+
+        <meta property="twitter:card" content="{{.OpenGraph.Card}}">
+        <meta property="twitter:site" content="@brnstz">
+        <meta property="twitter:title" content="{{.OpenGraph.Title}}">
+        <meta property="twitter:description" content="{{.OpenGraph.Description}}">
+        <meta property="twitter:image" content="{{.OpenGraph.Image}}">
+
+        <link rel="icon" sizes="32x32" href="/img/token_logo_mono.png">
+        <style>
+            body { font-family: Lato, Helvetica, Arial, sans-serif; margin: 0 auto; max-width: 800px; padding: 1em; }
+            img { max-width: 100%; }
+            .route { display: inline-block; min-width: 2em; padding: 0 0.3em; text-align: center; font-weight: bold; }
+            li { margin: 0.4em 0; }
+        </style>
+    </head>
+    <body>
+{{end}}
+
+{{define "route_name"}}<a href="{{routePath .AgencyID .RouteID}}" class="route" style="background: {{.RouteColor}}; color: {{.RouteTextColor}}">{{.DisplayName}}</a>{{end}}
+
+{{define "stop"}}{{template "head" .}}
+        <h1>{{.Name}}</h1>
+        <p><a href="{{.AppURL}}">Open in Token</a></p>
+        <img src="{{.OpenGraph.Image}}" alt="Map of {{.Name}}" width="600" height="315">
+
+        <h2>Departures</h2>
+        <ul>
+        {{range .Stops}}
+            <li>
+                {{template "route_name" .}} {{.JustHeadsign}}:
+                {{range .Departures}}{{clock .Time}}{{if .Live}} (live){{end}} {{else}}no departures in the next few hours{{end}}
+            </li>
+        {{end}}
+        </ul>
+    </body>
+</html>
+{{end}}
+
+{{define "route"}}{{template "head" .}}
+        <h1>{{.Route.ShortName}} {{.Route.LongName}}</h1>
+        <p><a href="{{.AppURL}}">Open in Token</a></p>
+
+        {{range .Directions}}
+        <h2>To {{.Headsign}}</h2>
+        <ul>
+            {{range .Stops}}<li><a href="{{stopPath .AgencyID .StopID}}">{{.Name}}</a></li>
+            {{end}}
+        </ul>
+        {{end}}
+    </body>
+</html>
+{{end}}
+`
+
+// stopPage is the data for the stop template
+type stopPage struct {
+	OpenGraph openGraph
+	Name      string
+	AppURL    string
+
+	// Stops has one value for each route and direction at this stop
+	Stops []*models.Stop
+}
+
+// routeDirection is the stops of a route in one direction
+type routeDirection struct {
+	Headsign string
+	Stops    []*models.Stop
+}
+
+// routePage is the data for the route template
+type routePage struct {
+	OpenGraph  openGraph
+	Route      *models.Route
+	AppURL     string
+	Directions []*routeDirection
+}
+
+// stopPath returns the path of the page for a stop
+func stopPath(agencyID, stopID string) string {
+	return "/stop/" + url.PathEscape(agencyID) + "/" + url.PathEscape(stopID)
+}
+
+// routePath returns the path of the page for a route
+func routePath(agencyID, routeID string) string {
+	return "/route/" + url.PathEscape(agencyID) + "/" + url.PathEscape(routeID)
+}
+
+// pageIDs reads the agency ID and the stop or route ID from a path like
+// /stop/{agency_id}/{stop_id}
+func pageIDs(r *http.Request, prefix string) (agencyID, id string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+	if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+		err = models.ErrNotFound
+		return
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// pageErr writes a plain error for a page
+func pageErr(w http.ResponseWriter, err error) {
+	code, ok := errCodes[err]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+
+	http.Error(w, http.StatusText(code), code)
+}
+
+// writePage executes the named template with data as the response
+func writePage(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+
+	err := pageTemplates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Println("can't execute template", name, err)
+	}
+}
+
+// getStopPage renders the page at /stop/{agency_id}/{stop_id} with the
+// routes at the stop and their next departures
+func getStopPage(w http.ResponseWriter, r *http.Request) {
+	agencyID, stopID, err := pageIDs(r, "/stop/")
+	if err != nil {
+		pageErr(w, err)
+		return
+	}
+
+	stops, err := models.GetStops(etc.DBConn, agencyID, stopID)
+	if err != nil {
+		log.Println("can't get stops", err)
+		pageErr(w, err)
+		return
+	}
+
+	page := stopPage{Name: stops[0].Name, Stops: stops}
+	stopOpenGraph(&page.OpenGraph, stops)
+
+	params := url.Values{}
+	params.Set("agency_id", agencyID)
+	params.Set("stop_id", stopID)
+	page.AppURL = "/?" + params.Encode()
+
+	// Get departures the same way as the here endpoint, by searching
+	// for this stop's ID
+	if stops[0].Lat.Valid && stops[0].Lon.Valid {
+		hp := hereParams{
+			lat:       stops[0].Lat.Float64,
+			lon:       stops[0].Lon.Float64,
+			area:      models.HereArea{StopIDs: []string{agencyID + "|" + stopID}},
+			lookahead: defaultLookahead,
+		}
+
+		live, _, err := liveStops(hp, etc.Now())
+		if err != nil {
+			// Show the stop without departures
+			log.Println("can't get departures for stop page", err)
+		}
+
+		for _, s := range stops {
+			for _, l := range live {
+				if l.RouteID == s.RouteID && l.DirectionID == s.DirectionID {
+					s.Departures = append(s.Departures, l.Departures...)
+				}
+			}
+
+			sort.Sort(models.SortableDepartures(s.Departures))
+			if len(s.Departures) > models.MaxDepartures {
+				s.Departures = s.Departures[:models.MaxDepartures]
+			}
+		}
+	}
+
+	writePage(w, "stop", page)
+}
+
+// getRoutePage renders the page at /route/{agency_id}/{route_id} with the
+// route's stops in each direction
+func getRoutePage(w http.ResponseWriter, r *http.Request) {
+	agencyID, routeID, err := pageIDs(r, "/route/")
+	if err != nil {
+		pageErr(w, err)
+		return
+	}
+
+	route, err := models.GetRoute(etc.DBConn, agencyID, routeID)
+	if err != nil {
+		log.Println("can't get route", err)
+		pageErr(w, models.ErrNotFound)
+		return
+	}
+
+	stops, err := models.GetStopsByRoute(etc.DBConn, agencyID, routeID)
+	if err != nil {
+		pageErr(w, err)
+		return
+	}
+
+	page := routePage{Route: route}
+	routeOpenGraph(&page.OpenGraph, route)
+
+	params := url.Values{}
+	params.Set("agency_id", agencyID)
+	params.Set("route_id", routeID)
+	page.AppURL = "/?" + params.Encode()
+
+	// Stops are ordered by direction, so start a new direction whenever
+	// it changes
+	var dir *routeDirection
+	for i, s := range stops {
+		if i == 0 || s.DirectionID != stops[i-1].DirectionID {
+			dir = &routeDirection{Headsign: s.Headsign}
+			page.Directions = append(page.Directions, dir)
+		}
+		dir.Stops = append(dir.Stops, s)
+	}
+
+	writePage(w, "route", page)
+}
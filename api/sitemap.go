@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// Sitemap types, see: https://www.sitemaps.org/protocol.html. There is
+// one sitemap for each agency, so that each is under the limit of
+// 50,000 URLs.
+
+const sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	NS       string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	NS      string       `xml:"xmlns,attr"`
+	URLs    []sitemapLoc `xml:"url"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// writeXML writes v as the response
+func writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		log.Println("can't marshal to xml", err)
+		pageErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func getRobots(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("User-Agent: *\n" +
+		"Disallow: /api/\n" +
+		"Disallow: /tiles/\n" +
+		"Disallow: /gtfs-rt/\n" +
+		"Disallow: /siri/\n" +
+		"Sitemap: " + conf.API.BaseURL + "/sitemap.xml\n",
+	))
+}
+
+// getSitemapIndex lists the sitemap of each agency
+func getSitemapIndex(w http.ResponseWriter, r *http.Request) {
+	agencyIDs, err := models.GetAgencyIDs(etc.DBConn)
+	if err != nil {
+		pageErr(w, err)
+		return
+	}
+
+	index := sitemapIndex{NS: sitemapNS}
+	for _, agencyID := range agencyIDs {
+		index.Sitemaps = append(index.Sitemaps, sitemapLoc{
+			conf.API.BaseURL + "/sitemap/" + url.PathEscape(agencyID) + ".xml",
+		})
+	}
+
+	writeXML(w, index)
+}
+
+// getSitemap lists the route and stop pages of the agency at
+// /sitemap/{agency_id}.xml
+func getSitemap(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/sitemap/")
+	if !strings.HasSuffix(name, ".xml") {
+		pageErr(w, models.ErrNotFound)
+		return
+	}
+	agencyID := strings.TrimSuffix(name, ".xml")
+
+	routes, err := models.GetAllRoutes(etc.DBConn, agencyID)
+	if err != nil {
+		log.Println("can't get routes", err)
+		pageErr(w, err)
+		return
+	}
+
+	stopIDs, err := models.GetStopIDs(etc.DBConn, agencyID)
+	if err != nil {
+		pageErr(w, err)
+		return
+	}
+
+	if len(routes) < 1 && len(stopIDs) < 1 {
+		pageErr(w, models.ErrNotFound)
+		return
+	}
+
+	set := urlSet{NS: sitemapNS}
+	for _, route := range routes {
+		set.URLs = append(set.URLs, sitemapLoc{
+			conf.API.BaseURL + routePath(route.AgencyID, route.RouteID),
+		})
+	}
+	for _, stopID := range stopIDs {
+		set.URLs = append(set.URLs, sitemapLoc{
+			conf.API.BaseURL + stopPath(agencyID, stopID),
+		})
+	}
+
+	writeXML(w, set)
+}
@@ -0,0 +1,230 @@
+// Package archive saves the live data that busprecache gets from
+// partners, which otherwise only lives in redis for a short time. Each
+// observation refers to the trip and stop it's about, so the history can
+// be compared to the schedule later. The raw responses of partners are
+// saved too, so that busapi can replay them.
+package archive
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+)
+
+var (
+	// ErrUnknownKind is returned by New for an unsupported kind of archive
+	ErrUnknownKind = errors.New("unknown kind of archive")
+
+	// ErrNoPayload is returned by Payload when nothing was saved at a key
+	// in the window before a time
+	ErrNoPayload = errors.New("no archived payload")
+
+	// predictionTTL is how long we remember the last prediction of a
+	// trip at a stop after it stops changing
+	predictionTTL = time.Duration(6) * time.Hour
+)
+
+// Archiver saves observations and partner payloads
+type Archiver interface {
+	Save(vehicles []*models.VehicleObservation, departures []*models.DepartureObservation) error
+
+	// SavePayload saves b, the data that was saved in redis at key k at
+	// t
+	SavePayload(k string, t time.Time, b []byte) error
+
+	// Payload returns the last data saved at key k before or at t, but
+	// not before t - window. If there's none, ErrNoPayload is returned.
+	Payload(k string, t time.Time, window time.Duration) ([]byte, error)
+}
+
+// New returns an Archiver of kind, which is "db" or "file". dir is the
+// directory of a file archive. A departure observation is only saved if
+// its prediction changed since the last one saved for its trip and stop.
+func New(kind, dir string) (Archiver, error) {
+	var a Archiver
+	var err error
+
+	switch kind {
+	case "db":
+		a = dbArchiver{}
+	case "file":
+		a, err = newFileArchiver(dir)
+	default:
+		err = ErrUnknownKind
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &changedArchiver{Archiver: a, last: map[string]prediction{}}, nil
+}
+
+// prediction is the last predicted arrival and departure saved for a trip
+// at a stop
+type prediction struct {
+	arrival    null.Time
+	departure  null.Time
+	observedAt time.Time
+}
+
+// same returns true if p predicts the same times as o
+func (p prediction) same(o *models.DepartureObservation) bool {
+	return sameTime(p.arrival, o.ArrivalTime) && sameTime(p.departure, o.DepartureTime)
+}
+
+func sameTime(a, b null.Time) bool {
+	return a.Valid == b.Valid && a.Time.Equal(b.Time)
+}
+
+// changedArchiver saves departure observations to an Archiver only when
+// their prediction changed, since most don't between requests
+type changedArchiver struct {
+	Archiver
+
+	mu sync.Mutex
+
+	// last is the last prediction saved for each trip at each stop,
+	// keyed like "agency_id|trip_id|stop_id"
+	last map[string]prediction
+
+	// pruned is when we last removed old predictions from last
+	pruned time.Time
+}
+
+func (a *changedArchiver) Save(vehicles []*models.VehicleObservation, departures []*models.DepartureObservation) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var changed []*models.DepartureObservation
+	var newest time.Time
+	saved := map[string]prediction{}
+
+	for _, d := range departures {
+		if d.ObservedAt.After(newest) {
+			newest = d.ObservedAt
+		}
+
+		k := fmt.Sprintf("%v|%v|%v", d.AgencyID, d.TripID, d.StopID)
+
+		p, exists := a.last[k]
+		if exists && p.same(d) {
+			continue
+		}
+
+		changed = append(changed, d)
+		saved[k] = prediction{d.ArrivalTime, d.DepartureTime, d.ObservedAt}
+	}
+
+	if len(vehicles) < 1 && len(changed) < 1 {
+		return nil
+	}
+
+	err := a.Archiver.Save(vehicles, changed)
+	if err != nil {
+		return err
+	}
+
+	// Only remember what was saved, so that a failed Save is retried
+	// with the next observation
+	for k, p := range saved {
+		a.last[k] = p
+	}
+
+	a.prune(newest)
+
+	return nil
+}
+
+// prune removes predictions that haven't changed for predictionTTL before
+// now, which are for trips that are over. It only runs once per
+// predictionTTL.
+func (a *changedArchiver) prune(now time.Time) {
+	if now.Sub(a.pruned) < predictionTTL {
+		return
+	}
+
+	for k, p := range a.last {
+		if now.Sub(p.observedAt) > predictionTTL {
+			delete(a.last, k)
+		}
+	}
+
+	a.pruned = now
+}
+
+// dbArchiver saves observations to the vehicle_observation and
+// departure_observation tables
+type dbArchiver struct{}
+
+func (a dbArchiver) Save(vehicles []*models.VehicleObservation, departures []*models.DepartureObservation) error {
+	return models.SaveObservations(etc.DBConn, vehicles, departures)
+}
+
+func (a dbArchiver) SavePayload(k string, t time.Time, b []byte) error {
+	return models.SavePayload(etc.DBConn, k, t, b)
+}
+
+func (a dbArchiver) Payload(k string, t time.Time, window time.Duration) ([]byte, error) {
+	b, err := models.GetPayload(etc.DBConn, k, t.Add(-window), t)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPayload
+	}
+
+	return b, err
+}
+
+// Observations converts the realtime data of partners to observations
+// made at now. Vehicles without their own timestamp are observed at now.
+func Observations(trips []*partners.TripUpdate, vehicles []*partners.VehiclePosition, now time.Time) (vobs []*models.VehicleObservation, dobs []*models.DepartureObservation) {
+	for _, v := range vehicles {
+		o := &models.VehicleObservation{
+			AgencyID:    v.AgencyID,
+			RouteID:     v.RouteID,
+			DirectionID: v.DirectionID,
+			TripID:      v.TripID,
+			Lat:         v.Lat,
+			Lon:         v.Lon,
+			Occupancy:   v.Occupancy,
+			ObservedAt:  v.Timestamp,
+		}
+		if len(v.StopID) > 0 {
+			o.StopID = null.StringFrom(v.StopID)
+		}
+		if o.ObservedAt.IsZero() {
+			o.ObservedAt = now
+		}
+
+		vobs = append(vobs, o)
+	}
+
+	for _, t := range trips {
+		for _, st := range t.Stops {
+			o := &models.DepartureObservation{
+				AgencyID:    t.AgencyID,
+				RouteID:     t.RouteID,
+				DirectionID: t.DirectionID,
+				TripID:      t.TripID,
+				StopID:      st.StopID,
+				ObservedAt:  now,
+			}
+			if !st.Arrival.IsZero() {
+				o.ArrivalTime = null.TimeFrom(st.Arrival)
+			}
+			if !st.Departure.IsZero() {
+				o.DepartureTime = null.TimeFrom(st.Departure)
+			}
+
+			dobs = append(dobs, o)
+		}
+	}
+
+	return
+}
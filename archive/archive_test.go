@@ -0,0 +1,351 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+)
+
+var (
+	// day1 and day2 are the days of our observations, which are saved
+	// a minute before and after midnight
+	day1 = time.Date(2016, 6, 12, 0, 0, 0, 0, time.UTC)
+	day2 = day1.AddDate(0, 0, 1)
+)
+
+// newArchive returns an archive of kind that's only used by t. A db
+// archive is saved to a new SQLite database.
+func newArchive(t *testing.T, kind string) (a Archiver, dir string) {
+	dir = t.TempDir()
+
+	if kind == "db" {
+		driver, path, db := conf.DB.Driver, conf.DB.Path, etc.DBConn
+		t.Cleanup(func() {
+			etc.DBConn.Close()
+			conf.DB.Driver, conf.DB.Path, etc.DBConn = driver, path, db
+		})
+
+		conf.DB.Driver = "sqlite3"
+		conf.DB.Path = filepath.Join(dir, "bus.db")
+		etc.DBConn = etc.MustDB()
+	}
+
+	a, err := New(kind, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// readLines reads every value in the gzipped JSON lines file at path into
+// a new value from newValue
+func readLines(t *testing.T, path string, newValue func() interface{}) {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		err = json.Unmarshal(scanner.Bytes(), newValue())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// observations returns what was saved in the archive for the day starting
+// at day
+func observations(t *testing.T, kind, dir string, day time.Time) (vobs []*models.VehicleObservation, dobs []*models.DepartureObservation) {
+	var err error
+
+	if kind == "db" {
+		vobs, err = models.GetVehicleObservations(etc.DBConn, "MTA NYCT", "", day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dobs, err = models.GetDepartureObservations(etc.DBConn, "MTA NYCT", "", day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	readLines(t, filepath.Join(DayDir(dir, day), vehiclesFile), func() interface{} {
+		v := &models.VehicleObservation{}
+		vobs = append(vobs, v)
+		return v
+	})
+
+	readLines(t, filepath.Join(DayDir(dir, day), departuresFile), func() interface{} {
+		d := &models.DepartureObservation{}
+		dobs = append(dobs, d)
+		return d
+	})
+
+	return
+}
+
+func vehicle(tripID string, observedAt time.Time) *models.VehicleObservation {
+	return &models.VehicleObservation{
+		AgencyID:    "MTA NYCT",
+		RouteID:     "B63",
+		DirectionID: null.IntFrom(0),
+		TripID:      tripID,
+		Lat:         40.7,
+		Lon:         -74.0,
+		ObservedAt:  observedAt,
+	}
+}
+
+func departure(tripID, stopID string, arrival, observedAt time.Time) *models.DepartureObservation {
+	return &models.DepartureObservation{
+		AgencyID:    "MTA NYCT",
+		RouteID:     "B63",
+		DirectionID: null.IntFrom(0),
+		TripID:      tripID,
+		StopID:      stopID,
+		ArrivalTime: null.TimeFrom(arrival),
+		ObservedAt:  observedAt,
+	}
+}
+
+func TestSaveByDay(t *testing.T) {
+	for _, kind := range []string{"db", "file"} {
+		a, dir := newArchive(t, kind)
+
+		before := day2.Add(-time.Minute)
+		after := day2.Add(time.Minute)
+
+		// Observations that were made on either side of midnight, but
+		// saved at once
+		err := a.Save(
+			[]*models.VehicleObservation{vehicle("T1", before), vehicle("T2", after)},
+			[]*models.DepartureObservation{
+				departure("T1", "S1", before.Add(time.Hour), before),
+				departure("T2", "S1", after.Add(time.Hour), after),
+			},
+		)
+		if err != nil {
+			t.Fatal(kind, err)
+		}
+
+		for _, day := range []time.Time{day1, day2} {
+			vobs, dobs := observations(t, kind, dir, day)
+
+			expectedTrip := "T1"
+			if day == day2 {
+				expectedTrip = "T2"
+			}
+
+			if len(vobs) != 1 || vobs[0].TripID != expectedTrip {
+				t.Errorf("%v: expected vehicle of %v on %v but got %+v", kind, expectedTrip, day, vobs)
+			}
+			if len(dobs) != 1 || dobs[0].TripID != expectedTrip {
+				t.Errorf("%v: expected departure of %v on %v but got %+v", kind, expectedTrip, day, dobs)
+			}
+		}
+	}
+}
+
+func TestSaveChangedPredictions(t *testing.T) {
+	for _, kind := range []string{"db", "file"} {
+		a, dir := newArchive(t, kind)
+
+		arrival := day1.Add(time.Duration(8) * time.Hour)
+
+		saves := []struct {
+			departures []*models.DepartureObservation
+			saved      int
+		}{
+			// Both are new
+			{[]*models.DepartureObservation{
+				departure("T1", "S1", arrival, day1.Add(time.Minute)),
+				departure("T1", "S2", arrival.Add(time.Minute), day1.Add(time.Minute)),
+			}, 2},
+
+			// Nothing changed
+			{[]*models.DepartureObservation{
+				departure("T1", "S1", arrival, day1.Add(2*time.Minute)),
+				departure("T1", "S2", arrival.Add(time.Minute), day1.Add(2*time.Minute)),
+			}, 0},
+
+			// The trip is late to S2
+			{[]*models.DepartureObservation{
+				departure("T1", "S1", arrival, day1.Add(3*time.Minute)),
+				departure("T1", "S2", arrival.Add(2*time.Minute), day1.Add(3*time.Minute)),
+			}, 1},
+
+			// No longer predicted at S2
+			{[]*models.DepartureObservation{
+				{
+					AgencyID: "MTA NYCT", RouteID: "B63", TripID: "T1", StopID: "S2",
+					ObservedAt: day1.Add(4 * time.Minute),
+				},
+			}, 1},
+		}
+
+		total := 0
+		for i, save := range saves {
+			err := a.Save(nil, save.departures)
+			if err != nil {
+				t.Fatal(kind, err)
+			}
+			total += save.saved
+
+			_, dobs := observations(t, kind, dir, day1)
+			if len(dobs) != total {
+				t.Errorf("%v: expected %v departures after save %v but got %v", kind, total, i, len(dobs))
+			}
+		}
+	}
+}
+
+func TestPayload(t *testing.T) {
+	for _, kind := range []string{"db", "file"} {
+		a, _ := newArchive(t, kind)
+
+		k := "MTA NYCT|B63|0"
+		first := day2.Add(-time.Minute)
+		second := day2.Add(time.Minute)
+
+		for _, p := range []struct {
+			t time.Time
+			b string
+		}{{first, "first"}, {second, "second"}} {
+			err := a.SavePayload(k, p.t, []byte(p.b))
+			if err != nil {
+				t.Fatal(kind, err)
+			}
+		}
+
+		tests := []struct {
+			t        time.Time
+			window   time.Duration
+			expected string
+			err      error
+		}{
+			{first, time.Minute, "first", nil},
+			{second.Add(-time.Second), 2 * time.Minute, "first", nil},
+
+			// The payload of the day before is found
+			{second.Add(-time.Second), time.Hour, "first", nil},
+			{second, time.Minute, "second", nil},
+			{second.Add(time.Hour), 2 * time.Hour, "second", nil},
+
+			// Nothing before the first or in the window
+			{first.Add(-time.Second), time.Hour, "", ErrNoPayload},
+			{second.Add(time.Hour), time.Minute, "", ErrNoPayload},
+		}
+
+		for _, test := range tests {
+			b, err := a.Payload(k, test.t, test.window)
+			if err != test.err {
+				t.Errorf("%v: expected error %v at %v but got %v", kind, test.err, test.t, err)
+				continue
+			}
+
+			if string(b) != test.expected {
+				t.Errorf("%v: expected %q at %v but got %q", kind, test.expected, test.t, b)
+			}
+		}
+
+		_, err := a.Payload("MTA NYCT|B62|0", second, time.Hour)
+		if err != ErrNoPayload {
+			t.Errorf("%v: expected no payload for another key but got %v", kind, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// testdata/replay has the B62 VehicleMonitoring response that was
+	// precached at 8am on June 12, 2016 in New York
+	a, err := New("file", filepath.Join("testdata", "replay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay := partners.Replay
+	t.Cleanup(func() {
+		partners.Replay = replay
+	})
+
+	p, err := partners.Find(models.Route{AgencyID: "MTA NYCT", RouteID: "B62", Type: models.Bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := time.Unix(1465732800, 0)
+	expected := []struct {
+		tripID string
+		time   time.Time
+	}{
+		{"GH_A6-Weekday-SDon-046500_B62_203", saved.Add(3*time.Minute + 12*time.Second)},
+		{"GH_A6-Weekday-SDon-047400_B62_207", saved.Add(11*time.Minute + 30*time.Second)},
+	}
+
+	tests := []struct {
+		now        time.Time
+		departures int
+		err        error
+	}{
+		{saved, 2, nil},
+		{saved.Add(59 * time.Second), 2, nil},
+
+		// Before it was saved and after it expired
+		{saved.Add(-time.Second), 0, ErrNoPayload},
+		{saved.Add(time.Minute), 0, ErrNoPayload},
+	}
+
+	for _, test := range tests {
+		now := test.now
+		partners.Replay = Replay(a, func() time.Time { return now }, time.Minute)
+
+		d, _, err := p.Live("MTA NYCT", "B62", "302456", 0)
+		if err != test.err {
+			t.Errorf("expected error %v at %v but got %v", test.err, now, err)
+			continue
+		}
+
+		if len(d) != test.departures {
+			t.Errorf("expected %v departures at %v but got %v", test.departures, now, len(d))
+			continue
+		}
+
+		for i := range d {
+			if d[i].TripID != expected[i].tripID || !d[i].Time.Equal(expected[i].time) {
+				t.Errorf("expected departure of %v at %v but got %v at %v",
+					expected[i].tripID, expected[i].time, d[i].TripID, d[i].Time,
+				)
+			}
+		}
+	}
+}
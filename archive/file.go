@@ -0,0 +1,127 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brnstz/bus/internal/models"
+)
+
+const (
+	vehiclesFile   = "vehicles.jsonl.gz"
+	departuresFile = "departures.jsonl.gz"
+)
+
+// fileArchiver saves observations as gzipped JSON lines in a directory
+// for each day, e.g., archive/2016-06-12/vehicles.jsonl.gz. Each Save is
+// appended to the day's files as a new gzip member, so the files can be
+// read by anything that reads gzip, like zcat.
+type fileArchiver struct {
+	dir string
+
+	// mu ensures only one Save writes to the files at a time
+	mu *sync.Mutex
+}
+
+func newFileArchiver(dir string) (fileArchiver, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println("can't create archive dir", err)
+		return fileArchiver{}, err
+	}
+
+	return fileArchiver{dir: dir, mu: &sync.Mutex{}}, nil
+}
+
+// DayDir returns the directory of the files for the day of t in an
+// archive in dir
+func DayDir(dir string, t time.Time) string {
+	return filepath.Join(dir, t.Format("2006-01-02"))
+}
+
+// Save appends each observation to the files of the day it was observed
+func (a fileArchiver) Save(vehicles []*models.VehicleObservation, departures []*models.DepartureObservation) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The observations of each day's directory
+	dayVehicles := map[string][]interface{}{}
+	dayDepartures := map[string][]interface{}{}
+
+	for _, v := range vehicles {
+		dir := DayDir(a.dir, v.ObservedAt)
+		dayVehicles[dir] = append(dayVehicles[dir], v)
+	}
+	for _, d := range departures {
+		dir := DayDir(a.dir, d.ObservedAt)
+		dayDepartures[dir] = append(dayDepartures[dir], d)
+	}
+
+	for dir, values := range dayVehicles {
+		err := appendDay(dir, vehiclesFile, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	for dir, values := range dayDepartures {
+		err := appendDay(dir, departuresFile, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendDay appends values to the file name in the day directory dir,
+// creating it if needed
+func appendDay(dir, name string, values []interface{}) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println("can't create archive dir", err)
+		return err
+	}
+
+	return appendLines(filepath.Join(dir, name), func(enc *json.Encoder) error {
+		for _, v := range values {
+			err := enc.Encode(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// appendLines opens the file at path for appending and calls write with
+// an encoder that writes each value as a line of JSON in a new gzip member
+func appendLines(path string, write func(enc *json.Encoder) error) error {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("can't open archive file", err)
+		return err
+	}
+	defer fh.Close()
+
+	gz := gzip.NewWriter(fh)
+
+	err = write(json.NewEncoder(gz))
+	if err != nil {
+		log.Println("can't write archive file", err)
+		return err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		log.Println("can't close archive file", err)
+		return err
+	}
+
+	return nil
+}
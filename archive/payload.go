@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/partners"
+)
+
+// payloadsDir is the directory in each day of a file archive that has a
+// directory of payloads for each key
+const payloadsDir = "payloads"
+
+// Replay returns a function for partners.Replay that reads payloads from a
+// at the time of now(). Like redis, data is only returned if it was saved
+// less than window before.
+func Replay(a Archiver, now func() time.Time, window time.Duration) func(k string) ([]byte, error) {
+	return func(k string) ([]byte, error) {
+		return a.Payload(k, now(), window)
+	}
+}
+
+// StartReplay makes partners read payloads from the archive of kind and
+// dir as if it were replayTime, a local time like "2016-06-12 08:00:00".
+// The clock of etc.Now starts at replayTime and advances in real time.
+func StartReplay(replayTime, kind, dir string, window time.Duration) error {
+	start, err := time.ParseInLocation("2006-01-02 15:04:05", replayTime, time.Local)
+	if err != nil {
+		log.Println("can't parse replay time", err)
+		return err
+	}
+
+	a, err := New(kind, dir)
+	if err != nil {
+		log.Println("can't create archive", err)
+		return err
+	}
+
+	etc.SetNow(start)
+	partners.Replay = Replay(a, etc.Now, window)
+
+	log.Println("replaying archive from", start)
+
+	return nil
+}
+
+// keyDir returns the directory of the payloads of k in the archive day
+// dir. Keys are hashed, since they can be longer than a file name.
+func keyDir(dayDir, k string) string {
+	return filepath.Join(dayDir, payloadsDir, fmt.Sprintf("%x", sha1.Sum([]byte(k))))
+}
+
+// SavePayload saves b gzipped in a file named after the UNIX timestamp of
+// t, e.g., archive/2016-06-12/payloads/<hash of k>/1465732800.gz
+func (a fileArchiver) SavePayload(k string, t time.Time, b []byte) error {
+	dir := keyDir(DayDir(a.dir, t), k)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println("can't create archive dir", err)
+		return err
+	}
+
+	fh, err := os.Create(filepath.Join(dir, strconv.FormatInt(t.Unix(), 10)+".gz"))
+	if err != nil {
+		log.Println("can't create payload file", err)
+		return err
+	}
+	defer fh.Close()
+
+	gz := gzip.NewWriter(fh)
+
+	_, err = gz.Write(b)
+	if err != nil {
+		log.Println("can't write payload file", err)
+		return err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		log.Println("can't close payload file", err)
+		return err
+	}
+
+	return nil
+}
+
+func (a fileArchiver) Payload(k string, t time.Time, window time.Duration) ([]byte, error) {
+	var best int64
+	var path string
+
+	start := t.Add(-window)
+
+	// Check the day of t and, if the window started the day before,
+	// that day too
+	days := []string{DayDir(a.dir, t)}
+	if DayDir(a.dir, start) != days[0] {
+		days = append(days, DayDir(a.dir, start))
+	}
+
+	for _, day := range days {
+		dir := keyDir(day, k)
+
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Println("can't read payload dir", err)
+			return nil, err
+		}
+
+		for _, f := range files {
+			ts, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".gz"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if ts > best && ts > start.Unix() && ts <= t.Unix() {
+				best = ts
+				path = filepath.Join(dir, f.Name())
+			}
+		}
+	}
+
+	if len(path) < 1 {
+		return nil, ErrNoPayload
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		log.Println("can't open payload file", err)
+		return nil, err
+	}
+	defer fh.Close()
+
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		log.Println("can't read payload file", err)
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
@@ -42,6 +42,11 @@ go get $CODE_ROOT/... || error
 go build -o $BIN_DIR/busapi $CODE_ROOT/cmds/busapi || error
 go build -o $BIN_DIR/busloader $CODE_ROOT/cmds/busloader || error
 go build -o $BIN_DIR/busprecache $CODE_ROOT/cmds/busprecache || error
+go build -o $BIN_DIR/busexport $CODE_ROOT/cmds/busexport || error
+go build -o $BIN_DIR/busdiff $CODE_ROOT/cmds/busdiff || error
+go build -o $BIN_DIR/busreport $CODE_ROOT/cmds/busreport || error
+go build -o $BIN_DIR/busmock $CODE_ROOT/cmds/busmock || error
+go build -o $BIN_DIR/bus $CODE_ROOT/cmds/bus || error
 
 # Run web build
 cd ../web || error
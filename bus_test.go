@@ -3,24 +3,38 @@
 // the API, checking for sane results. Most settings will be read
 // from the environment like the normal application, but
 // $BUS_GTFS_URLS and $BUS_ROUTE_FILTER will be overidden by
-// the tests.
+// the tests. With $BUS_TEST_MOCK=true, the tests run without network
+// access: the schedule is loaded from testdata/gtfs, and live data comes
+// from the recorded responses in testdata/mock instead of the partners.
+// It's precached before the tests run and again while they run, so it
+// doesn't expire.
 package bus_test
 
 import (
+	"context"
 	"encoding/json"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	"github.com/brnstz/bus/api"
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/health"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+	"github.com/brnstz/bus/internal/partners/transit_realtime"
 	"github.com/brnstz/bus/loader"
+	"github.com/brnstz/bus/mock"
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -65,10 +79,17 @@ func TestMain(m *testing.M) {
 		log.Fatal(err)
 	}
 
-	// Load the just subway and Brooklyn bus files
-	conf.Loader.GTFSURLs = []string{
-		"http://pub.brnstz.com.s3-website-us-east-1.amazonaws.com/bus/testdata/google_transit.zip",
-		"http://pub.brnstz.com.s3-website-us-east-1.amazonaws.com/bus/testdata/google_transit_brooklyn.zip",
+	mockPartners := os.Getenv("BUS_TEST_MOCK") == "true"
+
+	// Load the just subway and Brooklyn bus files, or our small copy of
+	// them when we're offline
+	if mockPartners {
+		conf.Loader.GTFSURLs = []string{"file://testdata/gtfs"}
+	} else {
+		conf.Loader.GTFSURLs = []string{
+			"http://pub.brnstz.com.s3-website-us-east-1.amazonaws.com/bus/testdata/google_transit.zip",
+			"http://pub.brnstz.com.s3-website-us-east-1.amazonaws.com/bus/testdata/google_transit_brooklyn.zip",
+		}
 	}
 
 	// Filter on a few routes for our tests
@@ -78,13 +99,47 @@ func TestMain(m *testing.M) {
 
 	conf.API.WebDir = "web/"
 
-	// Get a db connection
+	// Get a db connection and cache
 	etc.DBConn = etc.MustDB()
+	etc.Cache = etc.MustCache()
 
 	// Alow skipping the load if we trust our db is ok
 	if os.Getenv("BUS_TEST_SKIP_LOADER") != "true" {
 		// Load files once and return
-		loader.LoadOnce()
+		loader.LoadOnce(context.Background())
+	}
+
+	err = models.Prepare(etc.DBConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Use recorded partner responses instead of the real APIs
+	if mockPartners {
+		mockServer := httptest.NewServer(mock.NewHandler("testdata/mock", true))
+		defer mockServer.Close()
+
+		conf.Partner.BustimeURL = mockServer.URL + "/api/siri"
+		conf.Partner.DatamineURL = mockServer.URL + "/mta_esi.php"
+
+		precacheRoutes()
+
+		// Precache again before what we saved expires
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go func() {
+			ticker := time.NewTicker(time.Duration(conf.Cache.RedisTTL) * time.Second / 2)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					precacheRoutes()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 	}
 
 	// Create an HTTP server for our tests and set the URL
@@ -96,6 +151,32 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// precacheRoutes precaches each direction of the routes we filtered on,
+// the same way busprecache does. Routes without recorded responses
+// only log an error.
+func precacheRoutes() {
+	for _, routeID := range conf.Loader.RouteFilter {
+		route, err := models.GetRoute(etc.DBConn, "MTA NYCT", routeID)
+		if err != nil {
+			log.Println("can't get route to precache", routeID, err)
+			continue
+		}
+
+		p, err := partners.Find(*route)
+		if err != nil {
+			log.Println("can't find partner", routeID, err)
+			continue
+		}
+
+		for dir := 0; dir <= 1; dir++ {
+			err = p.Precache(route.AgencyID, route.RouteID, dir)
+			if err != nil {
+				log.Println("can't precache", routeID, dir, err)
+			}
+		}
+	}
+}
+
 // hereResponse is the response to /api/here
 type hereResponse struct {
 	Stops []struct {
@@ -581,3 +662,363 @@ func TestHereTomorrow(t *testing.T) {
 		}
 	}
 }
+
+// TestHereLookahead tests that departures are limited to the requested
+// window when it spans midnight
+func TestHereLookahead(t *testing.T) {
+	var resp hereResponse
+	var err error
+
+	params := url.Values{}
+
+	// Manhattan Av. and Greenpoint Av. in Brooklyn
+	params.Set("lat", "40.731324619044514")
+	params.Set("lon", "-73.95446261823963")
+	params.Set("sw_lat", "40.73059087592777")
+	params.Set("sw_lon", "-73.95548990429234")
+	params.Set("ne_lat", "40.73205835407014")
+	params.Set("ne_lon", "-73.95343533218693")
+	params.Set("now", "2016-07-18 23:47:01")
+	params.Set("lookahead_mins", "45")
+
+	err = getJSON(&resp, serverURL+"/api/here?"+params.Encode())
+	if err != nil {
+		t.Fatal("can't get API response for lookahead test", err)
+	}
+
+	now, err := time.ParseInLocation("2006-01-02 15:04:05", params.Get("now"), time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := now.Add(45 * time.Minute)
+
+	if len(resp.Stops) < 1 {
+		t.Fatal("expected at least one stop")
+	}
+
+	for _, stop := range resp.Stops {
+		for _, departure := range stop.Departures {
+			if departure.Time.Before(now) || departure.Time.After(end) {
+				t.Fatalf("departure time %v not between %v and %v", departure.Time, now, end)
+			}
+		}
+	}
+}
+
+// TestHereRadius tests that we can search by a radius in meters instead
+// of a box
+func TestHereRadius(t *testing.T) {
+	var resp hereResponse
+	var err error
+
+	params := url.Values{}
+
+	// Manhattan Av. and Greenpoint Av. in Brooklyn
+	params.Set("lat", "40.731324619044514")
+	params.Set("lon", "-73.95446261823963")
+	params.Set("radius", "400")
+	params.Set("now", "2016-07-18 12:05:00")
+
+	err = getJSON(&resp, serverURL+"/api/here?"+params.Encode())
+	if err != nil {
+		t.Fatal("can't get API response for radius test", err)
+	}
+
+	found := false
+	for _, stop := range resp.Stops {
+		if stop.Stop_ID == "G26N" || stop.Stop_ID == "G26S" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("expected to find G26N or G26S within radius")
+	}
+}
+
+// TestAPIError tests that bad parameters get a JSON error on both the
+// versioned and unversioned paths
+func TestAPIError(t *testing.T) {
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	params := url.Values{}
+	params.Set("lat", "not a number")
+	params.Set("lon", "-73.95446261823963")
+	params.Set("radius", "400")
+
+	for _, prefix := range []string{"/api/v1/", "/api/"} {
+		httpResp, err := http.Get(serverURL + prefix + "here?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+
+		if httpResp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %v but got %v", http.StatusBadRequest, httpResp.StatusCode)
+		}
+
+		err = json.NewDecoder(httpResp.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal("can't decode error response", err)
+		}
+
+		if resp.Error.Code != "invalid_parameter" {
+			t.Fatalf("expected invalid_parameter error but got %+v", resp.Error)
+		}
+	}
+}
+
+// TestTripGeoJSON tests that a trip can be returned as GeoJSON with
+// (lon, lat) coordinates
+func TestTripGeoJSON(t *testing.T) {
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+
+	params := url.Values{}
+	params.Set("agency_id", "MTA NYCT")
+	params.Set("trip_id", "B20160612SAT_083700_G..N13R")
+	params.Set("route_id", "G")
+	params.Set("format", "geojson")
+
+	err := getJSON(&fc, serverURL+"/api/v1/trip?"+params.Encode())
+	if err != nil {
+		t.Fatal("can't get API response for trip geojson", err)
+	}
+
+	if fc.Type != "FeatureCollection" {
+		t.Fatal("expected FeatureCollection but got:", fc.Type)
+	}
+
+	lines := 0
+	for _, f := range fc.Features {
+		if f.Geometry.Type != "LineString" {
+			continue
+		}
+		lines++
+
+		var coords [][]float64
+		err = json.Unmarshal(f.Geometry.Coordinates, &coords)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(coords) != 520 {
+			t.Fatal("expected 520 coordinates but got:", len(coords))
+		}
+
+		if coords[0][0] > -73 || coords[0][0] < -74 {
+			t.Fatal("expected longitude first but got:", coords[0])
+		}
+
+		if f.Properties["route_color"] == nil {
+			t.Fatal("expected route_color property")
+		}
+	}
+
+	if lines != 1 {
+		t.Fatal("expected 1 LineString but got:", lines)
+	}
+}
+
+// TestTile tests that a vector tile along the G line is returned and that
+// tiles outside the world are not found
+func TestTile(t *testing.T) {
+	resp, err := http.Get(serverURL + "/tiles/14/4826/6158.mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v but got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/vnd.mapbox-vector-tile" {
+		t.Fatal("unexpected content type:", resp.Header.Get("Content-Type"))
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) < 1 {
+		t.Fatal("expected a tile with data but it was empty")
+	}
+
+	resp, err = http.Get(serverURL + "/tiles/14/16384/6158.mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v but got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestTripMap tests that a trip can be drawn as a PNG
+func TestTripMap(t *testing.T) {
+	params := url.Values{}
+	params.Set("agency_id", "MTA NYCT")
+	params.Set("trip_id", "B20160612SAT_083700_G..N13R")
+	params.Set("route_id", "G")
+
+	resp, err := http.Get(serverURL + "/map/trip.png?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v but got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	img, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatal("can't decode trip map", err)
+	}
+
+	if img.Bounds().Dx() != 1200 || img.Bounds().Dy() != 630 {
+		t.Fatal("unexpected image size:", img.Bounds())
+	}
+}
+
+// TestStopPage tests that a stop page is rendered with a link to its
+// route and that the stop is in the agency's sitemap
+func TestStopPage(t *testing.T) {
+	resp, err := http.Get(serverURL + "/stop/MTA%20NYCT/G26N")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v but got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `href="/route/MTA%20NYCT/G"`) {
+		t.Fatal("expected a link to the G route page")
+	}
+
+	resp, err = http.Get(serverURL + "/sitemap/MTA%20NYCT.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "/stop/MTA%20NYCT/G26N</loc>") {
+		t.Fatal("expected G26N in the sitemap")
+	}
+}
+
+// TestGTFSRealtime tests that the trip updates feed is valid GTFS-realtime
+func TestGTFSRealtime(t *testing.T) {
+	resp, err := http.Get(serverURL + "/gtfs-rt/trip-updates.pb?agency_id=MTA+NYCT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v but got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := &transit_realtime.FeedMessage{}
+	err = proto.Unmarshal(b, fm)
+	if err != nil {
+		t.Fatal("can't unmarshal feed", err)
+	}
+
+	if fm.GetHeader().GetGtfsRealtimeVersion() != "1.0" {
+		t.Fatal("unexpected header:", fm.GetHeader())
+	}
+}
+
+// TestHealth tests that /healthz succeeds and /readyz reports the result
+// of each check
+func TestHealth(t *testing.T) {
+	var resp struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	health.Add("running", health.Running(ctx))
+	health.Add("db", health.DB(etc.DBConn))
+	health.Add("cache", health.Cache(etc.Cache))
+
+	// Don't leave our checks for other tests
+	t.Cleanup(func() {
+		health.Remove("running")
+		health.Remove("db")
+		health.Remove("cache")
+	})
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		err := getJSON(&resp, serverURL+path)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+
+		if resp.Status != "ok" {
+			t.Fatalf("expected %v to be ok but got %+v", path, resp)
+		}
+	}
+
+	if resp.Checks["db"] != "ok" || resp.Checks["cache"] != "ok" {
+		t.Fatal("expected db and cache checks but got", resp.Checks)
+	}
+
+	// We're not ready once we're stopping
+	stop()
+
+	httpResp, err := http.Get(serverURL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %v but got %v", http.StatusServiceUnavailable, httpResp.StatusCode)
+	}
+
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal("can't decode readyz response", err)
+	}
+
+	if resp.Checks["running"] != health.ErrStopping.Error() {
+		t.Fatal("expected running check to fail but got", resp.Checks)
+	}
+}
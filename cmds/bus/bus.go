@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brnstz/upsert"
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/brnstz/bus/api"
+	"github.com/brnstz/bus/archive"
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/loader"
+	"github.com/brnstz/bus/precache"
+)
+
+const usage = "usage: bus serve [--all] [--api] [--loader] [--precache]"
+
+func main() {
+	var err error
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	if len(os.Args) < 2 || os.Args[1] != "serve" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	all := fs.Bool("all", false, "run the loader, precache and API")
+	runAPI := fs.Bool("api", false, "run the API, like busapi")
+	runLoader := fs.Bool("loader", false, "load GTFS files now and every day, like busloader")
+	runPrecache := fs.Bool("precache", false, "precache live data from partners, like busprecache")
+	fs.Parse(os.Args[2:])
+
+	if *all {
+		*runAPI, *runLoader, *runPrecache = true, true, true
+	}
+
+	if !*runAPI && !*runLoader && !*runPrecache {
+		fmt.Fprintln(os.Stderr, usage)
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	specs := []interface{}{&conf.DB, &conf.Cache, &conf.Health}
+	if *runAPI {
+		specs = append(specs, &conf.API)
+	}
+	if *runLoader {
+		specs = append(specs, &conf.Loader)
+	}
+	if *runAPI || *runPrecache {
+		specs = append(specs, &conf.Partner)
+	}
+	if *runAPI || *runPrecache {
+		specs = append(specs, &conf.Archive)
+	}
+
+	for _, spec := range specs {
+		err = envconfig.Process("bus", spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Replayed data would be archived again as if it were live
+	if *runAPI && *runPrecache && len(conf.API.ReplayTime) > 0 {
+		log.Fatal("BUS_REPLAY_TIME can't be used with --precache")
+	}
+
+	// When every part runs in this process, nothing needs to share the
+	// cache with another process, so redis is only used if it's asked
+	// for. Otherwise, the parts that run elsewhere (e.g., busapi
+	// reading what we precache) need the same redis as us.
+	if *runAPI && *runLoader && *runPrecache && len(os.Getenv("BUS_CACHE")) < 1 {
+		conf.Cache.Kind = "memory"
+	}
+
+	time.Local, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	etc.DBConn = etc.MustDB()
+	etc.Cache = etc.MustCache()
+
+	// Stop when we're asked to, letting each part finish what it's doing
+	ctx, stop := etc.Start()
+	defer stop()
+
+	// Everything we started, which we wait for after we're asked to stop
+	var wg sync.WaitGroup
+
+	if *runAPI {
+		err = models.Prepare(etc.DBConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Read partner data from the archive instead of the cache when
+		// replaying
+		if len(conf.API.ReplayTime) > 0 {
+			err = archive.StartReplay(conf.API.ReplayTime, conf.Archive.Kind, conf.Archive.Dir,
+				time.Duration(conf.Cache.RedisTTL)*time.Second,
+			)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if conf.API.BuildTimestamp == 0 {
+			conf.API.BuildTimestamp = time.Now().Unix()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := api.Serve(ctx, conf.API.Addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Precache gets the routes to precache when it starts, so when we're
+	// also loading, it waits until the first load is finished
+	var startPrecache sync.Once
+	precacheAfterLoad := func() {
+		startPrecache.Do(func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				precache.Precache(ctx)
+			}()
+		})
+	}
+
+	if *runLoader {
+		upsert.LongQuery = time.Duration(1 * time.Second)
+
+		var loaded func()
+		if *runPrecache {
+			loaded = precacheAfterLoad
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loader.LoadForever(ctx, loaded)
+		}()
+	} else if *runPrecache {
+		precacheAfterLoad()
+	}
+
+	// Run until we're asked to stop and everything has finished
+	<-ctx.Done()
+	log.Println("stopping")
+
+	// Let another signal stop us right away
+	stop()
+
+	wg.Wait()
+	log.Println("stopped")
+}
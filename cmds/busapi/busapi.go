@@ -3,14 +3,16 @@ package main
 import (
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/kelseyhightower/envconfig"
 
 	"github.com/brnstz/bus/api"
+	"github.com/brnstz/bus/archive"
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
 
 	_ "net/http/pprof"
 )
@@ -39,20 +41,42 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = envconfig.Process("bus", &conf.Archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Health)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	time.Local, err = time.LoadLocation("America/New_York")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	etc.DBConn = etc.MustDB()
+	etc.Cache = etc.MustCache()
 
-	if conf.API.BuildTimestamp == 0 {
-		conf.API.BuildTimestamp = time.Now().Unix()
+	err = models.Prepare(etc.DBConn)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	handler := api.NewHandler()
+	// Read partner data from the archive instead of redis when replaying
+	if len(conf.API.ReplayTime) > 0 {
+		err = archive.StartReplay(conf.API.ReplayTime, conf.Archive.Kind, conf.Archive.Dir,
+			time.Duration(conf.Cache.RedisTTL)*time.Second,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	withgz := gziphandler.GzipHandler(handler)
+	if conf.API.BuildTimestamp == 0 {
+		conf.API.BuildTimestamp = time.Now().Unix()
+	}
 
 	/*
 		err = api.InitRouteCache()
@@ -61,21 +85,37 @@ func main() {
 		}
 	*/
 
+	// Stop when we're asked to, finishing the requests we have
+	ctx, stop := etc.Start()
+	defer stop()
+
+	// pprof, which isn't stopped with the rest
+	go func() {
+		http.ListenAndServe(conf.API.DebugAddr, nil)
+	}()
+
+	var wg sync.WaitGroup
+
 	// prod http to https redirect
+	redirMux := http.NewServeMux()
+	redirMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, conf.API.BaseURL+"/", http.StatusMovedPermanently)
+	})
+
+	wg.Add(1)
 	go func() {
-		redirMux := http.NewServeMux()
-		redirMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			http.Redirect(w, r, "https://token.live/", http.StatusMovedPermanently)
-		})
-		err = http.ListenAndServe(":8001", redirMux)
+		defer wg.Done()
+		err := etc.Serve(ctx, &http.Server{Addr: conf.API.RedirectAddr, Handler: redirMux})
 		if err != nil {
 			log.Fatal(err)
 		}
 	}()
 
-	go func() {
-		http.ListenAndServe("localhost:6060", nil)
-	}()
+	err = api.Serve(ctx, conf.API.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Fatal(http.ListenAndServe(conf.API.Addr, withgz))
+	wg.Wait()
+	log.Println("stopped")
 }
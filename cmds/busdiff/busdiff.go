@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/brnstz/bus/diff"
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/loader"
+)
+
+// readURL fetches and prepares the feed at u and reads it into a
+// diff.Feed
+func readURL(u string) (*diff.Feed, error) {
+	dir, err := ioutil.TempDir(conf.Loader.TmpDir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	log.Printf("fetching %v", u)
+
+	err = loader.Fetch(u, conf.Diff.RulesURL, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff.ReadDir(dir, conf.Loader.RouteFilter)
+}
+
+func main() {
+	var err error
+	var oldFeed *diff.Feed
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	err = envconfig.Process("bus", &conf.Loader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Diff)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	time.Local, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	newFeed, err := readURL(conf.Diff.NewURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(conf.Diff.OldURL) > 0 {
+		oldFeed, err = readURL(conf.Diff.OldURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	} else {
+		// Compare against what's loaded in the db for the same agencies
+		// as the new feed
+		err = envconfig.Process("bus", &conf.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		etc.DBConn = etc.MustDB()
+
+		oldFeed, err = diff.ReadDB(etc.DBConn, newFeed.AgencyIDs, conf.Loader.RouteFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report := diff.Compare(oldFeed, newFeed, conf.Diff.MinMeters)
+
+	switch conf.Diff.Format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+
+	default:
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
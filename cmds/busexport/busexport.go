@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/brnstz/bus/export"
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+)
+
+// nonEmpty removes empty strings from vals, so that setting a list to
+// an empty environment variable means no filter
+func nonEmpty(vals []string) (out []string) {
+	for _, v := range vals {
+		if len(v) > 0 {
+			out = append(out, v)
+		}
+	}
+
+	return
+}
+
+func main() {
+	var err error
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	err = envconfig.Process("bus", &conf.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Export)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	time.Local, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	etc.DBConn = etc.MustDB()
+
+	fh, err := os.Create(conf.Export.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Use a single read only transaction so that we get a consistent
+	// view even if the loader is running. A SQLite transaction is
+	// already isolated from the loader.
+	tx, err := etc.DBConn.Beginx()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Commit()
+
+	if !etc.SQLite() {
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	t1 := time.Now()
+
+	err = export.Write(tx, fh, export.Filter{
+		AgencyIDs: nonEmpty(conf.Export.AgencyIDs),
+		RouteIDs:  nonEmpty(conf.Export.RouteFilter),
+		AgencyURL: conf.Export.AgencyURL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = fh.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("took %v to write %v", time.Now().Sub(t1), conf.Export.File)
+}
@@ -27,12 +27,23 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = envconfig.Process("bus", &conf.Cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Health)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	time.Local, err = time.LoadLocation("America/New_York")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	etc.DBConn = etc.MustDB()
+	etc.Cache = etc.MustCache()
 
 	upsert.LongQuery = time.Duration(1 * time.Second)
 	//upsert.Debug = true
@@ -45,9 +56,13 @@ func main() {
 		os.MkdirAll(tmpdir, 0775)
 	}
 
+	// Stop when we're asked to, after the file we're loading
+	ctx, stop := etc.Start()
+	defer stop()
+
 	if conf.Loader.LoadForever {
-		loader.LoadForever()
+		loader.LoadForever(ctx, nil)
 	} else {
-		loader.LoadOnce()
+		loader.LoadOnce(ctx)
 	}
 }
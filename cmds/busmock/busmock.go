@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/mock"
+)
+
+func main() {
+	var err error
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	err = envconfig.Process("bus", &conf.Mock)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	time.Local, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("serving", conf.Mock.Dir, "on", conf.Mock.Addr)
+
+	log.Fatal(http.ListenAndServe(conf.Mock.Addr, mock.NewHandler(conf.Mock.Dir, conf.Mock.Shift)))
+}
@@ -29,12 +29,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = envconfig.Process("bus", &conf.Archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Health)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	time.Local, err = time.LoadLocation("America/New_York")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	etc.DBConn = etc.MustDB()
+	etc.Cache = etc.MustCache()
+
+	// Stop when we're asked to, finishing the requests we have
+	ctx, stop := etc.Start()
+	defer stop()
 
-	precache.Precache()
+	precache.Precache(ctx)
 }
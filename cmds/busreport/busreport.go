@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/reports"
+)
+
+func main() {
+	var err error
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	err = envconfig.Process("bus", &conf.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = envconfig.Process("bus", &conf.Report)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	time.Local, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	etc.DBConn = etc.MustDB()
+
+	start, end, err := reports.ParseDates(conf.Report.Start, conf.Report.End)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results, err := reports.GetOTP(etc.DBConn, reports.Params{
+		AgencyID: conf.Report.AgencyID,
+		RouteID:  conf.Report.RouteID,
+		Start:    start,
+		End:      end,
+		GroupBy:  conf.Report.GroupBy,
+		Early:    conf.Report.Early,
+		Late:     conf.Report.Late,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch conf.Report.Format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+
+	default:
+		err = reports.WriteText(os.Stdout, results)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// Route is a route that was added or removed
+type Route struct {
+	AgencyID string `json:"agency_id"`
+	RouteID  string `json:"route_id"`
+	Name     string `json:"name"`
+}
+
+// StopChange is a stop that was added, removed or moved. For added stops
+// Old is nil and for removed stops New is nil.
+type StopChange struct {
+	AgencyID string  `json:"agency_id"`
+	StopID   string  `json:"stop_id"`
+	Old      *Stop   `json:"old,omitempty"`
+	New      *Stop   `json:"new,omitempty"`
+	Meters   float64 `json:"meters,omitempty"`
+}
+
+// TripChange is a change in the number of trips on a route on a day of
+// the week
+type TripChange struct {
+	AgencyID string `json:"agency_id"`
+	RouteID  string `json:"route_id"`
+	Day      string `json:"day"`
+	Old      int    `json:"old"`
+	New      int    `json:"new"`
+}
+
+// CalendarChange is a service_id whose regular schedule was added,
+// removed or changed
+type CalendarChange struct {
+	AgencyID  string    `json:"agency_id"`
+	ServiceID string    `json:"service_id"`
+	Old       *Calendar `json:"old,omitempty"`
+	New       *Calendar `json:"new,omitempty"`
+}
+
+// ExceptionChange is a change to a single service exception. A zero
+// value for Old or New means there was no exception on that date.
+type ExceptionChange struct {
+	AgencyID  string `json:"agency_id"`
+	ServiceID string `json:"service_id"`
+	Date      string `json:"date"`
+	Old       int    `json:"old"`
+	New       int    `json:"new"`
+}
+
+// Report is the difference between two feeds
+type Report struct {
+	AddedRoutes   []Route `json:"added_routes"`
+	RemovedRoutes []Route `json:"removed_routes"`
+
+	AddedStops   []StopChange `json:"added_stops"`
+	RemovedStops []StopChange `json:"removed_stops"`
+	MovedStops   []StopChange `json:"moved_stops"`
+
+	TripChanges []TripChange `json:"trip_changes"`
+
+	CalendarChanges  []CalendarChange  `json:"calendar_changes"`
+	ExceptionChanges []ExceptionChange `json:"exception_changes"`
+}
+
+// Compare returns a Report of the differences from oldFeed to newFeed.
+// Stops that moved less than minMeters are not reported.
+func Compare(oldFeed, newFeed *Feed, minMeters float64) *Report {
+	r := &Report{}
+
+	// Routes
+	keys := keySet{}
+	for k := range newFeed.Routes {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		if _, exists := oldFeed.Routes[k]; !exists {
+			r.AddedRoutes = append(r.AddedRoutes, Route{k.AgencyID, k.ID, newFeed.Routes[k]})
+		}
+	}
+	keys = keySet{}
+	for k := range oldFeed.Routes {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		if _, exists := newFeed.Routes[k]; !exists {
+			r.RemovedRoutes = append(r.RemovedRoutes, Route{k.AgencyID, k.ID, oldFeed.Routes[k]})
+		}
+	}
+
+	// Stops
+	keys = keySet{}
+	for k := range newFeed.Stops {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		newStop := newFeed.Stops[k]
+		oldStop, exists := oldFeed.Stops[k]
+
+		if !exists {
+			r.AddedStops = append(r.AddedStops, StopChange{
+				AgencyID: k.AgencyID, StopID: k.ID, New: &newStop,
+			})
+			continue
+		}
+
+		meters := etc.Distance(oldStop.Lat, oldStop.Lon, newStop.Lat, newStop.Lon)
+		if meters > minMeters {
+			r.MovedStops = append(r.MovedStops, StopChange{
+				AgencyID: k.AgencyID, StopID: k.ID,
+				Old: &oldStop, New: &newStop, Meters: meters,
+			})
+		}
+	}
+	keys = keySet{}
+	for k := range oldFeed.Stops {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		oldStop := oldFeed.Stops[k]
+		if _, exists := newFeed.Stops[k]; !exists {
+			r.RemovedStops = append(r.RemovedStops, StopChange{
+				AgencyID: k.AgencyID, StopID: k.ID, Old: &oldStop,
+			})
+		}
+	}
+
+	// Trips per route per day, including routes that were added or
+	// removed
+	oldTrips := oldFeed.TripsPerDay()
+	newTrips := newFeed.TripsPerDay()
+	keys = keySet{}
+	for k := range oldTrips {
+		keys[k] = true
+	}
+	for k := range newTrips {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		for _, day := range etc.Days {
+			o := oldTrips[k][day]
+			n := newTrips[k][day]
+			if o != n {
+				r.TripChanges = append(r.TripChanges, TripChange{k.AgencyID, k.ID, day, o, n})
+			}
+		}
+	}
+
+	// Calendars
+	keys = keySet{}
+	for k := range oldFeed.Calendars {
+		keys[k] = true
+	}
+	for k := range newFeed.Calendars {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		o := oldFeed.Calendars[k]
+		n := newFeed.Calendars[k]
+
+		if o != nil && n != nil && o.String() == n.String() {
+			continue
+		}
+
+		r.CalendarChanges = append(r.CalendarChanges, CalendarChange{k.AgencyID, k.ID, o, n})
+	}
+
+	// Exceptions
+	keys = keySet{}
+	for k := range oldFeed.Exceptions {
+		keys[k] = true
+	}
+	for k := range newFeed.Exceptions {
+		keys[k] = true
+	}
+	for _, k := range keys.sorted() {
+		dates := map[string]bool{}
+		for date := range oldFeed.Exceptions[k] {
+			dates[date] = true
+		}
+		for date := range newFeed.Exceptions[k] {
+			dates[date] = true
+		}
+
+		for _, date := range sortedBoolKeys(dates) {
+			o := oldFeed.Exceptions[k][date]
+			n := newFeed.Exceptions[k][date]
+			if o != n {
+				r.ExceptionChanges = append(r.ExceptionChanges,
+					ExceptionChange{k.AgencyID, k.ID, date, o, n},
+				)
+			}
+		}
+	}
+
+	return r
+}
+
+// WriteText writes a human-readable version of the report to w
+func (r *Report) WriteText(w io.Writer) (err error) {
+	p := func(format string, a ...interface{}) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, format+"\n", a...)
+	}
+
+	p("Routes: %d added, %d removed", len(r.AddedRoutes), len(r.RemovedRoutes))
+	for _, v := range r.AddedRoutes {
+		p("  + %s %s (%s)", v.AgencyID, v.RouteID, v.Name)
+	}
+	for _, v := range r.RemovedRoutes {
+		p("  - %s %s (%s)", v.AgencyID, v.RouteID, v.Name)
+	}
+
+	p("")
+	p("Stops: %d added, %d removed, %d moved",
+		len(r.AddedStops), len(r.RemovedStops), len(r.MovedStops),
+	)
+	for _, v := range r.AddedStops {
+		p("  + %s %s %s (%f, %f)", v.AgencyID, v.StopID, v.New.Name, v.New.Lat, v.New.Lon)
+	}
+	for _, v := range r.RemovedStops {
+		p("  - %s %s %s (%f, %f)", v.AgencyID, v.StopID, v.Old.Name, v.Old.Lat, v.Old.Lon)
+	}
+	for _, v := range r.MovedStops {
+		p("  ~ %s %s %s moved %.0fm (%f, %f) -> (%f, %f)",
+			v.AgencyID, v.StopID, v.New.Name, v.Meters,
+			v.Old.Lat, v.Old.Lon, v.New.Lat, v.New.Lon,
+		)
+	}
+
+	p("")
+	p("Trips per route per day: %d changes", len(r.TripChanges))
+	for _, v := range r.TripChanges {
+		p("  ~ %s %s %s: %d -> %d (%+d)", v.AgencyID, v.RouteID, v.Day, v.Old, v.New, v.New-v.Old)
+	}
+
+	p("")
+	p("Calendars: %d changes", len(r.CalendarChanges))
+	for _, v := range r.CalendarChanges {
+		switch {
+		case v.Old == nil:
+			p("  + %s %s %s", v.AgencyID, v.ServiceID, v.New)
+		case v.New == nil:
+			p("  - %s %s %s", v.AgencyID, v.ServiceID, v.Old)
+		default:
+			p("  ~ %s %s %s -> %s", v.AgencyID, v.ServiceID, v.Old, v.New)
+		}
+	}
+
+	p("")
+	p("Calendar exceptions: %d changes", len(r.ExceptionChanges))
+	for _, v := range r.ExceptionChanges {
+		p("  ~ %s %s %s: %s -> %s", v.AgencyID, v.ServiceID, v.Date,
+			exceptionName(v.Old), exceptionName(v.New),
+		)
+	}
+
+	return
+}
+
+// exceptionName returns a description of an exception_type
+func exceptionName(exceptionType int) string {
+	switch exceptionType {
+	case 0:
+		return "none"
+	case models.ServiceAdded:
+		return "added"
+	case models.ServiceRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("unknown (%d)", exceptionType)
+	}
+}
+
+// keySet is a set of routes, stops or service_ids
+type keySet map[Key]bool
+
+// sorted returns the keys in order of agency and then ID
+func (ks keySet) sorted() (keys []Key) {
+	for k := range ks {
+		keys = append(keys, k)
+	}
+	sort.Sort(byKey(keys))
+
+	return
+}
+
+type byKey []Key
+
+func (b byKey) Len() int      { return len(b) }
+func (b byKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool {
+	if b[i].AgencyID != b[j].AgencyID {
+		return b[i].AgencyID < b[j].AgencyID
+	}
+	return b[i].ID < b[j].ID
+}
+
+func sortedBoolKeys(m map[string]bool) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return
+}
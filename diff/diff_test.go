@@ -0,0 +1,279 @@
+package diff
+
+import (
+	"io/ioutil"
+	"math"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(etc.DateFormat, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// testFeed returns a feed with one route, stop and service in each of two
+// agencies that use the same IDs
+func testFeed() *Feed {
+	f := newFeed()
+	f.AgencyIDs = []string{"A", "B"}
+
+	for _, agencyID := range f.AgencyIDs {
+		f.Routes[Key{agencyID, "1"}] = "Route 1"
+		f.Stops[Key{agencyID, "S1"}] = Stop{Name: "Main St", Lat: 40.7, Lon: -74.0}
+		f.addTrips(Key{agencyID, "1"}, "WKD", 10)
+		for _, day := range []string{"monday", "tuesday"} {
+			f.addCalendarDay(Key{agencyID, "WKD"}, day, date("20160101"), date("20161231"))
+		}
+	}
+
+	return f
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(f *Feed)
+		expected Report
+	}{
+		{
+			name:     "no changes",
+			change:   func(f *Feed) {},
+			expected: Report{},
+		},
+
+		{
+			name: "route added in one agency only",
+			change: func(f *Feed) {
+				f.Routes[Key{"B", "2"}] = "Route 2"
+			},
+			expected: Report{
+				AddedRoutes: []Route{{"B", "2", "Route 2"}},
+			},
+		},
+
+		{
+			name: "route removed from one agency only",
+			change: func(f *Feed) {
+				delete(f.Routes, Key{"A", "1"})
+			},
+			expected: Report{
+				RemovedRoutes: []Route{{"A", "1", "Route 1"}},
+			},
+		},
+
+		{
+			name: "stop moved less than the minimum",
+			change: func(f *Feed) {
+				f.Stops[Key{"A", "S1"}] = Stop{Name: "Main St", Lat: 40.7001, Lon: -74.0}
+			},
+			expected: Report{},
+		},
+
+		{
+			name: "stop moved, added and removed",
+			change: func(f *Feed) {
+				f.Stops[Key{"A", "S1"}] = Stop{Name: "Main St", Lat: 40.71, Lon: -74.0}
+				f.Stops[Key{"A", "S2"}] = Stop{Name: "Elm St", Lat: 40.8, Lon: -74.0}
+				delete(f.Stops, Key{"B", "S1"})
+			},
+			expected: Report{
+				AddedStops: []StopChange{
+					{AgencyID: "A", StopID: "S2", New: &Stop{"Elm St", 40.8, -74.0}},
+				},
+				RemovedStops: []StopChange{
+					{AgencyID: "B", StopID: "S1", Old: &Stop{"Main St", 40.7, -74.0}},
+				},
+				MovedStops: []StopChange{
+					{
+						AgencyID: "A", StopID: "S1",
+						Old:    &Stop{"Main St", 40.7, -74.0},
+						New:    &Stop{"Main St", 40.71, -74.0},
+						Meters: 1112,
+					},
+				},
+			},
+		},
+
+		{
+			name: "more trips on one agency's route",
+			change: func(f *Feed) {
+				f.addTrips(Key{"B", "1"}, "WKD", 5)
+			},
+			expected: Report{
+				TripChanges: []TripChange{
+					{"B", "1", "monday", 10, 15},
+					{"B", "1", "tuesday", 10, 15},
+				},
+			},
+		},
+
+		{
+			name: "calendar changed in one agency only",
+			change: func(f *Feed) {
+				f.addCalendarDay(Key{"A", "WKD"}, "wednesday", date("20160101"), date("20161231"))
+			},
+			expected: Report{
+				TripChanges: []TripChange{
+					{"A", "1", "wednesday", 0, 10},
+				},
+				CalendarChanges: []CalendarChange{
+					{
+						AgencyID: "A", ServiceID: "WKD",
+						Old: &Calendar{
+							Days:      map[string]bool{"monday": true, "tuesday": true},
+							StartDate: date("20160101"), EndDate: date("20161231"),
+						},
+						New: &Calendar{
+							Days:      map[string]bool{"monday": true, "tuesday": true, "wednesday": true},
+							StartDate: date("20160101"), EndDate: date("20161231"),
+						},
+					},
+				},
+			},
+		},
+
+		{
+			name: "exception added",
+			change: func(f *Feed) {
+				f.addException(Key{"B", "WKD"}, date("20160704"), 2)
+			},
+			expected: Report{
+				ExceptionChanges: []ExceptionChange{
+					{"B", "WKD", "20160704", 0, 2},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		newFeed := testFeed()
+		test.change(newFeed)
+
+		actual := Compare(testFeed(), newFeed, 50)
+
+		// Round the distance so we can compare it
+		for i := range actual.MovedStops {
+			actual.MovedStops[i].Meters = math.Round(actual.MovedStops[i].Meters)
+		}
+
+		if !reflect.DeepEqual(*actual, test.expected) {
+			t.Errorf("%v: expected\n%+v\nbut got\n%+v", test.name, test.expected, *actual)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string][]string{
+		"routes.txt": {
+			"route_id,agency_id,route_short_name,route_long_name",
+			"1,A,1,",
+			"2,A,,Second Avenue",
+			"3,B,3,",
+		},
+		"trips.txt": {
+			"route_id,service_id,trip_id",
+			"1,WKD,T1",
+			"1,WKD,T2",
+			"2,SAT,T3",
+			"3,WKD,T4",
+		},
+		"stops.txt": {
+			"stop_id,stop_name,stop_lat,stop_lon",
+			"S1,Main St, 40.7 ,-74.0",
+			"S2,Elm St,40.8,-74.0",
+			"P1,Parent Station,40.7,-74.0",
+		},
+		"stop_times.txt": {
+			"trip_id,stop_id",
+			"T1,S1",
+			"T3,S2",
+			"T4,S1",
+		},
+		"calendar.txt": {
+			"service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date",
+			"WKD,1,1,1,1,1,0,0,20160101,20161231",
+			"SAT,0,0,0,0,0,1,0,20160101,20161231",
+			"UNUSED,1,1,1,1,1,1,1,20160101,20161231",
+		},
+	}
+	for name, lines := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := ReadDir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f.AgencyIDs, []string{"A", "B"}) {
+		t.Errorf("unexpected agencies %v", f.AgencyIDs)
+	}
+
+	expectedRoutes := map[Key]string{
+		{"A", "1"}: "1",
+		{"A", "2"}: "Second Avenue",
+		{"B", "3"}: "3",
+	}
+	if !reflect.DeepEqual(f.Routes, expectedRoutes) {
+		t.Errorf("unexpected routes %v", f.Routes)
+	}
+
+	// Only stops with stop times are read, in each agency that stops
+	// there
+	expectedStops := map[Key]Stop{
+		{"A", "S1"}: {"Main St", 40.7, -74.0},
+		{"A", "S2"}: {"Elm St", 40.8, -74.0},
+		{"B", "S1"}: {"Main St", 40.7, -74.0},
+	}
+	if !reflect.DeepEqual(f.Stops, expectedStops) {
+		t.Errorf("unexpected stops %v", f.Stops)
+	}
+
+	// Only services with trips are read, in each agency that uses them
+	if len(f.Calendars) != 3 || f.Calendars[Key{"A", "WKD"}] == nil ||
+		f.Calendars[Key{"B", "WKD"}] == nil || f.Calendars[Key{"A", "SAT"}] == nil {
+		t.Errorf("unexpected calendars %v", f.Calendars)
+	}
+
+	// The route filter skips routes and everything that's only on them
+	f, err = ReadDir(dir, []string{"2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f.Routes, map[Key]string{{"A", "2"}: "Second Avenue"}) {
+		t.Errorf("unexpected filtered routes %v", f.Routes)
+	}
+	if !reflect.DeepEqual(f.Stops, map[Key]Stop{{"A", "S2"}: {"Elm St", 40.8, -74.0}}) {
+		t.Errorf("unexpected filtered stops %v", f.Stops)
+	}
+	if len(f.Calendars) != 1 || f.Calendars[Key{"A", "SAT"}] == nil {
+		t.Errorf("unexpected filtered calendars %v", f.Calendars)
+	}
+	if !reflect.DeepEqual(f.TripsPerDay(), map[Key]map[string]int{{"A", "2"}: {"saturday": 1}}) {
+		t.Errorf("unexpected filtered trips %v", f.TripsPerDay())
+	}
+
+	// An empty filter is no filter
+	f, err = ReadDir(dir, []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Routes) != 3 {
+		t.Errorf("unexpected routes with an empty filter %v", f.Routes)
+	}
+}
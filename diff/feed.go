@@ -0,0 +1,499 @@
+// Package diff compares two versions of a GTFS feed, either the version
+// loaded in the database or unloaded feed files, and reports what changed
+package diff
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// Stop is the location of a stop in a feed
+type Stop struct {
+	Name string  `json:"stop_name" db:"stop_name"`
+	Lat  float64 `json:"lat" db:"lat"`
+	Lon  float64 `json:"lon" db:"lon"`
+}
+
+// Calendar is the regular schedule of a service_id
+type Calendar struct {
+	Days      map[string]bool `json:"days"`
+	StartDate time.Time       `json:"start_date"`
+	EndDate   time.Time       `json:"end_date"`
+}
+
+// String returns a description like "sat,sun 20160101-20161231"
+func (c *Calendar) String() string {
+	var active []string
+
+	for _, day := range etc.Days {
+		if c.Days[day] {
+			active = append(active, day[0:3])
+		}
+	}
+
+	return fmt.Sprintf("%s %s-%s",
+		strings.Join(active, ","),
+		c.StartDate.Format(etc.DateFormat), c.EndDate.Format(etc.DateFormat),
+	)
+}
+
+// Key identifies a route, stop or service_id within its agency
+type Key struct {
+	AgencyID string
+	ID       string
+}
+
+// Feed is the subset of a GTFS feed that we compare
+type Feed struct {
+	// AgencyIDs are the distinct agencies in the feed's routes
+	AgencyIDs []string
+
+	// Routes is a mapping of route to a display name
+	Routes map[Key]string
+
+	// Stops is a mapping of stop to its location
+	Stops map[Key]Stop
+
+	// RouteTrips is a mapping of route to service_id to the number of
+	// trips on that route with that service_id
+	RouteTrips map[Key]map[string]int
+
+	// Calendars is a mapping of service_id to its regular schedule
+	Calendars map[Key]*Calendar
+
+	// Exceptions is a mapping of service_id to date to exception_type
+	Exceptions map[Key]map[string]int
+}
+
+func newFeed() *Feed {
+	return &Feed{
+		Routes:     map[Key]string{},
+		Stops:      map[Key]Stop{},
+		RouteTrips: map[Key]map[string]int{},
+		Calendars:  map[Key]*Calendar{},
+		Exceptions: map[Key]map[string]int{},
+	}
+}
+
+func (f *Feed) addTrips(route Key, serviceID string, count int) {
+	if f.RouteTrips[route] == nil {
+		f.RouteTrips[route] = map[string]int{}
+	}
+	f.RouteTrips[route][serviceID] += count
+}
+
+func (f *Feed) addCalendarDay(service Key, day string, start, end time.Time) {
+	c, exists := f.Calendars[service]
+	if !exists {
+		c = &Calendar{
+			Days:      map[string]bool{},
+			StartDate: start,
+			EndDate:   end,
+		}
+		f.Calendars[service] = c
+	}
+	c.Days[day] = true
+}
+
+func (f *Feed) addException(service Key, date time.Time, exceptionType int) {
+	if f.Exceptions[service] == nil {
+		f.Exceptions[service] = map[string]int{}
+	}
+	f.Exceptions[service][date.Format(etc.DateFormat)] = exceptionType
+}
+
+// TripsPerDay returns a mapping of route to day of the week to the
+// number of trips scheduled on that day, ignoring exceptions
+func (f *Feed) TripsPerDay() map[Key]map[string]int {
+	tpd := map[Key]map[string]int{}
+
+	for route, services := range f.RouteTrips {
+		tpd[route] = map[string]int{}
+
+		for serviceID, count := range services {
+			c, exists := f.Calendars[Key{route.AgencyID, serviceID}]
+			if !exists {
+				continue
+			}
+
+			for day := range c.Days {
+				tpd[route][day] += count
+			}
+		}
+	}
+
+	return tpd
+}
+
+// routeSet returns routeIDs as a set, or nil if there are none. Like the
+// loader, we ignore a single empty route_id (e.g., BUS_ROUTE_FILTER was
+// set to an empty string).
+func routeSet(routeIDs []string) map[string]bool {
+	if len(routeIDs) < 1 || len(routeIDs[0]) < 1 {
+		return nil
+	}
+
+	set := map[string]bool{}
+	for _, v := range routeIDs {
+		set[v] = true
+	}
+
+	return set
+}
+
+// ReadDB reads the currently loaded feed for agencyIDs from db. If
+// routeIDs isn't empty, only those routes are read, the same as the
+// loader's BUS_ROUTE_FILTER.
+func ReadDB(db sqlx.Ext, agencyIDs, routeIDs []string) (f *Feed, err error) {
+	if etc.SQLite() {
+		err = models.ErrUnsupported
+		return
+	}
+
+	f = newFeed()
+	f.AgencyIDs = agencyIDs
+
+	// An empty array matches every route. It can't be nil, which is NULL.
+	filter := []string{}
+	for routeID := range routeSet(routeIDs) {
+		filter = append(filter, routeID)
+	}
+
+	in := pq.Array(agencyIDs)
+	routeIn := pq.Array(filter)
+
+	var routes []struct {
+		AgencyID  string `db:"agency_id"`
+		RouteID   string `db:"route_id"`
+		ShortName string `db:"route_short_name"`
+		LongName  string `db:"route_long_name"`
+	}
+	err = sqlx.Select(db, &routes, `
+		SELECT agency_id, route_id,
+			COALESCE(route_short_name, '') AS route_short_name,
+			COALESCE(route_long_name, '')  AS route_long_name
+		FROM route
+		WHERE agency_id = ANY($1) AND
+			(cardinality($2::text[]) = 0 OR route_id = ANY($2))
+	`, in, routeIn)
+	if err != nil {
+		log.Println("can't get routes", err)
+		return
+	}
+	for _, r := range routes {
+		f.Routes[Key{r.AgencyID, r.RouteID}] = routeName(r.RouteID, r.ShortName, r.LongName)
+	}
+
+	var stops []struct {
+		AgencyID string `db:"agency_id"`
+		StopID   string `db:"stop_id"`
+		Stop
+	}
+	err = sqlx.Select(db, &stops, `
+		SELECT DISTINCT ON (agency_id, stop_id)
+			agency_id, stop_id, stop_name,
+			ST_X(location) AS lat,
+			ST_Y(location) AS lon
+		FROM stop
+		WHERE agency_id = ANY($1) AND
+			(cardinality($2::text[]) = 0 OR route_id = ANY($2))
+		ORDER BY agency_id, stop_id
+	`, in, routeIn)
+	if err != nil {
+		log.Println("can't get stops", err)
+		return
+	}
+	for _, s := range stops {
+		f.Stops[Key{s.AgencyID, s.StopID}] = s.Stop
+	}
+
+	var trips []struct {
+		AgencyID  string `db:"agency_id"`
+		RouteID   string `db:"route_id"`
+		ServiceID string `db:"service_id"`
+		Count     int    `db:"count"`
+	}
+	err = sqlx.Select(db, &trips, `
+		SELECT agency_id, route_id, service_id, COUNT(*) AS count
+		FROM trip
+		WHERE agency_id = ANY($1) AND
+			(cardinality($2::text[]) = 0 OR route_id = ANY($2))
+		GROUP BY agency_id, route_id, service_id
+	`, in, routeIn)
+	if err != nil {
+		log.Println("can't get trips", err)
+		return
+	}
+	for _, t := range trips {
+		f.addTrips(Key{t.AgencyID, t.RouteID}, t.ServiceID, t.Count)
+	}
+
+	// The service and service_exception tables don't have a route_id, so
+	// read from the tables they're built from
+	var services []struct {
+		AgencyID  string    `db:"agency_id"`
+		ServiceID string    `db:"service_id"`
+		Day       string    `db:"day"`
+		StartDate time.Time `db:"start_date"`
+		EndDate   time.Time `db:"end_date"`
+	}
+	err = sqlx.Select(db, &services, `
+		SELECT DISTINCT agency_id, service_id, day, start_date, end_date
+		FROM service_route_day
+		WHERE agency_id = ANY($1) AND
+			(cardinality($2::text[]) = 0 OR route_id = ANY($2))
+	`, in, routeIn)
+	if err != nil {
+		log.Println("can't get services", err)
+		return
+	}
+	for _, s := range services {
+		f.addCalendarDay(Key{s.AgencyID, s.ServiceID}, s.Day, s.StartDate, s.EndDate)
+	}
+
+	var exceptions []struct {
+		AgencyID      string    `db:"agency_id"`
+		ServiceID     string    `db:"service_id"`
+		ExceptionDate time.Time `db:"exception_date"`
+		ExceptionType int       `db:"exception_type"`
+	}
+	err = sqlx.Select(db, &exceptions, `
+		SELECT DISTINCT agency_id, service_id, exception_date, exception_type
+		FROM service_route_exception
+		WHERE agency_id = ANY($1) AND
+			(cardinality($2::text[]) = 0 OR route_id = ANY($2))
+	`, in, routeIn)
+	if err != nil {
+		log.Println("can't get service exceptions", err)
+		return
+	}
+	for _, e := range exceptions {
+		f.addException(Key{e.AgencyID, e.ServiceID}, e.ExceptionDate, e.ExceptionType)
+	}
+
+	return
+}
+
+// ReadDir reads the feed from the GTFS files in dir, which should already
+// be prepared for loading (see loader.Fetch). Like the loader, it skips
+// routes that aren't in routeIDs (if it isn't empty), along with their
+// trips, and only reads the stops and service_ids of the trips it keeps.
+func ReadDir(dir string, routeIDs []string) (f *Feed, err error) {
+	f = newFeed()
+	filter := routeSet(routeIDs)
+
+	// routeAgency is the agency of each route we read
+	routeAgency := map[string]string{}
+
+	err = eachRecord(dir, "routes.txt", true, func(rec map[string]string) error {
+		routeID := rec["route_id"]
+		if filter != nil && !filter[routeID] {
+			return nil
+		}
+
+		routeAgency[routeID] = rec["agency_id"]
+		f.Routes[Key{rec["agency_id"], routeID}] = routeName(
+			routeID, rec["route_short_name"], rec["route_long_name"],
+		)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	agencies := map[string]bool{}
+	for _, agencyID := range routeAgency {
+		agencies[agencyID] = true
+	}
+	for agencyID := range agencies {
+		f.AgencyIDs = append(f.AgencyIDs, agencyID)
+	}
+	sort.Strings(f.AgencyIDs)
+
+	// tripAgency is the agency of each trip we keep and services is
+	// each service_id those trips use
+	tripAgency := map[string]string{}
+	services := map[Key]bool{}
+
+	err = eachRecord(dir, "trips.txt", true, func(rec map[string]string) error {
+		routeID := rec["route_id"]
+		if filter != nil && !filter[routeID] {
+			return nil
+		}
+
+		agencyID := routeAgency[routeID]
+		tripAgency[rec["trip_id"]] = agencyID
+		services[Key{agencyID, rec["service_id"]}] = true
+		f.addTrips(Key{agencyID, routeID}, rec["service_id"], 1)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	stops := map[string]Stop{}
+	err = eachRecord(dir, "stops.txt", true, func(rec map[string]string) error {
+		lat, err := strconv.ParseFloat(strings.TrimSpace(rec["stop_lat"]), 64)
+		if err != nil {
+			return err
+		}
+
+		lon, err := strconv.ParseFloat(strings.TrimSpace(rec["stop_lon"]), 64)
+		if err != nil {
+			return err
+		}
+
+		stops[rec["stop_id"]] = Stop{Name: rec["stop_name"], Lat: lat, Lon: lon}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// The loader only saves stops that have stop times on the trips it
+	// keeps, so ignore any others (e.g., parent stations)
+	err = eachRecord(dir, "stop_times.txt", true, func(rec map[string]string) error {
+		agencyID, exists := tripAgency[rec["trip_id"]]
+		if !exists {
+			return nil
+		}
+
+		stop, exists := stops[rec["stop_id"]]
+		if exists {
+			f.Stops[Key{agencyID, rec["stop_id"]}] = stop
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = eachRecord(dir, "calendar.txt", false, func(rec map[string]string) error {
+		start, err := time.Parse(etc.DateFormat, rec["start_date"])
+		if err != nil {
+			return err
+		}
+
+		end, err := time.Parse(etc.DateFormat, rec["end_date"])
+		if err != nil {
+			return err
+		}
+
+		for _, agencyID := range f.AgencyIDs {
+			service := Key{agencyID, rec["service_id"]}
+			if !services[service] {
+				continue
+			}
+
+			for _, day := range etc.Days {
+				if rec[day] == "1" {
+					f.addCalendarDay(service, day, start, end)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = eachRecord(dir, "calendar_dates.txt", false, func(rec map[string]string) error {
+		date, err := time.Parse(etc.DateFormat, rec["date"])
+		if err != nil {
+			return err
+		}
+
+		exceptionType, err := strconv.Atoi(rec["exception_type"])
+		if err != nil {
+			return err
+		}
+
+		for _, agencyID := range f.AgencyIDs {
+			service := Key{agencyID, rec["service_id"]}
+			if services[service] {
+				f.addException(service, date, exceptionType)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// eachRecord calls fn with each record of dir/name as a mapping of header
+// to value. If required is false, a missing file is skipped.
+func eachRecord(dir, name string, required bool, fn func(map[string]string) error) error {
+	fh, err := os.Open(path.Join(dir, name))
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	r := csv.NewReader(fh)
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+
+	// Some feeds have a byte order mark and/or whitespace in headers
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	for i := 0; ; i++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%v on line %v of %v", err, i, name)
+		}
+
+		m := map[string]string{}
+		for j, v := range rec {
+			if j < len(header) {
+				m[header[j]] = v
+			}
+		}
+
+		err = fn(m)
+		if err != nil {
+			return fmt.Errorf("%v on line %v of %v", err, i, name)
+		}
+	}
+
+	return nil
+}
+
+// routeName returns the first non-empty name for a route
+func routeName(routeID, shortName, longName string) string {
+	for _, v := range []string{shortName, longName, routeID} {
+		if len(v) > 0 {
+			return v
+		}
+	}
+
+	return routeID
+}
@@ -0,0 +1,531 @@
+// Package export writes data that has been loaded into the database back
+// out as a GTFS zip file. See: https://developers.google.com/transit/gtfs/
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+// Filter limits which data is exported
+type Filter struct {
+	// AgencyIDs are the agencies to export. If empty, all agencies
+	// in the database are exported.
+	AgencyIDs []string
+
+	// RouteIDs are the routes to export. If empty, all routes for each
+	// agency are exported.
+	RouteIDs []string
+
+	// AgencyURL is written to agency.txt for every agency, since we don't
+	// store one
+	AgencyURL string
+}
+
+type exporter struct {
+	db sqlx.Ext
+	z  *zip.Writer
+	f  Filter
+
+	// prefix is true when we're exporting more than one agency and must
+	// prefix IDs with the agency_id to keep them unique
+	prefix bool
+}
+
+// Write writes a GTFS zip file to w containing the routes, trips, stops,
+// stop times, calendars and shapes in db that match f. Typically db
+// should be a read-only transaction, so that the result is consistent.
+func Write(db sqlx.Ext, w io.Writer, f Filter) (err error) {
+	if len(f.AgencyIDs) < 1 {
+		err = sqlx.Select(db, &f.AgencyIDs,
+			`SELECT DISTINCT agency_id FROM route ORDER BY agency_id`,
+		)
+		if err != nil {
+			log.Println("can't get agency ids", err)
+			return
+		}
+	}
+
+	e := &exporter{
+		db:     db,
+		z:      zip.NewWriter(w),
+		f:      f,
+		prefix: len(f.AgencyIDs) > 1,
+	}
+
+	steps := []func() error{
+		e.writeAgencies,
+		e.writeRoutes,
+		e.writeTrips,
+		e.writeStops,
+		e.writeStopTimes,
+		e.writeCalendars,
+		e.writeCalendarDates,
+		e.writeShapes,
+	}
+
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			return
+		}
+	}
+
+	return e.z.Close()
+}
+
+// id returns the exported value of an ID for this agency
+func (e *exporter) id(agencyID, id string) string {
+	if e.prefix && len(id) > 0 {
+		return agencyID + ":" + id
+	}
+
+	return id
+}
+
+// where returns a condition matching our filter for the table with
+// this alias. Its parameters are the values returned by args.
+func (e *exporter) where(alias string) string {
+	cond := fmt.Sprintf("%s.agency_id = ANY($1)", alias)
+
+	if len(e.f.RouteIDs) > 0 {
+		cond += fmt.Sprintf(" AND %s.route_id = ANY($2)", alias)
+	}
+
+	return cond
+}
+
+// args returns the query parameters used by where
+func (e *exporter) args() []interface{} {
+	args := []interface{}{pq.Array(e.f.AgencyIDs)}
+
+	if len(e.f.RouteIDs) > 0 {
+		args = append(args, pq.Array(e.f.RouteIDs))
+	}
+
+	return args
+}
+
+// create adds a file called name to the zip and writes its header
+func (e *exporter) create(name string, header []string) (*csv.Writer, error) {
+	fh, err := e.z.Create(name)
+	if err != nil {
+		log.Println("can't create", name, err)
+		return nil, err
+	}
+
+	w := csv.NewWriter(fh)
+
+	err = w.Write(header)
+	if err != nil {
+		log.Println("can't write header", name, err)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// each runs q and calls fn with every row, scanned into a new value
+// from newRow
+func (e *exporter) each(q string, newRow func() interface{}, fn func(interface{}) []string, w *csv.Writer) error {
+	rows, err := e.db.Queryx(q, e.args()...)
+	if err != nil {
+		log.Println("can't query", q, err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := newRow()
+
+		err = rows.StructScan(row)
+		if err != nil {
+			log.Println("can't scan", err)
+			return err
+		}
+
+		err = w.Write(fn(row))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+func (e *exporter) writeAgencies() error {
+	w, err := e.create("agency.txt", []string{
+		"agency_id", "agency_name", "agency_url", "agency_timezone",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, agencyID := range e.f.AgencyIDs {
+		err = w.Write([]string{
+			agencyID, agencyID, e.f.AgencyURL, time.Local.String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+type routeRow struct {
+	AgencyID  string `db:"agency_id"`
+	RouteID   string `db:"route_id"`
+	Type      int    `db:"route_type"`
+	Color     string `db:"route_color"`
+	TextColor string `db:"route_text_color"`
+	ShortName string `db:"route_short_name"`
+	LongName  string `db:"route_long_name"`
+}
+
+func (e *exporter) writeRoutes() error {
+	w, err := e.create("routes.txt", []string{
+		"route_id", "agency_id", "route_short_name", "route_long_name",
+		"route_type", "route_color", "route_text_color",
+	})
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, route_id, route_type, route_color, route_text_color,
+			COALESCE(route_short_name, '') AS route_short_name,
+			COALESCE(route_long_name, '')  AS route_long_name
+		FROM route r
+		WHERE ` + e.where("r") + `
+		ORDER BY agency_id, route_id
+	`
+
+	return e.each(q,
+		func() interface{} { return &routeRow{} },
+		func(v interface{}) []string {
+			r := v.(*routeRow)
+			return []string{
+				e.id(r.AgencyID, r.RouteID), r.AgencyID,
+				r.ShortName, r.LongName, strconv.Itoa(r.Type),
+				strings.TrimPrefix(r.Color, "#"),
+				strings.TrimPrefix(r.TextColor, "#"),
+			}
+		},
+		w,
+	)
+}
+
+type tripRow struct {
+	AgencyID    string `db:"agency_id"`
+	RouteID     string `db:"route_id"`
+	TripID      string `db:"trip_id"`
+	ServiceID   string `db:"service_id"`
+	ShapeID     string `db:"shape_id"`
+	Headsign    string `db:"headsign"`
+	DirectionID int    `db:"direction_id"`
+}
+
+func (e *exporter) writeTrips() error {
+	w, err := e.create("trips.txt", []string{
+		"route_id", "service_id", "trip_id", "trip_headsign",
+		"direction_id", "shape_id",
+	})
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, route_id, trip_id, service_id, shape_id,
+			headsign, direction_id
+		FROM trip t
+		WHERE ` + e.where("t") + `
+		ORDER BY agency_id, route_id, trip_id
+	`
+
+	return e.each(q,
+		func() interface{} { return &tripRow{} },
+		func(v interface{}) []string {
+			t := v.(*tripRow)
+			return []string{
+				e.id(t.AgencyID, t.RouteID), e.id(t.AgencyID, t.ServiceID),
+				e.id(t.AgencyID, t.TripID), t.Headsign,
+				strconv.Itoa(t.DirectionID), e.id(t.AgencyID, t.ShapeID),
+			}
+		},
+		w,
+	)
+}
+
+type stopRow struct {
+	AgencyID string  `db:"agency_id"`
+	StopID   string  `db:"stop_id"`
+	Name     string  `db:"stop_name"`
+	Lat      float64 `db:"lat"`
+	Lon      float64 `db:"lon"`
+}
+
+func (e *exporter) writeStops() error {
+	w, err := e.create("stops.txt", []string{
+		"stop_id", "stop_name", "stop_lat", "stop_lon",
+	})
+	if err != nil {
+		return err
+	}
+
+	// There's a row in the stop table for each route that serves the
+	// stop, but we only want one. They all have the same name and
+	// location. This is GROUP BY rather than DISTINCT ON so that it also
+	// runs on SQLite.
+	q := `
+		SELECT agency_id, stop_id,
+			MIN(stop_name)      AS stop_name,
+			MIN(ST_X(location)) AS lat,
+			MIN(ST_Y(location)) AS lon
+		FROM stop s
+		WHERE ` + e.where("s") + `
+		GROUP BY agency_id, stop_id
+		ORDER BY agency_id, stop_id
+	`
+
+	return e.each(q,
+		func() interface{} { return &stopRow{} },
+		func(v interface{}) []string {
+			s := v.(*stopRow)
+			return []string{
+				e.id(s.AgencyID, s.StopID), s.Name,
+				strconv.FormatFloat(s.Lat, 'f', -1, 64),
+				strconv.FormatFloat(s.Lon, 'f', -1, 64),
+			}
+		},
+		w,
+	)
+}
+
+type stopTimeRow struct {
+	AgencyID     string `db:"agency_id"`
+	TripID       string `db:"trip_id"`
+	StopID       string `db:"stop_id"`
+	ArrivalSec   int    `db:"arrival_sec"`
+	DepartureSec int    `db:"departure_sec"`
+	StopSequence int    `db:"stop_sequence"`
+}
+
+func (e *exporter) writeStopTimes() error {
+	w, err := e.create("stop_times.txt", []string{
+		"trip_id", "arrival_time", "departure_time", "stop_id",
+		"stop_sequence",
+	})
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, trip_id, stop_id, arrival_sec, departure_sec,
+			stop_sequence
+		FROM scheduled_stop_time sst
+		WHERE ` + e.where("sst") + `
+		ORDER BY agency_id, trip_id, stop_sequence
+	`
+
+	return e.each(q,
+		func() interface{} { return &stopTimeRow{} },
+		func(v interface{}) []string {
+			st := v.(*stopTimeRow)
+			return []string{
+				e.id(st.AgencyID, st.TripID),
+				etc.SecsToTimeStr(st.ArrivalSec),
+				etc.SecsToTimeStr(st.DepartureSec),
+				e.id(st.AgencyID, st.StopID),
+				strconv.Itoa(st.StopSequence),
+			}
+		},
+		w,
+	)
+}
+
+type calendarRow struct {
+	AgencyID  string    `db:"agency_id"`
+	ServiceID string    `db:"service_id"`
+	Day       string    `db:"day"`
+	StartDate time.Time `db:"start_date"`
+	EndDate   time.Time `db:"end_date"`
+}
+
+// usedServices is a condition that limits agency_id / service_id to the
+// services of exported trips
+func (e *exporter) usedServices() string {
+	return `(agency_id, service_id) IN (
+		SELECT agency_id, service_id FROM trip t WHERE ` + e.where("t") + `
+	)`
+}
+
+func (e *exporter) writeCalendars() error {
+	var rows []*calendarRow
+
+	w, err := e.create("calendar.txt", append(
+		append([]string{"service_id"}, etc.Days...), "start_date", "end_date",
+	))
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, service_id, day, start_date, end_date
+		FROM service
+		WHERE ` + e.usedServices() + `
+		ORDER BY agency_id, service_id, start_date, end_date
+	`
+
+	err = sqlx.Select(e.db, &rows, q, e.args()...)
+	if err != nil {
+		log.Println("can't get services", err)
+		return err
+	}
+
+	// The service table has a row for each day, but calendar.txt has a
+	// column for each day. Combine rows with the same service and dates,
+	// which are consecutive because of the ORDER BY.
+	var rec []string
+	var lastKey string
+
+	for _, row := range rows {
+		key := fmt.Sprintf("%s|%s|%s|%s", row.AgencyID, row.ServiceID,
+			row.StartDate.Format(etc.DateFormat), row.EndDate.Format(etc.DateFormat),
+		)
+
+		if key != lastKey {
+			if rec != nil {
+				err = w.Write(rec)
+				if err != nil {
+					return err
+				}
+			}
+
+			rec = []string{e.id(row.AgencyID, row.ServiceID)}
+			for range etc.Days {
+				rec = append(rec, "0")
+			}
+			rec = append(rec,
+				row.StartDate.Format(etc.DateFormat), row.EndDate.Format(etc.DateFormat),
+			)
+
+			lastKey = key
+		}
+
+		for i, day := range etc.Days {
+			if row.Day == day {
+				rec[i+1] = "1"
+			}
+		}
+	}
+
+	if rec != nil {
+		err = w.Write(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+type calendarDateRow struct {
+	AgencyID      string    `db:"agency_id"`
+	ServiceID     string    `db:"service_id"`
+	ExceptionDate time.Time `db:"exception_date"`
+	ExceptionType int       `db:"exception_type"`
+}
+
+func (e *exporter) writeCalendarDates() error {
+	w, err := e.create("calendar_dates.txt", []string{
+		"service_id", "date", "exception_type",
+	})
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, service_id, exception_date, exception_type
+		FROM service_exception
+		WHERE ` + e.usedServices() + `
+		ORDER BY agency_id, service_id, exception_date
+	`
+
+	return e.each(q,
+		func() interface{} { return &calendarDateRow{} },
+		func(v interface{}) []string {
+			cd := v.(*calendarDateRow)
+			return []string{
+				e.id(cd.AgencyID, cd.ServiceID),
+				cd.ExceptionDate.Format(etc.DateFormat),
+				strconv.Itoa(cd.ExceptionType),
+			}
+		},
+		w,
+	)
+}
+
+type shapeRow struct {
+	AgencyID string  `db:"agency_id"`
+	ShapeID  string  `db:"shape_id"`
+	Seq      int     `db:"seq"`
+	Lat      float64 `db:"lat"`
+	Lon      float64 `db:"lon"`
+}
+
+func (e *exporter) writeShapes() error {
+	w, err := e.create("shapes.txt", []string{
+		"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence",
+	})
+	if err != nil {
+		return err
+	}
+
+	q := `
+		SELECT agency_id, shape_id, seq,
+			ST_X(location) AS lat,
+			ST_Y(location) AS lon
+		FROM shape
+		WHERE (agency_id, shape_id) IN (
+			SELECT agency_id, shape_id FROM trip t WHERE ` + e.where("t") + `
+		)
+		ORDER BY agency_id, shape_id, seq
+	`
+
+	return e.each(q,
+		func() interface{} { return &shapeRow{} },
+		func(v interface{}) []string {
+			s := v.(*shapeRow)
+			return []string{
+				e.id(s.AgencyID, s.ShapeID),
+				strconv.FormatFloat(s.Lat, 'f', -1, 64),
+				strconv.FormatFloat(s.Lon, 'f', -1, 64),
+				strconv.Itoa(s.Seq),
+			}
+		},
+		w,
+	)
+}
@@ -0,0 +1,373 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brnstz/bus/diff"
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+)
+
+// sourceFeed is the GTFS feed of agency A in newExportDB. Route 1 runs on
+// weekdays, except on July 4th, and route 2 on Saturdays. Both stop at S1.
+var sourceFeed = map[string]string{
+	"routes.txt": `route_id,agency_id,route_short_name,route_long_name,route_type
+1,A,1,First Av,3
+2,A,2,,3
+`,
+	"trips.txt": `route_id,service_id,trip_id,trip_headsign,direction_id,shape_id
+1,WKD,1-a,North,0,SH1
+2,SAT,2-a,South,1,
+`,
+	"stops.txt": `stop_id,stop_name,stop_lat,stop_lon
+S1,Main St,40.7,-74
+S2,Second St,40.71,-74
+S3,Third St,40.69,-74.01
+P1,Parent Station,40.7,-74
+`,
+	"stop_times.txt": `trip_id,arrival_time,departure_time,stop_id,stop_sequence
+1-a,08:00:00,08:00:00,S1,1
+1-a,08:10:00,08:10:00,S2,2
+2-a,09:00:00,09:00:00,S1,1
+2-a,09:05:00,09:05:00,S3,2
+`,
+	"calendar.txt": `service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date
+WKD,1,1,1,1,1,0,0,20160101,20161231
+SAT,0,0,0,0,0,1,0,20160101,20161231
+`,
+	"calendar_dates.txt": `service_id,date,exception_type
+WKD,20160704,2
+`,
+}
+
+// newExportDB opens a new SQLite database with the rows that busloader
+// would load from sourceFeed, plus agency B, which uses the same IDs.
+// Rows are inserted directly, since saving models needs upsert.
+func newExportDB(t *testing.T) {
+	driver, path, db := conf.DB.Driver, conf.DB.Path, etc.DBConn
+	t.Cleanup(func() {
+		etc.DBConn.Close()
+		conf.DB.Driver, conf.DB.Path, etc.DBConn = driver, path, db
+	})
+
+	conf.DB.Driver = "sqlite3"
+	conf.DB.Path = filepath.Join(t.TempDir(), "bus.db")
+	etc.DBConn = etc.MustDB()
+
+	exec := func(q string, args ...interface{}) {
+		_, err := etc.DBConn.Exec(q, args...)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+	}
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2016, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	for _, r := range []struct {
+		agencyID  string
+		routeID   string
+		shortName string
+		longName  string
+	}{
+		{"A", "1", "1", "First Av"},
+		{"A", "2", "2", ""},
+		{"B", "1", "1", "Main St Shuttle"},
+	} {
+		exec(`INSERT INTO route (agency_id, route_id, route_type, route_color,
+			route_text_color, route_short_name, route_long_name)
+			VALUES ($1, $2, 3, '', '', $3, $4)`,
+			r.agencyID, r.routeID, r.shortName, r.longName,
+		)
+	}
+
+	for _, tr := range []struct {
+		agencyID    string
+		routeID     string
+		tripID      string
+		serviceID   string
+		shapeID     string
+		headsign    string
+		directionID int
+	}{
+		{"A", "1", "1-a", "WKD", "SH1", "North", 0},
+		{"A", "2", "2-a", "SAT", "", "South", 1},
+		{"B", "1", "1-a", "WKD", "", "North", 0},
+	} {
+		exec(`INSERT INTO trip (agency_id, route_id, trip_id, service_id,
+			shape_id, headsign, direction_id) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			tr.agencyID, tr.routeID, tr.tripID, tr.serviceID, tr.shapeID,
+			tr.headsign, tr.directionID,
+		)
+	}
+
+	// There's a row in the stop table for each route at the stop, so
+	// there are two for S1 in agency A
+	for _, s := range []struct {
+		agencyID string
+		routeID  string
+		stopID   string
+		name     string
+		lat      float64
+		lon      float64
+	}{
+		{"A", "1", "S1", "Main St", 40.7, -74},
+		{"A", "2", "S1", "Main St", 40.7, -74},
+		{"A", "1", "S2", "Second St", 40.71, -74},
+		{"A", "2", "S3", "Third St", 40.69, -74.01},
+		{"B", "1", "S1", "Main St", 40.7, -74},
+	} {
+		exec(`INSERT INTO stop (agency_id, stop_id, stop_name, direction_id,
+			headsign, route_id, location, lat, lon)
+			VALUES ($1, $2, $3, 0, '', $4, ST_SETSRID(ST_MAKEPOINT($5, $6), 4326), $5, $6)`,
+			s.agencyID, s.stopID, s.name, s.routeID, s.lat, s.lon,
+		)
+	}
+
+	for _, st := range []struct {
+		agencyID  string
+		routeID   string
+		tripID    string
+		serviceID string
+		stopID    string
+		secs      int
+		seq       int
+	}{
+		{"A", "1", "1-a", "WKD", "S1", 8 * 60 * 60, 1},
+		{"A", "1", "1-a", "WKD", "S2", 8*60*60 + 10*60, 2},
+		{"A", "2", "2-a", "SAT", "S1", 9 * 60 * 60, 1},
+		{"A", "2", "2-a", "SAT", "S3", 9*60*60 + 5*60, 2},
+		{"B", "1", "1-a", "WKD", "S1", 7 * 60 * 60, 1},
+	} {
+		exec(`INSERT INTO scheduled_stop_time (agency_id, route_id, stop_id,
+			service_id, trip_id, arrival_sec, departure_sec, stop_sequence)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, $7)`,
+			st.agencyID, st.routeID, st.stopID, st.serviceID, st.tripID,
+			st.secs, st.seq,
+		)
+	}
+
+	for _, s := range []struct {
+		agencyID  string
+		serviceID string
+		days      []string
+	}{
+		{"A", "WKD", etc.Days[0:5]},
+		{"A", "SAT", etc.Days[5:6]},
+		{"B", "WKD", etc.Days[0:1]},
+	} {
+		for _, day := range s.days {
+			exec(`INSERT INTO service (agency_id, service_id, day, start_date,
+				end_date) VALUES ($1, $2, $3, $4, $5)`,
+				s.agencyID, s.serviceID, day, start, end,
+			)
+		}
+	}
+
+	exec(`INSERT INTO service_exception (agency_id, service_id,
+		exception_date, exception_type) VALUES ($1, $2, $3, $4)`,
+		"A", "WKD", time.Date(2016, 7, 4, 0, 0, 0, 0, time.UTC), 2,
+	)
+
+	for seq, lat := range []float64{40.7, 40.71} {
+		exec(`INSERT INTO shape (agency_id, shape_id, location, seq, lat, lon)
+			VALUES ($1, $2, ST_SETSRID(ST_MAKEPOINT($3, $4), 4326), $5, $3, $4)`,
+			"A", "SH1", lat, -74, seq,
+		)
+	}
+}
+
+// writeDir writes each file in files to a new directory
+func writeDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// writeZip exports the data matching f and unzips it to a new directory
+func writeZip(t *testing.T, f Filter) string {
+	var buf bytes.Buffer
+
+	err := Write(etc.DBConn, &buf, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	for _, zf := range z.File {
+		fh, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(fh)
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files[zf.Name] = string(b)
+	}
+
+	return writeDir(t, files)
+}
+
+// TestWriteRoundTrip checks that an export of one agency is the same feed
+// as the one that was loaded, with and without a route filter
+func TestWriteRoundTrip(t *testing.T) {
+	newExportDB(t)
+
+	source := writeDir(t, sourceFeed)
+
+	for _, routeIDs := range [][]string{nil, {"2"}} {
+		dir := writeZip(t, Filter{AgencyIDs: []string{"A"}, RouteIDs: routeIDs})
+
+		expected, err := diff.ReadDir(source, routeIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := diff.ReadDir(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual.Routes) < 1 {
+			t.Errorf("%v: expected routes", routeIDs)
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			var report bytes.Buffer
+			diff.Compare(expected, actual, 0).WriteText(&report)
+			t.Errorf("%v: exported feed doesn't match the source\n%s", routeIDs, report.String())
+		}
+	}
+}
+
+// TestWriteAgencies checks the files of an export of every agency, whose
+// IDs are prefixed with the agency because both use the same IDs
+func TestWriteAgencies(t *testing.T) {
+	newExportDB(t)
+
+	dir := writeZip(t, Filter{AgencyURL: "http://example.com"})
+
+	expected := map[string]string{
+		"agency.txt": `agency_id,agency_name,agency_url,agency_timezone
+A,A,http://example.com,` + time.Local.String() + `
+B,B,http://example.com,` + time.Local.String() + `
+`,
+		"routes.txt": `route_id,agency_id,route_short_name,route_long_name,route_type,route_color,route_text_color
+A:1,A,1,First Av,3,,
+A:2,A,2,,3,,
+B:1,B,1,Main St Shuttle,3,,
+`,
+		"trips.txt": `route_id,service_id,trip_id,trip_headsign,direction_id,shape_id
+A:1,A:WKD,A:1-a,North,0,A:SH1
+A:2,A:SAT,A:2-a,South,1,
+B:1,B:WKD,B:1-a,North,0,
+`,
+		"stops.txt": `stop_id,stop_name,stop_lat,stop_lon
+A:S1,Main St,40.7,-74
+A:S2,Second St,40.71,-74
+A:S3,Third St,40.69,-74.01
+B:S1,Main St,40.7,-74
+`,
+		"stop_times.txt": `trip_id,arrival_time,departure_time,stop_id,stop_sequence
+A:1-a,08:00:00,08:00:00,A:S1,1
+A:1-a,08:10:00,08:10:00,A:S2,2
+A:2-a,09:00:00,09:00:00,A:S1,1
+A:2-a,09:05:00,09:05:00,A:S3,2
+B:1-a,07:00:00,07:00:00,B:S1,1
+`,
+		"calendar.txt": `service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date
+A:SAT,0,0,0,0,0,1,0,20160101,20161231
+A:WKD,1,1,1,1,1,0,0,20160101,20161231
+B:WKD,1,0,0,0,0,0,0,20160101,20161231
+`,
+		"calendar_dates.txt": `service_id,date,exception_type
+A:WKD,20160704,2
+`,
+		"shapes.txt": `shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence
+A:SH1,40.7,-74,0
+A:SH1,40.71,-74,1
+`,
+	}
+
+	for name, contents := range expected {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != contents {
+			t.Errorf("unexpected %v\n%s\nexpected\n%s", name, b, contents)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("unexpected files %v", strings.Join(names, ", "))
+	}
+}
+
+// TestWriteRouteFilter checks that a route filter only exports the stops,
+// calendars and shapes of that route's trips
+func TestWriteRouteFilter(t *testing.T) {
+	newExportDB(t)
+
+	dir := writeZip(t, Filter{AgencyIDs: []string{"A"}, RouteIDs: []string{"1"}})
+
+	expected := map[string]string{
+		"routes.txt": `route_id,agency_id,route_short_name,route_long_name,route_type,route_color,route_text_color
+1,A,1,First Av,3,,
+`,
+		"stops.txt": `stop_id,stop_name,stop_lat,stop_lon
+S1,Main St,40.7,-74
+S2,Second St,40.71,-74
+`,
+		"calendar.txt": `service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date
+WKD,1,1,1,1,1,0,0,20160101,20161231
+`,
+		"shapes.txt": `shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence
+SH1,40.7,-74,0
+SH1,40.71,-74,1
+`,
+	}
+
+	for name, contents := range expected {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != contents {
+			t.Errorf("unexpected %v\n%s\nexpected\n%s", name, b, contents)
+		}
+	}
+}
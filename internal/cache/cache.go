@@ -0,0 +1,117 @@
+// Package cache saves short-lived values like partner responses and
+// vector tiles. Values can be saved in redis, which is shared by every
+// binary, or in memory or on disk for a single process.
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMiss is returned by Get when there is no value at a key
+	ErrMiss = errors.New("no cached value")
+
+	// ErrUnknownKind is returned by New for an unsupported kind of cache
+	ErrUnknownKind = errors.New("unknown kind of cache")
+)
+
+// Cache saves values for a limited time and sends messages to
+// subscribers
+type Cache interface {
+	// Get returns the value saved at k, or ErrMiss if there isn't one
+	Get(k string) ([]byte, error)
+
+	// Set saves b at k for ttl
+	Set(k string, b []byte, ttl time.Duration) error
+
+	// Incr increments the counter at k and returns its new value.
+	// Counters don't expire.
+	Incr(k string) (int64, error)
+
+	// Publish sends msg to the subscribers of channel
+	Publish(channel, msg string) error
+
+	// Subscribe calls fn with each message published to channel. It
+	// blocks until there is an error.
+	Subscribe(channel string, fn func(string)) error
+}
+
+// Spec is the config of a Cache
+type Spec struct {
+	// Kind is "redis", "memory" or "disk"
+	Kind string
+
+	// RedisAddr is the "host:port" of redis and RedisPoolSize is the
+	// number of connections to keep open to it
+	RedisAddr     string
+	RedisPoolSize int
+
+	// MemorySize is the most values a memory cache holds
+	MemorySize int
+
+	// Dir is the directory of a disk cache and DiskSize is the most
+	// bytes of values that expire it keeps, or 0 for no limit
+	Dir      string
+	DiskSize int64
+}
+
+// New returns the Cache described by s
+func New(s Spec) (Cache, error) {
+	switch s.Kind {
+	case "redis":
+		return newRedis(s.RedisAddr, s.RedisPoolSize)
+	case "memory":
+		return newMemory(s.MemorySize), nil
+	case "disk":
+		dc, err := newDisk(s.Dir, s.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+		go dc.cleanForever()
+		return dc, nil
+	default:
+		return nil, ErrUnknownKind
+	}
+}
+
+// broker delivers messages to subscribers in the same process, for caches
+// that aren't shared between processes
+type broker struct {
+	mu   sync.Mutex
+	subs map[string][]chan string
+}
+
+func (br *broker) Publish(channel, msg string) error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	for _, ch := range br.subs[channel] {
+		// Don't block on a subscriber that's behind, like redis
+		// drops messages for slow clients
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (br *broker) Subscribe(channel string, fn func(string)) error {
+	ch := make(chan string, 100)
+
+	br.mu.Lock()
+	if br.subs == nil {
+		br.subs = map[string][]chan string{}
+	}
+	br.subs[channel] = append(br.subs[channel], ch)
+	br.mu.Unlock()
+
+	for msg := range ch {
+		fn(msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cleanInterval is how often a disk cache removes expired files and
+// files over its size
+var cleanInterval = time.Duration(1) * time.Minute
+
+// diskCache saves each value in a file in dir named after the hash of its
+// key. Each file starts with the UNIX time in nanoseconds when it expires
+// (or zero if it doesn't), followed by the value. Expired files are
+// removed when they're read and by clean.
+type diskCache struct {
+	broker
+
+	dir string
+
+	// size is the most bytes of values that expire that we keep.
+	// Counters, which don't expire, aren't counted or removed.
+	size int64
+
+	// mu ensures Incr isn't run at the same time for a key
+	mu sync.Mutex
+}
+
+func newDisk(dir string, size int64) (*diskCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println("can't create cache dir", err)
+		return nil, err
+	}
+
+	return &diskCache{dir: dir, size: size}, nil
+}
+
+// path returns the file of the value at k
+func (dc *diskCache) path(k string) string {
+	return filepath.Join(dc.dir, fmt.Sprintf("%x", sha1.Sum([]byte(k))))
+}
+
+func (dc *diskCache) Get(k string) ([]byte, error) {
+	p := dc.path(k)
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		log.Println("can't read cache file", err)
+		return nil, err
+	}
+
+	if len(b) < 8 {
+		return nil, ErrMiss
+	}
+
+	expires := int64(binary.BigEndian.Uint64(b))
+	if expires > 0 && time.Now().UnixNano() > expires {
+		os.Remove(p)
+		return nil, ErrMiss
+	}
+
+	// The modification time is when the value was last used, so that
+	// clean removes the least recently used first
+	now := time.Now()
+	os.Chtimes(p, now, now)
+
+	return b[8:], nil
+}
+
+func (dc *diskCache) Set(k string, b []byte, ttl time.Duration) error {
+	return dc.write(k, b, time.Now().Add(ttl).UnixNano())
+}
+
+// write saves b at k until the UNIX time in nanoseconds expires. The file
+// is written in full before it replaces the old one, so readers never see
+// part of a value.
+func (dc *diskCache) write(k string, b []byte, expires int64) error {
+	fh, err := ioutil.TempFile(dc.dir, ".tmp")
+	if err != nil {
+		log.Println("can't create cache file", err)
+		return err
+	}
+	defer os.Remove(fh.Name())
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(expires))
+
+	_, err = fh.Write(append(header, b...))
+	if err != nil {
+		fh.Close()
+		log.Println("can't write cache file", err)
+		return err
+	}
+
+	err = fh.Close()
+	if err != nil {
+		log.Println("can't close cache file", err)
+		return err
+	}
+
+	err = os.Rename(fh.Name(), dc.path(k))
+	if err != nil {
+		log.Println("can't rename cache file", err)
+		return err
+	}
+
+	return nil
+}
+
+func (dc *diskCache) Incr(k string) (int64, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	var n int64
+
+	b, err := dc.Get(k)
+	if err == nil {
+		n, err = strconv.ParseInt(string(b), 10, 64)
+	}
+	if err != nil && err != ErrMiss {
+		return 0, err
+	}
+	n++
+
+	err = dc.write(k, []byte(strconv.FormatInt(n, 10)), 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// cleanForever runs clean every cleanInterval
+func (dc *diskCache) cleanForever() {
+	for range time.Tick(cleanInterval) {
+		err := dc.clean()
+		if err != nil {
+			log.Println("can't clean cache dir", err)
+		}
+	}
+}
+
+// diskFile is a file of a value that expires
+type diskFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+type byUsed []diskFile
+
+func (b byUsed) Len() int           { return len(b) }
+func (b byUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byUsed) Less(i, j int) bool { return b[i].used.Before(b[j].used) }
+
+// clean removes the files of values that expired. If the rest are more
+// than size bytes, the least recently used are removed until they aren't.
+func (dc *diskCache) clean() error {
+	infos, err := ioutil.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+
+	var files []diskFile
+	var total int64
+
+	for _, fi := range infos {
+		// Skip files that are still being written
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		p := filepath.Join(dc.dir, fi.Name())
+
+		expires, err := readExpires(p)
+		if err != nil {
+			log.Println("can't read cache file", err)
+			continue
+		}
+
+		if expires == 0 {
+			continue
+		}
+
+		if now > expires {
+			os.Remove(p)
+			continue
+		}
+
+		files = append(files, diskFile{path: p, size: fi.Size(), used: fi.ModTime()})
+		total += fi.Size()
+	}
+
+	if dc.size < 1 || total <= dc.size {
+		return nil
+	}
+
+	sort.Sort(byUsed(files))
+
+	for _, f := range files {
+		if total <= dc.size {
+			break
+		}
+
+		err = os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("can't remove cache file", err)
+			continue
+		}
+
+		total -= f.size
+	}
+
+	return nil
+}
+
+// readExpires returns the expiration at the start of the file at p
+func readExpires(p string) (int64, error) {
+	fh, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	header := make([]byte, 8)
+	_, err = io.ReadFull(fh, header)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(binary.BigEndian.Uint64(header)), nil
+}
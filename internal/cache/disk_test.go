@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// files returns the number of files in dir
+func files(t *testing.T, dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(infos)
+}
+
+func TestDiskTTL(t *testing.T) {
+	dir := t.TempDir()
+
+	dc, err := newDisk(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.Set("short", []byte("1"), 10*time.Millisecond)
+	dc.Set("long", []byte("2"), time.Minute)
+	dc.Set("unread", []byte("3"), 10*time.Millisecond)
+
+	n, err := dc.Incr("counter")
+	if err != nil || n != 1 {
+		t.Fatalf("expected counter of 1 but got %v and %v", n, err)
+	}
+
+	b, err := dc.Get("short")
+	if err != nil || string(b) != "1" {
+		t.Fatalf("expected short before it expires but got %q and %v", b, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = dc.Get("short")
+	if err != ErrMiss {
+		t.Errorf("expected short to expire but got %v", err)
+	}
+
+	// Expired values that aren't read are removed by clean
+	if files(t, dir) != 3 {
+		t.Errorf("expected 3 files before clean but got %v", files(t, dir))
+	}
+
+	err = dc.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files(t, dir) != 2 {
+		t.Errorf("expected 2 files after clean but got %v", files(t, dir))
+	}
+
+	b, err = dc.Get("long")
+	if err != nil || string(b) != "2" {
+		t.Errorf("expected long to remain but got %q and %v", b, err)
+	}
+
+	n, err = dc.Incr("counter")
+	if err != nil || n != 2 {
+		t.Errorf("expected counter of 2 but got %v and %v", n, err)
+	}
+}
+
+func TestDiskSize(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each value is 8 bytes of header and 92 bytes of data, so there's
+	// room for 2
+	value := make([]byte, 92)
+
+	dc, err := newDisk(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values are used in order, a long time ago
+	for i, k := range []string{"a", "b", "c"} {
+		err = dc.Set(k, value, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		used := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(dc.path(k), used, used)
+	}
+
+	// Counters aren't removed or counted
+	_, err = dc.Incr("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading a makes b the least recently used
+	_, err = dc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dc.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		k   string
+		err error
+	}{
+		{"a", nil},
+		{"b", ErrMiss},
+		{"c", nil},
+		{"counter", nil},
+	}
+
+	for _, test := range tests {
+		_, err := dc.Get(test.k)
+		if err != test.err {
+			t.Errorf("%v: expected %v but got %v", test.k, test.err, err)
+		}
+	}
+}
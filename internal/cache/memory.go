@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryCache saves values in this process. When it has size values,
+// the least recently used one is removed to make room for a new one.
+type memoryCache struct {
+	broker
+
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+
+	// order has the most recently used entry in front
+	order *list.List
+}
+
+// memoryEntry is a value in a memoryCache. A zero expires never expires.
+type memoryEntry struct {
+	k       string
+	b       []byte
+	expires time.Time
+}
+
+func newMemory(size int) *memoryCache {
+	return &memoryCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the entry at k if it hasn't expired. The caller must hold
+// mu.
+func (mc *memoryCache) get(k string) (*memoryEntry, bool) {
+	el, exists := mc.entries[k]
+	if !exists {
+		return nil, false
+	}
+
+	e := el.Value.(*memoryEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		mc.order.Remove(el)
+		delete(mc.entries, k)
+		return nil, false
+	}
+
+	mc.order.MoveToFront(el)
+
+	return e, true
+}
+
+// set saves e, removing the least recently used entry if there's no
+// room. The caller must hold mu.
+func (mc *memoryCache) set(e *memoryEntry) {
+	el, exists := mc.entries[e.k]
+	if exists {
+		el.Value = e
+		mc.order.MoveToFront(el)
+		return
+	}
+
+	mc.entries[e.k] = mc.order.PushFront(e)
+
+	for mc.size > 0 && mc.order.Len() > mc.size {
+		last := mc.order.Back()
+		mc.order.Remove(last)
+		delete(mc.entries, last.Value.(*memoryEntry).k)
+	}
+}
+
+func (mc *memoryCache) Get(k string) ([]byte, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	e, exists := mc.get(k)
+	if !exists {
+		return nil, ErrMiss
+	}
+
+	return e.b, nil
+}
+
+func (mc *memoryCache) Set(k string, b []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.set(&memoryEntry{k: k, b: b, expires: time.Now().Add(ttl)})
+
+	return nil
+}
+
+func (mc *memoryCache) Incr(k string) (int64, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var n int64
+
+	e, exists := mc.get(k)
+	if exists {
+		var err error
+		n, err = strconv.ParseInt(string(e.b), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n++
+
+	mc.set(&memoryEntry{k: k, b: []byte(strconv.FormatInt(n, 10))})
+
+	return n, nil
+}
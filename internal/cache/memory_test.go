@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLRU(t *testing.T) {
+	mc := newMemory(2)
+
+	mc.Set("a", []byte("1"), time.Minute)
+	mc.Set("b", []byte("2"), time.Minute)
+
+	// Using a makes b the least recently used
+	_, err := mc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc.Set("c", []byte("3"), time.Minute)
+
+	tests := []struct {
+		k        string
+		expected string
+		err      error
+	}{
+		{"a", "1", nil},
+		{"b", "", ErrMiss},
+		{"c", "3", nil},
+	}
+
+	for _, test := range tests {
+		b, err := mc.Get(test.k)
+		if err != test.err || string(b) != test.expected {
+			t.Errorf("%v: expected %q and %v but got %q and %v", test.k, test.expected, test.err, b, err)
+		}
+	}
+
+	// Replacing a value doesn't remove another
+	mc.Set("c", []byte("4"), time.Minute)
+	b, err := mc.Get("a")
+	if err != nil || string(b) != "1" {
+		t.Errorf("expected a to remain but got %q and %v", b, err)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	mc := newMemory(10)
+
+	mc.Set("short", []byte("1"), 10*time.Millisecond)
+	mc.Set("long", []byte("2"), time.Minute)
+
+	n, err := mc.Incr("counter")
+	if err != nil || n != 1 {
+		t.Fatalf("expected counter of 1 but got %v and %v", n, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = mc.Get("short")
+	if err != ErrMiss {
+		t.Errorf("expected short to expire but got %v", err)
+	}
+
+	b, err := mc.Get("long")
+	if err != nil || string(b) != "2" {
+		t.Errorf("expected long to remain but got %q and %v", b, err)
+	}
+
+	// Counters don't expire
+	n, err = mc.Incr("counter")
+	if err != nil || n != 2 {
+		t.Errorf("expected counter of 2 but got %v and %v", n, err)
+	}
+
+	if len(mc.entries) != 2 || mc.order.Len() != 2 {
+		t.Errorf("expected the expired value to be removed but have %v entries", len(mc.entries))
+	}
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/fzzy/radix/extra/pool"
+	"github.com/fzzy/radix/extra/pubsub"
+	"github.com/fzzy/radix/redis"
+)
+
+const (
+	// redisConnectTimeout is how long we wait to connect to redis
+	// before giving up
+	redisConnectTimeout = 1 * time.Second
+)
+
+// redisCache saves values in redis using a pool of connections
+type redisCache struct {
+	addr string
+	pool *pool.Pool
+}
+
+func newRedis(addr string, size int) (*redisCache, error) {
+	p, err := pool.NewCustomPool("tcp", addr, size, func(network, addr string) (*redis.Client, error) {
+		return redis.DialTimeout(network, addr, redisConnectTimeout)
+	})
+	if err != nil {
+		log.Println("can't connect to redis", err)
+		return nil, err
+	}
+
+	return &redisCache{addr: addr, pool: p}, nil
+}
+
+// cmd runs a command on a connection from the pool. Connections that have
+// an error are closed instead of returned to the pool.
+func (rc *redisCache) cmd(name string, args ...interface{}) (r *redis.Reply, err error) {
+	c, err := rc.pool.Get()
+	if err != nil {
+		log.Println("can't connect to redis", err)
+		return
+	}
+	defer rc.pool.CarefullyPut(c, &err)
+
+	r = c.Cmd(name, args...)
+	err = r.Err
+	if err != nil {
+		log.Println("can't run redis command", name, err)
+		return
+	}
+
+	return
+}
+
+func (rc *redisCache) Get(k string) (b []byte, err error) {
+	r, err := rc.cmd("get", k)
+	if err != nil {
+		return
+	}
+
+	if r.Type == redis.NilReply {
+		err = ErrMiss
+		return
+	}
+
+	return r.Bytes()
+}
+
+func (rc *redisCache) Set(k string, b []byte, ttl time.Duration) error {
+	_, err := rc.cmd("set", k, b, "ex", strconv.Itoa(int(ttl/time.Second)))
+	return err
+}
+
+func (rc *redisCache) Incr(k string) (n int64, err error) {
+	r, err := rc.cmd("incr", k)
+	if err != nil {
+		return
+	}
+
+	return r.Int64()
+}
+
+func (rc *redisCache) Publish(channel, msg string) error {
+	_, err := rc.cmd("publish", channel, msg)
+	return err
+}
+
+// Subscribe uses its own connection, since a connection that's subscribed
+// can't run other commands
+func (rc *redisCache) Subscribe(channel string, fn func(string)) error {
+	c, err := redis.DialTimeout("tcp", rc.addr, redisConnectTimeout)
+	if err != nil {
+		log.Println("can't connect to redis", err)
+		return err
+	}
+	defer c.Close()
+
+	sc := pubsub.NewSubClient(c)
+
+	r := sc.Subscribe(channel)
+	if r.Err != nil {
+		log.Println("can't subscribe to redis channel", channel, r.Err)
+		return r.Err
+	}
+
+	for {
+		r = sc.Receive()
+		if r.Err != nil {
+			// Our connection has a read timeout, so we expect to
+			// time out when there are no messages
+			if r.Timeout() {
+				continue
+			}
+
+			log.Println("can't receive from redis channel", channel, r.Err)
+			return r.Err
+		}
+
+		if r.Type == pubsub.MessageReply {
+			fn(r.Message)
+		}
+	}
+}
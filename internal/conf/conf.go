@@ -17,19 +17,91 @@ var (
 
 	// Partner is the current partner config
 	Partner PartnerSpec
+
+	// Export is the current export config
+	Export ExportSpec
+
+	// Diff is the current diff config
+	Diff DiffSpec
+
+	// Archive is the current archive config
+	Archive ArchiveSpec
+
+	// Report is the current report config
+	Report ReportSpec
+
+	// Mock is the current mock partner server config
+	Mock MockSpec
+
+	// Health is the current health check config
+	Health HealthSpec
 )
 
-// CacheSpec is our redis config, used by busprecache and busapi
+// HealthSpec is our config for health checks and stopping, used by
+// busapi, busloader, busprecache and bus serve
+type HealthSpec struct {
+	// Addr is the "host:port" we listen to for /healthz and /readyz.
+	// busapi also serves them at $BUS_API_ADDR.
+	// Default: None (don't listen)
+	// Environment variable: $BUS_HEALTH_ADDR
+	Addr string `envconfig:"health_addr"`
+
+	// StopTimeout is the number of seconds we wait for HTTP requests to
+	// finish after we're asked to stop
+	// Default: 30
+	// Environment variable: $BUS_STOP_TIMEOUT
+	StopTimeout int `envconfig:"stop_timeout" default:"30"`
+}
+
+// CacheSpec is our cache config, used by busprecache and busapi
 type CacheSpec struct {
+	// Kind is where values are cached: "redis", "memory" for an LRU
+	// cache in this process, or "disk" for files in Dir. A memory cache
+	// can't be shared between processes, and neither memory nor disk
+	// caches send updates to streaming clients in other processes.
+	// Default: redis
+	// Environment variable: $BUS_CACHE
+	Kind string `envconfig:"cache" default:"redis"`
+
 	// RedisAddr is the "host:port" we use for connecting to redis
 	// Default: "localhost:6379"
 	// Environment variable: $BUS_REDIS_ADDR
 	RedisAddr string `envconfig:"redis_addr" default:"localhost:6379"`
 
-	// RedisTTL is the number of seconds we save things in Redis
+	// RedisPoolSize is the number of connections to redis we keep open
+	// Default: 10
+	// Environment variable: $BUS_REDIS_POOL_SIZE
+	RedisPoolSize int `envconfig:"redis_pool_size" default:"10"`
+
+	// RedisTTL is the number of seconds we save things in the cache
 	// Default: "90"
 	// Environment variable: $BUS_REDIS_TTL
 	RedisTTL int `envconfig:"redis_ttl" default:"90"`
+
+	// RedisUpdateChannel is the redis pub/sub channel where the key of
+	// each newly cached value is published, so that busapi can push
+	// updates to streaming clients
+	// Default: "bus:updates"
+	// Environment variable: $BUS_REDIS_UPDATE_CHANNEL
+	RedisUpdateChannel string `envconfig:"redis_update_channel" default:"bus:updates"`
+
+	// MemorySize is the most values a memory cache holds before the
+	// least recently used are removed
+	// Default: 10000
+	// Environment variable: $BUS_CACHE_MEMORY_SIZE
+	MemorySize int `envconfig:"cache_memory_size" default:"10000"`
+
+	// Dir is the directory of a disk cache
+	// Default: cache
+	// Environment variable: $BUS_CACHE_DIR
+	Dir string `envconfig:"cache_dir" default:"cache"`
+
+	// DiskSize is the most megabytes a disk cache holds before the
+	// least recently used values are removed. Expired values are
+	// removed every minute. Counters aren't counted or removed.
+	// Default: 1024
+	// Environment variable: $BUS_CACHE_DISK_SIZE
+	DiskSize int `envconfig:"cache_disk_size" default:"1024"`
 }
 
 // PartnerSpec includes config values specific to certain live partner
@@ -45,6 +117,27 @@ type PartnerSpec struct {
 	// Environment variable: $BUS_MTA_DATAMINE_API_KEY
 	DatamineAPIKey string `envconfig:"mta_datamine_api_key" required:"true"`
 
+	// BustimeStopMonitoring gets live bus departures for a stop from the
+	// SIRI StopMonitoring API instead of scanning every vehicle on the
+	// route from VehicleMonitoring. A stop's response is requested in the
+	// background the first time it's needed and cached for
+	// $BUS_REDIS_TTL seconds. Until then, VehicleMonitoring is used.
+	// Default: false
+	// Environment variable: $BUS_MTA_BUSTIME_STOP_MONITORING
+	BustimeStopMonitoring bool `envconfig:"mta_bustime_stop_monitoring" default:"false"`
+
+	// BustimeURL is the base URL of the Bus Time SIRI API, which can be
+	// changed to use a mock server like busmock
+	// Default: http://bustime.mta.info/api/siri
+	// Environment variable: $BUS_MTA_BUSTIME_URL
+	BustimeURL string `envconfig:"mta_bustime_url" default:"http://bustime.mta.info/api/siri"`
+
+	// DatamineURL is the URL of the subway GTFS-realtime feeds, which can
+	// be changed to use a mock server like busmock
+	// Default: http://datamine.mta.info/mta_esi.php
+	// Environment variable: $BUS_MTA_DATAMINE_URL
+	DatamineURL string `envconfig:"mta_datamine_url" default:"http://datamine.mta.info/mta_esi.php"`
+
 	// AgencyIDs is a comma-delimited list of agencies that
 	// precacher should be hitting
 	// Default: "MTA NYCT,MTABC,NYC DOT,MTA MNR,LI,PATH,NJT"
@@ -55,6 +148,19 @@ type PartnerSpec struct {
 // DBSpec is our database config used by both busapi and busloader
 type DBSpec struct {
 
+	// Driver is the database we use: "postgres", or "sqlite3" for a
+	// single SQLite file at Path. SQLite is meant for small deployments
+	// and tests, and doesn't support every feature.
+	// Default: postgres
+	// Environment variable: $BUS_DB_DRIVER
+	Driver string `envconfig:"db_driver" default:"postgres"`
+
+	// Path is the file of a SQLite database. It's created if it doesn't
+	// exist.
+	// Default: bus.db
+	// Environment variable: $BUS_DB_PATH
+	Path string `envconfig:"db_path" default:"bus.db"`
+
 	// DBAddr is the "host:port" we use for connecting to postgres
 	// Default: "localhost:5432"
 	// Environment variable: $BUS_DB_ADDR
@@ -94,10 +200,54 @@ type APISpec struct {
 	// Environment variable: $BUS_BUILD_TIMESTAMP
 	BuildTimestamp int64 `envconfig:"build_timestamp"`
 
+	// BaseURL is the public URL of the site, used for links in previews
+	// of shared pages
+	// Default: https://token.live
+	// Environment variable: $BUS_BASE_URL
+	BaseURL string `envconfig:"base_url" default:"https://token.live"`
+
 	// LogTiming will log timing info of some core operations / queries
 	// Default: false
 	// Environment variable: $BUS_LOG_TIMING
 	LogTiming bool `envconfig:"log_timing" default:"false"`
+
+	// TileTTL is the number of seconds we save each vector tile in Redis.
+	// Tiles are also replaced after each load by busloader.
+	// Default: 86400
+	// Environment variable: $BUS_TILE_TTL
+	TileTTL int `envconfig:"tile_ttl" default:"86400"`
+
+	// ReplayTime, when set, is a local time like "2016-06-12 08:00:00" to
+	// replay the partner data archived by busprecache from. The API
+	// serves it as if it were live, with the clock starting at
+	// ReplayTime. The archive is read using the Archive config.
+	// Default: None (serve live data)
+	// Environment variable: $BUS_REPLAY_TIME
+	ReplayTime string `envconfig:"replay_time"`
+
+	// HereIndex, when true, keeps a copy of the here_trip and service
+	// data in memory to answer here requests without the database. It's
+	// reloaded after each load by busloader.
+	// Default: true
+	// Environment variable: $BUS_HERE_INDEX
+	HereIndex bool `envconfig:"here_index" default:"true"`
+
+	// MaxDataAge is the number of seconds since busloader last rebuilt
+	// the here tables before /readyz fails, or 0 to not check
+	// Default: 172800 (48 hours)
+	// Environment variable: $BUS_MAX_DATA_AGE
+	MaxDataAge int `envconfig:"max_data_age" default:"172800"`
+
+	// RedirectAddr is the "host:port" we listen to for HTTP connections
+	// that are redirected to BaseURL
+	// Default: ":8001"
+	// Environment variable: $BUS_REDIRECT_ADDR
+	RedirectAddr string `envconfig:"redirect_addr" default:":8001"`
+
+	// DebugAddr is the "host:port" we listen to for pprof requests
+	// Default: "localhost:6060"
+	// Environment variable: $BUS_DEBUG_ADDR
+	DebugAddr string `envconfig:"debug_addr" default:"localhost:6060"`
 }
 
 // LoaderSpec is our config spec used by busloader
@@ -138,4 +288,149 @@ type LoaderSpec struct {
 	// Default: None
 	// Environment variable: $BUS_NJTRANSIT_FEED_PASSWORD
 	NJTransitFeedPassword string `envconfig:"njtransit_feed_password"`
+
+	// PrepRules is the path to a YAML or JSON file (detected by the
+	// .json extension) of per-feed rules for preparing GTFS files before
+	// they are loaded. Rules for a feed URL replace any built-in rules for
+	// that URL.
+	// Default: None (use only built-in rules)
+	// Environment variable: $BUS_PREP_RULES
+	PrepRules string `envconfig:"prep_rules"`
+}
+
+// ExportSpec is our config spec used by busexport
+type ExportSpec struct {
+	// File is the path of the GTFS zip file we write
+	// Default: gtfs.zip
+	// Environment variable: $BUS_EXPORT_FILE
+	File string `envconfig:"export_file" default:"gtfs.zip"`
+
+	// AgencyIDs is a comma-delimited list of agencies to export
+	// Default: None (export all agencies)
+	// Environment variable: $BUS_EXPORT_AGENCY_IDS (comma-delimited list)
+	AgencyIDs []string `envconfig:"export_agency_ids"`
+
+	// RouteFilter is a comma-delimited list of route_ids to export
+	// Default: None (no filter)
+	// Environment variable: $BUS_EXPORT_ROUTE_FILTER (comma-delimited list)
+	RouteFilter []string `envconfig:"export_route_filter"`
+
+	// AgencyURL is the agency_url written to agency.txt for each agency
+	// Default: https://token.live/
+	// Environment variable: $BUS_EXPORT_AGENCY_URL
+	AgencyURL string `envconfig:"export_agency_url" default:"https://token.live/"`
+}
+
+// DiffSpec is our config spec used by busdiff
+type DiffSpec struct {
+	// OldURL is the URL of the GTFS feed to compare from. A URL starting
+	// with file:// is read from the local filesystem.
+	// Default: None (compare from the data loaded in the database)
+	// Environment variable: $BUS_DIFF_OLD_URL
+	OldURL string `envconfig:"diff_old_url"`
+
+	// NewURL is the URL of the GTFS feed to compare to. A URL starting
+	// with file:// is read from the local filesystem.
+	// Default: None
+	// Environment variable: $BUS_DIFF_NEW_URL
+	NewURL string `envconfig:"diff_new_url" required:"true"`
+
+	// RulesURL is the URL whose preparation rules (see PrepRules) are
+	// used for both feeds, e.g., the URL we load a feed from when
+	// comparing a file:// copy of it
+	// Default: None (each feed's own URL)
+	// Environment variable: $BUS_DIFF_RULES_URL
+	RulesURL string `envconfig:"diff_rules_url"`
+
+	// Format is the output format, either "text" or "json"
+	// Default: text
+	// Environment variable: $BUS_DIFF_FORMAT
+	Format string `envconfig:"diff_format" default:"text"`
+
+	// MinMeters is the distance a stop must move before we report it
+	// Default: 50
+	// Environment variable: $BUS_DIFF_MIN_METERS
+	MinMeters float64 `envconfig:"diff_min_meters" default:"50"`
+}
+
+// ArchiveSpec is our config spec used by busprecache for saving the live
+// data it gets, and by busapi for replaying it
+type ArchiveSpec struct {
+	// Kind is where live observations are archived, either "db" for the
+	// vehicle_observation and departure_observation tables or "file" for
+	// gzipped daily files in Dir. Archiving to the db requires that
+	// busprecache uses a writeable database.
+	// Default: None (don't archive)
+	// Environment variable: $BUS_ARCHIVE
+	Kind string `envconfig:"archive"`
+
+	// Dir is the directory of archive files when Kind is "file"
+	// Default: archive
+	// Environment variable: $BUS_ARCHIVE_DIR
+	Dir string `envconfig:"archive_dir" default:"archive"`
+}
+
+// ReportSpec is our config spec used by busreport
+type ReportSpec struct {
+	// AgencyID is the agency to report on
+	// Default: MTA NYCT
+	// Environment variable: $BUS_REPORT_AGENCY_ID
+	AgencyID string `envconfig:"report_agency_id" default:"MTA NYCT"`
+
+	// RouteID limits the report to a single route
+	// Default: None (all routes)
+	// Environment variable: $BUS_REPORT_ROUTE_ID
+	RouteID string `envconfig:"report_route_id"`
+
+	// Start is the first day of the report, like 2016-06-12
+	// Default: None (yesterday)
+	// Environment variable: $BUS_REPORT_START
+	Start string `envconfig:"report_start"`
+
+	// End is the last day of the report, like 2016-06-18
+	// Default: None (same as start)
+	// Environment variable: $BUS_REPORT_END
+	End string `envconfig:"report_end"`
+
+	// GroupBy is a comma-delimited list of what to group results by,
+	// any of route, direction, stop and hour
+	// Default: route,direction,stop,hour
+	// Environment variable: $BUS_REPORT_GROUP_BY (comma-delimited list)
+	GroupBy []string `envconfig:"report_group_by" default:"route,direction,stop,hour"`
+
+	// Early is the number of seconds a departure can be before its
+	// scheduled time and still be on time
+	// Default: 60
+	// Environment variable: $BUS_REPORT_EARLY
+	Early int `envconfig:"report_early" default:"60"`
+
+	// Late is the number of seconds a departure can be after its
+	// scheduled time and still be on time
+	// Default: 300
+	// Environment variable: $BUS_REPORT_LATE
+	Late int `envconfig:"report_late" default:"300"`
+
+	// Format is the output format, either "text" or "json"
+	// Default: text
+	// Environment variable: $BUS_REPORT_FORMAT
+	Format string `envconfig:"report_format" default:"text"`
+}
+
+// MockSpec is our config spec used by busmock
+type MockSpec struct {
+	// Addr is the "host:port" we listen to for incoming HTTP connections
+	// Default: "localhost:8002"
+	// Environment variable: $BUS_MOCK_ADDR
+	Addr string `envconfig:"mock_addr" default:"localhost:8002"`
+
+	// Dir is the directory of recorded partner responses to serve
+	// Default: testdata/mock
+	// Environment variable: $BUS_MOCK_DIR
+	Dir string `envconfig:"mock_dir" default:"testdata/mock"`
+
+	// Shift moves the times in each response so that it appears to have
+	// been recorded now
+	// Default: true
+	// Environment variable: $BUS_MOCK_SHIFT
+	Shift bool `envconfig:"mock_shift" default:"true"`
 }
@@ -1,7 +1,6 @@
 package etc
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,27 +11,49 @@ import (
 	"strings"
 	"time"
 
+	"github.com/brnstz/bus/internal/cache"
 	"github.com/brnstz/bus/internal/conf"
-	"github.com/fzzy/radix/redis"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 const (
-	// redisConnectTimeout is how long we wait to connect to redis
-	// before giving up
-	redisConnectTimeout = 1 * time.Second
+	// DateFormat is the format of dates in GTFS files, like 20160612
+	DateFormat = "20060102"
 )
 
 var (
-	// DBConn is our shared connection to postgres
+	// Days are the day columns of calendar.txt, in order, which are also
+	// the days of service_route_day
+	Days = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+	// DBConn is our shared connection to the database, usually postgres
 	DBConn *sqlx.DB
 
+	// Cache is our shared cache, usually redis
+	Cache cache.Cache
+
 	// httpClient is an http.Client with a reasonable timeout for contacting
 	// external sites.
 	httpClient = http.Client{Timeout: time.Duration(20) * time.Second}
+
+	// replayOffset is how far behind the real time Now is. It's only
+	// set when replaying archived data.
+	replayOffset time.Duration
 )
 
+// Now returns the current time, which is in the past when replaying
+// archived data
+func Now() time.Time {
+	return time.Now().Add(-replayOffset)
+}
+
+// SetNow makes Now return t and advance from there in real time. It
+// should only be called at startup.
+func SetNow(t time.Time) {
+	replayOffset = time.Since(t)
+}
+
 // TimeStrToSecs takes a string like "01:23:45" (hours:minutes:seconds)
 // and returns a integer of the total number of seconds
 func TimeStrToSecs(timeStr string) int {
@@ -76,46 +97,42 @@ func TimeToDepartureSecs(t time.Time) int {
 	return t.Hour()*3600 + t.Minute()*60 + t.Second()
 }
 
-// RedisGet retrieves the data cached at k or returns an error if there is no
-// cached version or there's another error.
-func RedisGet(k string) (b []byte, err error) {
-	c, err := redis.DialTimeout("tcp", conf.Cache.RedisAddr, redisConnectTimeout)
+// MustCache returns the Cache described by conf.Cache or panics
+func MustCache() cache.Cache {
+	c, err := cache.New(cache.Spec{
+		Kind:          conf.Cache.Kind,
+		RedisAddr:     conf.Cache.RedisAddr,
+		RedisPoolSize: conf.Cache.RedisPoolSize,
+		MemorySize:    conf.Cache.MemorySize,
+		Dir:           conf.Cache.Dir,
+		DiskSize:      int64(conf.Cache.DiskSize) * 1024 * 1024,
+	})
 	if err != nil {
-		log.Println("can't connect to redis", err)
-		return
-	}
-
-	b, err = c.Cmd("get", k).Bytes()
-	if err != nil {
-		log.Println("can't get from redis", err)
-		return
+		log.Panic(err)
 	}
 
-	return
+	return c
 }
 
-// RedisCache saves bytes to redis using key k.
-func RedisCache(k string, b []byte) (err error) {
-	c, err := redis.DialTimeout("tcp", conf.Cache.RedisAddr, redisConnectTimeout)
+// CacheSave saves bytes to the cache using key k for conf.Cache.RedisTTL
+// seconds and publishes k to streaming clients
+func CacheSave(k string, b []byte) (err error) {
+	err = Cache.Set(k, b, time.Duration(conf.Cache.RedisTTL)*time.Second)
 	if err != nil {
-		log.Println("can't connect to redis", err)
+		log.Println("can't save value in cache", err)
 		return
 	}
 
-	// Save the data to redis
-	err = c.Cmd("set", k, b, "ex", strconv.Itoa(conf.Cache.RedisTTL)).Err
-	if err != nil {
-		log.Println("can't set value in redis")
-		return
-	}
+	publish(k)
 
 	return
 }
 
-// RedisCacheURL takes a URL and returns the bytes of the response from running
-// a GET on that URL. Responses are cached for redisTTL seconds. If Redis
-// is not available, an error is logged and we hit the URL directly.
-func RedisCacheURL(u string) (b []byte, err error) {
+// CacheURL takes a URL and returns the bytes of the response from running
+// a GET on that URL. Responses are saved at k with CacheSave, so that the
+// URL (and any API key in it) isn't used as a key. If the cache is not
+// available, an error is logged and the response is still returned.
+func CacheURL(k, u string) (b []byte, err error) {
 	// Get the value from the URL. If we can't do this, it's an error
 	// we should return.
 	resp, err := httpClient.Get(u)
@@ -131,24 +148,31 @@ func RedisCacheURL(u string) (b []byte, err error) {
 		return
 	}
 
-	c, err := redis.DialTimeout("tcp", conf.Cache.RedisAddr, redisConnectTimeout)
-	if err != nil {
-		log.Println("can't connect to redis", err)
-		return
-	}
+	CacheSave(k, b)
 
-	// Save the data to redis
-	err = c.Cmd("set", u, b, "ex", strconv.Itoa(conf.Cache.RedisTTL)).Err
+	return
+}
+
+// publish sends k on the update channel to let subscribers know there is
+// a new value. The value is already saved, so an error here is only
+// logged.
+func publish(k string) {
+	err := Cache.Publish(conf.Cache.RedisUpdateChannel, k)
 	if err != nil {
-		log.Println("can't set value in redis")
-		return
+		log.Println("can't publish update", k, err)
 	}
-
-	return
 }
 
-// MustDB returns an *sqlx.DB or panics
+// MustDB returns an *sqlx.DB for conf.DB.Driver or panics
 func MustDB() *sqlx.DB {
+	switch conf.DB.Driver {
+	case "postgres":
+	case "sqlite3":
+		return mustSQLite().Unsafe()
+	default:
+		log.Panicf("unknown db driver: %v", conf.DB.Driver)
+	}
+
 	host, port, err := net.SplitHostPort(conf.DB.Addr)
 	if err != nil {
 		log.Panic(err)
@@ -181,60 +205,12 @@ func BaseTime(t time.Time) time.Time {
 	return t
 }
 
-// CreateIntIDs takes  aslice of ints and returns a single sting
-// suitable for substitution into an IN clause
-func CreateIntIDs(ids []int) string {
-	strIDs := make([]string, len(ids))
-
-	for i, _ := range ids {
-		strIDs[i] = strconv.Itoa(ids[i])
-	}
-
-	return strings.Join(strIDs, ",")
-}
-
-// CreateIDs turns a slice of strings into a single string suitable
-// for substitution into an IN clause.
-func CreateIDs(ids []string) string {
-	escapedIDs := make([]string, len(ids))
-
-	// If there are no ids, we want a single blank value
-	if len(ids) < 1 {
-		return `''`
-	}
-
-	for i, _ := range ids {
-		escapedIDs[i] = escape(ids[i])
-	}
-
-	return strings.Join(escapedIDs, ",")
-}
-
-// escape ensures any single quotes inside of id are escaped / quoted
-// before creating an ad-hoc string for the IN query
-func escape(id string) string {
-	var b bytes.Buffer
-
-	b.WriteRune('\u0027')
-
-	for _, char := range id {
-		switch char {
-		case '\u0027':
-			b.WriteRune('\u0027')
-			b.WriteRune('\u0027')
-		default:
-			b.WriteRune(char)
-		}
-	}
-
-	b.WriteRune('\u0027')
-
-	return b.String()
-}
-
 const rad = math.Pi / 180.0
 const deg = 180.0 / math.Pi
 
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371000.0
+
 // stolen from https://github.com/kellydunn/golang-geo/blob/master/point.go
 // in turn stolen from http://www.movable-type.co.uk/scripts/latlong.html
 func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
@@ -248,3 +224,17 @@ func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
 
 	return math.Atan2(y, x) * deg
 }
+
+// Distance returns the great-circle distance in meters between two points
+// using the haversine formula, see:
+// http://www.movable-type.co.uk/scripts/latlong.html
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*
+			math.Sin(dlon/2)*math.Sin(dlon/2)
+
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
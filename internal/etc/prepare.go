@@ -0,0 +1,84 @@
+package etc
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// stmts and namedStmts are mappings of query text to statements
+	// prepared by Prepare and PrepareNamed. They are only written at
+	// startup, before any queries are run.
+	stmts      = map[string]*sqlx.Stmt{}
+	namedStmts = map[string]*sqlx.NamedStmt{}
+)
+
+// Prepare prepares each query on db so that later calls to Select with
+// the same query text use the prepared statement
+func Prepare(db *sqlx.DB, queries ...string) error {
+	for _, q := range queries {
+		stmt, err := db.Preparex(q)
+		if err != nil {
+			log.Println("can't prepare query", err, q)
+			return err
+		}
+
+		stmts[q] = stmt
+	}
+
+	return nil
+}
+
+// PrepareNamed prepares each named query on db so that later calls to
+// NamedQuery with the same query text use the prepared statement
+func PrepareNamed(db *sqlx.DB, queries ...string) error {
+	for _, q := range queries {
+		stmt, err := db.PrepareNamed(q)
+		if err != nil {
+			log.Println("can't prepare named query", err, q)
+			return err
+		}
+
+		namedStmts[q] = stmt
+	}
+
+	return nil
+}
+
+// Select is like sqlx.Select, but uses the statement prepared for q if
+// there is one. When db is a transaction, the statement runs within it.
+func Select(db sqlx.Ext, dest interface{}, q string, args ...interface{}) error {
+	stmt, ok := stmts[q]
+	if !ok {
+		return sqlx.Select(db, dest, q, args...)
+	}
+
+	switch v := db.(type) {
+	case *sqlx.Tx:
+		return v.Stmtx(stmt).Select(dest, args...)
+	case *sqlx.DB:
+		return stmt.Select(dest, args...)
+	default:
+		return sqlx.Select(db, dest, q, args...)
+	}
+}
+
+// NamedQuery is like sqlx.NamedQuery, but uses the statement prepared for
+// q if there is one. When db is a transaction, the statement runs
+// within it.
+func NamedQuery(db sqlx.Ext, q string, arg interface{}) (*sqlx.Rows, error) {
+	stmt, ok := namedStmts[q]
+	if !ok {
+		return sqlx.NamedQuery(db, q, arg)
+	}
+
+	switch v := db.(type) {
+	case *sqlx.Tx:
+		return v.NamedStmt(stmt).Queryx(arg)
+	case *sqlx.DB:
+		return stmt.Queryx(arg)
+	default:
+		return sqlx.NamedQuery(db, q, arg)
+	}
+}
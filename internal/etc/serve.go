@@ -0,0 +1,68 @@
+package etc
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/health"
+)
+
+// Start returns a context that's done when we're asked to stop with
+// SIGINT or SIGTERM. It adds the checks that every binary has to /readyz,
+// which fail while we're stopping or when DBConn or Cache don't work, and
+// serves /healthz and /readyz at conf.Health.Addr when it's set. Call
+// stop when we're done to stop listening for signals.
+func Start() (ctx context.Context, stop context.CancelFunc) {
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	health.Add("running", health.Running(ctx))
+	health.Add("db", health.DB(DBConn))
+	health.Add("cache", health.Cache(Cache))
+
+	if len(conf.Health.Addr) > 0 {
+		go func() {
+			log.Fatal(health.Serve(conf.Health.Addr))
+		}()
+	}
+
+	return
+}
+
+// Serve listens for HTTP connections with srv until ctx is done. It then
+// stops listening and waits up to conf.Health.StopTimeout seconds for
+// requests to finish. It returns nil if it stopped because of ctx.
+func Serve(ctx context.Context, srv *http.Server) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Println("can't serve", srv.Addr, err)
+		return err
+
+	case <-ctx.Done():
+	}
+
+	log.Println("stopping", srv.Addr)
+
+	timeout := time.Duration(conf.Health.StopTimeout) * time.Second
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(sctx)
+	if err != nil {
+		log.Println("can't stop", srv.Addr, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package etc
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/brnstz/bus/internal/conf"
+)
+
+const (
+	// sqliteDriver is go-sqlite3 with the PostGIS functions we use (see
+	// sqlite_geo.go) and our postgres queries translated to SQLite
+	sqliteDriver = "bus_sqlite3"
+
+	// sqliteTimeFormat is how times are saved in SQLite. Only the wall
+	// clock is saved, like a postgres date or timestamp without time
+	// zone, so that dates compare the same way as they do in postgres.
+	sqliteTimeFormat = "2006-01-02 15:04:05.999999999"
+)
+
+var (
+	// sqliteParams matches postgres positional params like $1, which are
+	// ?1 in SQLite
+	sqliteParams = regexp.MustCompile(`\$(\d+)`)
+
+	// sqliteAny matches "x = ANY(y)" where x is a column or columns
+	// joined with ||, e.g., agency_id || '|' || stop_id
+	sqliteAny = regexp.MustCompile(`([\w.]+(?:\s*\|\|\s*(?:'[^']*'|[\w.]+))*)\s*=\s*ANY\(([^()]+)\)`)
+
+	// sqliteCasts matches postgres casts like ::text and ::text[]
+	sqliteCasts = regexp.MustCompile(`::\w+(?:\[\])?`)
+
+	// sqliteLiterals matches string literals, which may have quotes
+	// escaped as '', and comments, which may have quotes of their own
+	sqliteLiterals = regexp.MustCompile(`'(?:[^']|'')*'|--[^\n]*`)
+)
+
+func init() {
+	sql.Register(sqliteDriver, &sqliteDriverConn{
+		d: &sqlite3.SQLiteDriver{ConnectHook: registerGeo},
+	})
+
+	sqlx.BindDriver(sqliteDriver, sqlx.QUESTION)
+}
+
+// SQLite returns true when our database is SQLite instead of postgres
+func SQLite() bool {
+	return conf.DB.Driver == "sqlite3"
+}
+
+// mustSQLite opens the SQLite database at conf.DB.Path, creating any
+// tables that don't exist, or panics
+func mustSQLite() *sqlx.DB {
+	// WAL lets the API read while the loader writes
+	db, err := sqlx.Connect(sqliteDriver,
+		conf.DB.Path+"?_busy_timeout=10000&_journal_mode=WAL",
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return db
+}
+
+// sqliteQuery translates the postgres syntax in our queries that SQLite
+// doesn't have. Arrays are passed as postgres array literals, so
+// x = ANY(y) is checked with pg_any. String literals aren't changed:
+// they're replaced by their position (e.g., '0') while the rest is
+// translated, and then put back. Comments are removed.
+func sqliteQuery(q string) string {
+	var literals []string
+	q = sqliteLiterals.ReplaceAllStringFunc(q, func(lit string) string {
+		if strings.HasPrefix(lit, "--") {
+			return ""
+		}
+
+		literals = append(literals, lit)
+		return "'" + strconv.Itoa(len(literals)-1) + "'"
+	})
+
+	q = sqliteParams.ReplaceAllString(q, "?$1")
+	q = sqliteAny.ReplaceAllString(q, "pg_any(${2}, ${1})")
+	q = sqliteCasts.ReplaceAllString(q, "")
+
+	return sqliteLiterals.ReplaceAllStringFunc(q, func(lit string) string {
+		i, err := strconv.Atoi(strings.Trim(lit, "'"))
+		if err != nil || i < 0 || i >= len(literals) {
+			return lit
+		}
+
+		return literals[i]
+	})
+}
+
+// sqliteDriverConn opens connections that translate queries with
+// sqliteQuery and save times with sqliteTimeFormat
+type sqliteDriverConn struct {
+	d *sqlite3.SQLiteDriver
+}
+
+func (d *sqliteDriverConn) Open(name string) (driver.Conn, error) {
+	c, err := d.d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteConn{c: c.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteConn struct {
+	c *sqlite3.SQLiteConn
+}
+
+func (c *sqliteConn) Prepare(q string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), q)
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, q string) (driver.Stmt, error) {
+	s, err := c.c.PrepareContext(ctx, sqliteQuery(q))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteStmt{s: s.(*sqlite3.SQLiteStmt)}, nil
+}
+
+// ExecContext runs q directly, which unlike a prepared statement allows
+// more than one statement in q. SQLite transactions are always
+// serializable, so postgres SET TRANSACTION statements are ignored.
+func (c *sqliteConn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(q)), "SET TRANSACTION") {
+		return driver.RowsAffected(0), nil
+	}
+
+	return c.c.ExecContext(ctx, sqliteQuery(q), args)
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.c.QueryContext(ctx, sqliteQuery(q), args)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteRows{rows}, nil
+}
+
+func (c *sqliteConn) Begin() (driver.Tx, error) {
+	return c.c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.c.BeginTx(ctx, opts)
+}
+
+func (c *sqliteConn) Close() error {
+	return c.c.Close()
+}
+
+// CheckNamedValue converts arguments as usual, except that times are
+// formatted with sqliteTimeFormat
+func (c *sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+
+	if t, ok := v.(time.Time); ok {
+		v = t.Format(sqliteTimeFormat)
+	}
+
+	nv.Value = v
+
+	return nil
+}
+
+type sqliteStmt struct {
+	s *sqlite3.SQLiteStmt
+}
+
+func (s *sqliteStmt) Close() error {
+	return s.s.Close()
+}
+
+func (s *sqliteStmt) NumInput() int {
+	return s.s.NumInput()
+}
+
+func (s *sqliteStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.s.Exec(args)
+}
+
+func (s *sqliteStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.s.Query(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteRows{rows}, nil
+}
+
+func (s *sqliteStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.s.ExecContext(ctx, args)
+}
+
+func (s *sqliteStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.s.QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteRows{rows}, nil
+}
+
+// sqliteRows returns times in time.Local. go-sqlite3 reads our times
+// without a zone as UTC, but they were saved with a local wall clock.
+type sqliteRows struct {
+	driver.Rows
+}
+
+func (r sqliteRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range dest {
+		t, ok := v.(time.Time)
+		if !ok {
+			continue
+		}
+
+		dest[i] = time.Date(
+			t.Year(), t.Month(), t.Day(),
+			t.Hour(), t.Minute(), t.Second(), t.Nanosecond(),
+			time.Local,
+		)
+	}
+
+	return nil
+}
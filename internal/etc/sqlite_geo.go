@@ -0,0 +1,351 @@
+package etc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// errGeometry is returned by our SQLite geometry functions when they
+// can't use a value
+var errGeometry = errors.New("invalid geometry")
+
+// geom is a geometry in SQLite, which we save as WKT. Points and
+// linestrings have a single ring.
+type geom struct {
+	kind  string
+	rings [][][2]float64
+}
+
+// parseGeom parses WKT in v. A nil geom is returned for NULL.
+func parseGeom(v interface{}) (*geom, error) {
+	var s string
+
+	switch t := v.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	default:
+		return nil, errGeometry
+	}
+
+	if len(s) < 1 {
+		return nil, nil
+	}
+
+	start := strings.Index(s, "(")
+	end := strings.LastIndex(s, ")")
+	if start < 0 || end < start {
+		return nil, errGeometry
+	}
+
+	g := &geom{kind: strings.ToUpper(strings.TrimSpace(s[:start]))}
+	body := s[start+1 : end]
+
+	var rings []string
+	switch g.kind {
+	case "POINT", "LINESTRING":
+		rings = []string{body}
+	case "POLYGON":
+		rings = strings.Split(body, "),")
+	default:
+		return nil, errGeometry
+	}
+
+	for _, r := range rings {
+		var ring [][2]float64
+
+		for _, c := range strings.Split(strings.Trim(r, " ()"), ",") {
+			fields := strings.Fields(c)
+			if len(fields) != 2 {
+				return nil, errGeometry
+			}
+
+			x, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, errGeometry
+			}
+
+			y, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, errGeometry
+			}
+
+			ring = append(ring, [2]float64{x, y})
+		}
+
+		g.rings = append(g.rings, ring)
+	}
+
+	return g, nil
+}
+
+// point returns the coordinates of g when it's a point
+func (g *geom) point() (x, y float64, err error) {
+	if g == nil || g.kind != "POINT" {
+		return 0, 0, errGeometry
+	}
+
+	return g.rings[0][0][0], g.rings[0][0][1], nil
+}
+
+// wkt returns the WKT of g
+func (g *geom) wkt() []byte {
+	rings := make([]string, len(g.rings))
+
+	for i, ring := range g.rings {
+		coords := make([]string, len(ring))
+
+		for j, c := range ring {
+			coords[j] = strconv.FormatFloat(c[0], 'f', -1, 64) + " " +
+				strconv.FormatFloat(c[1], 'f', -1, 64)
+		}
+
+		rings[i] = strings.Join(coords, ", ")
+	}
+
+	if g.kind == "POLYGON" {
+		return []byte(fmt.Sprintf("POLYGON((%s))", strings.Join(rings, "), (")))
+	}
+
+	return []byte(fmt.Sprintf("%s(%s)", g.kind, rings[0]))
+}
+
+// contains returns true if x, y is inside the outer ring of polygon g
+func (g *geom) contains(x, y float64) bool {
+	ring := g.rings[0]
+	in := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+
+	return in
+}
+
+// number returns v as a float64, or false when it's NULL
+func number(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	default:
+		return 0, false
+	}
+}
+
+// geomBytes returns the geometry v unchanged, as bytes so that NULL
+// stays NULL
+func geomBytes(v interface{}) []byte {
+	if s, ok := v.(string); ok {
+		return []byte(s)
+	}
+
+	b, _ := v.([]byte)
+	return b
+}
+
+// registerGeo adds the PostGIS functions that our queries use to a
+// SQLite connection. Geometries are WKT and SRIDs are ignored. Like
+// PostGIS, distances between geometries are in their own units and
+// distances between geographies, with lon then lat, are in meters.
+func registerGeo(c *sqlite3.SQLiteConn) error {
+	funcs := map[string]interface{}{
+		"st_makepoint": func(xv, yv interface{}) []byte {
+			x, xok := number(xv)
+			y, yok := number(yv)
+			if !xok || !yok {
+				return nil
+			}
+
+			g := geom{kind: "POINT", rings: [][][2]float64{{{x, y}}}}
+			return g.wkt()
+		},
+
+		"st_setsrid": func(v interface{}, srid int64) []byte {
+			return geomBytes(v)
+		},
+
+		"st_geomfromtext": func(v interface{}, srid ...int64) ([]byte, error) {
+			g, err := parseGeom(v)
+			if g == nil {
+				return nil, err
+			}
+
+			return g.wkt(), nil
+		},
+
+		"geography": func(v interface{}) []byte {
+			return geomBytes(v)
+		},
+
+		"st_x": func(v interface{}) (float64, error) {
+			g, err := parseGeom(v)
+			if err != nil {
+				return 0, err
+			}
+
+			x, _, err := g.point()
+			return x, err
+		},
+
+		"st_y": func(v interface{}) (float64, error) {
+			g, err := parseGeom(v)
+			if err != nil {
+				return 0, err
+			}
+
+			_, y, err := g.point()
+			return y, err
+		},
+
+		"st_flipcoordinates": func(v interface{}) ([]byte, error) {
+			g, err := parseGeom(v)
+			if g == nil {
+				return nil, err
+			}
+
+			for _, ring := range g.rings {
+				for i := range ring {
+					ring[i][0], ring[i][1] = ring[i][1], ring[i][0]
+				}
+			}
+
+			return g.wkt(), nil
+		},
+
+		"st_makepolygon": func(v interface{}) ([]byte, error) {
+			g, err := parseGeom(v)
+			if g == nil {
+				return nil, err
+			}
+
+			if g.kind != "LINESTRING" {
+				return nil, errGeometry
+			}
+
+			g.kind = "POLYGON"
+			return g.wkt(), nil
+		},
+
+		"st_contains": func(pv, v interface{}) (bool, error) {
+			p, err := parseGeom(pv)
+			if err != nil {
+				return false, err
+			}
+
+			g, err := parseGeom(v)
+			if err != nil {
+				return false, err
+			}
+
+			if p == nil || p.kind != "POLYGON" {
+				return false, errGeometry
+			}
+
+			x, y, err := g.point()
+			if err != nil {
+				return false, err
+			}
+
+			return p.contains(x, y), nil
+		},
+
+		"st_distance": func(av, bv interface{}) (float64, error) {
+			a, err := parseGeom(av)
+			if err != nil {
+				return 0, err
+			}
+
+			b, err := parseGeom(bv)
+			if err != nil {
+				return 0, err
+			}
+
+			ax, ay, err := a.point()
+			if err != nil {
+				return 0, err
+			}
+
+			bx, by, err := b.point()
+			if err != nil {
+				return 0, err
+			}
+
+			return math.Hypot(ax-bx, ay-by), nil
+		},
+
+		"st_dwithin": func(av, bv interface{}, meters float64) (bool, error) {
+			a, err := parseGeom(av)
+			if err != nil {
+				return false, err
+			}
+
+			b, err := parseGeom(bv)
+			if err != nil {
+				return false, err
+			}
+
+			alon, alat, err := a.point()
+			if err != nil {
+				return false, err
+			}
+
+			blon, blat, err := b.point()
+			if err != nil {
+				return false, err
+			}
+
+			return Distance(alat, alon, blat, blon) <= meters, nil
+		},
+
+		// pg_any(a, v) is v = ANY(a), where a is a postgres array
+		// literal
+		"pg_any": func(av, v interface{}) (bool, error) {
+			var a pq.StringArray
+
+			if b, ok := av.([]byte); ok && b == nil {
+				return false, nil
+			}
+
+			err := a.Scan(av)
+			if err != nil {
+				return false, err
+			}
+
+			s := fmt.Sprint(v)
+			if b, ok := v.([]byte); ok {
+				s = string(b)
+			}
+
+			for _, x := range a {
+				if x == s {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		},
+	}
+
+	for name, f := range funcs {
+		err := c.RegisterFunc(name, f, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package etc
+
+// sqliteSchema is the SQLite version of the schema in migrations/, which
+// is created when the database is opened. Geometries are saved as WKT.
+// here_trip_rtree indexes the location of each here_trip row by its id.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS route (
+    agency_id           TEXT NOT NULL,
+    route_id            TEXT NOT NULL,
+    route_type          INT NOT NULL,
+    route_color         TEXT NOT NULL,
+    route_text_color    TEXT NOT NULL,
+    route_short_name    TEXT NOT NULL DEFAULT '',
+    route_long_name     TEXT NOT NULL DEFAULT '',
+
+    UNIQUE(agency_id, route_id)
+);
+
+CREATE TABLE IF NOT EXISTS stop (
+    agency_id       TEXT NOT NULL,
+    stop_id         TEXT NOT NULL,
+    stop_name       TEXT NOT NULL,
+    direction_id    INT NOT NULL,
+    headsign        TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    location        GEOMETRY NOT NULL,
+    lat             DOUBLE PRECISION,
+    lon             DOUBLE PRECISION,
+
+    UNIQUE(agency_id, route_id, stop_id, direction_id)
+);
+
+CREATE TABLE IF NOT EXISTS service_route_day (
+    agency_id   TEXT NOT NULL,
+    route_id    TEXT NOT NULL,
+    service_id  TEXT NOT NULL,
+    day         TEXT NOT NULL,
+    start_date  DATE NOT NULL,
+    end_date    DATE NOT NULL,
+
+    UNIQUE(agency_id, route_id, service_id, day, start_date, end_date)
+);
+
+CREATE TABLE IF NOT EXISTS trip (
+    agency_id    TEXT NOT NULL,
+    route_id     TEXT NOT NULL,
+    trip_id      TEXT NOT NULL,
+    service_id   TEXT NOT NULL,
+    shape_id     TEXT NOT NULL,
+    headsign     TEXT NOT NULL,
+    direction_id INT NOT NULL,
+
+    UNIQUE(agency_id, route_id, trip_id)
+);
+
+CREATE TABLE IF NOT EXISTS shape (
+    agency_id   TEXT NOT NULL,
+    shape_id    TEXT NOT NULL,
+    location    GEOMETRY NOT NULL,
+    seq         INT NOT NULL,
+    lat         DOUBLE PRECISION,
+    lon         DOUBLE PRECISION,
+
+    UNIQUE(agency_id, shape_id, seq)
+);
+
+CREATE TABLE IF NOT EXISTS service_route_exception (
+    agency_id       TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    service_id      TEXT NOT NULL,
+    exception_date  DATE NOT NULL,
+    exception_type  INT NOT NULL,
+
+    UNIQUE(agency_id, route_id, service_id, exception_date)
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_stop_time (
+    agency_id           TEXT NOT NULL,
+    route_id            TEXT NOT NULL,
+    stop_id             TEXT NOT NULL,
+    service_id          TEXT NOT NULL,
+    trip_id             TEXT NOT NULL,
+    arrival_sec         INT NOT NULL,
+    departure_sec       INT NOT NULL,
+    stop_sequence       INT NOT NULL,
+    last_stop           BOOLEAN,
+    next_stop_id        TEXT,
+    next_stop_location  GEOMETRY,
+    next_stop_lat       DOUBLE PRECISION,
+    next_stop_lon       DOUBLE PRECISION,
+
+    UNIQUE(agency_id, route_id, stop_id, service_id, trip_id)
+);
+
+CREATE TABLE IF NOT EXISTS route_shape (
+    agency_id       TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    direction_id    INT NOT NULL,
+    headsign        TEXT NOT NULL,
+    shape_id        TEXT NOT NULL,
+
+    UNIQUE(agency_id, route_id, direction_id, headsign)
+);
+
+CREATE TABLE IF NOT EXISTS fake_shape (
+    agency_id       TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    direction_id    INT NOT NULL,
+    headsign        TEXT NOT NULL,
+    seq             INT NOT NULL,
+    location        GEOMETRY NOT NULL,
+    lat             DOUBLE PRECISION,
+    lon             DOUBLE PRECISION,
+
+    UNIQUE(agency_id, route_id, direction_id, headsign, seq)
+);
+
+CREATE TABLE IF NOT EXISTS here_trip (
+    id                  INTEGER PRIMARY KEY,
+    agency_id           TEXT NOT NULL,
+    route_id            TEXT NOT NULL,
+    stop_id             TEXT NOT NULL,
+    service_id          TEXT NOT NULL,
+    trip_ids            TEXT NOT NULL,
+    arrival_secs        TEXT NOT NULL,
+    departure_secs      TEXT NOT NULL,
+    stop_sequences      TEXT NOT NULL,
+    next_stop_ids       TEXT,
+    next_stop_lats      TEXT,
+    next_stop_lons      TEXT,
+    stop_name           TEXT NOT NULL,
+    direction_id        INT NOT NULL,
+    stop_headsign       TEXT NOT NULL,
+    location            GEOMETRY NOT NULL,
+    route_type          INT NOT NULL,
+    route_color         TEXT NOT NULL,
+    route_text_color    TEXT NOT NULL,
+    route_short_name    TEXT NOT NULL,
+    route_long_name     TEXT NOT NULL,
+    trip_headsign       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_service_id_here_trip ON here_trip (service_id);
+CREATE INDEX IF NOT EXISTS idx_agency_id_here_trip ON here_trip (agency_id);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS here_trip_rtree USING rtree(
+    id, min_lat, max_lat, min_lon, max_lon
+);
+
+CREATE TABLE IF NOT EXISTS here_load (
+    agency_id   TEXT NOT NULL PRIMARY KEY,
+    loaded_at   TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS service (
+    id          INTEGER PRIMARY KEY,
+    agency_id   TEXT NOT NULL,
+    service_id  TEXT NOT NULL,
+    day         TEXT NOT NULL,
+    start_date  DATE NOT NULL,
+    end_date    DATE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_service ON service (agency_id, service_id, day);
+
+CREATE TABLE IF NOT EXISTS service_exception (
+    id              INTEGER PRIMARY KEY,
+    agency_id       TEXT NOT NULL,
+    service_id      TEXT NOT NULL,
+    exception_date  DATE NOT NULL,
+    exception_type  INT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_service_exception ON service_exception (agency_id, service_id, exception_date);
+
+CREATE TABLE IF NOT EXISTS vehicle_observation (
+    agency_id     TEXT NOT NULL,
+    route_id      TEXT NOT NULL,
+    direction_id  INT,
+    trip_id       TEXT NOT NULL,
+    stop_id       TEXT,
+    lat           DOUBLE PRECISION NOT NULL,
+    lon           DOUBLE PRECISION NOT NULL,
+    occupancy     TEXT,
+    observed_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_vehicle_observation_route ON vehicle_observation
+    (agency_id, route_id, observed_at);
+
+CREATE TABLE IF NOT EXISTS departure_observation (
+    agency_id       TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    direction_id    INT,
+    trip_id         TEXT NOT NULL,
+    stop_id         TEXT NOT NULL,
+    arrival_time    TIMESTAMP,
+    departure_time  TIMESTAMP,
+    observed_at     TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_departure_observation_route ON departure_observation
+    (agency_id, route_id, observed_at);
+CREATE INDEX IF NOT EXISTS idx_departure_observation_trip ON departure_observation
+    (agency_id, trip_id, stop_id);
+
+CREATE TABLE IF NOT EXISTS partner_payload (
+    key         TEXT NOT NULL,
+    fetched_at  TIMESTAMP NOT NULL,
+    body        BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_partner_payload_key ON partner_payload
+    (key, fetched_at);
+`
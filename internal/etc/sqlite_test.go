@@ -0,0 +1,47 @@
+package etc
+
+import (
+	"testing"
+)
+
+func TestSQLiteQuery(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected string
+	}{
+		{
+			q:        `SELECT * FROM stop WHERE agency_id = $1 AND stop_id = $2`,
+			expected: `SELECT * FROM stop WHERE agency_id = ?1 AND stop_id = ?2`,
+		},
+		{
+			q:        `SELECT $1::text, x::int FROM t`,
+			expected: `SELECT ?1, x FROM t`,
+		},
+		{
+			q:        `WHERE agency_id || '|' || stop_id = ANY($1) AND route_id = ANY($2::text[])`,
+			expected: `WHERE pg_any(?1, agency_id || '|' || stop_id) AND pg_any(?2, route_id)`,
+		},
+		{
+			// Literals aren't changed
+			q:        `SELECT '$1', 'a::text', 'x = ANY(y)', 'it''s $2' FROM t WHERE id = $3`,
+			expected: `SELECT '$1', 'a::text', 'x = ANY(y)', 'it''s $2' FROM t WHERE id = ?3`,
+		},
+		{
+			// Nor are literals that look like the ones we replace them with
+			q:        `SELECT '1', '0', $1`,
+			expected: `SELECT '1', '0', ?1`,
+		},
+		{
+			// Comments are removed, even with quotes
+			q:        "SELECT $1 -- the agency's ID, e.g. '$2'\nFROM t",
+			expected: "SELECT ?1 \nFROM t",
+		},
+	}
+
+	for _, test := range tests {
+		actual := sqliteQuery(test.q)
+		if actual != test.expected {
+			t.Errorf("expected\n%v\nbut got\n%v", test.expected, actual)
+		}
+	}
+}
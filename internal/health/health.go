@@ -0,0 +1,239 @@
+// Package health reports whether a daemon is working. /healthz succeeds
+// as long as the process can answer, and /readyz runs every check that
+// was added, like whether the database, the cache and our data are ok.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/brnstz/bus/internal/cache"
+)
+
+var (
+	// ErrStopping is returned by the Check from Running after we're
+	// asked to stop
+	ErrStopping = errors.New("stopping")
+
+	// ErrTimeout is returned for a check that doesn't finish in time
+	ErrTimeout = errors.New("check timed out")
+
+	// checkTimeout is how long we wait for each check
+	checkTimeout = time.Duration(5) * time.Second
+
+	// cacheKey is the key we get to check the cache. It's never set.
+	cacheKey = "health"
+
+	checksLock sync.Mutex
+	names      []string
+	checks     = map[string]Check{}
+)
+
+// Check returns an error if something isn't working
+type Check func() error
+
+// Add adds c to the checks of /readyz. A check with the same name is
+// replaced.
+func Add(name string, c Check) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	_, exists := checks[name]
+	if !exists {
+		names = append(names, name)
+	}
+	checks[name] = c
+}
+
+// Remove removes the check named name from /readyz, if there is one
+func Remove(name string) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	_, exists := checks[name]
+	if !exists {
+		return
+	}
+	delete(checks, name)
+
+	for i, n := range names {
+		if n == name {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Running returns a Check that fails once ctx is done, so that we're not
+// ready while we're stopping
+func Running(ctx context.Context) Check {
+	return func() error {
+		if ctx.Err() != nil {
+			return ErrStopping
+		}
+		return nil
+	}
+}
+
+// DB returns a Check that pings db
+func DB(db *sqlx.DB) Check {
+	return func() error {
+		return db.Ping()
+	}
+}
+
+// Cache returns a Check that gets a value from c. It's ok if there isn't
+// one.
+func Cache(c cache.Cache) Check {
+	return func() error {
+		_, err := c.Get(cacheKey)
+		if err == cache.ErrMiss {
+			return nil
+		}
+		return err
+	}
+}
+
+// Beat is the last time something succeeded, like a load or a request to
+// a partner
+type Beat struct {
+	// last is the UnixNano of the last Mark
+	last int64
+}
+
+// Mark records that something succeeded now
+func (b *Beat) Mark() {
+	atomic.StoreInt64(&b.last, time.Now().UnixNano())
+}
+
+// Last returns the time of the last Mark
+func (b *Beat) Last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&b.last))
+}
+
+// Check returns a Check that fails if b hasn't been marked within maxAge
+func (b *Beat) Check(maxAge time.Duration) Check {
+	return func() error {
+		last := b.Last()
+		if time.Now().Sub(last) > maxAge {
+			return fmt.Errorf("last success was at %v, more than %v ago", last, maxAge)
+		}
+		return nil
+	}
+}
+
+// status is the response of /healthz and /readyz
+type status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// run runs every check at once and returns the result of each, along
+// with whether they all succeeded
+func run() (results map[string]string, ok bool) {
+	checksLock.Lock()
+	current := map[string]Check{}
+	for _, name := range names {
+		current[name] = checks[name]
+	}
+	checksLock.Unlock()
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	// Buffered so that a check that times out can still finish
+	ch := make(chan result, len(current))
+	for name, c := range current {
+		go func(name string, c Check) {
+			ch <- result{name, c()}
+		}(name, c)
+	}
+
+	results = map[string]string{}
+	ok = true
+
+	timeout := time.After(checkTimeout)
+	for len(results) < len(current) {
+		var r result
+
+		select {
+		case r = <-ch:
+		case <-timeout:
+			for name := range current {
+				_, exists := results[name]
+				if !exists {
+					results[name] = ErrTimeout.Error()
+				}
+			}
+			return results, false
+		}
+
+		if r.err != nil {
+			log.Println("health check failed", r.name, r.err)
+			results[r.name] = r.err.Error()
+			ok = false
+		} else {
+			results[r.name] = "ok"
+		}
+	}
+
+	return
+}
+
+func writeStatus(w http.ResponseWriter, code int, s status) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Println("can't marshal health status", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// GetHealthz responds that we're alive
+func GetHealthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, status{Status: "ok"})
+}
+
+// GetReadyz runs every check and responds with 200 if they all succeed or
+// 503 if any of them fail
+func GetReadyz(w http.ResponseWriter, r *http.Request) {
+	results, ok := run()
+	if !ok {
+		writeStatus(w, http.StatusServiceUnavailable, status{Status: "failing", Checks: results})
+		return
+	}
+
+	writeStatus(w, http.StatusOK, status{Status: "ok", Checks: results})
+}
+
+// Handle adds /healthz and /readyz to mux
+func Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", GetHealthz)
+	mux.HandleFunc("/readyz", GetReadyz)
+}
+
+// Serve listens on addr for /healthz and /readyz. It isn't stopped with
+// the rest of the process, so that /readyz can report that we're
+// stopping until we exit.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	Handle(mux)
+
+	return http.ListenAndServe(addr, mux)
+}
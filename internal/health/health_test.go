@@ -0,0 +1,32 @@
+package health
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	errFailing := errors.New("failing")
+
+	Add("ok", func() error { return nil })
+	Add("failing", func() error { return errFailing })
+	t.Cleanup(func() {
+		Remove("ok")
+		Remove("failing")
+	})
+
+	results, ok := run()
+	if ok || results["ok"] != "ok" || results["failing"] != errFailing.Error() {
+		t.Fatalf("unexpected results %v %v", results, ok)
+	}
+
+	Remove("failing")
+
+	// Removing a check that isn't there does nothing
+	Remove("missing")
+
+	results, ok = run()
+	if !ok || len(results) != 1 || results["ok"] != "ok" {
+		t.Fatalf("unexpected results after removing a check %v %v", results, ok)
+	}
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+)
 
 const (
 	// midnightSecs is what a depature_sec value of midnight looks like. We
@@ -21,6 +25,18 @@ type Departure struct {
 	// CompassDir is the direction to the next stop
 	CompassDir float64 `json:"compass_dir" db:"-" upsert:"omit"`
 
+	// StopsFromCall and DistanceFromCall are how many stops and meters
+	// the vehicle is from the stop, and PresentableDistance describes
+	// that for riders, e.g., "approaching" or "1 stop away". They are
+	// only set for live departures from partners that provide them.
+	StopsFromCall       null.Int    `json:"stops_from_call" db:"-" upsert:"omit"`
+	DistanceFromCall    null.Float  `json:"distance_from_call" db:"-" upsert:"omit"`
+	PresentableDistance null.String `json:"presentable_distance" db:"-" upsert:"omit"`
+
+	// Occupancy is how crowded the vehicle of a live departure is, in
+	// the same form as Vehicle.Occupancy
+	Occupancy null.String `json:"occupancy" db:"-" upsert:"omit"`
+
 	baseTime time.Time `json:"-" db:"-"`
 }
 
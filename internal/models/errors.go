@@ -15,4 +15,8 @@ var (
 	// ErrNotFound is returned when something can't be found in a
 	// Get call
 	ErrNotFound = errors.New("not found")
+
+	// ErrUnsupported is returned by features that our SQLite database
+	// doesn't support
+	ErrUnsupported = errors.New("not supported by this database")
 )
@@ -0,0 +1,342 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+var (
+	errBadPolygon = errors.New("polygon must be a GeoJSON or WKT Polygon or MultiPolygon")
+)
+
+// HereArea is the area that a HereQuery searches. If Polygon is set, it
+// is used. Otherwise if Radius is set, we search that many meters around
+// the midpoint of the query. Otherwise we search the box between the
+// southwest and northeast points. StopIDs and RouteIDs further limit
+// any of these areas, or are the whole area if there is no box.
+type HereArea struct {
+	SWLat float64
+	SWLon float64
+	NELat float64
+	NELon float64
+
+	// Radius is in meters
+	Radius float64
+
+	// Polygon is WKT with points in the usual (lon lat) order, such
+	// as the result of ParsePolygon
+	Polygon string
+
+	// StopIDs are like "agency_id|stop_id" and RouteIDs are like
+	// "agency_id|route_id"
+	StopIDs  []string
+	RouteIDs []string
+}
+
+// hasBox returns true if any of the box points are set
+func (a HereArea) hasBox() bool {
+	return a.SWLat != 0 || a.SWLon != 0 || a.NELat != 0 || a.NELon != 0
+}
+
+// geoJSON is the subset of a GeoJSON object we accept as a polygon
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+}
+
+// Polygon is a search area parsed by ParsePolygon
+type Polygon struct {
+	// WKT has points in the usual (lon lat) order
+	WKT string
+
+	// Vertices is the number of points in every ring
+	Vertices int
+
+	// Area is the approximate area in square meters of the outer rings,
+	// ignoring any holes
+	Area float64
+
+	// SWLat, SWLon, NELat and NELon are the box around the polygon
+	SWLat float64
+	SWLon float64
+	NELat float64
+	NELon float64
+
+	// polys are the rings of each polygon, with points as (lon lat)
+	polys [][][][]float64
+}
+
+// ParsePolygon reads a Polygon or MultiPolygon in either GeoJSON or WKT
+func ParsePolygon(val string) (p Polygon, err error) {
+	var polys [][][][]float64
+
+	val = strings.TrimSpace(val)
+
+	if strings.HasPrefix(val, "{") {
+		polys, err = parseGeoJSON(val)
+	} else {
+		polys, err = parseWKT(val)
+	}
+	if err != nil {
+		return
+	}
+
+	if len(polys) < 1 {
+		err = errBadPolygon
+		return
+	}
+
+	var parts []string
+	first := true
+	for _, rings := range polys {
+		var part string
+		part, err = wktPolygon(rings)
+		if err != nil {
+			return
+		}
+		parts = append(parts, part)
+
+		for _, ring := range rings {
+			p.Vertices += len(ring)
+		}
+		p.Area += ringArea(rings[0])
+
+		// Holes are inside the outer ring, so only it can extend the
+		// box
+		for _, point := range rings[0] {
+			lon, lat := point[0], point[1]
+			if first {
+				p.SWLat, p.SWLon, p.NELat, p.NELon = lat, lon, lat, lon
+				first = false
+			}
+			p.SWLat = math.Min(p.SWLat, lat)
+			p.SWLon = math.Min(p.SWLon, lon)
+			p.NELat = math.Max(p.NELat, lat)
+			p.NELon = math.Max(p.NELon, lon)
+		}
+	}
+
+	p.polys = polys
+
+	if len(parts) == 1 {
+		p.WKT = "POLYGON" + parts[0]
+	} else {
+		p.WKT = "MULTIPOLYGON(" + strings.Join(parts, ",") + ")"
+	}
+
+	return
+}
+
+// contains returns true if lat, lon is inside one of the polygons of p
+// and not in one of its holes
+func (p Polygon) contains(lat, lon float64) bool {
+	for _, rings := range p.polys {
+		in := false
+
+		// Each ring the point is inside of flips whether it's inside the
+		// polygon, so a point inside a hole is outside
+		for _, ring := range rings {
+			for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+				loni, lati := ring[i][0], ring[i][1]
+				lonj, latj := ring[j][0], ring[j][1]
+
+				if (lati > lat) != (latj > lat) && lon < (lonj-loni)*(lat-lati)/(latj-lati)+loni {
+					in = !in
+				}
+			}
+		}
+
+		if in {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseGeoJSON returns the polygons of a GeoJSON Polygon or MultiPolygon
+func parseGeoJSON(val string) (polys [][][][]float64, err error) {
+	g := &geoJSON{}
+	err = json.Unmarshal([]byte(val), g)
+	if err != nil {
+		return
+	}
+
+	// Allow a Feature that wraps our geometry
+	if g.Type == "Feature" && g.Geometry != nil {
+		g = g.Geometry
+	}
+
+	switch g.Type {
+	case "Polygon":
+		var rings [][][]float64
+
+		err = json.Unmarshal(g.Coordinates, &rings)
+		if err != nil {
+			return
+		}
+
+		polys = [][][][]float64{rings}
+
+	case "MultiPolygon":
+		err = json.Unmarshal(g.Coordinates, &polys)
+
+	default:
+		err = errBadPolygon
+	}
+
+	return
+}
+
+// parseWKT returns the polygons of a WKT POLYGON or MULTIPOLYGON
+func parseWKT(val string) (polys [][][][]float64, err error) {
+	var body string
+
+	// The depth of the parentheses around each polygon and each ring
+	var polyDepth, ringDepth int
+
+	upper := strings.ToUpper(val)
+	switch {
+	case strings.HasPrefix(upper, "MULTIPOLYGON"):
+		body = val[len("MULTIPOLYGON"):]
+		polyDepth, ringDepth = 2, 3
+
+	case strings.HasPrefix(upper, "POLYGON"):
+		body = val[len("POLYGON"):]
+		polyDepth, ringDepth = 1, 2
+
+	default:
+		return nil, errBadPolygon
+	}
+
+	var rings [][][]float64
+	depth := 0
+	start := 0
+
+	for i, c := range body {
+		switch c {
+		case '(':
+			depth++
+			if depth > ringDepth {
+				return nil, errBadPolygon
+			}
+			if depth == ringDepth {
+				start = i + 1
+			}
+
+		case ')':
+			if depth == ringDepth {
+				var ring [][]float64
+				ring, err = parseWKTRing(body[start:i])
+				if err != nil {
+					return
+				}
+				rings = append(rings, ring)
+			}
+			if depth == polyDepth {
+				polys = append(polys, rings)
+				rings = nil
+			}
+
+			depth--
+			if depth < 0 {
+				return nil, errBadPolygon
+			}
+
+		case ' ', ',', '\t', '\n', '\r':
+
+		default:
+			// Anything else must be inside a ring
+			if depth != ringDepth {
+				return nil, errBadPolygon
+			}
+		}
+	}
+
+	if depth != 0 {
+		return nil, errBadPolygon
+	}
+
+	return
+}
+
+// parseWKTRing parses points like "lon lat, lon lat"
+func parseWKTRing(val string) (ring [][]float64, err error) {
+	for _, point := range strings.Split(val, ",") {
+		fields := strings.Fields(point)
+		if len(fields) != 2 {
+			return nil, errBadPolygon
+		}
+
+		p := make([]float64, 2)
+		for i, f := range fields {
+			p[i], err = strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, errBadPolygon
+			}
+		}
+
+		ring = append(ring, p)
+	}
+
+	return
+}
+
+// ringArea returns the approximate area of ring in square meters, which
+// is small enough that we can treat the earth as flat
+func ringArea(ring [][]float64) float64 {
+	var lat, sum float64
+
+	for _, p := range ring {
+		lat += p[1]
+	}
+	lat /= float64(len(ring))
+
+	// Meters per degree of each coordinate
+	my := etc.Distance(lat, 0, lat+1, 0)
+	mx := etc.Distance(lat, 0, lat, 1)
+
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		sum += ring[i][0]*mx*ring[j][1]*my - ring[j][0]*mx*ring[i][1]*my
+	}
+
+	return math.Abs(sum) / 2
+}
+
+// wktPolygon returns the rings of a polygon in WKT, like
+// "((lon lat, lon lat, ...))"
+func wktPolygon(rings [][][]float64) (string, error) {
+	var wktRings []string
+
+	for _, ring := range rings {
+		var points []string
+
+		// A ring needs to be closed, so it has at least 4 points
+		if len(ring) < 4 {
+			return "", errBadPolygon
+		}
+
+		for _, p := range ring {
+			if len(p) < 2 {
+				return "", errBadPolygon
+			}
+			points = append(points, fmt.Sprintf("%f %f", p[0], p[1]))
+		}
+
+		wktRings = append(wktRings, "("+strings.Join(points, ", ")+")")
+	}
+
+	if len(wktRings) < 1 {
+		return "", errBadPolygon
+	}
+
+	return "(" + strings.Join(wktRings, ",") + ")", nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParsePolygon(t *testing.T) {
+	// A box of about 1km x 1km in Manhattan, in each format we accept
+	square := "POLYGON((-74.000000 40.700000, -73.988183 40.700000, -73.988183 40.709000, -74.000000 40.709000, -74.000000 40.700000))"
+
+	tests := []struct {
+		val      string
+		wkt      string
+		vertices int
+		area     float64
+		err      error
+	}{
+		{
+			val:      square,
+			wkt:      square,
+			vertices: 5,
+			area:     1000000,
+		},
+		{
+			val:      "polygon ((-74 40.7, -73.988183 40.7, -73.988183 40.709, -74 40.709, -74 40.7))",
+			wkt:      square,
+			vertices: 5,
+			area:     1000000,
+		},
+		{
+			val:      `{"type": "Polygon", "coordinates": [[[-74, 40.7], [-73.988183, 40.7], [-73.988183, 40.709], [-74, 40.709], [-74, 40.7]]]}`,
+			wkt:      square,
+			vertices: 5,
+			area:     1000000,
+		},
+		{
+			val:      `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[-74, 40.7], [-73.988183, 40.7], [-73.988183, 40.709], [-74, 40.709], [-74, 40.7]]]}}`,
+			wkt:      square,
+			vertices: 5,
+			area:     1000000,
+		},
+		{
+			// Holes count toward vertices but not area
+			val:      "POLYGON((-74 40.7, -73.988183 40.7, -73.988183 40.709, -74 40.709, -74 40.7), (-73.995 40.704, -73.994 40.704, -73.994 40.705, -73.995 40.704))",
+			vertices: 9,
+			area:     1000000,
+		},
+		{
+			val:      "MULTIPOLYGON(((-74 40.7, -73.988183 40.7, -73.988183 40.709, -74 40.709, -74 40.7)), ((-73 40.7, -72.988183 40.7, -72.988183 40.709, -73 40.709, -73 40.7)))",
+			vertices: 10,
+			area:     2000000,
+		},
+		{
+			val: `{"type": "MultiPolygon", "coordinates": []}`,
+			err: errBadPolygon,
+		},
+		{
+			val: "POLYGON((-74 40.7, -73.9 40.7, -74 40.7))",
+			err: errBadPolygon,
+		},
+		{
+			val: "POLYGON((-74 40.7, -73.9 40.7, -73.9 40.8, -74 40.7)",
+			err: errBadPolygon,
+		},
+		{
+			val: "POLYGON((-74 40.7, -73.9 40.7, -73.9 40.8, -74 40.7)); DROP TABLE stop",
+			err: errBadPolygon,
+		},
+		{
+			val: "POINT(-74 40.7)",
+			err: errBadPolygon,
+		},
+		{
+			val: `{"type": "Point", "coordinates": [-74, 40.7]}`,
+			err: errBadPolygon,
+		},
+	}
+
+	for _, test := range tests {
+		p, err := ParsePolygon(test.val)
+		if err != test.err {
+			t.Errorf("%v: expected error %v but got %v", test.val, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if len(test.wkt) > 0 && p.WKT != test.wkt {
+			t.Errorf("%v: expected WKT %v but got %v", test.val, test.wkt, p.WKT)
+		}
+
+		if p.Vertices != test.vertices {
+			t.Errorf("%v: expected %v vertices but got %v", test.val, test.vertices, p.Vertices)
+		}
+
+		// Within 1%
+		if math.Abs(p.Area-test.area) > test.area/100 {
+			t.Errorf("%v: expected area %v but got %v", test.val, test.area, p.Area)
+		}
+	}
+}
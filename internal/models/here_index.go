@@ -0,0 +1,518 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+const (
+	// hereIndexQuery reads every row of here_trip for the here index
+	hereIndexQuery = `
+		SELECT
+			agency_id,
+			route_id,
+			stop_id,
+			service_id,
+			trip_ids,
+			departure_secs,
+			next_stop_lats,
+			next_stop_lons,
+
+			stop_name,
+			direction_id,
+			stop_headsign,
+			ST_X(location) AS lat,
+			ST_Y(location) AS lon,
+
+			route_type,
+			route_color,
+			route_text_color,
+			route_short_name,
+			route_long_name,
+
+			trip_headsign
+
+		FROM here_trip
+	`
+
+	// hereServiceQuery and hereRouteServiceQuery read every service day
+	// for the here index. Route service days are in the order that
+	// combineRouteServiceIDs expects.
+	hereServiceQuery = `
+		SELECT agency_id, service_id, day, start_date, end_date
+		FROM   service
+	`
+	hereRouteServiceQuery = `
+		SELECT agency_id, route_id, service_id, day, start_date, end_date
+		FROM   service_route_day
+		ORDER BY agency_id, route_id, start_date DESC
+	`
+
+	// hereServiceExceptionQuery and hereRouteServiceExceptionQuery read
+	// every service exception for the here index
+	hereServiceExceptionQuery = `
+		SELECT agency_id, service_id, exception_date, exception_type
+		FROM   service_exception
+	`
+	hereRouteServiceExceptionQuery = `
+		SELECT agency_id, route_id, service_id, exception_date, exception_type
+		FROM   service_route_exception
+	`
+
+	// hereLoadedAtQuery gets the last time that busloader rebuilt the
+	// here tables of any agency
+	hereLoadedAtQuery = `
+		SELECT loaded_at
+		FROM   here_load
+		ORDER BY loaded_at DESC
+		LIMIT 1
+	`
+
+	// hereDateFormat is how the here index compares dates
+	hereDateFormat = "2006-01-02"
+
+	// hereCellSize is the size in degrees of each cell of the here
+	// index's grid, roughly 1 km
+	hereCellSize = 0.01
+)
+
+// hereIndex is the value of the current HereIndex
+var hereIndex atomic.Value
+
+// hereCell is the position of a cell in the here index's grid
+type hereCell struct {
+	lat int32
+	lon int32
+}
+
+func newHereCell(lat, lon float64) hereCell {
+	return hereCell{
+		lat: int32(math.Floor(lat / hereCellSize)),
+		lon: int32(math.Floor(lon / hereCellSize)),
+	}
+}
+
+// hereService is a row of service or service_route_day, which has a
+// route_id
+type hereService struct {
+	AgencyID  string    `db:"agency_id"`
+	RouteID   string    `db:"route_id"`
+	ServiceID string    `db:"service_id"`
+	Day       string    `db:"day"`
+	StartDate time.Time `db:"start_date"`
+	EndDate   time.Time `db:"end_date"`
+
+	// start and end are the dates formatted with hereDateFormat
+	start string
+	end   string
+}
+
+// hereServiceException is a row of service_exception or
+// service_route_exception, which has a route_id
+type hereServiceException struct {
+	AgencyID      string    `db:"agency_id"`
+	RouteID       string    `db:"route_id"`
+	ServiceID     string    `db:"service_id"`
+	ExceptionDate time.Time `db:"exception_date"`
+	ExceptionType int       `db:"exception_type"`
+}
+
+// HereIndex is an in-memory copy of here_trip and the service days that
+// answers here queries without the database. Rows are found by the cell
+// of the grid that they're in, and their departures are parsed and
+// sorted once when the index is loaded. A HereIndex isn't changed after
+// it's loaded, so it can be used by any number of requests.
+type HereIndex struct {
+	// rows are the rows of here_trip without their comma-joined values
+	rows []*HereResult
+
+	// cells, stops and routes are the positions in rows of each cell,
+	// agency_id|stop_id and agency_id|route_id
+	cells  map[hereCell][]int32
+	stops  map[string][]int32
+	routes map[string][]int32
+
+	// services and routeServices are the rows of service and
+	// service_route_day by day of the week
+	services      map[string][]*hereService
+	routeServices map[string][]*hereService
+
+	// exceptions and routeExceptions are the rows of service_exception
+	// and service_route_exception by date
+	exceptions      map[string][]*hereServiceException
+	routeExceptions map[string][]*hereServiceException
+}
+
+// LoadHereIndex reads here_trip and the service days from db and
+// replaces the current HereIndex used by NewHereQuery and GetHereResults
+func LoadHereIndex(db sqlx.Queryer) error {
+	t1 := time.Now()
+
+	index := &HereIndex{
+		cells:  map[hereCell][]int32{},
+		stops:  map[string][]int32{},
+		routes: map[string][]int32{},
+	}
+
+	err := index.loadServices(db)
+	if err != nil {
+		return err
+	}
+
+	// Most trips stop many times, so we only keep one copy of each ID
+	tripIDs := map[string]string{}
+
+	rows, err := db.Queryx(hereIndexQuery)
+	if err != nil {
+		log.Println("can't get here index", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		here := &HereResult{}
+
+		err = rows.StructScan(here)
+		if err != nil {
+			log.Println("can't scan here index row", err)
+			return err
+		}
+
+		here.trips, err = parseHereTrips(here, tripIDs)
+		if err != nil {
+			log.Println("can't parse here index row", err)
+			continue
+		}
+
+		here.TripIDs = ""
+		here.DepartureSecs = ""
+		here.NextStopLats = ""
+		here.NextStopLons = ""
+
+		i := int32(len(index.rows))
+		index.rows = append(index.rows, here)
+
+		cell := newHereCell(here.Lat, here.Lon)
+		index.cells[cell] = append(index.cells[cell], i)
+
+		stopKey := here.AgencyID + "|" + here.StopID
+		index.stops[stopKey] = append(index.stops[stopKey], i)
+
+		routeKey := here.AgencyID + "|" + here.RouteID
+		index.routes[routeKey] = append(index.routes[routeKey], i)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Println("can't get here index", err)
+		return err
+	}
+
+	hereIndex.Store(index)
+
+	log.Printf("loaded here index with %v rows in %v", len(index.rows), time.Now().Sub(t1))
+
+	return nil
+}
+
+// loadServices reads every service day and exception from db
+func (index *HereIndex) loadServices(db sqlx.Queryer) (err error) {
+	var services, routeServices []*hereService
+	var exceptions, routeExceptions []*hereServiceException
+
+	err = sqlx.Select(db, &services, hereServiceQuery)
+	if err != nil {
+		log.Println("can't get here index services", err)
+		return
+	}
+
+	err = sqlx.Select(db, &routeServices, hereRouteServiceQuery)
+	if err != nil {
+		log.Println("can't get here index route services", err)
+		return
+	}
+
+	err = sqlx.Select(db, &exceptions, hereServiceExceptionQuery)
+	if err != nil {
+		log.Println("can't get here index service exceptions", err)
+		return
+	}
+
+	err = sqlx.Select(db, &routeExceptions, hereRouteServiceExceptionQuery)
+	if err != nil {
+		log.Println("can't get here index route service exceptions", err)
+		return
+	}
+
+	index.services = servicesByDay(services)
+	index.routeServices = servicesByDay(routeServices)
+	index.exceptions = exceptionsByDate(exceptions)
+	index.routeExceptions = exceptionsByDate(routeExceptions)
+
+	return
+}
+
+// servicesByDay returns services by their day of the week, keeping their
+// order
+func servicesByDay(services []*hereService) map[string][]*hereService {
+	m := map[string][]*hereService{}
+
+	for _, s := range services {
+		s.start = s.StartDate.Format(hereDateFormat)
+		s.end = s.EndDate.Format(hereDateFormat)
+		m[s.Day] = append(m[s.Day], s)
+	}
+
+	return m
+}
+
+// exceptionsByDate returns exceptions by their date
+func exceptionsByDate(exceptions []*hereServiceException) map[string][]*hereServiceException {
+	m := map[string][]*hereServiceException{}
+
+	for _, e := range exceptions {
+		date := e.ExceptionDate.Format(hereDateFormat)
+		m[date] = append(m[date], e)
+	}
+
+	return m
+}
+
+// GetHereLoadedAt returns the last time that busloader rebuilt the here
+// tables in db, or the zero time if it never has
+func GetHereLoadedAt(db sqlx.Queryer) (t time.Time, err error) {
+	err = sqlx.Get(db, &t, hereLoadedAtQuery)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		log.Println("can't get here loaded at", err)
+		return
+	}
+
+	return
+}
+
+// currentHereIndex returns the HereIndex loaded by LoadHereIndex or nil
+// if there isn't one
+func currentHereIndex() *HereIndex {
+	index, _ := hereIndex.Load().(*HereIndex)
+	return index
+}
+
+// serviceIDs returns the same service IDs and relevant route service IDs
+// as GetAgencyServiceIDs and getRouteServiceIDs for these agencies on
+// day, which is named dayName
+func (index *HereIndex) serviceIDs(agencyIDs []string, dayName string, day time.Time) (serviceIDs []string, relevant map[string]bool) {
+	date := day.Format(hereDateFormat)
+
+	agencies := map[string]bool{}
+	for _, id := range agencyIDs {
+		agencies[id] = true
+	}
+
+	var normalIDs, addedIDs, removedIDs []string
+
+	for _, s := range index.services[dayName] {
+		if agencies[s.AgencyID] && s.start <= date && s.end >= date {
+			normalIDs = append(normalIDs, s.ServiceID)
+		}
+	}
+
+	for _, e := range index.exceptions[date] {
+		if !agencies[e.AgencyID] {
+			continue
+		}
+
+		switch e.ExceptionType {
+		case ServiceAdded:
+			addedIDs = append(addedIDs, e.ServiceID)
+		case ServiceRemoved:
+			removedIDs = append(removedIDs, e.ServiceID)
+		}
+	}
+
+	serviceIDs = combineServiceIDs(normalIDs, addedIDs, removedIDs)
+
+	var rawRouteIDs, addedRouteIDs, removedRouteIDs []*routeService
+
+	for _, s := range index.routeServices[dayName] {
+		if agencies[s.AgencyID] && s.start <= date && s.end >= date {
+			rawRouteIDs = append(rawRouteIDs, &routeService{
+				AgencyID: s.AgencyID, RouteID: s.RouteID, ServiceID: s.ServiceID,
+			})
+		}
+	}
+
+	for _, e := range index.routeExceptions[date] {
+		if !agencies[e.AgencyID] {
+			continue
+		}
+
+		rs := &routeService{
+			AgencyID: e.AgencyID, RouteID: e.RouteID, ServiceID: e.ServiceID,
+		}
+
+		switch e.ExceptionType {
+		case ServiceAdded:
+			addedRouteIDs = append(addedRouteIDs, rs)
+		case ServiceRemoved:
+			removedRouteIDs = append(removedRouteIDs, rs)
+		}
+	}
+
+	relevant = combineRouteServiceIDs(rawRouteIDs, addedRouteIDs, removedRouteIDs)
+
+	return
+}
+
+// find returns the rows that match hq, in the same order as the database
+// would
+func (index *HereIndex) find(hq *HereQuery) (results []*HereResult) {
+	filterIDs := len(hq.StopIDs) > 0 || len(hq.RouteIDs) > 0
+	onlyIDs := filterIDs && len(hq.Polygon) < 1 && hq.Radius <= 0 && !hq.hasBox()
+
+	// The rows that may match, which are then filtered below. Every area
+	// but IDs has a box around it.
+	var candidates [][]int32
+
+	if onlyIDs {
+		for _, id := range hq.StopIDs {
+			candidates = append(candidates, index.stops[id])
+		}
+		for _, id := range hq.RouteIDs {
+			candidates = append(candidates, index.routes[id])
+		}
+
+	} else {
+		candidates = index.inBox(hq.MinLat, hq.MinLon, hq.MaxLat, hq.MaxLon)
+	}
+
+	serviceIDs := map[string]bool{}
+	for _, id := range hq.ServiceIDs {
+		serviceIDs[id] = true
+	}
+
+	routeTypes := map[int]bool{}
+	for _, t := range hq.RouteTypes {
+		routeTypes[int(t)] = true
+	}
+
+	ids := map[string]bool{}
+	for _, id := range hq.StopIDs {
+		ids["stop|"+id] = true
+	}
+	for _, id := range hq.RouteIDs {
+		ids["route|"+id] = true
+	}
+
+	// A row can be a candidate more than once when searching by IDs
+	seen := map[int32]bool{}
+
+	for _, positions := range candidates {
+		for _, i := range positions {
+			row := index.rows[i]
+
+			if seen[i] || !serviceIDs[row.ServiceID] {
+				continue
+			}
+			seen[i] = true
+
+			if len(routeTypes) > 0 && !routeTypes[row.RouteType] {
+				continue
+			}
+
+			if filterIDs &&
+				!ids["stop|"+row.AgencyID+"|"+row.StopID] &&
+				!ids["route|"+row.AgencyID+"|"+row.RouteID] {
+				continue
+			}
+
+			// The same order of areas as NewHereQuery
+			switch {
+			case len(hq.Polygon) > 0:
+				if !hq.polygon.contains(row.Lat, row.Lon) {
+					continue
+				}
+
+			case hq.Radius > 0:
+				if etc.Distance(hq.MidLat, hq.MidLon, row.Lat, row.Lon) > hq.Radius {
+					continue
+				}
+
+			case onlyIDs:
+
+			default:
+				if row.Lat <= hq.SWLat || row.Lat >= hq.NELat ||
+					row.Lon <= hq.SWLon || row.Lon >= hq.NELon {
+					continue
+				}
+			}
+
+			// Copy the row so that each request has its own
+			here := *row
+			here.HQ = hq
+			here.Dist = math.Hypot(row.Lat-hq.MidLat, row.Lon-hq.MidLon)
+
+			results = append(results, &here)
+		}
+	}
+
+	sort.Sort(hereResultsByDist(results))
+
+	if len(results) > hq.Limit {
+		results = results[:hq.Limit]
+	}
+
+	return
+}
+
+// inBox returns the positions of the rows in every cell that overlaps
+// the box
+func (index *HereIndex) inBox(swLat, swLon, neLat, neLon float64) (positions [][]int32) {
+	sw := newHereCell(swLat, swLon)
+	ne := newHereCell(neLat, neLon)
+
+	// Don't look through more cells than there are
+	if int64(ne.lat-sw.lat+1)*int64(ne.lon-sw.lon+1) > int64(len(index.cells)) {
+		for _, p := range index.cells {
+			positions = append(positions, p)
+		}
+
+		return
+	}
+
+	for lat := sw.lat; lat <= ne.lat; lat++ {
+		for lon := sw.lon; lon <= ne.lon; lon++ {
+			p, exists := index.cells[hereCell{lat: lat, lon: lon}]
+			if exists {
+				positions = append(positions, p)
+			}
+		}
+	}
+
+	return
+}
+
+// hereResultsByDist sorts here results by their distance
+type hereResultsByDist []*HereResult
+
+func (r hereResultsByDist) Len() int {
+	return len(r)
+}
+
+func (r hereResultsByDist) Less(i, j int) bool {
+	return r[i].Dist < r[j].Dist
+}
+
+func (r hereResultsByDist) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+)
+
+const hereTestAgency = "MTA NYCT"
+
+// newHereTestDB opens a new SQLite database with a few rows in the here
+// tables and the service days. On Monday 2016-06-13, the B62 and Q run
+// the WKD service, the B62 also runs the HOL service that's added that
+// day, and the G's GWKD service is removed that day.
+func newHereTestDB(t *testing.T) {
+	driver, path, db := conf.DB.Driver, conf.DB.Path, etc.DBConn
+	agencyIDs := conf.Partner.AgencyIDs
+	t.Cleanup(func() {
+		etc.DBConn.Close()
+		conf.DB.Driver, conf.DB.Path, etc.DBConn = driver, path, db
+		conf.Partner.AgencyIDs = agencyIDs
+		hereIndex.Store((*HereIndex)(nil))
+	})
+
+	conf.DB.Driver = "sqlite3"
+	conf.DB.Path = filepath.Join(t.TempDir(), "bus.db")
+	conf.Partner.AgencyIDs = []string{hereTestAgency}
+	etc.DBConn = etc.MustDB()
+
+	exec := func(q string, args ...interface{}) {
+		_, err := etc.DBConn.Exec(q, args...)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+	}
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2099, 12, 31, 0, 0, 0, 0, time.Local)
+	monday := time.Date(2016, 6, 13, 0, 0, 0, 0, time.Local)
+
+	seen := map[string]bool{}
+	for _, s := range []struct {
+		routeID   string
+		serviceID string
+		day       string
+	}{
+		{"B62", "WKD", "monday"},
+		{"Q", "WKD", "monday"},
+		{"G", "GWKD", "monday"},
+		{"B62", "SAT", "saturday"},
+	} {
+		if !seen[s.serviceID] {
+			exec(`INSERT INTO service (agency_id, service_id, day, start_date, end_date)
+				VALUES ($1, $2, $3, $4, $5)`,
+				hereTestAgency, s.serviceID, s.day, start, end,
+			)
+			seen[s.serviceID] = true
+		}
+		exec(`INSERT INTO service_route_day (agency_id, route_id, service_id,
+			day, start_date, end_date) VALUES ($1, $2, $3, $4, $5, $6)`,
+			hereTestAgency, s.routeID, s.serviceID, s.day, start, end,
+		)
+	}
+
+	for _, e := range []struct {
+		routeID       string
+		serviceID     string
+		exceptionType int
+	}{
+		{"B62", "HOL", ServiceAdded},
+		{"G", "GWKD", ServiceRemoved},
+	} {
+		exec(`INSERT INTO service_exception (agency_id, service_id,
+			exception_date, exception_type) VALUES ($1, $2, $3, $4)`,
+			hereTestAgency, e.serviceID, monday, e.exceptionType,
+		)
+		exec(`INSERT INTO service_route_exception (agency_id, route_id,
+			service_id, exception_date, exception_type) VALUES ($1, $2, $3, $4, $5)`,
+			hereTestAgency, e.routeID, e.serviceID, monday, e.exceptionType,
+		)
+	}
+
+	for _, h := range []struct {
+		routeID   string
+		routeType int
+		stopID    string
+		serviceID string
+		lat       float64
+		lon       float64
+	}{
+		{"B62", Bus, "S1", "WKD", 40.700, -73.990},
+		{"B62", Bus, "S1", "SAT", 40.700, -73.990},
+		{"B62", Bus, "S2", "WKD", 40.702, -73.990},
+		{"B62", Bus, "S3", "HOL", 40.7012, -73.9905},
+		{"G", Subway, "G1", "GWKD", 40.7025, -73.9895},
+		{"Q", Subway, "Q1", "WKD", 40.7008, -73.9885},
+		{"Q", Subway, "F1", "WKD", 40.800, -73.950},
+	} {
+		tripID := h.routeID + "-" + h.serviceID
+
+		exec(`INSERT INTO here_trip (agency_id, route_id, stop_id, service_id,
+			trip_ids, arrival_secs, departure_secs, stop_sequences,
+			next_stop_ids, next_stop_lats, next_stop_lons,
+			stop_name, direction_id, stop_headsign, location,
+			route_type, route_color, route_text_color,
+			route_short_name, route_long_name, trip_headsign)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8, $9, $10, $11, $12, $13,
+				ST_SETSRID(ST_MAKEPOINT($14, $15), 4326),
+				$16, $17, $18, $2, $19, $13)`,
+			hereTestAgency, h.routeID, h.stopID, h.serviceID,
+			tripID+"-0800,"+tripID+"-0820,"+tripID+"-1000",
+			"28800,30000,36000", "1,1,1", "X,X,X",
+			fmt.Sprintf("%v,%v,%v", h.lat+0.001, h.lat+0.001, h.lat+0.001),
+			fmt.Sprintf("%v,%v,%v", h.lon, h.lon, h.lon),
+			h.stopID+" St", 0, "North", h.lat, h.lon,
+			h.routeType, "6CBE45", "FFFFFF", "",
+		)
+	}
+
+	exec(`INSERT INTO here_trip_rtree
+		SELECT id, ST_X(location), ST_X(location), ST_Y(location), ST_Y(location)
+		FROM here_trip`,
+	)
+}
+
+// hereSummary returns each stop and its departures from GetHereResults in
+// a comparable form
+func hereSummary(t *testing.T, hq *HereQuery) (summary []string) {
+	stops, _, err := GetHereResults(etc.DBConn, hq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range stops {
+		for _, d := range s.Departures {
+			summary = append(summary, fmt.Sprintf("%v %v %v %v %v",
+				s.RouteID, s.StopID, d.TripID, d.Time.Format(time.RFC3339), s.Dist,
+			))
+		}
+	}
+
+	sort.Strings(summary)
+
+	return
+}
+
+// TestHereIndex checks that the here index returns the same service days,
+// stops and departures as the database
+func TestHereIndex(t *testing.T) {
+	newHereTestDB(t)
+
+	// Monday morning
+	now := time.Date(2016, 6, 13, 7, 55, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		area       HereArea
+		routeTypes []int
+	}{
+		{
+			name: "box",
+			area: HereArea{SWLat: 40.699, SWLon: -73.991, NELat: 40.703, NELon: -73.988},
+		},
+		{
+			name:       "box of subway stops",
+			area:       HereArea{SWLat: 40.699, SWLon: -73.991, NELat: 40.703, NELon: -73.988},
+			routeTypes: []int{Subway},
+		},
+		{
+			name: "radius",
+			area: HereArea{Radius: 200},
+		},
+		{
+			name: "polygon",
+			area: HereArea{
+				Polygon: "POLYGON((-73.991 40.7005, -73.988 40.7005, -73.988 40.703, -73.991 40.703, -73.991 40.7005))",
+			},
+		},
+		{
+			name: "stop IDs",
+			area: HereArea{StopIDs: []string{hereTestAgency + "|F1", hereTestAgency + "|S2"}},
+		},
+		{
+			name: "route IDs in a box",
+			area: HereArea{
+				SWLat: 40.699, SWLon: -73.991, NELat: 40.703, NELon: -73.988,
+				RouteIDs: []string{hereTestAgency + "|Q"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		// The database
+		hereIndex.Store((*HereIndex)(nil))
+
+		dbHQ, err := NewHereQuery(40.700, -73.990, test.area, test.routeTypes, now, time.Hour)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if dbHQ.index != nil {
+			t.Fatal(test.name, "expected the database to be used")
+		}
+		dbSummary := hereSummary(t, dbHQ)
+
+		// The index
+		err = LoadHereIndex(etc.DBConn)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		indexHQ, err := NewHereQuery(40.700, -73.990, test.area, test.routeTypes, now, time.Hour)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if indexHQ.index == nil {
+			t.Fatal(test.name, "expected the index to be used")
+		}
+		indexSummary := hereSummary(t, indexHQ)
+
+		if len(dbSummary) < 1 {
+			t.Errorf("%v: expected departures", test.name)
+		}
+
+		if !reflect.DeepEqual(dbSummary, indexSummary) {
+			t.Errorf("%v: database and index don't match\n%v\n%v", test.name, dbSummary, indexSummary)
+		}
+
+		if len(dbHQ.ServiceDays) != len(indexHQ.ServiceDays) {
+			t.Fatalf("%v: expected %v service days but got %v", test.name, len(dbHQ.ServiceDays), len(indexHQ.ServiceDays))
+		}
+		for i, dbSD := range dbHQ.ServiceDays {
+			indexSD := indexHQ.ServiceDays[i]
+			sort.Strings(dbSD.ServiceIDs)
+			sort.Strings(indexSD.ServiceIDs)
+
+			if !reflect.DeepEqual(dbSD, indexSD) {
+				t.Errorf("%v: service days don't match\n%+v\n%+v", test.name, dbSD, indexSD)
+			}
+		}
+	}
+}
+
+// TestHereIndexServiceIDs checks the services running on the Monday of
+// newHereTestDB
+func TestHereIndexServiceIDs(t *testing.T) {
+	newHereTestDB(t)
+
+	err := LoadHereIndex(etc.DBConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2016, 6, 13, 0, 0, 0, 0, time.Local)
+	serviceIDs, relevant := currentHereIndex().serviceIDs([]string{hereTestAgency}, "monday", monday)
+	sort.Strings(serviceIDs)
+
+	if !reflect.DeepEqual(serviceIDs, []string{"HOL", "WKD"}) {
+		t.Errorf("unexpected service IDs %v", serviceIDs)
+	}
+
+	expected := map[string]bool{
+		hereTestAgency + "|B62|WKD": true,
+		hereTestAgency + "|B62|HOL": true,
+		hereTestAgency + "|Q|WKD":   true,
+	}
+	if !reflect.DeepEqual(relevant, expected) {
+		t.Errorf("unexpected relevant IDs %v", relevant)
+	}
+
+	// No agencies
+	serviceIDs, relevant = currentHereIndex().serviceIDs(nil, "monday", monday)
+	if len(serviceIDs) > 0 || len(relevant) > 0 {
+		t.Errorf("unexpected service IDs %v %v", serviceIDs, relevant)
+	}
+}
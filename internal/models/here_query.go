@@ -3,16 +3,23 @@ package models
 import (
 	"fmt"
 	"log"
+	"math"
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
+
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
 )
 
 const (
-	hereQueryLimit         = 1000
-	departureLookaheadSecs = 60 * 60 * 3
+	hereQueryLimit = 1000
+
+	// maxServiceDaySecs is the latest departure_sec we expect relative to
+	// the start of its service day. Trips that run past midnight have
+	// times past 24:00:00, so we allow up to 48:00:00.
+	maxServiceDaySecs = midnightSecs * 2
 
 	hereQuery = `
 		SELECT
@@ -46,18 +53,64 @@ const (
 		FROM here_trip
 
 		WHERE
+			%s AND
+
+			service_id = ANY(:service_ids)
+	`
+
+	// boxFilter matches stops inside the box of line_string
+	boxFilter = `
 			ST_CONTAINS(ST_SETSRID(
-				ST_MAKEPOLYGON(:line_string), 4326), location) AND
+				ST_MAKEPOLYGON(:line_string), 4326), location)
+	`
+
+	// sqliteBoxFilter is boxFilter on SQLite, which has no SRID
+	sqliteBoxFilter = `
+			ST_CONTAINS(ST_MAKEPOLYGON(:line_string), location)
+	`
 
-			( 
-				service_id IN (%s) OR
-				service_id IN (%s) OR
-				service_id IN (%s) 
+	// sqliteNearFilter is added before each area filter on SQLite, to
+	// first find stops in the box around the area with here_trip_rtree
+	sqliteNearFilter = `
+			id IN (
+				SELECT id FROM here_trip_rtree
+				WHERE max_lat >= :min_lat AND min_lat <= :max_lat AND
+				      max_lon >= :min_lon AND min_lon <= :max_lon
+			) AND
+	`
+
+	// radiusFilter matches stops within radius meters of point_string.
+	// Our points are stored as (lat lon), so we flip them to get a
+	// geography. This must match idx_geography_here_trip.
+	radiusFilter = `
+			ST_DWITHIN(
+				GEOGRAPHY(ST_FLIPCOORDINATES(location)),
+				GEOGRAPHY(ST_FLIPCOORDINATES(ST_GEOMFROMTEXT(:point_string, 4326))),
+				:radius
 			)
 	`
 
+	// polygonFilter matches stops inside polygon, which is (lon lat) WKT
+	polygonFilter = `
+			ST_CONTAINS(
+				ST_FLIPCOORDINATES(ST_GEOMFROMTEXT(:polygon, 4326)), location)
+	`
+
+	// anyFilter matches all stops and is used when the area is only
+	// given as stop and route IDs
+	anyFilter = `TRUE`
+
+	// idFilter matches stops with these stop or route IDs, which are
+	// prefixed with the agency_id
+	idFilter = `
+		AND (
+			agency_id || '|' || stop_id  = ANY(:stop_ids) OR
+			agency_id || '|' || route_id = ANY(:route_ids)
+		)
+	`
+
 	routeTypeFilter = `
-		AND route_type IN (%s)
+		AND route_type = ANY(:route_types)
 	`
 
 	hereOrderLimit = `
@@ -66,6 +119,22 @@ const (
 	`
 )
 
+// ServiceDay is a single day of service that may have departures within
+// the window of a HereQuery
+type ServiceDay struct {
+	// Base is the start of the service day. Departure secs are relative
+	// to this time.
+	Base time.Time
+
+	// DepartureMin and DepartureMax are the range of departure secs on
+	// this service day that fall within our window
+	DepartureMin int
+	DepartureMax int
+
+	ServiceIDs  []string
+	RelevantIDs map[string]bool
+}
+
 type HereQuery struct {
 	// The southwest and northeast bounding points of the box we are
 	// searching
@@ -81,135 +150,124 @@ type HereQuery struct {
 	LineString  string `db:"line_string"`
 	PointString string `db:"point_string"`
 
-	YesterdayDepartureMin  int
-	YesterdayDepartureMax  int
-	YesterdaySecDiff       int
-	YesterdayDepartureBase time.Time
-	YesterdayServiceIDs    []string
-	YesterdayRelevantIDs   map[string]bool
-
-	TodayDepartureMin  int
-	TodayDepartureMax  int
-	TodayDepartureBase time.Time
-	TodayServiceIDs    []string
-	TodayRelevantIDs   map[string]bool
-
-	TomorrowDepartureMin  int
-	TomorrowDepartureMax  int
-	TomorrowSecDiff       int
-	TomorrowDepartureBase time.Time
-	TomorrowServiceIDs    []string
-	TomorrowRelevantIDs   map[string]bool
+	// Radius in meters and Polygon in WKT, used instead of the box
+	// when set
+	Radius  float64 `db:"radius"`
+	Polygon string  `db:"polygon"`
 
-	Limit int `db:"limit"`
+	// polygon is Polygon after it's parsed
+	polygon Polygon
 
-	Query string
-}
+	// MinLat, MinLon, MaxLat and MaxLon are the box around the area we
+	// are searching, whether it's a box, radius or polygon
+	MinLat float64 `db:"min_lat"`
+	MinLon float64 `db:"min_lon"`
+	MaxLat float64 `db:"max_lat"`
+	MaxLon float64 `db:"max_lon"`
 
-func NewHereQuery(lat, lon, swlat, swlon, nelat, nelon float64, routeTypes []int, now time.Time) (hq *HereQuery, err error) {
+	// ServiceIDs is the union of service IDs on all ServiceDays
+	ServiceIDs pq.StringArray `db:"service_ids"`
 
-	// FIXME: hard coded, we need a lat/lon to agencyID mapping
-	agencyIDs := conf.Partner.AgencyIDs
+	// RouteTypes optionally limits results to these route types
+	RouteTypes pq.Int64Array `db:"route_types"`
 
-	today := etc.BaseTime(now)
-	todayName := strings.ToLower(now.Format("Monday"))
-	todayMinSec := etc.TimeToDepartureSecs(now)
-	todayMaxSec := todayMinSec + departureLookaheadSecs
-	todayServiceIDs, err := GetAgencyServiceIDs(etc.DBConn, agencyIDs, todayName, today)
-	if err != nil {
-		log.Println("can't get today serviceIDs", err)
-		return
-	}
-	todayRelevantIDs, err := getRouteServiceIDs(etc.DBConn, agencyIDs, todayName, today)
-	if err != nil {
-		log.Println("can't get today relevent IDs", err)
-		return
-	}
+	// StopIDs and RouteIDs optionally limit results to these stops
+	// or routes
+	StopIDs  pq.StringArray `db:"stop_ids"`
+	RouteIDs pq.StringArray `db:"route_ids"`
 
-	yesterday := today.AddDate(0, 0, -1)
-	yesterdayName := strings.ToLower(yesterday.Format("Monday"))
-	yesterdayMinSec := now.Hour()*3600 + now.Minute()*60 + now.Second() + midnightSecs
-	yesterdayMaxSec := yesterdayMinSec + departureLookaheadSecs
-	yesterdaySecDiff := int(today.Sub(yesterday).Seconds())
-	yesterdayServiceIDs, err := GetAgencyServiceIDs(etc.DBConn, agencyIDs, yesterdayName, yesterday)
-	if err != nil {
-		log.Println("can't get yesterday serviceIDs", err)
-		return
-	}
-	yesterdayRelevantIDs, err := getRouteServiceIDs(etc.DBConn, agencyIDs, yesterdayName, yesterday)
-	if err != nil {
-		log.Println("can't get yesterday relevent IDs", err)
-		return
-	}
+	// ServiceDays are all days that may have departures between now
+	// and now plus the lookahead, in order
+	ServiceDays []*ServiceDay
 
-	tomorrow := today.AddDate(0, 0, 1)
-	tomorrowName := strings.ToLower(tomorrow.Format("Monday"))
-	tomorrowMinSec := 0
-	tomorrowMaxSec := departureLookaheadSecs
-	tomorrowSecDiff := int(tomorrow.Sub(today).Seconds())
-	tomorrowServiceIDs, err := GetAgencyServiceIDs(etc.DBConn, agencyIDs, tomorrowName, tomorrow)
-	if err != nil {
-		log.Println("can't get tomorrow serviceIDs", err)
-		return
-	}
-	tomorrowRelevantIDs, err := getRouteServiceIDs(etc.DBConn, agencyIDs, tomorrowName, tomorrow)
-	if err != nil {
-		log.Println("can't get tomorrow relevent IDs", err)
-		return
-	}
+	Limit int `db:"limit"`
 
-	// Check for overlap. If there is overlap, then nullify that day in
-	// preference for today.
-	if yesterdayMinSec <= todayMaxSec && todayMinSec <= yesterdayMaxSec {
-		yesterdayMinSec = -1
-		yesterdayMaxSec = -1
-	}
+	Query string
 
-	if tomorrowMinSec <= todayMaxSec && todayMinSec <= tomorrowMaxSec {
-		tomorrowMinSec = -1
-		tomorrowMaxSec = -1
-	}
+	// index is the here index used for hq, or nil if it isn't loaded
+	index *HereIndex
+}
 
-	// Check that yesterday is relevant
-	if todayMinSec > departureLookaheadSecs {
-		yesterdayMinSec = -1
-		yesterdayMaxSec = -1
-	}
+// NewHereQuery creates a query for departures within area that leave
+// between now and now plus lookahead. Results are ordered by distance
+// from lat, lon.
+func NewHereQuery(lat, lon float64, area HereArea, routeTypes []int, now time.Time, lookahead time.Duration) (hq *HereQuery, err error) {
 
-	// Check that tomorrow is relevant
-	if todayMaxSec < midnightSecs {
-		tomorrowMinSec = -1
-		tomorrowMaxSec = -1
-	}
+	// FIXME: hard coded, we need a lat/lon to agencyID mapping
+	agencyIDs := conf.Partner.AgencyIDs
 
 	hq = &HereQuery{
-		MidLat: lat,
-		MidLon: lon,
-		SWLat:  swlat,
-		SWLon:  swlon,
-		NELat:  nelat,
-		NELon:  nelon,
-		Limit:  hereQueryLimit,
-
-		TodayServiceIDs:    todayServiceIDs,
-		TodayDepartureMin:  todayMinSec,
-		TodayDepartureMax:  todayMaxSec,
-		TodayDepartureBase: today,
-		TodayRelevantIDs:   todayRelevantIDs,
-
-		YesterdayServiceIDs:    yesterdayServiceIDs,
-		YesterdayDepartureMin:  yesterdayMinSec,
-		YesterdayDepartureMax:  yesterdayMaxSec,
-		YesterdayDepartureBase: yesterday,
-		YesterdaySecDiff:       yesterdaySecDiff,
-		YesterdayRelevantIDs:   yesterdayRelevantIDs,
-
-		TomorrowServiceIDs:    tomorrowServiceIDs,
-		TomorrowDepartureMin:  tomorrowMinSec,
-		TomorrowDepartureMax:  tomorrowMaxSec,
-		TomorrowDepartureBase: tomorrow,
-		TomorrowSecDiff:       tomorrowSecDiff,
-		TomorrowRelevantIDs:   tomorrowRelevantIDs,
+		MidLat:   lat,
+		MidLon:   lon,
+		SWLat:    area.SWLat,
+		SWLon:    area.SWLon,
+		NELat:    area.NELat,
+		NELon:    area.NELon,
+		Radius:   area.Radius,
+		Polygon:  area.Polygon,
+		StopIDs:  area.StopIDs,
+		RouteIDs: area.RouteIDs,
+		Limit:    hereQueryLimit,
+	}
+
+	lookaheadSecs := int(lookahead.Seconds())
+	today := etc.BaseTime(now)
+	index := currentHereIndex()
+	hq.index = index
+
+	// The union of service IDs on all days
+	seen := map[string]bool{}
+
+	// Start with the earliest day that could still have trips running
+	// now (yesterday, since no departure_sec is past 48:00:00) and
+	// continue until a day starts after our window ends. Each day's range
+	// is computed from its own base time, so that it's correct even when
+	// the day isn't 24 hours long.
+	for offset := -((maxServiceDaySecs - 1) / midnightSecs); ; offset++ {
+		day := today.AddDate(0, 0, offset)
+
+		minSec := int(now.Sub(day).Seconds())
+		maxSec := minSec + lookaheadSecs
+
+		if maxSec < 0 {
+			break
+		}
+
+		dayName := strings.ToLower(day.Format("Monday"))
+
+		sd := &ServiceDay{
+			Base:         day,
+			DepartureMin: minSec,
+			DepartureMax: maxSec,
+		}
+
+		// Use the service days of the here index when it's loaded, so
+		// that the database isn't used at all
+		if index != nil {
+			sd.ServiceIDs, sd.RelevantIDs = index.serviceIDs(agencyIDs, dayName, day)
+
+		} else {
+			sd.ServiceIDs, err = GetAgencyServiceIDs(etc.DBConn, agencyIDs, dayName, day)
+			if err != nil {
+				log.Println("can't get serviceIDs", day, err)
+				return
+			}
+
+			sd.RelevantIDs, err = getRouteServiceIDs(etc.DBConn, agencyIDs, dayName, day)
+			if err != nil {
+				log.Println("can't get relevant IDs", day, err)
+				return
+			}
+		}
+
+		for _, id := range sd.ServiceIDs {
+			if !seen[id] {
+				seen[id] = true
+				hq.ServiceIDs = append(hq.ServiceIDs, id)
+			}
+		}
+
+		hq.ServiceDays = append(hq.ServiceDays, sd)
 	}
 
 	hq.LineString = fmt.Sprintf(
@@ -226,17 +284,97 @@ func NewHereQuery(lat, lon, swlat, swlon, nelat, nelon float64, routeTypes []int
 		hq.MidLat, hq.MidLon,
 	)
 
-	hq.Query = fmt.Sprintf(hereQuery,
-		etc.CreateIDs(hq.YesterdayServiceIDs),
-		etc.CreateIDs(hq.TodayServiceIDs),
-		etc.CreateIDs(hq.TomorrowServiceIDs),
-	)
+	for _, v := range routeTypes {
+		hq.RouteTypes = append(hq.RouteTypes, int64(v))
+	}
+
+	filterIDs := len(hq.StopIDs) > 0 || len(hq.RouteIDs) > 0
+
+	var areaFilter string
+	switch {
+	case len(hq.Polygon) > 0:
+		hq.polygon, err = ParsePolygon(hq.Polygon)
+		if err != nil {
+			log.Println("can't parse polygon", err)
+			return
+		}
+		p := hq.polygon
+		hq.MinLat, hq.MinLon, hq.MaxLat, hq.MaxLon = p.SWLat, p.SWLon, p.NELat, p.NELon
+		areaFilter = hereAreaFilter(polygonFilter)
+
+	case hq.Radius > 0:
+		dlat := hq.Radius / metersPerDegree
+		dlon := dlat / math.Cos(hq.MidLat*math.Pi/180.0)
+		hq.MinLat, hq.MinLon, hq.MaxLat, hq.MaxLon = hq.MidLat-dlat, hq.MidLon-dlon, hq.MidLat+dlat, hq.MidLon+dlon
+		areaFilter = hereAreaFilter(radiusFilter)
+
+	case filterIDs && !area.hasBox():
+		areaFilter = anyFilter
+
+	default:
+		hq.MinLat, hq.MinLon, hq.MaxLat, hq.MaxLon = hq.SWLat, hq.SWLon, hq.NELat, hq.NELon
+		areaFilter = hereAreaFilter(boxFilter)
+	}
+
+	hq.Query = hereQueryText(areaFilter, len(hq.RouteTypes) > 0, filterIDs)
+
+	return
+}
+
+// hasBox returns true if hq has a box, which is only missing when
+// searching by IDs
+func (hq *HereQuery) hasBox() bool {
+	return hq.SWLat != 0 || hq.SWLon != 0 || hq.NELat != 0 || hq.NELon != 0
+}
+
+// hereAreaFilter returns areaFilter for our database. On SQLite, stops
+// are first found in the box around the area.
+func hereAreaFilter(areaFilter string) string {
+	if !etc.SQLite() {
+		return areaFilter
+	}
+
+	if areaFilter == boxFilter {
+		areaFilter = sqliteBoxFilter
+	}
 
-	if len(routeTypes) > 0 {
-		hq.Query = hq.Query + fmt.Sprintf(routeTypeFilter, etc.CreateIntIDs(routeTypes))
+	return sqliteNearFilter + areaFilter
+}
+
+// hereQueryText returns the full text of the here query for this area
+// filter, with or without filtering by route type and IDs. The text
+// depends only on these values so that each variant can be prepared once.
+func hereQueryText(areaFilter string, filterRouteTypes, filterIDs bool) string {
+	q := fmt.Sprintf(hereQuery, areaFilter)
+
+	if filterRouteTypes {
+		q = q + routeTypeFilter
+	}
+
+	if filterIDs {
+		q = q + idFilter
 	}
 
-	hq.Query = hq.Query + hereOrderLimit
+	return q + hereOrderLimit
+}
+
+// hereQueryTexts returns every variant of the here query
+func hereQueryTexts() (queries []string) {
+	for _, areaFilter := range []string{
+		hereAreaFilter(boxFilter), hereAreaFilter(radiusFilter),
+		hereAreaFilter(polygonFilter), anyFilter,
+	} {
+		for _, filterRouteTypes := range []bool{false, true} {
+			for _, filterIDs := range []bool{false, true} {
+				// We never search everywhere without IDs
+				if areaFilter == anyFilter && !filterIDs {
+					continue
+				}
+
+				queries = append(queries, hereQueryText(areaFilter, filterRouteTypes, filterIDs))
+			}
+		}
+	}
 
 	return
 }
@@ -47,6 +47,9 @@ type HereResult struct {
 
 	HQ *HereQuery
 
+	// trips are the parsed departures of the row
+	trips *hereTrips
+
 	Stop  *Stop
 	Route *Route
 
@@ -130,17 +133,81 @@ func (h *HereResult) Initialize() error {
 }
 
 func (h *HereResult) createDepartures() (departures []*Departure, err error) {
-	var (
-		departureSec  int
-		compassDir    float64
-		nextLat       float64
-		nextLon       float64
-		tripID        string
-		departureBase time.Time
-	)
+	if h.trips == nil {
+		h.trips, err = parseHereTrips(h, nil)
+		if err != nil {
+			log.Println("can't parse trips", err)
+			return
+		}
+	}
+
+	relID := h.AgencyID + "|" + h.RouteID + "|" + h.ServiceID
+	secs := h.trips.departureSecs
+
+	// Each service day has its own range of departure secs that fall
+	// within our window. A departure is included once for every day
+	// that it's in range and its service is running.
+	for _, sd := range h.HQ.ServiceDays {
+		if !sd.RelevantIDs[relID] {
+			continue
+		}
+
+		i := sort.Search(len(secs), func(i int) bool {
+			return int(secs[i]) >= sd.DepartureMin
+		})
+
+		for ; i < len(secs) && int(secs[i]) <= sd.DepartureMax; i++ {
+			departure := &Departure{
+				DepartureSec: int(secs[i]),
+				TripID:       h.trips.tripIDs[i],
+				ServiceID:    h.ServiceID,
+				baseTime:     sd.Base,
+				CompassDir:   h.trips.compassDirs[i],
+			}
+
+			err = departure.Initialize()
+			if err != nil {
+				log.Println("can't init departure", err)
+				return
+			}
+
+			departures = append(departures, departure)
+		}
+	}
+
+	return
+}
 
+// hereTrips are the departures of a here_trip row, sorted by departure
+// sec
+type hereTrips struct {
+	departureSecs []int32
+	tripIDs       []string
+
+	// compassDirs are the directions to each trip's next stop
+	compassDirs []float64
+}
+
+func (t *hereTrips) Len() int {
+	return len(t.departureSecs)
+}
+
+func (t *hereTrips) Less(i, j int) bool {
+	return t.departureSecs[i] < t.departureSecs[j]
+}
+
+func (t *hereTrips) Swap(i, j int) {
+	t.departureSecs[i], t.departureSecs[j] = t.departureSecs[j], t.departureSecs[i]
+	t.tripIDs[i], t.tripIDs[j] = t.tripIDs[j], t.tripIDs[i]
+	t.compassDirs[i], t.compassDirs[j] = t.compassDirs[j], t.compassDirs[i]
+}
+
+// parseHereTrips parses the comma-joined departures of h. When
+// tripIDs isn't nil, it's used to share the memory of trip IDs that
+// are in many rows.
+func parseHereTrips(h *HereResult, tripIDs map[string]string) (t *hereTrips, err error) {
 	departureSecs := strings.Split(h.DepartureSecs, ",")
-	tripIDs := strings.Split(h.TripIDs, ",")
+	ids := strings.Split(h.TripIDs, ",")
 	nextLats := strings.Split(h.NextStopLats, ",")
 	nextLons := strings.Split(h.NextStopLons, ",")
 
@@ -152,8 +219,8 @@ func (h *HereResult) createDepartures() (departures []*Departure, err error) {
 		err = fmt.Errorf("empty departure secs")
 		return
 	}
-	if len(departureSecs) != len(tripIDs) {
-		err = fmt.Errorf("mismatch between departureSecs length (%v) and tripIDs length (%v)", len(departureSecs), len(tripIDs))
+	if len(departureSecs) != len(ids) {
+		err = fmt.Errorf("mismatch between departureSecs length (%v) and tripIDs length (%v)", len(departureSecs), len(ids))
 		return
 	}
 
@@ -167,15 +234,25 @@ func (h *HereResult) createDepartures() (departures []*Departure, err error) {
 		return
 	}
 
+	t = &hereTrips{
+		departureSecs: make([]int32, len(departureSecs)),
+		tripIDs:       make([]string, len(departureSecs)),
+		compassDirs:   make([]float64, len(departureSecs)),
+	}
+
 	for i := range departureSecs {
-		relID := h.AgencyID + "|" + h.RouteID + "|" + h.ServiceID
+		var (
+			departureSec int
+			nextLat      float64
+			nextLon      float64
+		)
 
 		departureSec, err = strconv.Atoi(strings.TrimSpace(departureSecs[i]))
 		if err != nil {
 			log.Println("can't parse departure sec", err)
 			return
 		}
-		tripID = strings.TrimSpace(tripIDs[i])
+
 		nextLat, err = strconv.ParseFloat(nextLats[i], 64)
 		if err != nil {
 			log.Println("can't parse next lat dir", err)
@@ -188,47 +265,52 @@ func (h *HereResult) createDepartures() (departures []*Departure, err error) {
 			return
 		}
 
-		compassDir = etc.Bearing(h.Lat, h.Lon, nextLat, nextLon)
-
-		// We have up to three non-overlapping ranges of departure sec,
-		// that could be yesterday, today or tomorrow. We're able to do this
-		// because the range is only 3 hours.
+		tripID := strings.TrimSpace(ids[i])
+		if tripIDs != nil {
+			shared, exists := tripIDs[tripID]
+			if !exists {
+				tripIDs[tripID] = tripID
+				shared = tripID
+			}
+			tripID = shared
+		}
 
-		if departureSec >= h.HQ.YesterdayDepartureMin &&
-			departureSec <= h.HQ.YesterdayDepartureMax &&
-			h.HQ.YesterdayRelevantIDs[relID] {
-			departureBase = h.HQ.YesterdayDepartureBase
+		t.departureSecs[i] = int32(departureSec)
+		t.tripIDs[i] = tripID
+		t.compassDirs[i] = etc.Bearing(h.Lat, h.Lon, nextLat, nextLon)
+	}
 
-		} else if departureSec >= h.HQ.TodayDepartureMin &&
-			departureSec <= h.HQ.TodayDepartureMax &&
-			h.HQ.TodayRelevantIDs[relID] {
-			departureBase = h.HQ.TodayDepartureBase
+	sort.Sort(t)
 
-		} else if departureSec >= h.HQ.TomorrowDepartureMin &&
-			departureSec <= h.HQ.TomorrowDepartureMax &&
-			h.HQ.TomorrowRelevantIDs[relID] {
-			departureBase = h.HQ.TomorrowDepartureBase
+	return
+}
 
-		} else {
-			// If it's not in our range, then we ignore it
-			continue
-		}
+// queryHereResults runs hq on db
+func queryHereResults(db sqlx.Ext, hq *HereQuery) (results []*HereResult, err error) {
+	rows, err := etc.NamedQuery(db, hq.Query, hq)
+	if err != nil {
+		log.Println("can't get stops", err)
+		log.Printf("%s %+v", hq.Query, hq)
+		return
+	}
+	defer rows.Close()
 
-		departure := &Departure{
-			DepartureSec: departureSec,
-			TripID:       tripID,
-			ServiceID:    h.ServiceID,
-			baseTime:     departureBase,
-			CompassDir:   compassDir,
-		}
+	for rows.Next() {
+		here := &HereResult{HQ: hq}
 
-		err = departure.Initialize()
+		err = rows.StructScan(here)
 		if err != nil {
-			log.Println("can't init departure", err)
-			return
+			log.Println("can't scan row", err)
+			continue
 		}
 
-		departures = append(departures, departure)
+		results = append(results, here)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Println("can't get stops", err)
+		return
 	}
 
 	return
@@ -251,32 +333,20 @@ func GetHereResults(db sqlx.Ext, hq *HereQuery) (stops []*Stop, stopRoutes map[s
 		defer func() { log.Println(time.Now().Sub(t1)) }()
 	}
 
-	//t3 := time.Now()
-	rows, err := sqlx.NamedQuery(db, hq.Query, hq)
-	if err != nil {
-		log.Println("can't get stops", err)
-		log.Printf("%s %+v", hq.Query, hq)
-		return
-	}
-	/*
-		queryDur := time.Now().Sub(t3)
-		if conf.API.LogTiming && queryDur > time.Duration(1)*time.Second {
-			log.Printf("long here query (%v): %+v", queryDur, hq)
-		}
-	*/
-
-	defer rows.Close()
-
-	count := 0
-	for rows.Next() {
-		here := HereResult{HQ: hq}
-
-		err = rows.StructScan(&here)
+	// Use the here index that hq was created with, otherwise query the
+	// database
+	var results []*HereResult
+	if hq.index != nil {
+		results = hq.index.find(hq)
+	} else {
+		results, err = queryHereResults(db, hq)
 		if err != nil {
-			log.Println("can't scan row", err)
-			continue
+			return
 		}
+	}
 
+	count := 0
+	for _, here := range results {
 		err = here.Initialize()
 		if err != nil {
 			log.Println("can't initialize here", err)
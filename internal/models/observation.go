@@ -0,0 +1,151 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	null "gopkg.in/guregu/null.v3"
+)
+
+const (
+	insertVehicleObservation = `
+		INSERT INTO vehicle_observation
+			(agency_id, route_id, direction_id, trip_id, stop_id,
+			 lat, lon, occupancy, observed_at)
+		VALUES
+			(:agency_id, :route_id, :direction_id, :trip_id, :stop_id,
+			 :lat, :lon, :occupancy, :observed_at)
+	`
+
+	insertDepartureObservation = `
+		INSERT INTO departure_observation
+			(agency_id, route_id, direction_id, trip_id, stop_id,
+			 arrival_time, departure_time, observed_at)
+		VALUES
+			(:agency_id, :route_id, :direction_id, :trip_id, :stop_id,
+			 :arrival_time, :departure_time, :observed_at)
+	`
+)
+
+// VehicleObservation is the location of a vehicle as reported by a
+// partner at ObservedAt
+type VehicleObservation struct {
+	AgencyID    string   `json:"agency_id" db:"agency_id"`
+	RouteID     string   `json:"route_id" db:"route_id"`
+	DirectionID null.Int `json:"direction_id" db:"direction_id"`
+	TripID      string   `json:"trip_id" db:"trip_id"`
+
+	// StopID is the next stop of the vehicle, if it's known
+	StopID null.String `json:"stop_id" db:"stop_id"`
+
+	Lat       float64     `json:"lat" db:"lat"`
+	Lon       float64     `json:"lon" db:"lon"`
+	Occupancy null.String `json:"occupancy" db:"occupancy"`
+
+	ObservedAt time.Time `json:"observed_at" db:"observed_at"`
+}
+
+// DepartureObservation is the predicted time of a trip at a stop as
+// reported by a partner at ObservedAt
+type DepartureObservation struct {
+	AgencyID    string   `json:"agency_id" db:"agency_id"`
+	RouteID     string   `json:"route_id" db:"route_id"`
+	DirectionID null.Int `json:"direction_id" db:"direction_id"`
+	TripID      string   `json:"trip_id" db:"trip_id"`
+	StopID      string   `json:"stop_id" db:"stop_id"`
+
+	ArrivalTime   null.Time `json:"arrival_time" db:"arrival_time"`
+	DepartureTime null.Time `json:"departure_time" db:"departure_time"`
+
+	ObservedAt time.Time `json:"observed_at" db:"observed_at"`
+}
+
+// SaveObservations inserts vehicle and departure observations in a
+// single transaction
+func SaveObservations(db *sqlx.DB, vehicles []*VehicleObservation, departures []*DepartureObservation) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println("can't begin transaction", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	vstmt, err := tx.PrepareNamed(insertVehicleObservation)
+	if err != nil {
+		log.Println("can't prepare vehicle observation", err)
+		return err
+	}
+	defer vstmt.Close()
+
+	for _, v := range vehicles {
+		_, err = vstmt.Exec(v)
+		if err != nil {
+			log.Println("can't insert vehicle observation", err)
+			return err
+		}
+	}
+
+	dstmt, err := tx.PrepareNamed(insertDepartureObservation)
+	if err != nil {
+		log.Println("can't prepare departure observation", err)
+		return err
+	}
+	defer dstmt.Close()
+
+	for _, d := range departures {
+		_, err = dstmt.Exec(d)
+		if err != nil {
+			log.Println("can't insert departure observation", err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit observations", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetVehicleObservations returns the vehicle observations of an agency
+// from start up to end, in the order they were observed. If routeID is
+// empty, every route is included.
+func GetVehicleObservations(db sqlx.Ext, agencyID, routeID string, start, end time.Time) (obs []*VehicleObservation, err error) {
+	err = sqlx.Select(db, &obs, `
+		SELECT * FROM vehicle_observation
+		WHERE agency_id = $1 AND
+		      ($2::text = '' OR route_id = $2) AND
+		      observed_at >= $3 AND
+		      observed_at <  $4
+		ORDER BY observed_at
+	`, agencyID, routeID, start, end)
+	if err != nil {
+		log.Println("can't get vehicle observations", err)
+		return
+	}
+
+	return
+}
+
+// GetDepartureObservations returns the departure observations of an
+// agency from start up to end, in the order they were observed. If
+// routeID is empty, every route is included.
+func GetDepartureObservations(db sqlx.Ext, agencyID, routeID string, start, end time.Time) (obs []*DepartureObservation, err error) {
+	err = sqlx.Select(db, &obs, `
+		SELECT * FROM departure_observation
+		WHERE agency_id = $1 AND
+		      ($2::text = '' OR route_id = $2) AND
+		      observed_at >= $3 AND
+		      observed_at <  $4
+		ORDER BY observed_at
+	`, agencyID, routeID, start, end)
+	if err != nil {
+		log.Println("can't get departure observations", err)
+		return
+	}
+
+	return
+}
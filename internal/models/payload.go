@@ -0,0 +1,41 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SavePayload inserts the response b that was saved at key k at t
+func SavePayload(db sqlx.Execer, k string, t time.Time, b []byte) error {
+	_, err := db.Exec(`
+		INSERT INTO partner_payload (key, fetched_at, body)
+		VALUES ($1, $2, $3)
+	`, k, t, b)
+	if err != nil {
+		log.Println("can't insert partner payload", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetPayload returns the latest response saved at key k from start up to
+// and including end
+func GetPayload(db sqlx.Queryer, k string, start, end time.Time) (b []byte, err error) {
+	err = sqlx.Get(db, &b, `
+		SELECT body FROM partner_payload
+		WHERE key = $1 AND
+		      fetched_at >  $2 AND
+		      fetched_at <= $3
+		ORDER BY fetched_at DESC
+		LIMIT 1
+	`, k, start, end)
+	if err != nil {
+		log.Println("can't get partner payload", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+// Prepare prepares the queries that are run on every here request, so
+// that they are parsed and planned once at startup
+func Prepare(db *sqlx.DB) error {
+	queries := []string{
+		agencyServiceQuery,
+		agencyServiceExceptionQuery,
+		routeServiceQuery,
+		routeServiceExceptionQuery,
+	}
+
+	// Tiles aren't supported on SQLite
+	if !etc.SQLite() {
+		queries = append(queries, tileQuery)
+	}
+
+	err := etc.Prepare(db, queries...)
+	if err != nil {
+		log.Println("can't prepare queries", err)
+		return err
+	}
+
+	err = etc.PrepareNamed(db, hereQueryTexts()...)
+	if err != nil {
+		log.Println("can't prepare here queries", err)
+		return err
+	}
+
+	return nil
+}
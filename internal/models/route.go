@@ -1,13 +1,14 @@
 package models
 
 import (
-	"fmt"
 	"log"
+	"math"
 	"strings"
 
 	"github.com/brnstz/bus/internal/etc"
 	"github.com/brnstz/upsert"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 const (
@@ -24,6 +25,10 @@ const (
 const (
 	defaultColor     = "#FFFFFF"
 	defaultTextColor = "#000000"
+
+	// metersPerDegree is about how many meters are in a degree of
+	// latitude
+	metersPerDegree = 111320.0
 )
 
 var (
@@ -168,14 +173,24 @@ func GetAllRoutes(db sqlx.Ext, agencyID string) (routes []*Route, err error) {
 	return
 }
 
+// GetAgencyIDs returns the ID of every agency that has a route
+func GetAgencyIDs(db sqlx.Ext) (agencyIDs []string, err error) {
+	err = sqlx.Select(db, &agencyIDs,
+		`SELECT DISTINCT agency_id FROM route ORDER BY agency_id`,
+	)
+	if err != nil {
+		log.Println("can't get agency ids", err)
+		return
+	}
+
+	return
+}
+
 // test func for static json file
 func GetPreloadRoutes(db sqlx.Ext, agencyIDs []string) (routes []*Route, err error) {
-	q := fmt.Sprintf(
-		`SELECT * FROM route WHERE route_type != $1 AND agency_id IN (%s)`,
-		etc.CreateIDs(agencyIDs),
-	)
+	q := `SELECT * FROM route WHERE route_type != $1 AND agency_id = ANY($2)`
 
-	err = sqlx.Select(db, &routes, q, Bus)
+	err = sqlx.Select(db, &routes, q, Bus, pq.Array(agencyIDs))
 	if err != nil {
 		return
 	}
@@ -220,6 +235,48 @@ func GetRoute(db sqlx.Ext, agencyID, routeID string) (r *Route, err error) {
 	return
 }
 
+// GetNearbyRoutes returns the routes that have a stop within meters of
+// lat, lon
+func GetNearbyRoutes(db sqlx.Ext, lat, lon, meters float64) (routes []*Route, err error) {
+	// Search a box around the point first so we can use the stop
+	// location index
+	dLat := meters / metersPerDegree
+	dLon := meters / (metersPerDegree * math.Cos(lat*math.Pi/180.0))
+
+	q := `
+		SELECT DISTINCT route.*
+		FROM route
+		INNER JOIN stop
+			ON route.agency_id = stop.agency_id AND
+			   route.route_id  = stop.route_id
+		WHERE stop.location && ST_MakeEnvelope($1, $2, $3, $4, 4326) AND
+			ST_DWITHIN(
+				GEOGRAPHY(ST_FLIPCOORDINATES(stop.location)),
+				GEOGRAPHY(ST_SETSRID(ST_MAKEPOINT($5, $6), 4326)),
+				$7
+			)
+		ORDER BY route.route_type, route.route_id
+	`
+
+	err = sqlx.Select(db, &routes, q,
+		lat-dLat, lon-dLon, lat+dLat, lon+dLon,
+		lon, lat, meters,
+	)
+	if err != nil {
+		log.Println("can't get nearby routes", err)
+		return
+	}
+
+	for _, r := range routes {
+		err = r.Initialize()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 // Save saves a route to the database
 func (r *Route) Save() error {
 	_, err := upsert.Upsert(etc.DBConn, r)
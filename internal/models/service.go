@@ -1,12 +1,49 @@
 package models
 
 import (
-	"fmt"
 	"log"
 	"time"
 
 	"github.com/brnstz/bus/internal/etc"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	agencyServiceQuery = `
+		SELECT service_id 
+		FROM   service 
+		WHERE  day = $1 AND
+			   end_date >= $2 AND
+			   start_date <= $3 AND 
+			   agency_id = ANY($4)
+	`
+
+	agencyServiceExceptionQuery = `
+		SELECT service_id 
+		FROM   service_exception
+		WHERE  exception_date = $1 AND
+			   exception_type = $2 AND
+			   agency_id = ANY($3)
+	`
+
+	routeServiceQuery = `
+		SELECT agency_id, route_id, service_id
+		FROM   service_route_day 
+		WHERE  day = $1 AND
+			   end_date >= $2 AND
+			   start_date <= $3 AND 
+			   agency_id = ANY($4)
+		ORDER BY agency_id, route_id, start_date DESC
+	`
+
+	routeServiceExceptionQuery = `
+		SELECT agency_id, route_id, service_id 
+		FROM   service_route_exception
+		WHERE  exception_date = $1 AND
+			   exception_type = $2 AND
+			   agency_id = ANY($3)
+	`
 )
 
 // Service is used by the Loader to map service IDs to route IDs
@@ -24,49 +61,41 @@ func GetAgencyServiceIDs(db sqlx.Ext, agencyIDs []string, day string, now time.T
 	var addedIDs []string
 	var removedIDs []string
 
-	inAgencyIDs := etc.CreateIDs(agencyIDs)
-
-	removed := map[string]bool{}
-
 	// Select all serviceIDs matching our agencies and within our time window
-	q := fmt.Sprintf(`
-		SELECT service_id 
-		FROM   service 
-		WHERE  day = $1 AND
-			   end_date >= $2 AND
-			   start_date <= $3 AND 
-			   agency_id IN (%s)
-	`, inAgencyIDs)
-
-	err = sqlx.Select(db, &normalIDs, q, day, now, now)
+	q := agencyServiceQuery
+	err = etc.Select(db, &normalIDs, q, day, now, now, pq.Array(agencyIDs))
 	if err != nil {
 		log.Println("can't scan service ids", err, q, day, now, agencyIDs)
 		return
 	}
 
 	// Get services added / removed
-	q = fmt.Sprintf(`
-		SELECT service_id 
-		FROM   service_exception
-		WHERE  exception_date = $1 AND
-			   exception_type = $2 AND
-			   agency_id IN (%s)
-	`, inAgencyIDs)
+	q = agencyServiceExceptionQuery
 
 	// Added
-	err = sqlx.Select(db, &addedIDs, q, now, ServiceAdded)
+	err = etc.Select(db, &addedIDs, q, now, ServiceAdded, pq.Array(agencyIDs))
 	if err != nil {
 		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceAdded)
 		return
 	}
 
 	// Removed
-	err = sqlx.Select(db, &removedIDs, q, now, ServiceRemoved)
+	err = etc.Select(db, &removedIDs, q, now, ServiceRemoved, pq.Array(agencyIDs))
 	if err != nil {
 		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceRemoved)
 		return
 	}
 
+	serviceIDs = combineServiceIDs(normalIDs, addedIDs, removedIDs)
+
+	return
+}
+
+// combineServiceIDs returns the normal and added service IDs that haven't
+// been removed
+func combineServiceIDs(normalIDs, addedIDs, removedIDs []string) (serviceIDs []string) {
+	removed := map[string]bool{}
+
 	// Create mapping for removed IDs
 	for _, v := range removedIDs {
 		removed[v] = true
@@ -109,36 +138,52 @@ func (rs *routeService) fullID() string {
 func getRouteServiceIDs(db sqlx.Ext, agencyIDs []string, day string, now time.Time) (relevant map[string]bool, err error) {
 
 	var rawNormalIDs []*routeService
-	var normalIDs []*routeService
 	var addedIDs []*routeService
 	var removedIDs []*routeService
-	var serviceIDs []*routeService
-
-	inAgencyIDs := etc.CreateIDs(agencyIDs)
-
-	removed := map[string]bool{}
-
-	// agency_id|route_id|service_id => true/false
-	relevant = map[string]bool{}
 
 	// Select all service
+	q := routeServiceQuery
+	err = etc.Select(db, &rawNormalIDs, q, day, now, now, pq.Array(agencyIDs))
+	if err != nil {
+		log.Println("can't scan service ids", err, q, day, now, agencyIDs)
+		return
+	}
 
-	q := fmt.Sprintf(`
-		SELECT agency_id, route_id, service_id
-		FROM   service_route_day 
-		WHERE  day = $1 AND
-			   end_date >= $2 AND
-			   start_date <= $3 AND 
-			   agency_id IN (%s)
-		ORDER BY agency_id, route_id, start_date DESC
-	`, inAgencyIDs)
+	// Get services added / removed
+	q = routeServiceExceptionQuery
 
-	err = sqlx.Select(db, &rawNormalIDs, q, day, now, now)
+	// Added
+	err = etc.Select(db, &addedIDs, q, now, ServiceAdded, pq.Array(agencyIDs))
 	if err != nil {
-		log.Println("can't scan service ids", err, q, day, now, agencyIDs)
+		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceAdded)
+		return
+	}
+
+	// Removed
+	err = etc.Select(db, &removedIDs, q, now, ServiceRemoved, pq.Array(agencyIDs))
+	if err != nil {
+		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceRemoved)
 		return
 	}
 
+	relevant = combineRouteServiceIDs(rawNormalIDs, addedIDs, removedIDs)
+
+	return
+}
+
+// combineRouteServiceIDs returns the relevant route service IDs like
+// agency_id|route_id|service_id. Only the first of the normal IDs of each
+// route is used, so they must be ordered by agency_id, route_id and then
+// by start_date descending.
+func combineRouteServiceIDs(rawNormalIDs, addedIDs, removedIDs []*routeService) (relevant map[string]bool) {
+	var normalIDs []*routeService
+	var serviceIDs []*routeService
+
+	removed := map[string]bool{}
+
+	// agency_id|route_id|service_id => true/false
+	relevant = map[string]bool{}
+
 	// Keep only the first value for each unique id
 	var lastID string
 	for _, v := range rawNormalIDs {
@@ -155,29 +200,6 @@ func getRouteServiceIDs(db sqlx.Ext, agencyIDs []string, day string, now time.Ti
 		lastID = id
 	}
 
-	// Get services added / removed
-	q = fmt.Sprintf(`
-		SELECT agency_id, route_id, service_id 
-		FROM   service_route_exception
-		WHERE  exception_date = $1 AND
-			   exception_type = $2 AND
-			   agency_id IN (%s) 
-	`, inAgencyIDs)
-
-	// Added
-	err = sqlx.Select(db, &addedIDs, q, now, ServiceAdded)
-	if err != nil {
-		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceAdded)
-		return
-	}
-
-	// Removed
-	err = sqlx.Select(db, &removedIDs, q, now, ServiceRemoved)
-	if err != nil {
-		log.Println("can't scan service ids", err, q, day, now, agencyIDs, ServiceRemoved)
-		return
-	}
-
 	for _, v := range removedIDs {
 		removed[v.fullID()] = true
 	}
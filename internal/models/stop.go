@@ -286,3 +286,104 @@ func newSortableStops(stops []*Stop) (ss sortableStops) {
 
 	return
 }
+
+// GetStops returns the stop with this agencyID and stopID for each route
+// and direction that serves it, with the route info filled in. If there
+// is no such stop, ErrNotFound is returned.
+func GetStops(db sqlx.Ext, agencyID, stopID string) (stops []*Stop, err error) {
+	var rows []struct {
+		Stop
+		RouteType      int    `db:"route_type"`
+		RouteColor     string `db:"route_color"`
+		RouteTextColor string `db:"route_text_color"`
+		RouteShortName string `db:"route_short_name"`
+		RouteLongName  string `db:"route_long_name"`
+	}
+
+	q := `
+		SELECT stop.*,
+			ST_X(stop.location) AS lat,
+			ST_Y(stop.location) AS lon,
+			route.route_type, route.route_color, route.route_text_color,
+			route.route_short_name, route.route_long_name
+
+		FROM stop
+		INNER JOIN route
+			ON stop.agency_id = route.agency_id AND
+			   stop.route_id  = route.route_id
+
+		WHERE stop.agency_id = $1 AND
+			  stop.stop_id   = $2
+
+		ORDER BY route.route_type, stop.route_id, stop.direction_id
+	`
+
+	err = sqlx.Select(db, &rows, q, agencyID, stopID)
+	if err != nil {
+		log.Println("can't get stops", err)
+		return
+	}
+
+	if len(rows) < 1 {
+		err = ErrNotFound
+		return
+	}
+
+	for _, row := range rows {
+		s := row.Stop
+		s.RouteType = row.RouteType
+		s.RouteColor = row.RouteColor
+		s.RouteTextColor = row.RouteTextColor
+		s.RouteShortName = row.RouteShortName
+		s.RouteLongName = row.RouteLongName
+		s.TripHeadsign = s.Headsign
+
+		err = s.Initialize()
+		if err != nil {
+			return
+		}
+
+		stops = append(stops, &s)
+	}
+
+	return
+}
+
+// GetStopsByRoute returns the stops of a route for each direction,
+// ordered by direction and name
+func GetStopsByRoute(db sqlx.Ext, agencyID, routeID string) (stops []*Stop, err error) {
+	q := `
+		SELECT stop.*,
+			ST_X(location) AS lat,
+			ST_Y(location) AS lon
+
+		FROM stop
+
+		WHERE agency_id = $1 AND
+			  route_id  = $2
+
+		ORDER BY direction_id, stop_name, stop_id
+	`
+
+	err = sqlx.Select(db, &stops, q, agencyID, routeID)
+	if err != nil {
+		log.Println("can't get stops by route", err)
+		return
+	}
+
+	return
+}
+
+// GetStopIDs returns the distinct stop IDs of an agency
+func GetStopIDs(db sqlx.Ext, agencyID string) (stopIDs []string, err error) {
+	err = sqlx.Select(db, &stopIDs,
+		`SELECT DISTINCT stop_id FROM stop WHERE agency_id = $1 ORDER BY stop_id`,
+		agencyID,
+	)
+	if err != nil {
+		log.Println("can't get stop ids", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"log"
+	"math"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+const (
+	// TileVersionKey is the cache key of a counter that busloader
+	// increments after each load. It's part of the key of every cached
+	// tile, so that tiles from before the load are no longer used.
+	TileVersionKey = "tile_version"
+
+	// maxTileZoom is the deepest zoom level we serve
+	maxTileZoom = 22
+
+	// minRouteZoom and minStopZoom are the zoom levels where routes and
+	// stops are first included. Tiles at lower zooms would be too large
+	// to be useful.
+	minRouteZoom = 8
+	minStopZoom  = 13
+
+	// tileExtent is the size of a tile in its own coordinate space and
+	// tileBuffer is how far geometries extend past the edge, so that
+	// lines are drawn without gaps where tiles meet
+	tileExtent = 4096
+	tileBuffer = 64
+
+	// mercatorMax is half the width of the world in web mercator meters
+	mercatorMax = 20037508.342789244
+)
+
+// tileQuery creates a tile with a routes layer and a stops layer. $1 to $4
+// are the tile's bounds in web mercator and $5 to $8 are its bounds
+// (plus the buffer) as stored, lat then lon. $9 is true when stops are
+// included. Shapes are found by their points in the tile, so a segment
+// that crosses the tile without a point in it is not included. The extent
+// and buffer must match tileExtent and tileBuffer.
+const tileQuery = `
+	WITH
+	routes AS (
+		SELECT
+			ST_AsMVTGeom(
+				ST_Transform(ST_FlipCoordinates(line), 3857),
+				ST_MakeEnvelope($1, $2, $3, $4, 3857),
+				4096, 64, true
+			) AS geom,
+			agency_id, route_id, direction_id, headsign, route_type,
+			route_color, route_text_color, route_short_name, route_long_name
+		FROM (
+			SELECT
+				rs.agency_id, rs.route_id, rs.direction_id, rs.headsign,
+				route.route_type, route.route_color, route.route_text_color,
+				route.route_short_name, route.route_long_name,
+				ST_MakeLine(shape.location ORDER BY shape.seq) AS line
+			FROM route_shape rs
+			INNER JOIN route ON
+				rs.agency_id = route.agency_id AND
+				rs.route_id = route.route_id
+			INNER JOIN shape ON
+				rs.agency_id = shape.agency_id AND
+				rs.shape_id = shape.shape_id
+			WHERE (rs.agency_id, rs.shape_id) IN (
+				SELECT DISTINCT agency_id, shape_id
+				FROM shape
+				WHERE location && ST_MakeEnvelope($5, $6, $7, $8, 4326)
+			)
+			GROUP BY rs.agency_id, rs.route_id, rs.direction_id,
+				rs.headsign, route.route_type, route.route_color,
+				route.route_text_color, route.route_short_name,
+				route.route_long_name
+		) AS lines
+	),
+	stops AS (
+		SELECT
+			ST_AsMVTGeom(
+				ST_Transform(ST_FlipCoordinates(stop.location), 3857),
+				ST_MakeEnvelope($1, $2, $3, $4, 3857),
+				4096, 64, true
+			) AS geom,
+			stop.agency_id, stop.stop_id, stop.stop_name, stop.route_id,
+			stop.direction_id, stop.headsign, route.route_type,
+			route.route_color, route.route_text_color
+		FROM stop
+		INNER JOIN route ON
+			stop.agency_id = route.agency_id AND
+			stop.route_id = route.route_id
+		WHERE $9 AND stop.location && ST_MakeEnvelope($5, $6, $7, $8, 4326)
+	)
+	SELECT
+		COALESCE(
+			(SELECT ST_AsMVT(routes, 'routes', 4096, 'geom')
+			 FROM routes WHERE geom IS NOT NULL),
+			''::bytea
+		) ||
+		COALESCE(
+			(SELECT ST_AsMVT(stops, 'stops', 4096, 'geom')
+			 FROM stops WHERE geom IS NOT NULL),
+			''::bytea
+		)
+`
+
+// Tile is a single map tile at zoom Z, in column X and row Y, as in
+// https://wiki.openstreetmap.org/wiki/Slippy_map_tilenames
+type Tile struct {
+	Z int
+	X int
+	Y int
+}
+
+// NewTile returns a tile or ErrNotFound when there is no such tile
+func NewTile(z, x, y int) (*Tile, error) {
+	if z < 0 || z > maxTileZoom {
+		return nil, ErrNotFound
+	}
+
+	n := 1 << uint(z)
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return nil, ErrNotFound
+	}
+
+	return &Tile{Z: z, X: x, Y: y}, nil
+}
+
+// mercator returns the bounds of the tile in web mercator meters
+func (t *Tile) mercator() (minX, minY, maxX, maxY float64) {
+	size := 2 * mercatorMax / float64(int(1)<<uint(t.Z))
+
+	minX = -mercatorMax + float64(t.X)*size
+	maxX = minX + size
+	maxY = mercatorMax - float64(t.Y)*size
+	minY = maxY - size
+
+	return
+}
+
+// latLon returns the bounds of the tile in degrees, extended by the
+// tile buffer
+func (t *Tile) latLon() (minLat, minLon, maxLat, maxLon float64) {
+	n := float64(int(1) << uint(t.Z))
+	buf := float64(tileBuffer) / float64(tileExtent)
+
+	lon := func(x float64) float64 {
+		return x/n*360.0 - 180.0
+	}
+	lat := func(y float64) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180.0 / math.Pi
+	}
+
+	minLon = lon(float64(t.X) - buf)
+	maxLon = lon(float64(t.X+1) + buf)
+	maxLat = lat(float64(t.Y) - buf)
+	minLat = lat(float64(t.Y+1) + buf)
+
+	return
+}
+
+// Get returns the tile encoded as a Mapbox Vector Tile. Tiles with
+// nothing in them are empty.
+func (t *Tile) Get(db sqlx.Ext) ([]byte, error) {
+	var b [][]byte
+
+	if etc.SQLite() {
+		return nil, ErrUnsupported
+	}
+
+	if t.Z < minRouteZoom {
+		return []byte{}, nil
+	}
+
+	minX, minY, maxX, maxY := t.mercator()
+	minLat, minLon, maxLat, maxLon := t.latLon()
+
+	err := etc.Select(db, &b, tileQuery,
+		minX, minY, maxX, maxY,
+		minLat, minLon, maxLat, maxLon,
+		t.Z >= minStopZoom,
+	)
+	if err != nil {
+		log.Println("can't get tile", t, err)
+		return nil, err
+	}
+
+	if len(b) < 1 {
+		return []byte{}, nil
+	}
+
+	return b[0], nil
+}
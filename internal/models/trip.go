@@ -124,7 +124,7 @@ func (t *Trip) addShapes(db sqlx.Ext, agencyID, shapeID string) (err error) {
 
 			if lastShape.Lat.Valid && lastShape.Lon.Valid && lastStop.Lat.Valid && lastStop.Lon.Valid {
 				directionRouteShapeMatches = lastShape.Lat == lastStop.Lat && lastShape.Lon == lastStop.Lon
-				log.Printf("shape: %v %v, stop: %v %v", lastShape.Lat, lastShape.Lon, lastStop.Lat, lastStop.Lon, directionRouteShapeMatches)
+				log.Printf("shape: %v %v, stop: %v %v, match: %v", lastShape.Lat, lastShape.Lon, lastStop.Lat, lastStop.Lon, directionRouteShapeMatches)
 			}
 		}
 	}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/brnstz/bus/internal/etc"
 	"github.com/jmoiron/sqlx"
+	null "gopkg.in/guregu/null.v3"
 )
 
 // Vehicle is the location (and maybe any other info) we want to provide
@@ -15,6 +16,11 @@ type Vehicle struct {
 
 	// Is this location live or estimated based on scheduled?
 	Live bool `json:"live"`
+
+	// Occupancy is how crowded the vehicle is, if the partner provides
+	// it. Values are the GTFS-realtime OccupancyStatus names in lower
+	// case, like "many_seats_available" or "standing_room_only".
+	Occupancy null.String `json:"occupancy" db:"-"`
 }
 
 func GetVehicle(agencyID, routeID, stopID string, directionID int) (vehicle Vehicle, err error) {
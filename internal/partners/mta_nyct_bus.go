@@ -6,15 +6,37 @@ import (
 	"log"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/cache"
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
 	"github.com/brnstz/bus/internal/models"
 )
 
+const (
+	// vmPath and smPath are the VehicleMonitoring and StopMonitoring
+	// endpoints relative to conf.Partner.BustimeURL
+	vmPath = "/vehicle-monitoring.json"
+	smPath = "/stop-monitoring.json"
+
+	// maxStopRefreshes is the most StopMonitoring requests we make at
+	// once
+	maxStopRefreshes = 10
+)
+
 var (
-	vmURL = "http://bustime.mta.info/api/siri/vehicle-monitoring.json"
+	// stopRefreshes has a value for each StopMonitoring request in
+	// progress
+	stopRefreshes = make(chan bool, maxStopRefreshes)
+
+	// stopsRefreshing are the stop keys with a request in progress
+	stopsRefreshing     = map[string]bool{}
+	stopsRefreshingLock sync.Mutex
 )
 
 type mtaNYCBus struct{}
@@ -32,15 +54,37 @@ func (p mtaNYCBus) getURL(agencyID, routeID string, directionID int) string {
 	q.Set("VehicleMonitoringDetailLevel", "calls")
 	q.Set("LineRef", lineRef)
 
-	return vmURL + "?" + q.Encode()
+	return conf.Partner.BustimeURL + vmPath + "?" + q.Encode()
+}
+
+// getStopURL returns the StopMonitoring URL for arrivals of this route and
+// direction at stopID
+func (p mtaNYCBus) getStopURL(agencyID, routeID, stopID string, directionID int) string {
+	q := url.Values{}
+	q.Set("key", conf.Partner.BustimeAPIKey)
+	q.Set("MonitoringRef", fmt.Sprint("MTA_", stopID))
+	q.Set("DirectionRef", strconv.Itoa(directionID))
+	q.Set("LineRef", fmt.Sprintf("%v_%v", agencyID, routeID))
+
+	return conf.Partner.BustimeURL + smPath + "?" + q.Encode()
+}
+
+func (p mtaNYCBus) Key(agencyID, routeID string, directionID int) string {
+	return fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
+}
+
+// stopKey returns the cache key of the StopMonitoring response for
+// this route and direction at stopID
+func (p mtaNYCBus) stopKey(agencyID, routeID, stopID string, directionID int) string {
+	return fmt.Sprintf("%v|%v|%v|%v", agencyID, routeID, directionID, stopID)
 }
 
 func (p mtaNYCBus) Precache(agencyID, routeID string, directionID int) error {
-	k := fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
+	k := p.Key(agencyID, routeID, directionID)
 
 	u := p.getURL(agencyID, routeID, directionID)
 
-	_, err := etc.RedisCacheURL(u)
+	_, err := etc.CacheURL(k, u)
 	if err != nil {
 		log.Println("can't cache live buses", err)
 		return err
@@ -58,13 +102,23 @@ func (p mtaNYCBus) Precache(agencyID, routeID string, directionID int) error {
 	return nil
 }
 
+// Live returns departures at stopID and the vehicles on the route. When
+// StopMonitoring is enabled and the stop's response is cached, its
+// departures and the vehicles headed to it come from StopMonitoring.
+// Otherwise they come from the precached VehicleMonitoring response for
+// the route. StopMonitoring responses aren't archived, so they aren't
+// used when replaying.
 func (p mtaNYCBus) Live(agencyID, routeID, stopID string, directionID int) (d []*models.Departure, v []models.Vehicle, err error) {
+	if conf.Partner.BustimeStopMonitoring && len(stopID) > 0 && Replay == nil {
+		d, v, err = p.liveStop(agencyID, routeID, stopID, directionID)
+		if err != cache.ErrMiss {
+			return
+		}
+	}
 
 	stopPointRef := fmt.Sprint("MTA_", stopID)
 
-	u := p.getURL(agencyID, routeID, directionID)
-
-	b, err := etc.RedisGet(u)
+	b, err := cached(p.Key(agencyID, routeID, directionID))
 	if err != nil {
 		log.Println("can't get live buses", err)
 		return
@@ -81,25 +135,14 @@ func (p mtaNYCBus) Live(agencyID, routeID, stopID string, directionID int) (d []
 
 	if len(vmd) > 0 {
 		for _, act := range vmd[0].VehicleActivity {
-			v = append(v, models.Vehicle{
-				Lat:  act.MonitoredVehicleJourney.VehicleLocation.Latitude,
-				Lon:  act.MonitoredVehicleJourney.VehicleLocation.Longitude,
-				Live: true,
-			})
+			v = append(v, act.MonitoredVehicleJourney.vehicle())
 
 			for _, oc := range act.MonitoredVehicleJourney.OnwardCalls.OnwardCall {
 				if oc.StopPointRef == stopPointRef {
-					tripID := act.MonitoredVehicleJourney.FramedVehicleJourneyRef.DatedVehicleJourneyRef
-					// remove "MTA NYCT_" from front of string
-					if len(tripID) > 9 {
-						tripID = tripID[9:]
-					}
+					// remove "MTA NYCT_" or "MTABC_" from front of string
+					tripID := siriID(act.MonitoredVehicleJourney.FramedVehicleJourneyRef.DatedVehicleJourneyRef)
 					if !oc.ExpectedArrivalTime.IsZero() {
-						d = append(d, &models.Departure{
-							Time:   oc.ExpectedArrivalTime,
-							TripID: tripID,
-							Live:   true,
-						})
+						d = append(d, act.MonitoredVehicleJourney.departure(oc, tripID))
 					}
 				}
 			}
@@ -110,6 +153,189 @@ func (p mtaNYCBus) Live(agencyID, routeID, stopID string, directionID int) (d []
 	return
 }
 
+// Realtime reads every vehicle on the route and its onward calls from the
+// precached VehicleMonitoring response
+func (p mtaNYCBus) Realtime(agencyID, routeID string, directionID int) (t []*TripUpdate, v []*VehiclePosition, err error) {
+	b, err := cached(p.Key(agencyID, routeID, directionID))
+	if err != nil {
+		log.Println("can't get live buses", err)
+		return
+	}
+
+	sr := siriResp{}
+	err = json.Unmarshal(b, &sr)
+	if err != nil {
+		log.Println("can't get unmarshal siriresp", err)
+		return
+	}
+
+	vmd := sr.Siri.ServiceDelivery.VehicleMonitoringDelivery
+	if len(vmd) < 1 {
+		return
+	}
+
+	for _, act := range vmd[0].VehicleActivity {
+		mvj := act.MonitoredVehicleJourney
+		tripID := siriID(mvj.FramedVehicleJourneyRef.DatedVehicleJourneyRef)
+
+		vp := &VehiclePosition{
+			AgencyID:    agencyID,
+			RouteID:     routeID,
+			TripID:      tripID,
+			DirectionID: null.IntFrom(int64(directionID)),
+			Lat:         mvj.VehicleLocation.Latitude,
+			Lon:         mvj.VehicleLocation.Longitude,
+			Occupancy:   occupancyFromSiri(mvj.Occupancy),
+			Timestamp:   act.RecordedAtTime,
+		}
+
+		tu := &TripUpdate{
+			AgencyID:    agencyID,
+			RouteID:     routeID,
+			TripID:      tripID,
+			DirectionID: null.IntFrom(int64(directionID)),
+		}
+
+		for _, oc := range mvj.OnwardCalls.OnwardCall {
+			if len(vp.StopID) < 1 {
+				vp.StopID = siriID(oc.StopPointRef)
+			}
+
+			tu.Stops = append(tu.Stops, StopTimeUpdate{
+				StopID:    siriID(oc.StopPointRef),
+				Arrival:   oc.ExpectedArrivalTime,
+				Departure: oc.ExpectedDepartureTime,
+			})
+		}
+
+		v = append(v, vp)
+		if len(tu.Stops) > 0 {
+			t = append(t, tu)
+		}
+	}
+
+	return
+}
+
+// siriID removes the agency prefix from a SIRI reference, e.g.,
+// "MTA_308214" becomes "308214"
+func siriID(ref string) string {
+	parts := strings.SplitN(ref, "_", 2)
+	if len(parts) < 2 {
+		return ref
+	}
+
+	return parts[1]
+}
+
+// refreshStop requests the StopMonitoring response for a stop in the
+// background and caches it at k. If the stop is already being requested
+// or there are already maxStopRefreshes requests, nothing is done and a
+// later miss tries again.
+func (p mtaNYCBus) refreshStop(k, u string) {
+	stopsRefreshingLock.Lock()
+	defer stopsRefreshingLock.Unlock()
+
+	if stopsRefreshing[k] {
+		return
+	}
+
+	select {
+	case stopRefreshes <- true:
+	default:
+		return
+	}
+
+	stopsRefreshing[k] = true
+
+	go func() {
+		_, err := etc.CacheURL(k, u)
+		if err != nil {
+			log.Println("can't get stop monitoring", err)
+		}
+
+		stopsRefreshingLock.Lock()
+		delete(stopsRefreshing, k)
+		stopsRefreshingLock.Unlock()
+
+		<-stopRefreshes
+	}()
+}
+
+// liveStop reads departures and vehicles from the StopMonitoring response
+// for stopID. Stops aren't precached, so if the response isn't cached,
+// it's requested in the background and cache.ErrMiss is returned.
+func (p mtaNYCBus) liveStop(agencyID, routeID, stopID string, directionID int) (d []*models.Departure, v []models.Vehicle, err error) {
+	k := p.stopKey(agencyID, routeID, stopID, directionID)
+
+	b, err := etc.Cache.Get(k)
+	if err == cache.ErrMiss {
+		p.refreshStop(k, p.getStopURL(agencyID, routeID, stopID, directionID))
+		return
+	}
+	if err != nil {
+		log.Println("can't get stop monitoring", err)
+		return
+	}
+
+	sr := siriResp{}
+	err = json.Unmarshal(b, &sr)
+	if err != nil {
+		log.Println("can't get unmarshal siriresp", err)
+		return
+	}
+
+	smd := sr.Siri.ServiceDelivery.StopMonitoringDelivery
+
+	if len(smd) > 0 {
+		for _, visit := range smd[0].MonitoredStopVisit {
+			mvj := visit.MonitoredVehicleJourney
+
+			v = append(v, mvj.vehicle())
+
+			// remove "MTA NYCT_" or "MTABC_" from front of string
+			tripID := siriID(mvj.FramedVehicleJourneyRef.DatedVehicleJourneyRef)
+
+			if !mvj.MonitoredCall.ExpectedArrivalTime.IsZero() {
+				d = append(d, mvj.departure(mvj.MonitoredCall, tripID))
+			}
+		}
+	}
+
+	return
+}
+
+// vehicle returns the live vehicle of this journey
+func (j journey) vehicle() models.Vehicle {
+	return models.Vehicle{
+		Lat:       j.VehicleLocation.Latitude,
+		Lon:       j.VehicleLocation.Longitude,
+		Live:      true,
+		Occupancy: occupancyFromSiri(j.Occupancy),
+	}
+}
+
+// departure returns a live departure for the vehicle making call c,
+// including how far away it is when the distance extensions are present
+func (j journey) departure(c call, tripID string) *models.Departure {
+	dist := c.Extensions.Distances
+
+	d := &models.Departure{
+		Time:      c.ExpectedArrivalTime,
+		TripID:    tripID,
+		Live:      true,
+		Occupancy: occupancyFromSiri(j.Occupancy),
+	}
+
+	if len(dist.PresentableDistance) > 0 {
+		d.StopsFromCall = null.IntFrom(int64(dist.StopsFromCall))
+		d.DistanceFromCall = null.FloatFrom(dist.DistanceFromCall)
+		d.PresentableDistance = null.StringFrom(dist.PresentableDistance)
+	}
+
+	return d
+}
+
 type call struct {
 	ExpectedDepartureTime time.Time
 	ExpectedArrivalTime   time.Time
@@ -138,13 +364,18 @@ type journey struct {
 		Longitude float64
 	}
 
+	// Occupancy is "seatsAvailable", "standingAvailable" or "full", and
+	// is only present for buses that count passengers
+	Occupancy string
+
 	OnwardCalls struct {
 		OnwardCall []call
 	}
 
-	// MonitoredCall is the current stop of the bus, but this
-	// info appears to be duped in OnwardCall.
-	// MonitoredCall Call
+	// MonitoredCall is the current stop of the bus in VehicleMonitoring,
+	// but this info appears to be duped in OnwardCall. In
+	// StopMonitoring, it's the call at the requested stop.
+	MonitoredCall call
 }
 
 type siriResp struct {
@@ -158,6 +389,15 @@ type siriResp struct {
 					RecordedAtTime          time.Time
 				}
 			}
+
+			StopMonitoringDelivery []struct {
+				ResponseTimestamp  time.Time
+				ValidUntil         time.Time
+				MonitoredStopVisit []struct {
+					MonitoredVehicleJourney journey
+					RecordedAtTime          time.Time
+				}
+			}
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package partners
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -14,13 +15,12 @@ import (
 	"github.com/brnstz/bus/internal/partners/transit_realtime"
 
 	"github.com/golang/protobuf/proto"
+	null "gopkg.in/guregu/null.v3"
 )
 
 var (
 	cacheDirection = 0
 
-	esiURL = "http://datamine.mta.info/mta_esi.php"
-
 	mtaSubwayRouteToFeed = map[string]string{
 		"1":  "1",
 		"2":  "1",
@@ -95,11 +95,28 @@ func (p mtaNYCSubway) getURL(routeID string) (string, bool) {
 	q := url.Values{}
 	q.Set("key", conf.Partner.DatamineAPIKey)
 	q.Set("feed_id", feed)
-	u = fmt.Sprint(esiURL, "?", q.Encode())
+	u = fmt.Sprint(conf.Partner.DatamineURL, "?", q.Encode())
 
 	return u, true
 }
 
+// Key returns the key of the feed that has routeID, which every route in
+// the feed shares, e.g., "MTA NYCT|1|0" for the 1 through 6
+func (p mtaNYCSubway) Key(agencyID, routeID string, directionID int) string {
+	feed, exists := mtaSubwayRouteToFeed[routeID]
+	if !exists {
+		return ""
+	}
+
+	for r := range cacheRoute {
+		if mtaSubwayRouteToFeed[r] == feed {
+			return fmt.Sprintf("%v|%v|%v", agencyID, r, cacheDirection)
+		}
+	}
+
+	return ""
+}
+
 func (p mtaNYCSubway) Precache(agencyID, routeID string, directionID int) error {
 	k := fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
 
@@ -122,7 +139,7 @@ func (p mtaNYCSubway) Precache(agencyID, routeID string, directionID int) error
 		return nil
 	}
 
-	_, err := etc.RedisCacheURL(u)
+	_, err := etc.CacheURL(p.Key(agencyID, routeID, directionID), u)
 	if err != nil {
 		log.Println("can't cache live subway response", k, err)
 		return err
@@ -140,15 +157,30 @@ func (p mtaNYCSubway) Precache(agencyID, routeID string, directionID int) error
 	return nil
 }
 
-func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d []*models.Departure, v []models.Vehicle, err error) {
-	now := time.Now()
+// subwayFeed is the part of a precached feed for a single route
+type subwayFeed struct {
+	// entities have the trip updates of the route
+	entities []*transit_realtime.FeedEntity
 
-	u, exists := p.getURL(routeID)
-	if !exists {
+	// occupancy is the occupancy of each trip ID with a vehicle
+	// position that has one
+	occupancy map[string]null.String
+
+	// ts is the time of the feed
+	ts time.Time
+}
+
+// routeFeed reads the precached feed for routeID and returns the part of
+// it for the route
+func (p mtaNYCSubway) routeFeed(agencyID, routeID string) (f subwayFeed, err error) {
+	f.occupancy = map[string]null.String{}
+
+	k := p.Key(agencyID, routeID, cacheDirection)
+	if len(k) < 1 {
 		return
 	}
 
-	b, err := etc.RedisGet(u)
+	b, err := cached(k)
 	if err != nil {
 		log.Println("can't get live subways", err)
 		return
@@ -162,9 +194,17 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 		return
 	}
 
+	f.ts = time.Unix(int64(tr.GetHeader().GetTimestamp()), 0)
+
 	// Look at each message in the feed
 	for _, e := range tr.Entity {
 
+		// Vehicle positions are separate entities from trip updates
+		occupancy := occupancyFromGTFS(e.GetVehicle())
+		if occupancy.Valid {
+			f.occupancy[e.GetVehicle().GetTrip().GetTripId()] = occupancy
+		}
+
 		// Get some updates
 		tripUpdate := e.GetTripUpdate()
 		trip := tripUpdate.GetTrip()
@@ -179,8 +219,7 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 		var updateEvent interface{}
 		firstUpdate := stopTimeUpdates[0]
 
-		// Get the NYC extension so we can see if the Trip is "assigned"
-		// yet. If it's assigned, we'll put the vehicle on the map.
+		// Get the NYC extension so we can see which track the trip is on
 		updateEvent, err = proto.GetExtension(
 			firstUpdate, nyct_subway.E_NyctStopTimeUpdate,
 		)
@@ -190,7 +229,8 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 		}
 		nycEvent, ok := updateEvent.(*nyct_subway.NyctStopTimeUpdate)
 		if !ok {
-			log.Println("can't coerce to nyct_subway.NyctStopTimeUpdate")
+			err = errors.New("can't coerce to nyct_subway.NyctStopTimeUpdate")
+			log.Println(err)
 			return
 		}
 
@@ -214,30 +254,59 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 			continue
 		}
 
+		f.entities = append(f.entities, e)
+	}
+
+	return
+}
+
+// isAssigned returns true if the trip is "assigned", which means it's
+// about to start or has already started
+func isAssigned(trip *transit_realtime.TripDescriptor) (bool, error) {
+	event, err := proto.GetExtension(
+		trip, nyct_subway.E_NyctTripDescriptor,
+	)
+	if err != nil {
+		log.Println("can't get extension", err)
+		return false, err
+	}
+	nycTrip, ok := event.(*nyct_subway.NyctTripDescriptor)
+	if !ok {
+		err = errors.New("can't coerce to nyct_subway.NyctTripDescriptor")
+		log.Println(err)
+		return false, err
+	}
+
+	return nycTrip.GetIsAssigned(), nil
+}
+
+func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d []*models.Departure, v []models.Vehicle, err error) {
+	now := etc.Now()
+
+	f, err := p.routeFeed(agencyID, routeID)
+	if err != nil {
+		return
+	}
+
+	for _, e := range f.entities {
+		trip := e.GetTripUpdate().GetTrip()
+		stopTimeUpdates := e.GetTripUpdate().GetStopTimeUpdate()
+		occupancy := f.occupancy[trip.GetTripId()]
+
 		// If we have at least one stopTimeUpdate (already checked before) and
 		// the trip is non-nil, we can get the NYCT extensions.
 		if trip != nil {
-			var event interface{}
+			var assigned bool
 
-			// Get the NYC extension so we can see if the Trip is "assigned"
-			// yet. If it's assigned, we'll put the vehicle on the map.
-			event, err = proto.GetExtension(
-				trip, nyct_subway.E_NyctTripDescriptor,
-			)
+			assigned, err = isAssigned(trip)
 			if err != nil {
-				log.Println("can't get extension", err)
-				return
-			}
-			nycTrip, ok := event.(*nyct_subway.NyctTripDescriptor)
-			if !ok {
-				log.Println("can't coerce to nyct_subway.NyctTripDescriptor")
 				return
 			}
 
 			// The first update in an entity is the stop where the train will
 			// next be. Include only "assigned" trips, which are those that
 			// are about to start.
-			if nycTrip.GetIsAssigned() {
+			if assigned {
 				var vehicle models.Vehicle
 
 				// Get a "vehicle" with the lat/lon of the update's stop
@@ -253,6 +322,7 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 
 				} else {
 					vehicle.Live = true
+					vehicle.Occupancy = occupancy
 					v = append(v, vehicle)
 				}
 			}
@@ -266,9 +336,10 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 				if dtime.After(now) {
 					d = append(d,
 						&models.Departure{
-							Time:   dtime,
-							TripID: trip.GetTripId(),
-							Live:   true,
+							Time:      dtime,
+							TripID:    trip.GetTripId(),
+							Live:      true,
+							Occupancy: occupancy,
 						},
 					)
 				}
@@ -278,3 +349,67 @@ func (p mtaNYCSubway) Live(agencyID, routeID, stopID string, directionID int) (d
 
 	return
 }
+
+// Realtime returns the trip updates in the feed for routeID. Vehicles of
+// assigned trips are placed at their next stop. The feed has both
+// directions, so only cacheDirection returns data.
+func (p mtaNYCSubway) Realtime(agencyID, routeID string, directionID int) (t []*TripUpdate, v []*VehiclePosition, err error) {
+	if directionID != cacheDirection {
+		return
+	}
+
+	f, err := p.routeFeed(agencyID, routeID)
+	if err != nil {
+		return
+	}
+
+	for _, e := range f.entities {
+		trip := e.GetTripUpdate().GetTrip()
+		stopTimeUpdates := e.GetTripUpdate().GetStopTimeUpdate()
+
+		tu := &TripUpdate{
+			AgencyID: agencyID,
+			RouteID:  routeID,
+			TripID:   trip.GetTripId(),
+		}
+
+		for _, u := range stopTimeUpdates {
+			stu := StopTimeUpdate{StopID: u.GetStopId()}
+			if u.GetArrival().GetTime() > 0 {
+				stu.Arrival = time.Unix(u.GetArrival().GetTime(), 0)
+			}
+			if u.GetDeparture().GetTime() > 0 {
+				stu.Departure = time.Unix(u.GetDeparture().GetTime(), 0)
+			}
+
+			tu.Stops = append(tu.Stops, stu)
+		}
+		t = append(t, tu)
+
+		assigned, aerr := isAssigned(trip)
+		if aerr != nil || !assigned {
+			continue
+		}
+
+		// The stop's direction is part of the stop ID, so it's fine
+		// to look up the vehicle with either direction
+		nextStopID := stopTimeUpdates[0].GetStopId()
+		vehicle, verr := models.GetVehicle(agencyID, routeID, nextStopID, directionID)
+		if verr != nil {
+			continue
+		}
+
+		v = append(v, &VehiclePosition{
+			AgencyID:  agencyID,
+			RouteID:   routeID,
+			TripID:    trip.GetTripId(),
+			Lat:       vehicle.Lat,
+			Lon:       vehicle.Lon,
+			StopID:    nextStopID,
+			Occupancy: f.occupancy[trip.GetTripId()],
+			Timestamp: f.ts,
+		})
+	}
+
+	return
+}
@@ -0,0 +1,39 @@
+package partners
+
+import (
+	"strings"
+
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/partners/transit_realtime"
+)
+
+// siriOccupancy converts the SIRI Occupancy values used by Bus Time to
+// our values, which are the GTFS-realtime OccupancyStatus names in lower
+// case
+var siriOccupancy = map[string]string{
+	"seatsAvailable":    "many_seats_available",
+	"standingAvailable": "standing_room_only",
+	"full":              "full",
+}
+
+// occupancyFromSiri returns the occupancy of a SIRI Occupancy value, which
+// is null if the value is missing or unknown
+func occupancyFromSiri(s string) null.String {
+	o, exists := siriOccupancy[s]
+	if !exists {
+		return null.String{}
+	}
+
+	return null.StringFrom(o)
+}
+
+// occupancyFromGTFS returns the occupancy of a GTFS-realtime vehicle
+// position, which is null if it isn't set
+func occupancyFromGTFS(vp *transit_realtime.VehiclePosition) null.String {
+	if vp == nil || vp.OccupancyStatus == nil {
+		return null.String{}
+	}
+
+	return null.StringFrom(strings.ToLower(vp.GetOccupancyStatus().String()))
+}
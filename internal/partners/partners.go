@@ -3,29 +3,47 @@ package partners
 import (
 	"errors"
 
+	"github.com/brnstz/bus/internal/etc"
 	"github.com/brnstz/bus/internal/models"
 )
 
 var (
 	// ErrNoPartner means there is no configured partner for this route
 	ErrNoPartner = errors.New("no partner for this route")
+
+	// Replay, when not nil, is used instead of the cache to read the data
+	// that Precache saved at a key, so that Live and Realtime return what
+	// partners told us in the past
+	Replay func(k string) ([]byte, error)
 )
 
 // P is an interface that can pull live info from partners
 type P interface {
 	// Precache is called by the precacher binary and saves raw bytes of
-	// response into redis. Doing precache prevents clients from hammering
+	// response into the cache. Doing precache prevents clients from hammering
 	// partner serves and also ensures our own responses are fast.
 	// The precacher will call this function for every valid
 	// agency / route / direction combo that returns a partner with
 	// Find().
 	Precache(agencyID, routeID string, directionID int) error
 
-	// Live reads the data saved into redis by Precache, parses it and
+	// Live reads the data saved into the cache by Precache, parses it and
 	// returns any Departure and/or Vehicle info that can be appended
 	// to the response.
 	Live(agencyID, routeID, stopID string, directionID int) ([]*models.Departure, []models.Vehicle, error)
 
+	// Key returns the cache key that Precache saves to and Live reads
+	// from for this agency / route / direction. When Precache saves a
+	// new value, the key is published on the update channel. An empty
+	// string means there is nothing cached.
+	Key(agencyID, routeID string, directionID int) string
+
+	// Realtime reads the data saved into the cache by Precache and returns
+	// every trip update and vehicle position of the route. Partners
+	// without live data return nothing. For partners whose response is
+	// the same for both directions, only one direction returns data.
+	Realtime(agencyID, routeID string, directionID int) ([]*TripUpdate, []*VehiclePosition, error)
+
 	IsLive() bool
 }
 
@@ -59,3 +77,13 @@ func Find(route models.Route) (P, error) {
 	}
 
 }
+
+// cached returns the data that Precache saved at k, from Replay if it's
+// set or otherwise from the cache
+func cached(k string) ([]byte, error) {
+	if Replay != nil {
+		return Replay(k)
+	}
+
+	return etc.Cache.Get(k)
+}
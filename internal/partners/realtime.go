@@ -0,0 +1,47 @@
+package partners
+
+import (
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+)
+
+// TripUpdate is the live arrival and departure times of a trip at its
+// next stops, in the same form for every partner
+type TripUpdate struct {
+	AgencyID    string
+	RouteID     string
+	TripID      string
+	DirectionID null.Int
+
+	Stops []StopTimeUpdate
+}
+
+// StopTimeUpdate is when a trip is expected at a stop. Either time may
+// be zero if the partner doesn't provide it.
+type StopTimeUpdate struct {
+	StopID    string
+	Arrival   time.Time
+	Departure time.Time
+}
+
+// VehiclePosition is the location of a vehicle on a trip, in the same
+// form for every partner
+type VehiclePosition struct {
+	AgencyID    string
+	RouteID     string
+	TripID      string
+	DirectionID null.Int
+
+	Lat float64
+	Lon float64
+
+	// StopID is the next stop of the vehicle, if it's known
+	StopID string
+
+	// Occupancy is in the same form as models.Vehicle.Occupancy
+	Occupancy null.String
+
+	// Timestamp is when the position was recorded
+	Timestamp time.Time
+}
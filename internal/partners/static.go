@@ -18,8 +18,12 @@ func (p static) IsLive() bool {
 	return false
 }
 
+func (p static) Key(agencyID, routeID string, directionID int) string {
+	return fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
+}
+
 func (p static) Precache(agencyID, routeID string, directionID int) error {
-	k := fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
+	k := p.Key(agencyID, routeID, directionID)
 	now := time.Now()
 
 	today := etc.BaseTime(now)
@@ -40,9 +44,9 @@ func (p static) Precache(agencyID, routeID string, directionID int) error {
 		return err
 	}
 
-	err = etc.RedisCache(k, b)
+	err = etc.CacheSave(k, b)
 	if err != nil {
-		log.Println("can't save static vehicles to redis", err)
+		log.Println("can't save static vehicles to cache", err)
 		return err
 	}
 
@@ -51,12 +55,18 @@ func (p static) Precache(agencyID, routeID string, directionID int) error {
 	return nil
 }
 
+// Realtime returns nothing, because static vehicle locations are estimated
+// from the schedule
+func (p static) Realtime(agencyID, routeID string, directionID int) (t []*TripUpdate, v []*VehiclePosition, err error) {
+	return
+}
+
 func (p static) Live(agencyID, routeID, stopID string, directionID int) (d []*models.Departure, v []models.Vehicle, err error) {
-	k := fmt.Sprintf("%v|%v|%v", agencyID, routeID, directionID)
+	k := p.Key(agencyID, routeID, directionID)
 
-	b, err := etc.RedisGet(k)
+	b, err := cached(k)
 	if err != nil {
-		log.Println("can't get from redis", err)
+		log.Println("can't get from cache", err)
 		return
 	}
 
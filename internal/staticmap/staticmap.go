@@ -0,0 +1,263 @@
+// Package staticmap draws lines and points on a plain background and
+// encodes the result as a PNG. It's used to create preview images of
+// trips and stops without depending on an external tile server.
+package staticmap
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Background is the color of the map before anything is drawn
+	Background = color.RGBA{0xF2, 0xEF, 0xE9, 0xFF}
+
+	// padding is the fraction of each side of the image that we leave
+	// empty when fitting the view to what's drawn
+	padding = 0.08
+
+	// minMeters is the smallest distance we show across the image when
+	// fitting the view, so that a single point isn't zoomed in forever
+	minMeters = 500.0
+)
+
+// mercatorRadius is the radius of the earth in web mercator meters
+const mercatorRadius = 6378137.0
+
+type line struct {
+	lats  []float64
+	lons  []float64
+	color color.RGBA
+	width float64
+}
+
+type point struct {
+	lat    float64
+	lon    float64
+	fill   color.RGBA
+	stroke color.RGBA
+	radius float64
+}
+
+// Map is an image of lines and points. Items are drawn in the order
+// they are added, lines first and then points.
+type Map struct {
+	width  int
+	height int
+
+	lines  []line
+	points []point
+
+	// When centered is true, the view is centered on (lat, lon) and
+	// shows meters across the shorter side of the image. Otherwise it
+	// fits everything that's drawn.
+	centered bool
+	lat      float64
+	lon      float64
+	meters   float64
+}
+
+// New returns an empty map of width x height pixels
+func New(width, height int) *Map {
+	return &Map{width: width, height: height}
+}
+
+// Center sets the view to be centered on lat, lon with meters visible
+// across the shorter side of the image. Anything outside of the view is
+// not drawn.
+func (m *Map) Center(lat, lon, meters float64) {
+	m.centered = true
+	m.lat = lat
+	m.lon = lon
+	m.meters = meters
+}
+
+// AddLine adds a line through each lat[i], lon[i] of width pixels
+func (m *Map) AddLine(lats, lons []float64, c color.RGBA, width float64) {
+	if len(lats) != len(lons) || len(lats) < 2 {
+		return
+	}
+
+	m.lines = append(m.lines, line{lats: lats, lons: lons, color: c, width: width})
+}
+
+// AddPoint adds a circle at lat, lon. The stroke is drawn around the
+// fill and is a quarter of the radius wide.
+func (m *Map) AddPoint(lat, lon float64, fill, stroke color.RGBA, radius float64) {
+	m.points = append(m.points, point{lat: lat, lon: lon, fill: fill, stroke: stroke, radius: radius})
+}
+
+// project converts lat, lon to web mercator meters
+func project(lat, lon float64) (x, y float64) {
+	x = mercatorRadius * lon * math.Pi / 180.0
+	y = mercatorRadius * math.Log(math.Tan(math.Pi/4+lat*math.Pi/360.0))
+	return
+}
+
+// view returns the center of the view in web mercator and the number of
+// mercator meters per pixel
+func (m *Map) view() (cx, cy, scale float64) {
+	short := float64(m.width)
+	if m.height < m.width {
+		short = float64(m.height)
+	}
+
+	if m.centered {
+		cx, cy = project(m.lat, m.lon)
+
+		// Mercator meters are stretched away from the equator
+		scale = m.meters / math.Cos(m.lat*math.Pi/180.0) / short
+		return
+	}
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	minLat, maxLat := math.Inf(1), math.Inf(-1)
+
+	add := func(lat, lon float64) {
+		x, y := project(lat, lon)
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+		minLat, maxLat = math.Min(minLat, lat), math.Max(maxLat, lat)
+	}
+	for _, l := range m.lines {
+		for i := range l.lats {
+			add(l.lats[i], l.lons[i])
+		}
+	}
+	for _, p := range m.points {
+		add(p.lat, p.lon)
+	}
+
+	if math.IsInf(minX, 1) {
+		return 0, 0, 1
+	}
+
+	cx = (minX + maxX) / 2
+	cy = (minY + maxY) / 2
+
+	usable := 1 - 2*padding
+	scale = math.Max(
+		(maxX-minX)/(float64(m.width)*usable),
+		(maxY-minY)/(float64(m.height)*usable),
+	)
+
+	minScale := minMeters / math.Cos((minLat+maxLat)/2*math.Pi/180.0) / short
+	if scale < minScale {
+		scale = minScale
+	}
+
+	return
+}
+
+// Image draws the map
+func (m *Map) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, m.width, m.height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = Background.R
+		img.Pix[i+1] = Background.G
+		img.Pix[i+2] = Background.B
+		img.Pix[i+3] = Background.A
+	}
+
+	cx, cy, scale := m.view()
+	pixel := func(lat, lon float64) (px, py float64) {
+		x, y := project(lat, lon)
+		px = (x-cx)/scale + float64(m.width)/2
+		py = (cy-y)/scale + float64(m.height)/2
+		return
+	}
+
+	for _, l := range m.lines {
+		x0, y0 := pixel(l.lats[0], l.lons[0])
+		for i := 1; i < len(l.lats); i++ {
+			x1, y1 := pixel(l.lats[i], l.lons[i])
+			drawSegment(img, x0, y0, x1, y1, l.width, l.color)
+			x0, y0 = x1, y1
+		}
+	}
+
+	for _, p := range m.points {
+		x, y := pixel(p.lat, p.lon)
+		drawSegment(img, x, y, x, y, p.radius*2, p.stroke)
+		drawSegment(img, x, y, x, y, p.radius*1.5, p.fill)
+	}
+
+	return img
+}
+
+// Encode draws the map and writes it to w as a PNG
+func (m *Map) Encode(w io.Writer) error {
+	return png.Encode(w, m.Image())
+}
+
+// drawSegment draws a line from (x0, y0) to (x1, y1) that is width pixels
+// wide with round ends. When the ends are the same, it's a circle.
+func drawSegment(img *image.RGBA, x0, y0, x1, y1, width float64, c color.RGBA) {
+	r := width / 2
+	b := img.Bounds()
+
+	minX := int(math.Max(math.Floor(math.Min(x0, x1)-r-1), float64(b.Min.X)))
+	maxX := int(math.Min(math.Ceil(math.Max(x0, x1)+r+1), float64(b.Max.X-1)))
+	minY := int(math.Max(math.Floor(math.Min(y0, y1)-r-1), float64(b.Min.Y)))
+	maxY := int(math.Min(math.Ceil(math.Max(y0, y1)+r+1), float64(b.Max.Y-1)))
+
+	dx, dy := x1-x0, y1-y0
+	length2 := dx*dx + dy*dy
+
+	for py := minY; py <= maxY; py++ {
+		for px := minX; px <= maxX; px++ {
+			// Distance from the center of the pixel to the segment
+			x, y := float64(px)+0.5, float64(py)+0.5
+
+			t := 0.0
+			if length2 > 0 {
+				t = ((x-x0)*dx + (y-y0)*dy) / length2
+				t = math.Max(0, math.Min(1, t))
+			}
+			d := math.Hypot(x-(x0+t*dx), y-(y0+t*dy))
+
+			// Anti-alias the edge over one pixel
+			coverage := math.Max(0, math.Min(1, r+0.5-d))
+			if coverage > 0 {
+				blend(img, px, py, c, coverage)
+			}
+		}
+	}
+}
+
+// blend mixes c into the pixel at x, y by the fraction a
+func blend(img *image.RGBA, x, y int, c color.RGBA, a float64) {
+	a = a * float64(c.A) / 0xFF
+
+	i := img.PixOffset(x, y)
+	mix := func(dst, src uint8) uint8 {
+		return uint8(float64(src)*a + float64(dst)*(1-a) + 0.5)
+	}
+
+	img.Pix[i] = mix(img.Pix[i], c.R)
+	img.Pix[i+1] = mix(img.Pix[i+1], c.G)
+	img.Pix[i+2] = mix(img.Pix[i+2], c.B)
+	img.Pix[i+3] = 0xFF
+}
+
+// ParseColor converts a color like "#00933C" or "00933C" to a
+// color.RGBA, returning def if it can't be parsed
+func ParseColor(s string, def color.RGBA) color.RGBA {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return def
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return def
+	}
+
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xFF}
+}
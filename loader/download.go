@@ -10,12 +10,18 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/brnstz/bus/internal/conf"
 )
 
 func download(dlURL, dir string) error {
+	// Allow local files for testing and comparing feeds
+	if strings.HasPrefix(dlURL, "file://") {
+		return fileDL(strings.TrimPrefix(dlURL, "file://"), dir)
+	}
+
 	switch dlURL {
 
 	case "https://www.njtransit.com/mt/mt_servlet.srv?hdnPageAction=MTDevResourceDownloadTo&Category=rail", "https://www.njtransit.com/mt/mt_servlet.srv?hdnPageAction=MTDevResourceDownloadTo&Category=bus":
@@ -163,3 +169,50 @@ func defaultDL(dlURL, dir string) error {
 
 	return unzipit(dir, fh, n)
 }
+
+// fileDL copies a local feed to dir. filename is either a zip file or a
+// directory of GTFS files, like testdata/gtfs.
+func fileDL(filename, dir string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return copyDir(filename, dir)
+	}
+
+	return unzipit(dir, fh, fi.Size())
+}
+
+// copyDir copies each file in src to dst
+func copyDir(src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(path.Join(src, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(path.Join(dst, f.Name()), b, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package loader
+
+import (
+	"testing"
+)
+
+func TestDownloadDir(t *testing.T) {
+	src := writeFeed(t, map[string]string{
+		"routes.txt": "route_id,route_type\nG,1\n",
+		"stops.txt":  "stop_id,stop_name\nG26N,Greenpoint Av\n",
+	})
+	dir := t.TempDir()
+
+	err := download("file://"+src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readFeed(t, dir, "routes.txt") != "route_id,route_type\nG,1\n" {
+		t.Error("unexpected routes.txt", readFeed(t, dir, "routes.txt"))
+	}
+	if readFeed(t, dir, "stops.txt") != "stop_id,stop_name\nG26N,Greenpoint Av\n" {
+		t.Error("unexpected stops.txt", readFeed(t, dir, "stops.txt"))
+	}
+}
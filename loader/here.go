@@ -0,0 +1,128 @@
+package loader
+
+import (
+	"log"
+
+	"github.com/brnstz/bus/internal/etc"
+)
+
+// hereTables are the statements that rebuild the rows of one agency, $1,
+// in here_trip, service and service_exception. These tables aggregate
+// the rest of the schema for the queries of busapi. The time of the
+// rebuild is saved in here_load.
+var hereTables = []string{
+	`DELETE FROM here_trip WHERE agency_id = $1`,
+	`INSERT INTO here_trip (
+		agency_id, route_id, stop_id, service_id,
+		trip_ids, arrival_secs, departure_secs, stop_sequences,
+		next_stop_ids, next_stop_lats, next_stop_lons,
+		stop_name, direction_id, stop_headsign, location,
+		route_type, route_color, route_text_color,
+		route_short_name, route_long_name, trip_headsign
+	)
+	SELECT
+		sst.agency_id,
+		sst.route_id,
+		sst.stop_id,
+		sst.service_id,
+
+		string_agg(sst.trip_id::text,       ','),
+		string_agg(sst.arrival_sec::text,   ','),
+		string_agg(sst.departure_sec::text, ','),
+		string_agg(sst.stop_sequence::text, ','),
+		string_agg(sst.next_stop_id::text,  ','),
+		string_agg(st_x(sst.next_stop_location)::text, ','),
+		string_agg(st_y(sst.next_stop_location)::text, ','),
+
+		stop.stop_name,
+		stop.direction_id,
+		stop.headsign,
+		stop.location,
+
+		route.route_type,
+		route.route_color,
+		route.route_text_color,
+		COALESCE(route.route_short_name, ''),
+		COALESCE(route.route_long_name, ''),
+
+		trip.headsign
+
+	FROM scheduled_stop_time sst
+
+	INNER JOIN trip ON
+		sst.agency_id = trip.agency_id AND
+		sst.trip_id   = trip.trip_id
+
+	INNER JOIN stop ON
+		sst.agency_id     = stop.agency_id AND
+		sst.route_id      = stop.route_id  AND
+		sst.stop_id       = stop.stop_id   AND
+		trip.direction_id = stop.direction_id
+
+	INNER JOIN route ON
+		sst.agency_id = route.agency_id AND
+		sst.route_id  = route.route_id
+
+	WHERE
+		sst.agency_id          = $1        AND
+		sst.last_stop          IS FALSE    AND
+		sst.last_stop          IS NOT NULL AND
+		sst.next_stop_location IS NOT NULL
+
+	GROUP BY
+	sst.agency_id, sst.route_id, sst.stop_id, sst.service_id,
+	stop.stop_name, stop.direction_id, stop.headsign, stop.location,
+	route.route_type, route.route_color, route.route_text_color,
+	route.route_short_name, route.route_long_name, trip.headsign`,
+
+	`DELETE FROM service WHERE agency_id = $1`,
+	`INSERT INTO service (agency_id, service_id, day, start_date, end_date)
+	SELECT DISTINCT ON (agency_id, service_id, day)
+		agency_id, service_id, day, start_date, end_date
+	FROM service_route_day
+	WHERE agency_id = $1`,
+
+	`DELETE FROM service_exception WHERE agency_id = $1`,
+	`INSERT INTO service_exception (agency_id, service_id, exception_date, exception_type)
+	SELECT DISTINCT ON (agency_id, service_id, exception_date)
+		agency_id, service_id, exception_date, exception_type
+	FROM service_route_exception
+	WHERE agency_id = $1`,
+
+	`DELETE FROM here_load WHERE agency_id = $1`,
+	`INSERT INTO here_load (agency_id, loaded_at) VALUES ($1, now())`,
+}
+
+// updateHere rebuilds the rows of agencyID in here_trip, service and
+// service_exception. It's done in one transaction, so queries see
+// either all of the old rows or all of the new ones. Other agencies
+// aren't changed.
+func updateHere(agencyID string) (err error) {
+	statements := hereTables
+	if etc.SQLite() {
+		statements = sqliteHereTables
+	}
+
+	tx, err := etc.DBConn.Beginx()
+	if err != nil {
+		log.Println("can't create tx to update here tables", agencyID, err)
+		return
+	}
+
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, agencyID)
+		if err != nil {
+			log.Println("can't update here tables", agencyID, statement, err)
+			tx.Rollback()
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit update to here tables", agencyID, err)
+		return
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package loader
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,17 +15,17 @@ import (
 
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/health"
 	"github.com/brnstz/bus/internal/models"
 )
 
 var (
-	days        = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
-	datefmt     = "20060102"
 	loaderBreak = time.Hour * 24
 
-	views = []string{"here_trip", "service", "service_exception"}
-
 	logp = 1000
+
+	// beat is marked after each load by LoadForever
+	beat health.Beat
 )
 
 // rskey is the unique key for a route_shape
@@ -121,7 +122,10 @@ func (l *Loader) load() {
 	l.loadCalendarDates()
 	l.loadShapes()
 
-	l.updateRouteShapes()
+	err := l.updateRouteShapes()
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
 // skipRoute returns true if we should skip this route given our routeFilter
@@ -141,7 +145,7 @@ func (l *Loader) loadRoutes() {
 
 	header, err := f.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	routeIdx := find(header, "route_id")
@@ -169,7 +173,7 @@ func (l *Loader) loadRoutes() {
 
 		routeType, err := strconv.Atoi(rec[routeTypeIdx])
 		if err != nil {
-			log.Fatalf("%v on line %v of routes.txt", err, i)
+			log.Panicf("%v on line %v of routes.txt", err, i)
 		}
 
 		routeColor := rec[routeColorIdx]
@@ -195,12 +199,12 @@ func (l *Loader) loadRoutes() {
 			shortName, longName,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of routes.txt", err, i)
+			log.Panicf("%v on line %v of routes.txt", err, i)
 		}
 
 		err = r.Save()
 		if err != nil {
-			log.Fatalf("%v on line %v of routes.txt", err, i)
+			log.Panicf("%v on line %v of routes.txt", err, i)
 		}
 
 		l.routeAgency[route] = agencyID
@@ -215,7 +219,7 @@ func (l *Loader) loadTrips() {
 
 	header, err := f.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	tripIdx := find(header, "trip_id")
@@ -232,11 +236,11 @@ func (l *Loader) loadTrips() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of trips.txt", err, i)
+			log.Panicf("%v on line %v of trips.txt", err, i)
 		}
 		direction, err := strconv.Atoi(rec[dirIdx])
 		if err != nil {
-			log.Fatalf("%v on line %v of trips.txt", err, i)
+			log.Panicf("%v on line %v of trips.txt", err, i)
 		}
 
 		id := rec[tripIdx]
@@ -253,7 +257,7 @@ func (l *Loader) loadTrips() {
 			id, route, agency, service, shape, rec[headIdx], direction,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of trips.txt", err, i)
+			log.Panicf("%v on line %v of trips.txt", err, i)
 		}
 
 		l.trips[trip.TripID] = trip
@@ -272,7 +276,7 @@ func (l *Loader) loadTrips() {
 
 		err = trip.Save()
 		if err != nil {
-			log.Fatalf("%v on line %v of trips.txt", err, i)
+			log.Panicf("%v on line %v of trips.txt", err, i)
 		}
 
 		l.tripRoute[id] = route
@@ -290,7 +294,7 @@ func (l *Loader) loadStopTimes() {
 
 	header, err := stopTimesUnsorted.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	stopIdx := find(header, "stop_id")
@@ -304,14 +308,14 @@ func (l *Loader) loadStopTimes() {
 	// be sure
 	noFirstLine, err := ioutil.TempFile(l.dir, "")
 	if err != nil {
-		log.Fatal("can't create first line file", err)
+		log.Panic("can't create first line file", err)
 	}
 	defer noFirstLine.Close()
 	defer os.Remove(noFirstLine.Name())
 
 	sorted, err := ioutil.TempFile(l.dir, "")
 	if err != nil {
-		log.Fatal("can't create sorted file", err)
+		log.Panic("can't create sorted file", err)
 	}
 	defer sorted.Close()
 	defer os.Remove(sorted.Name())
@@ -322,11 +326,11 @@ func (l *Loader) loadStopTimes() {
 	cmd.Stdout = noFirstLine
 	err = cmd.Run()
 	if err != nil {
-		log.Fatal("can't create file with no first line", err)
+		log.Panic("can't create file with no first line", err)
 	}
 	err = noFirstLine.Close()
 	if err != nil {
-		log.Fatal("can't close no first line file", err)
+		log.Panic("can't close no first line file", err)
 	}
 
 	// Sort primarily by trip then by sequence id
@@ -341,11 +345,11 @@ func (l *Loader) loadStopTimes() {
 	cmd.Stdout = sorted
 	err = cmd.Run()
 	if err != nil {
-		log.Fatal("can't sort file", err, cmd)
+		log.Panic("can't sort file", err, cmd)
 	}
 	err = sorted.Close()
 	if err != nil {
-		log.Fatal("can't close sorted file")
+		log.Panic("can't close sorted file")
 	}
 
 	// Open the sorted file and process
@@ -360,14 +364,14 @@ func (l *Loader) loadStopTimes() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 
 		trip := rec[tripIdx]
 		sequenceStr := rec[sequenceIdx]
 		sequence, err := strconv.Atoi(sequenceStr)
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 
 		if sequence > l.maxTripSeq[trip] {
@@ -376,7 +380,7 @@ func (l *Loader) loadStopTimes() {
 	}
 	err = fh.Close()
 	if err != nil {
-		log.Fatal("can't close", err)
+		log.Panic("can't close", err)
 	}
 
 	stopTimes, fh = getcsv(l.dir, path.Base(sorted.Name()))
@@ -393,7 +397,7 @@ func (l *Loader) loadStopTimes() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 
 		stop = rec[stopIdx]
@@ -404,7 +408,7 @@ func (l *Loader) loadStopTimes() {
 		sequenceStr := rec[sequenceIdx]
 		sequence, err := strconv.Atoi(sequenceStr)
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 
 		l.stopTrips[stop] = append(l.stopTrips[stop], trip)
@@ -425,7 +429,7 @@ func (l *Loader) loadStopTimes() {
 
 			ll := l.stopLocation[stop]
 			if ll == nil {
-				log.Fatal("can't get lat lon", stop)
+				log.Panic("can't get lat lon", stop)
 			}
 
 			if sst.TripID == trip {
@@ -440,7 +444,7 @@ func (l *Loader) loadStopTimes() {
 
 			err = sst.Save()
 			if err != nil {
-				log.Fatalf("%v on line %v of stop_times.txt", err, i)
+				log.Panicf("%v on line %v of stop_times.txt", err, i)
 			}
 		}
 
@@ -449,7 +453,7 @@ func (l *Loader) loadStopTimes() {
 			agencyID, trip, sequence, lastStop,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 	}
 
@@ -460,7 +464,7 @@ func (l *Loader) loadStopTimes() {
 
 		err = sst.Save()
 		if err != nil {
-			log.Fatalf("%v on line %v of stop_times.txt", err, i)
+			log.Panicf("%v on line %v of stop_times.txt", err, i)
 		}
 	}
 }
@@ -473,7 +477,7 @@ func (l *Loader) loadStopLocations() {
 
 	header, err := stops.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	stopIdx := find(header, "stop_id")
@@ -486,21 +490,21 @@ func (l *Loader) loadStopLocations() {
 			break
 		}
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		stopLat, err := strconv.ParseFloat(
 			strings.TrimSpace(rec[stopLatIdx]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		stopLon, err := strconv.ParseFloat(
 			strings.TrimSpace(rec[stopLonIdx]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		ll := &latlon{
@@ -520,7 +524,7 @@ func (l *Loader) loadUniqueStop() {
 
 	header, err := stops.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	stopIdx := find(header, "stop_id")
@@ -535,21 +539,21 @@ func (l *Loader) loadUniqueStop() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		stopLat, err := strconv.ParseFloat(
 			strings.TrimSpace(rec[stopLatIdx]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		stopLon, err := strconv.ParseFloat(
 			strings.TrimSpace(rec[stopLonIdx]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of stops.txt", err, i)
+			log.Panicf("%v on line %v of stops.txt", err, i)
 		}
 
 		trips, exists := l.stopTrips[rec[stopIdx]]
@@ -573,7 +577,7 @@ func (l *Loader) loadUniqueStop() {
 
 				err = obj.Save()
 				if err != nil {
-					log.Fatalf("%v on line %v of stops.txt", err, i)
+					log.Panicf("%v on line %v of stops.txt", err, i)
 				}
 			}
 		}
@@ -587,7 +591,7 @@ func (l *Loader) loadCalendarDates() {
 
 	header, err := cal.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	serviceIdx := find(header, "service_id")
@@ -601,25 +605,25 @@ func (l *Loader) loadCalendarDates() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of calendar_dates.txt", err, i)
+			log.Panicf("%v on line %v of calendar_dates.txt", err, i)
 		}
 
 		serviceId := rec[serviceIdx]
 
-		exceptionDate, err := time.Parse(datefmt, rec[exceptionDateIdx])
+		exceptionDate, err := time.Parse(etc.DateFormat, rec[exceptionDateIdx])
 		if err != nil {
-			log.Fatalf("can't parse exception date %v %v",
+			log.Panicf("can't parse exception date %v %v",
 				err, rec[exceptionDateIdx])
 		}
 
 		exceptionType, err := strconv.Atoi(rec[exceptionTypeIdx])
 		if err != nil {
-			log.Fatalf("can't parse exception type integer %v %v",
+			log.Panicf("can't parse exception type integer %v %v",
 				err, rec[exceptionTypeIdx])
 		}
 
 		if !(exceptionType == models.ServiceAdded || exceptionType == models.ServiceRemoved) {
-			log.Fatalf("invalid value for exception_type %v", exceptionType)
+			log.Panicf("invalid value for exception_type %v", exceptionType)
 		}
 
 		for route, _ := range l.serviceRoute[serviceId] {
@@ -633,7 +637,7 @@ func (l *Loader) loadCalendarDates() {
 
 			err = s.Save()
 			if err != nil {
-				log.Fatalf("%v on line %v of calendar_dates.txt with %v", err, i, s)
+				log.Panicf("%v on line %v of calendar_dates.txt with %v", err, i, s)
 			}
 		}
 	}
@@ -653,11 +657,11 @@ func (l *Loader) loadCalendars() {
 
 	header, err := cal.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	idxs := map[string]int{}
-	for _, day := range days {
+	for _, day := range etc.Days {
 		idxs[day] = find(header, day)
 	}
 	serviceIdx := find(header, "service_id")
@@ -671,19 +675,19 @@ func (l *Loader) loadCalendars() {
 		}
 
 		if err != nil {
-			log.Fatalf("%v on line %v of calendar.txt", err, i)
+			log.Panicf("%v on line %v of calendar.txt", err, i)
 		}
 
 		serviceId := rec[serviceIdx]
 
-		startDate, err := time.Parse(datefmt, rec[startDateIdx])
+		startDate, err := time.Parse(etc.DateFormat, rec[startDateIdx])
 		if err != nil {
-			log.Fatalf("can't parse start date %v %v", err, rec[startDateIdx])
+			log.Panicf("can't parse start date %v %v", err, rec[startDateIdx])
 		}
 
-		endDate, err := time.Parse(datefmt, rec[endDateIdx])
+		endDate, err := time.Parse(etc.DateFormat, rec[endDateIdx])
 		if err != nil {
-			log.Fatalf("can't parse end date %v %v", err, rec[endDateIdx])
+			log.Panicf("can't parse end date %v %v", err, rec[endDateIdx])
 		}
 
 		for day, dayIdx := range idxs {
@@ -703,7 +707,7 @@ func (l *Loader) loadCalendars() {
 
 				err = srd.Save()
 				if err != nil {
-					log.Fatalf("%v on line %v of calendar.txt with %v", err, i, srd)
+					log.Panicf("%v on line %v of calendar.txt with %v", err, i, srd)
 				}
 			}
 		}
@@ -718,7 +722,7 @@ func (l *Loader) loadShapes() {
 
 	header, err := shapes.Read()
 	if err != nil {
-		log.Fatalf("unable to read header: %v", err)
+		log.Panicf("unable to read header: %v", err)
 	}
 
 	idIDX := find(header, "shape_id")
@@ -736,14 +740,14 @@ func (l *Loader) loadShapes() {
 			strings.TrimSpace(rec[latIDX]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of shapes.txt", err, i)
+			log.Panicf("%v on line %v of shapes.txt", err, i)
 		}
 
 		lon, err := strconv.ParseFloat(
 			strings.TrimSpace(rec[lonIDX]), 64,
 		)
 		if err != nil {
-			log.Fatalf("%v on line %v of shapes.txt", err, i)
+			log.Panicf("%v on line %v of shapes.txt", err, i)
 		}
 
 		seq, err := strconv.ParseInt(
@@ -763,31 +767,28 @@ func (l *Loader) loadShapes() {
 		)
 		err = shape.Save(etc.DBConn)
 		if err != nil {
-			log.Fatalf("%v on line %v of shapes.txt", err, i)
+			log.Panicf("%v on line %v of shapes.txt", err, i)
 		}
 	}
 }
 
 // updateRouteShapes updates the route_shape table by identifying
 // the "biggest" shapes typical for a route
-func (l *Loader) updateRouteShapes() {
-	var err error
-
+func (l *Loader) updateRouteShapes() (err error) {
 	tx, err := etc.DBConn.Beginx()
 	if err != nil {
-		log.Fatal(err)
+		log.Println("can't create tx to update route shapes", err)
+		return
 	}
 	defer func() {
-		if err == nil {
-			err = tx.Commit()
-			if err != nil {
-				log.Println("can't commit route shapes", err)
-			}
-		} else {
+		if err != nil {
 			tx.Rollback()
-			if err != nil {
-				log.Println("can't rollback route shapes", err)
-			}
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Println("can't commit route shapes", err)
 		}
 	}()
 
@@ -795,20 +796,23 @@ func (l *Loader) updateRouteShapes() {
 	// unless committed)
 	err = models.DeleteRouteShapes(tx)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("can't delete route shapes", err)
+		return
 	}
 
 	// Get shapes ordered from smallest to largest
 	routeShapes, err := models.GetRouteShapes(tx)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("can't get route shapes", err)
+		return
 	}
 
 	for _, rs := range routeShapes {
 		// upsert each route so we end up with the most common
 		err = rs.Save(tx)
 		if err != nil {
-			log.Fatal(err)
+			log.Println("can't save route shape", err)
+			return
 		}
 	}
 
@@ -816,34 +820,55 @@ func (l *Loader) updateRouteShapes() {
 	// unless committed)
 	err = models.DeleteFakeShapes(tx)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("can't delete fake shapes", err)
+		return
 	}
 
 	// Get shapes ordered from smallest to largest
 	fakeShapes, err := models.GetFakeRouteShapes(tx)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("can't get fake shapes", err)
+		return
 	}
 
 	for _, fs := range fakeShapes {
 		// upsert each route so we end up with the most common
 		err = fs.Save(tx)
 		if err != nil {
-			log.Fatal(err)
+			log.Println("can't save fake shape", err)
+			return
 		}
 	}
 
+	return
 }
 
 // LoadOnce loads the files in conf.Loader.GTFSURLs, possibly filtering by the
 // routes specified in conf.Loader.RouteFilter. If no filter is defined,
-// it loads all data in the specified URLs.
-func LoadOnce() {
+// it loads all data in the specified URLs. If ctx is done, it finishes the
+// file it's loading and skips the rest. An error in a file is logged and
+// the next file is loaded.
+func LoadOnce(ctx context.Context) {
+	rules, err := getFeedRules()
+	if err != nil {
+		log.Println("can't get prep rules", err)
+		return
+	}
+
+	// The agencies of every feed that we loaded. A feed may have more
+	// than one agency, and an agency may have more than one feed.
+	loaded := map[string]bool{}
+
 	for _, url := range conf.Loader.GTFSURLs {
 		if len(url) < 1 {
 			continue
 		}
 
+		if ctx.Err() != nil {
+			log.Printf("stopping before %v", url)
+			break
+		}
+
 		log.Printf("starting %v", url)
 
 		dir, err := ioutil.TempDir(conf.Loader.TmpDir, "")
@@ -858,7 +883,7 @@ func LoadOnce() {
 			continue
 		}
 
-		err = prepare(url, dir)
+		err = prepare(rules[url], dir)
 		if err != nil {
 			log.Println(err)
 			continue
@@ -869,7 +894,7 @@ func LoadOnce() {
 			defer func() {
 				r := recover()
 				if r != nil {
-					log.Println("recovering from error in %v %v: %v", url, dir, r)
+					log.Printf("recovering from error in %v %v: %v", url, dir, r)
 				}
 				os.RemoveAll(dir)
 			}()
@@ -879,59 +904,87 @@ func LoadOnce() {
 			l.load()
 			t2 := time.Now()
 
+			for _, agencyID := range l.routeAgency {
+				loaded[agencyID] = true
+			}
+
 			log.Printf("took %v for %v", t2.Sub(t1), url)
 		}()
 	}
 
-	// Update materialized views. Use a transaction for each one, because
-	// we reset each view's primary ID sequence in a separate statement.
-	for _, view := range views {
-		func() {
-			var err error
+	// Rebuild the here tables of only the agencies we loaded
+	for agencyID := range loaded {
+		log.Printf("updating here tables for %v", agencyID)
 
-			tx, err := etc.DBConn.Beginx()
-			if err != nil {
-				log.Fatal("can't create tx to update view", view, err)
-			}
+		err = updateHere(agencyID)
+		if err != nil {
+			log.Println("can't update here tables", agencyID, err)
+			continue
+		}
 
-			defer func() {
-				if err == nil {
-					commitErr := tx.Commit()
-					if commitErr != nil {
-						log.Fatal("error committing update to view", view, err)
-					}
-				} else {
-					rollbackErr := tx.Rollback()
-					if rollbackErr != nil {
-						log.Fatal("error rolling back update to view", view, err)
-					}
-				}
-			}()
+		log.Printf("updated here tables for %v", agencyID)
+	}
 
-			statements := []string{
-				fmt.Sprintf("ALTER SEQUENCE %s_seq RESTART WITH 1", view),
-				fmt.Sprintf("REFRESH MATERIALIZED VIEW CONCURRENTLY %s", view),
-			}
+	// Cached vector tiles are keyed by this version, so incrementing it
+	// replaces them with tiles of the new data
+	_, err = etc.Cache.Incr(models.TileVersionKey)
+	if err != nil {
+		log.Println("can't update tile version", err)
+	}
+}
 
-			for _, statement := range statements {
-				log.Println(statement)
-				_, err = tx.Exec(statement)
-				if err != nil {
-					log.Println("can't exec", statement, err)
-					return
-				}
-				log.Println("complete")
-			}
-		}()
+// Fetch downloads the GTFS feed at url into dir and runs the same
+// preparation rules as LoadOnce, without loading it. A url starting with
+// file:// is read from the local filesystem. The rules are the ones for
+// rulesURL, or url if rulesURL is empty, so that a local copy of a feed
+// can be prepared like the feed we load.
+func Fetch(url, rulesURL, dir string) error {
+	rules, err := getFeedRules()
+	if err != nil {
+		return err
+	}
+
+	if len(rulesURL) < 1 {
+		rulesURL = url
 	}
+
+	err = download(url, dir)
+	if err != nil {
+		return err
+	}
+
+	return prepare(rules[rulesURL], dir)
 }
 
-// LoadForever continuously runs LoadOnce, breaking for 24 hours between loads
-func LoadForever() {
+// LoadForever continuously runs LoadOnce, breaking for 24 hours between
+// loads, until ctx is done. If loaded isn't nil, it's called after each
+// load that wasn't stopped. /readyz fails if a load hasn't finished in
+// twice the break.
+func LoadForever(ctx context.Context, loaded func()) {
+	// Give the first load a chance to finish before we're not ready
+	beat.Mark()
+	health.Add("load", beat.Check(2*loaderBreak))
+
 	for {
-		LoadOnce()
+		LoadOnce(ctx)
+		if ctx.Err() != nil {
+			log.Println("stopped loading")
+			return
+		}
+
+		beat.Mark()
+
+		if loaded != nil {
+			loaded()
+		}
 
 		log.Printf("finished loading, sleeping for %v", loaderBreak)
-		time.Sleep(loaderBreak)
+
+		select {
+		case <-time.After(loaderBreak):
+		case <-ctx.Done():
+			log.Println("stopped loading")
+			return
+		}
 	}
 }
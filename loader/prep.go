@@ -1,304 +1,574 @@
 package loader
 
 import (
-	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/brnstz/bus/internal/conf"
 )
 
-// prepare runs any special hacks for prepping the data before passing it onto
-// the loader
-func prepare(url, dir string) error {
-	switch url {
-	case "http://www.nyc.gov/html/dot/downloads/misc/siferry-gtfs.zip":
-		return siFerry(dir)
+var (
+	// errNoRuleType is returned when a prepRule does not define any
+	// transform
+	errNoRuleType = errors.New("prep rule must define exactly one transform")
+
+	// defaultFeedRules are the transforms needed for the feeds we know
+	// about. Rules loaded from conf.Loader.PrepRules are merged on top of
+	// these, replacing the rules for any feed with the same URL.
+	defaultFeedRules = []feedRules{
+		// Staten Island Ferry has a misnamed headsign column and
+		// no direction_id
+		{
+			URL: "http://www.nyc.gov/html/dot/downloads/misc/siferry-gtfs.zip",
+			Rules: []prepRule{
+				{RenameColumn: &renameColumnRule{
+					File: "trips.txt", From: "headsign", To: "trip_headsign",
+				}},
+				{FillDirection: &fillDirectionRule{
+					Column:  "trip_headsign",
+					Values:  map[string]string{"To Whitehall": "0"},
+					Default: "1",
+				}},
+			},
+		},
 
-	case "http://web.mta.info/developers/data/mnr/google_transit.zip":
-		return mnr(dir)
+		// Standardize on "MTA MNR" rather than a numeric id, skipping
+		// anything that isn't agency_id 1
+		{
+			URL: "http://web.mta.info/developers/data/mnr/google_transit.zip",
+			Rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{
+					Agencies: map[string]string{"1": "MTA MNR"},
+				}},
+			},
+		},
 
-	case "http://web.mta.info/developers/data/lirr/google_transit.zip":
-		return lirr(dir)
+		// LIRR has no agency_id at all
+		{
+			URL: "http://web.mta.info/developers/data/lirr/google_transit.zip",
+			Rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{
+					Agencies: map[string]string{"": "LI"},
+				}},
+			},
+		},
 
-	case "http://data.trilliumtransit.com/gtfs/path-nj-us/path-nj-us.zip":
-		return njpath(dir)
+		{
+			URL: "http://data.trilliumtransit.com/gtfs/path-nj-us/path-nj-us.zip",
+			Rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{
+					Agencies: map[string]string{"151": "PATH"},
+				}},
+			},
+		},
 
-	case "https://www.njtransit.com/mt/mt_servlet.srv?hdnPageAction=MTDevResourceDownloadTo&Category=rail":
-		return njtrail(dir)
+		// NJT rail has no route_text_color and no useful route_color
+		{
+			URL: "https://www.njtransit.com/mt/mt_servlet.srv?hdnPageAction=MTDevResourceDownloadTo&Category=rail",
+			Rules: []prepRule{
+				{RouteColors: &routeColorsRule{
+					Column: "route_long_name",
+					Colors: map[string]routeColor{
+						"Atlantic City Rail Line":  {"005DAB", "FFFFFF"},
+						"Montclair-Boonton Line":   {"FAA634", "FFFFFF"},
+						"Hudson-Bergen Light Rail": {"63F519", "000000"},
+						"Newark Light Rail":        {"63F519", "000000"},
+						"Riverline Light Rail":     {"63F519", "000000"},
+						"Main/Bergen County Line":  {"FFD006", "000000"},
+						"Port Jervis Line":         {"BBCBE2", "000000"},
+						"Morris & Essex Line":      {"00A850", "FFFFFF"},
+						"Gladstone Branch":         {"00A850", "FFFFFF"},
+						"Northeast Corridor":       {"EE3A43", "FFFFFF"},
+						"Princeton Shuttle":        {"EE3A43", "FFFFFF"},
+						"North Jersey Coast Line":  {"00A3E4", "000000"},
+						"Pascack Valley Line":      {"A0218C", "FFFFFF"},
+						"Raritan Valley Line":      {"FAA634", "000000"},
+					},
+					Default: &routeColor{"1E1D78", "FFFFFF"},
+				}},
+			},
+		},
 
-	case "http://web.mta.info/developers/data/nyct/subway/google_transit.zip":
-		return mtasubway(dir)
+		// 6X should be same color as 6
+		{
+			URL: "http://web.mta.info/developers/data/nyct/subway/google_transit.zip",
+			Rules: []prepRule{
+				{RouteColors: &routeColorsRule{
+					Column: "route_id",
+					Colors: map[string]routeColor{
+						"6X": {Color: "00933C"},
+					},
+				}},
+			},
+		},
 	}
+)
 
-	return nil
+// feedRules is the list of transforms to run against the files of the
+// GTFS feed downloaded from URL, in order, before passing them on to the
+// loader
+type feedRules struct {
+	URL   string     `json:"url" yaml:"url"`
+	Rules []prepRule `json:"rules" yaml:"rules"`
 }
 
-type amods map[string]amod
+// prepRule is a single transform. Exactly one of its fields should be
+// set.
+type prepRule struct {
+	RenameColumn  *renameColumnRule  `json:"rename_column" yaml:"rename_column"`
+	RenameAgency  *renameAgencyRule  `json:"rename_agency" yaml:"rename_agency"`
+	DropRoutes    *dropRoutesRule    `json:"drop_routes" yaml:"drop_routes"`
+	RouteColors   *routeColorsRule   `json:"route_colors" yaml:"route_colors"`
+	FillDirection *fillDirectionRule `json:"fill_direction" yaml:"fill_direction"`
+	RewriteIDs    *rewriteIDsRule    `json:"rewrite_ids" yaml:"rewrite_ids"`
+}
 
-type amod struct {
-	// skip this row completely
-	skip   bool
-	newVal string
+// transform is implemented by each type of rule
+type transform interface {
+	apply(dir string) error
 }
 
-func modifyAgencies(dir string, mods amods) error {
-	// appendedHeader is true if we need to append "agency_id", false
-	// otherwise
-	var appendedHeader bool
-	var currentAgency string
+// transform returns the single transform defined by this rule
+func (pr prepRule) transform() (transform, error) {
+	var t transform
+	count := 0
 
-	// Open up routes file as csv reader
-	routeFile := path.Join(dir, "routes.txt")
-	inFH, err := os.Open(routeFile)
-	if err != nil {
-		return err
+	if pr.RenameColumn != nil {
+		t = pr.RenameColumn
+		count++
 	}
-	r := csv.NewReader(inFH)
-	r.LazyQuotes = true
-
-	// Create an outgoing csv file for transformed data
-	w, outFH := writecsvtmp(dir)
-	defer outFH.Close()
-	defer os.Remove(outFH.Name())
-
-	// Read the existing header
-	header, err := r.Read()
-	if err != nil {
-		return err
+	if pr.RenameAgency != nil {
+		t = pr.RenameAgency
+		count++
 	}
-
-	// Try to find agency id idx. If there is no agency_id header,
-	// then add one.
-	agencyIdx := maybeFind(header, "agency_id")
-	if agencyIdx == -1 {
-		appendedHeader = true
-		header = append(header, "agency_id")
+	if pr.DropRoutes != nil {
+		t = pr.DropRoutes
+		count++
+	}
+	if pr.RouteColors != nil {
+		t = pr.RouteColors
+		count++
+	}
+	if pr.FillDirection != nil {
+		t = pr.FillDirection
+		count++
+	}
+	if pr.RewriteIDs != nil {
+		t = pr.RewriteIDs
+		count++
 	}
 
-	// Write header to the output file
-	err = w.Write(header)
-	if err != nil {
-		return err
+	if count != 1 {
+		return nil, errNoRuleType
 	}
 
-	for {
-		// Read until EOF or error
-		rec, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+	return t, nil
+}
 
-		if appendedHeader {
-			// If there was an appended error, current value is blank
-			currentAgency = ""
-		} else {
-			// Otherwise get the actual value
-			currentAgency = rec[agencyIdx]
-		}
+// renameColumnRule renames the header From to To in File
+type renameColumnRule struct {
+	File string `json:"file" yaml:"file"`
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
 
-		mod, ok := mods[currentAgency]
-		// skip if requested
-		if ok && mod.skip {
-			continue
-		}
+func (rule *renameColumnRule) apply(dir string) error {
+	return rewriteRows(dir, rule.File,
+		func(header []string) ([]string, error) {
+			for k, v := range header {
+				if v == rule.From {
+					header[k] = rule.To
+				}
+			}
+			return header, nil
+		},
+		func(rec []string) ([]string, error) {
+			return rec, nil
+		},
+	)
+}
 
-		if ok && appendedHeader {
-			// We found an empty "" => "newVal" with appended header, we must
-			// append it. Basically if we're appending the header, the old
-			// value must by definition be blank
-			rec = append(rec, mod.newVal)
+// renameAgencyRule maps the agency_id values in routes.txt from the keys
+// of Agencies to their values. An empty key matches routes.txt files with
+// no agency_id column. Routes with an agency_id not in Agencies are
+// removed unless KeepUnmapped is true.
+type renameAgencyRule struct {
+	Agencies     map[string]string `json:"agencies" yaml:"agencies"`
+	KeepUnmapped bool              `json:"keep_unmapped" yaml:"keep_unmapped"`
+}
 
-		} else if ok && !appendedHeader {
-			// We found a "oldVal" => "newVal" with no need to append.
-			rec[agencyIdx] = mod.newVal
+func (rule *renameAgencyRule) apply(dir string) error {
+	// appendedHeader is true if we need to append "agency_id", false
+	// otherwise
+	var appendedHeader bool
+	var agencyIdx int
+
+	return rewriteRows(dir, "routes.txt",
+		func(header []string) ([]string, error) {
+			// Try to find agency id idx. If there is no agency_id header,
+			// then add one.
+			agencyIdx = maybeFind(header, "agency_id")
+			if agencyIdx == -1 {
+				appendedHeader = true
+				header = append(header, "agency_id")
+				agencyIdx = len(header) - 1
+			}
+			return header, nil
+		},
+		func(rec []string) ([]string, error) {
+			// If we're appending the header, the old value must by
+			// definition be blank
+			if appendedHeader {
+				rec = append(rec, "")
+			}
+
+			newVal, ok := rule.Agencies[rec[agencyIdx]]
+			switch {
+			case ok:
+				rec[agencyIdx] = newVal
+
+			case appendedHeader:
+				// Return an error if we didn't find a value but we
+				// needed to append agency
+				return nil, errors.New("no new value found and no existing agency")
+
+			case !rule.KeepUnmapped:
+				return nil, nil
+			}
+
+			return rec, nil
+		},
+	)
+}
 
-		} else if !ok && appendedHeader {
-			// Return an error if we didn't find a value but we needed
-			// to append agency
-			err = errors.New("no new value found and no existing agency")
-			return err
-		} else if !ok {
-			// Skip if it wasn't found
-			continue
-		}
+// dropRoutesRule removes routes from routes.txt that are in RouteIDs or
+// that match Pattern, along with their trips and stop times
+type dropRoutesRule struct {
+	RouteIDs []string `json:"route_ids" yaml:"route_ids"`
+	Pattern  string   `json:"pattern" yaml:"pattern"`
+}
 
-		// Write modified record to output
-		err = w.Write(rec)
+func (rule *dropRoutesRule) apply(dir string) error {
+	var re *regexp.Regexp
+	var err error
+
+	if len(rule.Pattern) > 0 {
+		re, err = regexp.Compile(rule.Pattern)
 		if err != nil {
 			return err
 		}
+	}
 
+	drop := map[string]bool{}
+	for _, v := range rule.RouteIDs {
+		drop[v] = true
 	}
 
-	// Flush and close output
-	w.Flush()
-	err = outFH.Close()
-	if err != nil {
-		return err
+	dropRoute := func(routeID string) bool {
+		return drop[routeID] || (re != nil && re.MatchString(routeID))
 	}
 
-	// Rename to official name in same dir
-	err = os.Rename(outFH.Name(), routeFile)
+	// trip_ids that belong to dropped routes
+	dropTrips := map[string]bool{}
+
+	var routeIdx, tripIdx int
+
+	err = rewriteRows(dir, "routes.txt",
+		func(header []string) (_ []string, err error) {
+			routeIdx, err = findColumn(header, "routes.txt", "route_id")
+			return header, err
+		},
+		func(rec []string) ([]string, error) {
+			if dropRoute(rec[routeIdx]) {
+				return nil, nil
+			}
+			return rec, nil
+		},
+	)
 	if err != nil {
 		return err
 	}
 
-	// Success!
-	return nil
-}
+	err = rewriteRows(dir, "trips.txt",
+		func(header []string) (_ []string, err error) {
+			routeIdx, err = findColumn(header, "trips.txt", "route_id")
+			if err != nil {
+				return
+			}
 
-// njpath modifies agency_id to PATH
-func njpath(dir string) error {
-	return modifyAgencies(dir,
-		amods{
-			"151": amod{false, "PATH"},
+			tripIdx, err = findColumn(header, "trips.txt", "trip_id")
+			return header, err
+		},
+		func(rec []string) ([]string, error) {
+			if dropRoute(rec[routeIdx]) {
+				dropTrips[rec[tripIdx]] = true
+				return nil, nil
+			}
+			return rec, nil
 		},
 	)
-}
+	if err != nil {
+		return err
+	}
 
-func lirr(dir string) error {
-	return modifyAgencies(dir,
-		amods{
-			"": amod{false, "LI"},
+	return rewriteRows(dir, "stop_times.txt",
+		func(header []string) (_ []string, err error) {
+			tripIdx, err = findColumn(header, "stop_times.txt", "trip_id")
+			return header, err
+		},
+		func(rec []string) ([]string, error) {
+			if dropTrips[rec[tripIdx]] {
+				return nil, nil
+			}
+			return rec, nil
 		},
 	)
 }
 
-// mnr modifies the agency id to standardize on simply "MTA MNR" rather than
-// different numeric ids. Skip anything that isn't agency_id == 1.
-func mnr(dir string) error {
-	return modifyAgencies(dir,
-		amods{
-			"1": amod{false, "MTA MNR"},
-		},
-	)
+// routeColor is a route_color / route_text_color pair. Empty values are
+// left unchanged.
+type routeColor struct {
+	Color     string `json:"color" yaml:"color"`
+	TextColor string `json:"text_color" yaml:"text_color"`
 }
 
-// siFerry preps the Staten Island Ferry download by adding a direction id
-// to files and fixing the header name of trip_headsign
-func siFerry(dir string) error {
-	var directionID string
-	var err error
+// routeColorsRule sets the colors in routes.txt by looking up the value of
+// Column (e.g., route_id or route_long_name) in Colors. Routes that aren't
+// found get the Default color, if there is one. A route_color or
+// route_text_color column that doesn't exist is only added if the rule
+// sets that color for some route, so that other columns are unchanged.
+type routeColorsRule struct {
+	Column  string                `json:"column" yaml:"column"`
+	Colors  map[string]routeColor `json:"colors" yaml:"colors"`
+	Default *routeColor           `json:"default" yaml:"default"`
+}
 
-	// Get the incoming file
-	tripFile := path.Join(dir, "trips.txt")
-	inFH, err := os.Open(tripFile)
-	if err != nil {
-		return err
+// sets returns whether the rule sets route_color and route_text_color
+// for any route
+func (rule *routeColorsRule) sets() (color, textColor bool) {
+	colors := []routeColor{}
+	for _, c := range rule.Colors {
+		colors = append(colors, c)
 	}
-	r := csv.NewReader(inFH)
-	r.LazyQuotes = true
-
-	// Create an outgoing csv file for transformed data
-	w, outFH := writecsvtmp(dir)
-	defer outFH.Close()
-	defer os.Remove(outFH.Name())
-
-	header, err := r.Read()
-	if err != nil {
-		return err
+	if rule.Default != nil {
+		colors = append(colors, *rule.Default)
 	}
 
-	// Fix incorrectly named header
-	for k, v := range header {
-		if v == "headsign" {
-			header[k] = "trip_headsign"
-		}
+	for _, c := range colors {
+		color = color || len(c.Color) > 0
+		textColor = textColor || len(c.TextColor) > 0
 	}
 
-	headsignIdx := find(header, "trip_headsign")
+	return
+}
 
-	// Add a direction id header
-	header = append(header, "direction_id")
-	err = w.Write(header)
-	if err != nil {
-		return err
-	}
+func (rule *routeColorsRule) apply(dir string) error {
+	var colIdx, rcIdx, rtIdx int
+	var appendRC, appendRT bool
+
+	setsColor, setsTextColor := rule.sets()
+
+	return rewriteRows(dir, "routes.txt",
+		func(header []string) (_ []string, err error) {
+			colIdx, err = findColumn(header, "routes.txt", rule.Column)
+			if err != nil {
+				return
+			}
+
+			rcIdx = maybeFind(header, "route_color")
+			if rcIdx == -1 && setsColor {
+				appendRC = true
+				header = append(header, "route_color")
+				rcIdx = len(header) - 1
+			}
+
+			rtIdx = maybeFind(header, "route_text_color")
+			if rtIdx == -1 && setsTextColor {
+				appendRT = true
+				header = append(header, "route_text_color")
+				rtIdx = len(header) - 1
+			}
+
+			return header, nil
+		},
+		func(rec []string) ([]string, error) {
+			// Add space for any columns we appended
+			if appendRC {
+				rec = append(rec, "")
+			}
+			if appendRT {
+				rec = append(rec, "")
+			}
+
+			val := rec[colIdx]
+			color, ok := rule.Colors[val]
+			if !ok {
+				if rule.Default == nil {
+					return rec, nil
+				}
+
+				color = *rule.Default
+				log.Printf("unrecognized %v: %s, using default color", rule.Column, val)
+			}
+
+			if len(color.Color) > 0 {
+				rec[rcIdx] = color.Color
+			}
+			if len(color.TextColor) > 0 {
+				rec[rtIdx] = color.TextColor
+			}
+
+			return rec, nil
+		},
+	)
+}
 
-	for {
-		rec, err := r.Read()
-		if err == io.EOF {
-			break
-		}
+// fillDirectionRule sets a missing or blank direction_id in trips.txt by
+// looking up the value of Column (e.g., trip_headsign) in Values, falling
+// back to Default
+type fillDirectionRule struct {
+	Column  string            `json:"column" yaml:"column"`
+	Values  map[string]string `json:"values" yaml:"values"`
+	Default string            `json:"default" yaml:"default"`
+}
 
-		if err != nil {
-			return err
-		}
+func (rule *fillDirectionRule) apply(dir string) error {
+	var colIdx, dirIdx int
+	var appendDir bool
+
+	return rewriteRows(dir, "trips.txt",
+		func(header []string) (_ []string, err error) {
+			colIdx, err = findColumn(header, "trips.txt", rule.Column)
+			if err != nil {
+				return
+			}
+
+			// Add a direction id header
+			dirIdx = maybeFind(header, "direction_id")
+			if dirIdx == -1 {
+				appendDir = true
+				header = append(header, "direction_id")
+				dirIdx = len(header) - 1
+			}
+
+			return header, nil
+		},
+		func(rec []string) ([]string, error) {
+			if appendDir {
+				rec = append(rec, "")
+			}
+
+			if len(strings.TrimSpace(rec[dirIdx])) > 0 {
+				return rec, nil
+			}
+
+			directionID, ok := rule.Values[rec[colIdx]]
+			if !ok {
+				directionID = rule.Default
+			}
+			rec[dirIdx] = directionID
+
+			return rec, nil
+		},
+	)
+}
 
-		headsign := rec[headsignIdx]
+// rewriteIDsRule replaces Pattern with Replace in every value of Column,
+// in every file in the feed that has that column, so that references
+// between files stay consistent. Replace may refer to submatches like
+// ${1}, see regexp.Regexp.ReplaceAllString.
+type rewriteIDsRule struct {
+	Column  string `json:"column" yaml:"column"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+	Replace string `json:"replace" yaml:"replace"`
+}
 
-		// SI Ferry has two destinations, add a 0/1 direction ID
-		if headsign == "To Whitehall" {
-			directionID = "0"
-		} else {
-			directionID = "1"
-		}
+func (rule *rewriteIDsRule) apply(dir string) error {
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return err
+	}
 
-		rec = append(rec, directionID)
+	files, err := filepath.Glob(path.Join(dir, "*.txt"))
+	if err != nil {
+		return err
+	}
 
-		err = w.Write(rec)
+	for _, file := range files {
+		var colIdx int
+
+		err = rewriteRows(dir, path.Base(file),
+			func(header []string) ([]string, error) {
+				colIdx = maybeFind(header, rule.Column)
+				return header, nil
+			},
+			func(rec []string) ([]string, error) {
+				if colIdx >= 0 {
+					rec[colIdx] = re.ReplaceAllString(rec[colIdx], rule.Replace)
+				}
+				return rec, nil
+			},
+		)
 		if err != nil {
 			return err
 		}
-
 	}
 
-	w.Flush()
-	err = outFH.Close()
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	err = os.Rename(outFH.Name(), tripFile)
-	if err != nil {
-		return err
+// findColumn returns the index of col in the header of filename, or an
+// error if it doesn't have one, so that a rule naming a column the feed
+// doesn't have fails instead of panicking
+func findColumn(header []string, filename, col string) (int, error) {
+	idx := maybeFind(header, col)
+	if idx == -1 {
+		return idx, fmt.Errorf("%v: no column %v", filename, col)
 	}
 
-	return nil
+	return idx, nil
 }
 
-// njtrail adds route_color and route_text_color to NJT files
-func njtrail(dir string) error {
-	// Open up routes file as csv reader
-	routeFile := path.Join(dir, "routes.txt")
-	inFH, err := os.Open(routeFile)
+// rewriteRows rewrites filename in dir in place. The header is passed
+// to headerFn, which returns the header to write. Each following record is
+// passed to rowFn, which returns the record to write or nil if the record
+// should be removed. Files that don't exist are skipped.
+func rewriteRows(dir, filename string, headerFn func([]string) ([]string, error), rowFn func([]string) ([]string, error)) error {
+	_, err := os.Stat(path.Join(dir, filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	rw, err := newRewrite(dir, filename)
 	if err != nil {
 		return err
 	}
-	r := csv.NewReader(inFH)
-	r.LazyQuotes = true
-
-	// Create an outgoing csv file for transformed data
-	w, outFH := writecsvtmp(dir)
-	defer outFH.Close()
-	defer os.Remove(outFH.Name())
+	defer rw.clean()
 
-	// Read the existing header
-	header, err := r.Read()
+	header, err := headerFn(rw.header)
 	if err != nil {
 		return err
 	}
 
-	nameIdx := find(header, "route_long_name")
-	rcIdx := find(header, "route_color")
-
-	header = append(header, "route_text_color")
-	rtIdx := len(header) - 1
-
-	// Write header to the output file
-	err = w.Write(header)
+	err = rw.w.Write(header)
 	if err != nil {
 		return err
 	}
 
 	for {
 		// Read until EOF or error
-		rec, err := r.Read()
+		rec, err := rw.r.Read()
 		if err == io.EOF {
 			break
 		}
@@ -306,119 +576,96 @@ func njtrail(dir string) error {
 			return err
 		}
 
-		// Add one space to rec to allow for text color
-		rec = append(rec, "")
-
-		name := rec[nameIdx]
-		switch name {
-		case "Atlantic City Rail Line":
-			rec[rcIdx] = "005DAB"
-			rec[rtIdx] = "FFFFFF"
-
-		case "Montclair-Boonton Line":
-			rec[rcIdx] = "FAA634"
-			rec[rtIdx] = "FFFFFF"
-
-		case "Hudson-Bergen Light Rail", "Newark Light Rail", "Riverline Light Rail":
-			rec[rcIdx] = "63F519"
-			rec[rtIdx] = "000000"
-
-		case "Main/Bergen County Line":
-			rec[rcIdx] = "FFD006"
-			rec[rtIdx] = "000000"
-
-		case "Port Jervis Line":
-			rec[rcIdx] = "BBCBE2"
-			rec[rtIdx] = "000000"
-
-		case "Morris & Essex Line", "Gladstone Branch":
-			rec[rcIdx] = "00A850"
-			rec[rtIdx] = "FFFFFF"
-
-		case "Northeast Corridor", "Princeton Shuttle":
-			rec[rcIdx] = "EE3A43"
-			rec[rtIdx] = "FFFFFF"
-
-		case "North Jersey Coast Line":
-			rec[rcIdx] = "00A3E4"
-			rec[rtIdx] = "000000"
-
-		case "Pascack Valley Line":
-			rec[rcIdx] = "A0218C"
-			rec[rtIdx] = "FFFFFF"
-
-		case "Raritan Valley Line":
-			rec[rcIdx] = "FAA634"
-			rec[rtIdx] = "000000"
+		rec, err = rowFn(rec)
+		if err != nil {
+			return err
+		}
 
-		default:
-			rec[rcIdx] = "1E1D78"
-			rec[rtIdx] = "FFFFFF"
-			log.Printf("unrecognized NJT line: %s, using default color", name)
+		// skip if requested
+		if rec == nil {
+			continue
 		}
 
-		err = w.Write(rec)
+		err = rw.w.Write(rec)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Flush and close output
-	w.Flush()
-	err = outFH.Close()
+	return rw.finish()
+}
+
+// readFeedRules reads a list of feedRules from filename, which is
+// parsed as JSON if it ends in .json and YAML otherwise
+func readFeedRules(filename string) (rules []feedRules, err error) {
+	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return err
+		return
 	}
 
-	// Rename to official name in same dir
-	err = os.Rename(outFH.Name(), routeFile)
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(b, &rules)
+	default:
+		err = yaml.Unmarshal(b, &rules)
+	}
 	if err != nil {
-		return err
+		return
 	}
 
-	// Success!
-	return nil
+	// Check that each rule is valid before we try to use it
+	for _, fr := range rules {
+		for i, rule := range fr.Rules {
+			_, err = rule.transform()
+			if err != nil {
+				err = fmt.Errorf("rule %d for %v: %v", i, fr.URL, err)
+				return
+			}
+		}
+	}
+
+	return
 }
 
-// mtasubway changes the color of 6X to same color as 6
-func mtasubway(dir string) error {
-	rw, err := newRewrite(dir, "routes.txt")
-	if err != nil {
-		return err
+// getFeedRules returns a mapping of feed URL to the rules for that feed,
+// combining defaultFeedRules and any rules in conf.Loader.PrepRules
+func getFeedRules() (map[string][]prepRule, error) {
+	rules := map[string][]prepRule{}
+
+	for _, fr := range defaultFeedRules {
+		rules[fr.URL] = fr.Rules
+	}
+
+	if len(conf.Loader.PrepRules) < 1 {
+		return rules, nil
 	}
-	defer rw.clean()
 
-	// Write header to the output file, unmodified
-	err = rw.w.Write(rw.header)
+	fileRules, err := readFeedRules(conf.Loader.PrepRules)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	routeIdx := find(rw.header, "route_id")
-	routeColorIdx := find(rw.header, "route_color")
+	for _, fr := range fileRules {
+		rules[fr.URL] = fr.Rules
+	}
 
-	for {
-		// Read until EOF or error
-		rec, err := rw.r.Read()
-		if err == io.EOF {
-			break
-		}
+	return rules, nil
+}
+
+// prepare runs the rules for prepping the data before passing it onto
+// the loader
+func prepare(rules []prepRule, dir string) error {
+	for _, rule := range rules {
+		t, err := rule.transform()
 		if err != nil {
 			return err
 		}
 
-		routeID := rec[routeIdx]
-
-		// 6X should be same color as 6
-		if routeID == "6X" {
-			rec[routeColorIdx] = "00933C"
-		}
-
-		err = rw.w.Write(rec)
+		err = t.apply(dir)
 		if err != nil {
 			return err
 		}
 	}
 
-	return rw.finish()
+	return nil
 }
@@ -0,0 +1,365 @@
+package loader
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/brnstz/bus/internal/conf"
+)
+
+// writeFeed writes each file of a feed to a new directory and returns it
+func writeFeed(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, body := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// readFeed returns the contents of name in dir
+func readFeed(t *testing.T, dir, name string) string {
+	b, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// lines joins each line with a newline, like the csv package writes them
+func lines(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
+
+func TestPrepRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []prepRule
+		in    map[string]string
+		out   map[string]string
+	}{
+		{
+			name: "rename column",
+			rules: []prepRule{
+				{RenameColumn: &renameColumnRule{File: "trips.txt", From: "headsign", To: "trip_headsign"}},
+			},
+			in: map[string]string{
+				"trips.txt": lines("trip_id,headsign", "T1,To Whitehall"),
+			},
+			out: map[string]string{
+				"trips.txt": lines("trip_id,trip_headsign", "T1,To Whitehall"),
+			},
+		},
+
+		{
+			name: "rename agency drops unmapped routes",
+			rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{Agencies: map[string]string{"1": "MTA MNR"}}},
+			},
+			in: map[string]string{
+				"routes.txt": lines("route_id,agency_id", "R1,1", "R2,2"),
+			},
+			out: map[string]string{
+				"routes.txt": lines("route_id,agency_id", "R1,MTA MNR"),
+			},
+		},
+
+		{
+			name: "rename agency keeps unmapped routes",
+			rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{Agencies: map[string]string{"1": "MTA MNR"}, KeepUnmapped: true}},
+			},
+			in: map[string]string{
+				"routes.txt": lines("route_id,agency_id", "R1,1", "R2,2"),
+			},
+			out: map[string]string{
+				"routes.txt": lines("route_id,agency_id", "R1,MTA MNR", "R2,2"),
+			},
+		},
+
+		{
+			name: "rename agency adds missing column",
+			rules: []prepRule{
+				{RenameAgency: &renameAgencyRule{Agencies: map[string]string{"": "LI"}}},
+			},
+			in: map[string]string{
+				"routes.txt": lines("route_id,route_type", "R1,2"),
+			},
+			out: map[string]string{
+				"routes.txt": lines("route_id,route_type,agency_id", "R1,2,LI"),
+			},
+		},
+
+		{
+			name: "drop routes with their trips and stop times",
+			rules: []prepRule{
+				{DropRoutes: &dropRoutesRule{RouteIDs: []string{"A"}, Pattern: "^X"}},
+			},
+			in: map[string]string{
+				"routes.txt":     lines("route_id", "A", "B", "X1"),
+				"trips.txt":      lines("route_id,trip_id", "A,T1", "B,T2", "X1,T3"),
+				"stop_times.txt": lines("trip_id,stop_id", "T1,S1", "T2,S1", "T3,S1"),
+			},
+			out: map[string]string{
+				"routes.txt":     lines("route_id", "B"),
+				"trips.txt":      lines("route_id,trip_id", "B,T2"),
+				"stop_times.txt": lines("trip_id,stop_id", "T2,S1"),
+			},
+		},
+
+		{
+			name: "route colors only change the colors they set",
+			rules: []prepRule{
+				{RouteColors: &routeColorsRule{
+					Column: "route_id",
+					Colors: map[string]routeColor{"6X": {Color: "00933C"}},
+				}},
+			},
+			in: map[string]string{
+				"routes.txt": lines("route_id,route_color", "6,00933C", "6X,00A65C", "7,B933AD"),
+			},
+			out: map[string]string{
+				"routes.txt": lines("route_id,route_color", "6,00933C", "6X,00933C", "7,B933AD"),
+			},
+		},
+
+		{
+			name: "route colors add text colors and use the default",
+			rules: []prepRule{
+				{RouteColors: &routeColorsRule{
+					Column:  "route_long_name",
+					Colors:  map[string]routeColor{"Port Jervis Line": {"BBCBE2", "000000"}},
+					Default: &routeColor{"1E1D78", "FFFFFF"},
+				}},
+			},
+			in: map[string]string{
+				"routes.txt": lines("route_id,route_long_name,route_color", "1,Port Jervis Line,", "2,Unknown Line,"),
+			},
+			out: map[string]string{
+				"routes.txt": lines(
+					"route_id,route_long_name,route_color,route_text_color",
+					"1,Port Jervis Line,BBCBE2,000000",
+					"2,Unknown Line,1E1D78,FFFFFF",
+				),
+			},
+		},
+
+		{
+			name: "fill direction",
+			rules: []prepRule{
+				{FillDirection: &fillDirectionRule{
+					Column:  "trip_headsign",
+					Values:  map[string]string{"To Whitehall": "0"},
+					Default: "1",
+				}},
+			},
+			in: map[string]string{
+				"trips.txt": lines("trip_id,trip_headsign", "T1,To Whitehall", "T2,To St. George"),
+			},
+			out: map[string]string{
+				"trips.txt": lines("trip_id,trip_headsign,direction_id", "T1,To Whitehall,0", "T2,To St. George,1"),
+			},
+		},
+
+		{
+			name: "fill direction keeps existing values",
+			rules: []prepRule{
+				{FillDirection: &fillDirectionRule{Column: "trip_headsign", Default: "1"}},
+			},
+			in: map[string]string{
+				"trips.txt": lines("trip_id,trip_headsign,direction_id", "T1,North,0", "T2,South,"),
+			},
+			out: map[string]string{
+				"trips.txt": lines("trip_id,trip_headsign,direction_id", "T1,North,0", "T2,South,1"),
+			},
+		},
+
+		{
+			name: "rewrite ids in every file",
+			rules: []prepRule{
+				{RewriteIDs: &rewriteIDsRule{Column: "trip_id", Pattern: "^[A-Z]+-(.*)$", Replace: "${1}"}},
+			},
+			in: map[string]string{
+				"trips.txt":      lines("route_id,trip_id", "A,OLD-T1"),
+				"stop_times.txt": lines("trip_id,stop_id", "OLD-T1,S1"),
+				"stops.txt":      lines("stop_id", "OLD-S1"),
+			},
+			out: map[string]string{
+				"trips.txt":      lines("route_id,trip_id", "A,T1"),
+				"stop_times.txt": lines("trip_id,stop_id", "T1,S1"),
+				"stops.txt":      lines("stop_id", "OLD-S1"),
+			},
+		},
+
+		{
+			name: "rules run in order and skip missing files",
+			rules: []prepRule{
+				{RenameColumn: &renameColumnRule{File: "trips.txt", From: "headsign", To: "trip_headsign"}},
+				{FillDirection: &fillDirectionRule{Column: "trip_headsign", Default: "0"}},
+				{DropRoutes: &dropRoutesRule{RouteIDs: []string{"A"}}},
+			},
+			in: map[string]string{
+				"trips.txt": lines("route_id,trip_id,headsign", "A,T1,North", "B,T2,South"),
+			},
+			out: map[string]string{
+				"trips.txt": lines("route_id,trip_id,trip_headsign,direction_id", "B,T2,South,0"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dir := writeFeed(t, test.in)
+
+		err := prepare(test.rules, dir)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		for name, expected := range test.out {
+			actual := readFeed(t, dir, name)
+			if actual != expected {
+				t.Errorf("%v: expected %v to be:\n%v\nbut got:\n%v", test.name, name, expected, actual)
+			}
+		}
+	}
+}
+
+func TestPrepRulesMissingColumn(t *testing.T) {
+	tests := []struct {
+		name string
+		rule prepRule
+		in   map[string]string
+		err  string
+	}{
+		{
+			name: "route colors",
+			rule: prepRule{RouteColors: &routeColorsRule{Column: "route_long_name"}},
+			in:   map[string]string{"routes.txt": lines("route_id,route_color", "6,00933C")},
+			err:  "routes.txt: no column route_long_name",
+		},
+		{
+			name: "fill direction",
+			rule: prepRule{FillDirection: &fillDirectionRule{Column: "trip_headsign"}},
+			in:   map[string]string{"trips.txt": lines("trip_id,headsign", "T1,North")},
+			err:  "trips.txt: no column trip_headsign",
+		},
+		{
+			name: "drop routes without route_id",
+			rule: prepRule{DropRoutes: &dropRoutesRule{RouteIDs: []string{"A"}}},
+			in:   map[string]string{"routes.txt": lines("id", "A")},
+			err:  "routes.txt: no column route_id",
+		},
+		{
+			name: "drop routes without trip_id",
+			rule: prepRule{DropRoutes: &dropRoutesRule{RouteIDs: []string{"A"}}},
+			in: map[string]string{
+				"routes.txt": lines("route_id", "A"),
+				"trips.txt":  lines("route_id,id", "A,T1"),
+			},
+			err: "trips.txt: no column trip_id",
+		},
+		{
+			name: "drop routes without stop_times trip_id",
+			rule: prepRule{DropRoutes: &dropRoutesRule{RouteIDs: []string{"A"}}},
+			in: map[string]string{
+				"routes.txt":     lines("route_id", "A"),
+				"trips.txt":      lines("route_id,trip_id", "A,T1"),
+				"stop_times.txt": lines("id,stop_id", "T1,S1"),
+			},
+			err: "stop_times.txt: no column trip_id",
+		},
+	}
+
+	for _, test := range tests {
+		dir := writeFeed(t, test.in)
+
+		err := prepare([]prepRule{test.rule}, dir)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%v: expected error %v but got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestPrepRuleTransform(t *testing.T) {
+	tests := []struct {
+		rule prepRule
+		err  error
+	}{
+		{prepRule{}, errNoRuleType},
+		{prepRule{RenameColumn: &renameColumnRule{}}, nil},
+		{prepRule{RenameColumn: &renameColumnRule{}, DropRoutes: &dropRoutesRule{}}, errNoRuleType},
+	}
+
+	for i, test := range tests {
+		_, err := test.rule.transform()
+		if err != test.err {
+			t.Errorf("rule %v: expected error %v but got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestReadFeedRules(t *testing.T) {
+	dir := writeFeed(t, map[string]string{
+		"rules.yml": lines(
+			"- url: http://example.com/gtfs.zip",
+			"  rules:",
+			"    - drop_routes:",
+			"        route_ids: [A]",
+		),
+		"rules.json": `[{"url": "http://example.com/gtfs.zip",
+			"rules": [{"rename_agency": {"agencies": {"1": "X"}}}]}]`,
+		"bad.yml": lines(
+			"- url: http://example.com/gtfs.zip",
+			"  rules:",
+			"    - {}",
+		),
+	})
+
+	rules, err := readFeedRules(path.Join(dir, "rules.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Rules[0].DropRoutes == nil ||
+		rules[0].Rules[0].DropRoutes.RouteIDs[0] != "A" {
+		t.Fatalf("unexpected yaml rules %+v", rules)
+	}
+
+	rules, err = readFeedRules(path.Join(dir, "rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Rules[0].RenameAgency == nil ||
+		rules[0].Rules[0].RenameAgency.Agencies["1"] != "X" {
+		t.Fatalf("unexpected json rules %+v", rules)
+	}
+
+	_, err = readFeedRules(path.Join(dir, "bad.yml"))
+	if err == nil {
+		t.Fatal("expected an error for a rule with no transform")
+	}
+
+	// Rules from a file replace the built-in rules for the same URL
+	defer func(prepRules string) {
+		conf.Loader.PrepRules = prepRules
+	}(conf.Loader.PrepRules)
+
+	conf.Loader.PrepRules = path.Join(dir, "rules.yml")
+	ruleMap, err := getFeedRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ruleMap["http://example.com/gtfs.zip"]) != 1 {
+		t.Fatal("expected rules from the file")
+	}
+	if len(ruleMap[defaultFeedRules[0].URL]) != len(defaultFeedRules[0].Rules) {
+		t.Fatal("expected built-in rules")
+	}
+}
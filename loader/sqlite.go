@@ -0,0 +1,95 @@
+package loader
+
+// sqliteHereTables are hereTables on SQLite, which also update
+// here_trip_rtree
+var sqliteHereTables = []string{
+	`DELETE FROM here_trip_rtree WHERE id IN (
+		SELECT id FROM here_trip WHERE agency_id = $1
+	)`,
+	`DELETE FROM here_trip WHERE agency_id = $1`,
+	`INSERT INTO here_trip (
+		agency_id, route_id, stop_id, service_id,
+		trip_ids, arrival_secs, departure_secs, stop_sequences,
+		next_stop_ids, next_stop_lats, next_stop_lons,
+		stop_name, direction_id, stop_headsign, location,
+		route_type, route_color, route_text_color,
+		route_short_name, route_long_name, trip_headsign
+	)
+	SELECT
+		sst.agency_id,
+		sst.route_id,
+		sst.stop_id,
+		sst.service_id,
+
+		group_concat(sst.trip_id,       ','),
+		group_concat(sst.arrival_sec,   ','),
+		group_concat(sst.departure_sec, ','),
+		group_concat(sst.stop_sequence, ','),
+		group_concat(sst.next_stop_id,  ','),
+		group_concat(ST_X(sst.next_stop_location), ','),
+		group_concat(ST_Y(sst.next_stop_location), ','),
+
+		stop.stop_name,
+		stop.direction_id,
+		stop.headsign,
+		stop.location,
+
+		route.route_type,
+		route.route_color,
+		route.route_text_color,
+		COALESCE(route.route_short_name, ''),
+		COALESCE(route.route_long_name, ''),
+
+		trip.headsign
+
+	FROM scheduled_stop_time sst
+
+	INNER JOIN trip ON
+		sst.agency_id = trip.agency_id AND
+		sst.trip_id   = trip.trip_id
+
+	INNER JOIN stop ON
+		sst.agency_id     = stop.agency_id AND
+		sst.route_id      = stop.route_id  AND
+		sst.stop_id       = stop.stop_id   AND
+		trip.direction_id = stop.direction_id
+
+	INNER JOIN route ON
+		sst.agency_id = route.agency_id AND
+		sst.route_id  = route.route_id
+
+	WHERE
+		sst.agency_id          = $1        AND
+		sst.last_stop          IS FALSE    AND
+		sst.last_stop          IS NOT NULL AND
+		sst.next_stop_location IS NOT NULL
+
+	GROUP BY
+	sst.agency_id, sst.route_id, sst.stop_id, sst.service_id,
+	stop.stop_name, stop.direction_id, stop.headsign, stop.location,
+	route.route_type, route.route_color, route.route_text_color,
+	route.route_short_name, route.route_long_name, trip.headsign`,
+
+	`INSERT INTO here_trip_rtree
+	SELECT id, ST_X(location), ST_X(location), ST_Y(location), ST_Y(location)
+	FROM here_trip
+	WHERE agency_id = $1`,
+
+	`DELETE FROM service WHERE agency_id = $1`,
+	`INSERT INTO service (agency_id, service_id, day, start_date, end_date)
+	SELECT agency_id, service_id, day, start_date, end_date
+	FROM service_route_day
+	WHERE agency_id = $1
+	GROUP BY agency_id, service_id, day`,
+
+	`DELETE FROM service_exception WHERE agency_id = $1`,
+	`INSERT INTO service_exception (agency_id, service_id, exception_date, exception_type)
+	SELECT agency_id, service_id, exception_date, exception_type
+	FROM service_route_exception
+	WHERE agency_id = $1
+	GROUP BY agency_id, service_id, exception_date`,
+
+	`DELETE FROM here_load WHERE agency_id = $1`,
+	`INSERT INTO here_load (agency_id, loaded_at)
+	VALUES ($1, datetime('now', 'localtime'))`,
+}
@@ -0,0 +1,280 @@
+package loader
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+// sqliteAgency is the agency of our SQLite fixture
+const sqliteAgency = "MTA NYCT"
+
+// sqliteStops are the stops of our SQLite fixture. The B62 runs north
+// from S1 to S3, the G from G1, which is near S1 and S2, to G2, and the
+// Q from F1 to F2, which are about 11km away.
+var sqliteStops = []struct {
+	routeID string
+	stopID  string
+	name    string
+	lat     float64
+	lon     float64
+}{
+	{"B62", "S1", "First St", 40.700, -73.990},
+	{"B62", "S2", "Second St", 40.702, -73.990},
+	{"B62", "S3", "Third St", 40.704, -73.990},
+	{"G", "G1", "Greenpoint Av", 40.7025, -73.9895},
+	{"G", "G2", "Nassau Av", 40.710, -73.985},
+	{"Q", "F1", "Far Av", 40.800, -73.950},
+	{"Q", "F2", "Farther Av", 40.802, -73.950},
+}
+
+// newSQLiteFixture opens a new SQLite database and loads the rows of our
+// fixture into it, then builds the here tables like the loader does.
+// Rows are inserted directly, since saving models needs upsert.
+func newSQLiteFixture(t *testing.T) {
+	driver, path, db := conf.DB.Driver, conf.DB.Path, etc.DBConn
+	agencyIDs := conf.Partner.AgencyIDs
+	t.Cleanup(func() {
+		etc.DBConn.Close()
+		conf.DB.Driver, conf.DB.Path, etc.DBConn = driver, path, db
+		conf.Partner.AgencyIDs = agencyIDs
+	})
+
+	conf.DB.Driver = "sqlite3"
+	conf.DB.Path = filepath.Join(t.TempDir(), "bus.db")
+	conf.Partner.AgencyIDs = []string{sqliteAgency}
+	etc.DBConn = etc.MustDB()
+
+	exec := func(q string, args ...interface{}) {
+		_, err := etc.DBConn.Exec(q, args...)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+	}
+
+	for _, route := range []struct {
+		routeID   string
+		routeType int
+	}{{"B62", models.Bus}, {"G", models.Subway}, {"Q", models.Subway}} {
+		exec(`INSERT INTO route (agency_id, route_id, route_type, route_color,
+			route_text_color, route_short_name) VALUES ($1, $2, $3, $4, $5, $2)`,
+			sqliteAgency, route.routeID, route.routeType, "6CBE45", "FFFFFF",
+		)
+
+		exec(`INSERT INTO service_route_day (agency_id, route_id, service_id,
+			day, start_date, end_date) VALUES ($1, $2, $3, $4, $5, $6)`,
+			sqliteAgency, route.routeID, "WKD", "monday",
+			time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local),
+			time.Date(2099, 12, 31, 0, 0, 0, 0, time.Local),
+		)
+
+		exec(`INSERT INTO trip (agency_id, route_id, trip_id, service_id,
+			shape_id, headsign, direction_id) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			sqliteAgency, route.routeID, route.routeID+"-0800", "WKD", "", "North", 0,
+		)
+	}
+
+	for i, s := range sqliteStops {
+		exec(`INSERT INTO stop (agency_id, stop_id, stop_name, direction_id,
+			headsign, route_id, location, lat, lon)
+			VALUES ($1, $2, $3, $4, $5, $6, ST_SETSRID(ST_MAKEPOINT($7, $8), 4326), $7, $8)`,
+			sqliteAgency, s.stopID, s.name, 0, "North", s.routeID, s.lat, s.lon,
+		)
+
+		// Each stop's departure is 5 minutes after the last stop of the
+		// route, starting at 8am
+		seq := 0
+		for j := i; j > 0 && sqliteStops[j-1].routeID == s.routeID; j-- {
+			seq++
+		}
+		secs := 8*60*60 + seq*5*60
+
+		last := i+1 == len(sqliteStops) || sqliteStops[i+1].routeID != s.routeID
+		if last {
+			exec(`INSERT INTO scheduled_stop_time (agency_id, route_id, stop_id,
+				service_id, trip_id, arrival_sec, departure_sec, stop_sequence,
+				last_stop) VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8)`,
+				sqliteAgency, s.routeID, s.stopID, "WKD", s.routeID+"-0800",
+				secs, seq, true,
+			)
+			continue
+		}
+
+		next := sqliteStops[i+1]
+		exec(`INSERT INTO scheduled_stop_time (agency_id, route_id, stop_id,
+			service_id, trip_id, arrival_sec, departure_sec, stop_sequence,
+			last_stop, next_stop_id, next_stop_location, next_stop_lat, next_stop_lon)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8, $9,
+				ST_SETSRID(ST_MAKEPOINT($10, $11), 4326), $10, $11)`,
+			sqliteAgency, s.routeID, s.stopID, "WKD", s.routeID+"-0800",
+			secs, seq, false, next.stopID, next.lat, next.lon,
+		)
+	}
+
+	err := updateHere(sqliteAgency)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteHere(t *testing.T) {
+	newSQLiteFixture(t)
+
+	// Monday morning, 5 minutes before the first departure
+	now := time.Date(2016, 6, 13, 7, 55, 0, 0, time.Local)
+
+	// Only the nearest stop of each route and direction is returned
+	tests := []struct {
+		name     string
+		area     models.HereArea
+		expected []string
+	}{
+		{
+			name: "box",
+			area: models.HereArea{
+				SWLat: 40.699, SWLon: -73.991, NELat: 40.703, NELon: -73.989,
+			},
+			expected: []string{"G1", "S1"},
+		},
+		{
+			name:     "small radius",
+			area:     models.HereArea{Radius: 100},
+			expected: []string{"S1"},
+		},
+		{
+			name:     "large radius",
+			area:     models.HereArea{Radius: 300},
+			expected: []string{"G1", "S1"},
+		},
+		{
+			// Around S2, S3 and G1, and S3 is a last stop so it's
+			// never in here_trip
+			name: "polygon",
+			area: models.HereArea{
+				Polygon: "POLYGON((-73.991 40.701, -73.989 40.701, -73.989 40.705, -73.991 40.705, -73.991 40.701))",
+			},
+			expected: []string{"G1", "S2"},
+		},
+		{
+			name: "far box",
+			area: models.HereArea{
+				SWLat: 40.799, SWLon: -73.951, NELat: 40.801, NELon: -73.949,
+			},
+			expected: []string{"F1"},
+		},
+		{
+			name: "stop IDs",
+			area: models.HereArea{
+				StopIDs: []string{sqliteAgency + "|F1", sqliteAgency + "|S2"},
+			},
+			expected: []string{"F1", "S2"},
+		},
+	}
+
+	for _, test := range tests {
+		hq, err := models.NewHereQuery(40.700, -73.990, test.area, nil, now, time.Hour)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		stops, _, err := models.GetHereResults(etc.DBConn, hq)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		var stopIDs []string
+		for _, s := range stops {
+			stopIDs = append(stopIDs, s.StopID)
+
+			if len(s.Departures) != 1 {
+				t.Errorf("%v: expected 1 departure at %v but got %v", test.name, s.StopID, len(s.Departures))
+			}
+		}
+		sort.Strings(stopIDs)
+
+		if len(stopIDs) != len(test.expected) {
+			t.Errorf("%v: expected stops %v but got %v", test.name, test.expected, stopIDs)
+			continue
+		}
+		for i := range stopIDs {
+			if stopIDs[i] != test.expected[i] {
+				t.Errorf("%v: expected stops %v but got %v", test.name, test.expected, stopIDs)
+				break
+			}
+		}
+	}
+}
+
+func TestSQLiteStopAndTrip(t *testing.T) {
+	newSQLiteFixture(t)
+
+	stops, err := models.GetStops(etc.DBConn, sqliteAgency, "S2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stops) != 1 || stops[0].Name != "Second St" || stops[0].RouteID != "B62" ||
+		stops[0].Lat.Float64 != 40.702 || stops[0].Lon.Float64 != -73.990 {
+
+		t.Errorf("unexpected stops %+v", stops)
+	}
+
+	_, err = models.GetStops(etc.DBConn, sqliteAgency, "S9")
+	if err != models.ErrNotFound {
+		t.Errorf("expected %v but got %v", models.ErrNotFound, err)
+	}
+
+	trip, err := models.GetTrip(etc.DBConn, sqliteAgency, "B62", "B62-0800", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trip.ServiceID != "WKD" || trip.Headsign != "North" {
+		t.Errorf("unexpected trip %+v", trip)
+	}
+
+	stops, err = models.GetStopsByTrip(etc.DBConn, &trip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stops) != 3 || stops[0].StopID != "S1" || stops[2].StopID != "S3" {
+		t.Errorf("unexpected trip stops %+v", stops)
+	}
+
+	// A partial match of the trip ID, like a live trip ID
+	tripID, err := models.GetPartialTripIDMatch(etc.DBConn, sqliteAgency, "B62", "0800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tripID != "B62-0800" {
+		t.Errorf("expected partial match B62-0800 but got %v", tripID)
+	}
+}
+
+func TestSQLiteHereLoadedAt(t *testing.T) {
+	newSQLiteFixture(t)
+
+	loadedAt, err := models.GetHereLoadedAt(etc.DBConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedAt.IsZero() || time.Since(loadedAt) > time.Minute || time.Since(loadedAt) < -time.Minute {
+		t.Errorf("expected here tables to be loaded now but got %v", loadedAt)
+	}
+
+	// Rebuilding an agency replaces its time
+	var count int
+	err = updateHere(sqliteAgency)
+	if err == nil {
+		err = etc.DBConn.Get(&count, `SELECT COUNT(*) FROM here_load`)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 row in here_load but got %v", count)
+	}
+}
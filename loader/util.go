@@ -26,7 +26,7 @@ func getcsv(dir, name string) (*csv.Reader, io.Closer) {
 func writecsvtmp(dir string) (*csv.Writer, *os.File) {
 	outFH, err := ioutil.TempFile(dir, "")
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	w := csv.NewWriter(outFH)
@@ -69,6 +69,16 @@ type rewrite struct {
 func (rw *rewrite) finish() (err error) {
 	rw.w.Flush()
 
+	err = rw.w.Error()
+	if err != nil {
+		return err
+	}
+
+	err = rw.inFH.Close()
+	if err != nil {
+		return err
+	}
+
 	err = rw.outFH.Close()
 	if err != nil {
 		return err
@@ -78,18 +88,25 @@ func (rw *rewrite) finish() (err error) {
 }
 
 func (rw *rewrite) clean() (err error) {
-	err = rw.outFH.Close()
-	if err != nil {
-		return err
+	// Either or both of these may already be closed by finish(), so
+	// ignore any errors here.
+	rw.inFH.Close()
+	rw.outFH.Close()
+
+	// If finish() succeeded, the temp file has already been renamed
+	// and there is nothing to remove.
+	err = os.Remove(rw.outFH.Name())
+	if os.IsNotExist(err) {
+		err = nil
 	}
 
-	return os.Remove(rw.outFH.Name())
+	return err
 }
 
 func newRewrite(dir, filename string) (rw *rewrite, err error) {
 	rw = &rewrite{}
 
-	rw.filepath = path.Join(dir, "routes.txt")
+	rw.filepath = path.Join(dir, filename)
 	rw.inFH, err = os.Open(rw.filepath)
 	if err != nil {
 		return
@@ -103,6 +120,7 @@ func newRewrite(dir, filename string) (rw *rewrite, err error) {
 	// Read the existing header
 	rw.header, err = rw.r.Read()
 	if err != nil {
+		rw.clean()
 		return
 	}
 
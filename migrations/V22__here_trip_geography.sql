@@ -0,0 +1,4 @@
+-- Locations are stored as POINT(lat lon), so flip them to get a
+-- geography that we can use for searching by radius in meters
+CREATE INDEX idx_geography_here_trip ON here_trip
+    USING gist(geography(ST_FlipCoordinates(location)));
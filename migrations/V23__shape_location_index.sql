@@ -0,0 +1,2 @@
+-- Vector tiles find the shapes that pass through each tile by location
+CREATE INDEX idx_location_shape ON shape USING gist(location);
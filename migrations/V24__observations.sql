@@ -0,0 +1,42 @@
+-- Live data archived by busprecache. Each row is what a partner told us
+-- at observed_at, so a trip has many rows as it moves along its route.
+
+CREATE TABLE vehicle_observation (
+    agency_id     TEXT NOT NULL,
+    route_id      TEXT NOT NULL,
+    direction_id  INT,
+    trip_id       TEXT NOT NULL,
+
+    -- the next stop of the vehicle, if the partner provides it
+    stop_id       TEXT,
+
+    lat           DOUBLE PRECISION NOT NULL,
+    lon           DOUBLE PRECISION NOT NULL,
+    occupancy     TEXT,
+
+    observed_at   TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE departure_observation (
+    agency_id       TEXT NOT NULL,
+    route_id        TEXT NOT NULL,
+    direction_id    INT,
+    trip_id         TEXT NOT NULL,
+    stop_id         TEXT NOT NULL,
+
+    -- the predicted times of the trip at the stop, either may be
+    -- missing
+    arrival_time    TIMESTAMP WITH TIME ZONE,
+    departure_time  TIMESTAMP WITH TIME ZONE,
+
+    observed_at     TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_vehicle_observation_route ON vehicle_observation
+    (agency_id, route_id, observed_at);
+
+CREATE INDEX idx_departure_observation_route ON departure_observation
+    (agency_id, route_id, observed_at);
+
+CREATE INDEX idx_departure_observation_trip ON departure_observation
+    (agency_id, trip_id, stop_id);
@@ -0,0 +1,12 @@
+-- Raw responses from partners archived by busprecache, so that busapi can
+-- replay them later. key is the redis key of the response without any
+-- API key.
+
+CREATE TABLE partner_payload (
+    key         TEXT NOT NULL,
+    fetched_at  TIMESTAMP WITH TIME ZONE NOT NULL,
+    body        BYTEA NOT NULL
+);
+
+CREATE INDEX idx_partner_payload_key ON partner_payload
+    (key, fetched_at);
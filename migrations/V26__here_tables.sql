@@ -0,0 +1,36 @@
+-- here_trip, service and service_exception were materialized views that
+-- busloader refreshed all at once. They're now tables, and busloader
+-- rebuilds only the rows of the agencies it loaded, each in a single
+-- transaction.
+BEGIN;
+
+    CREATE TABLE here_trip_table AS SELECT * FROM here_trip;
+    ALTER TABLE here_trip_table DROP COLUMN id;
+    DROP MATERIALIZED VIEW here_trip;
+    ALTER TABLE here_trip_table RENAME TO here_trip;
+
+    CREATE INDEX idx_location_here_trip ON here_trip USING gist(location);
+    CREATE INDEX idx_geography_here_trip ON here_trip
+        USING gist(geography(ST_FlipCoordinates(location)));
+    CREATE INDEX idx_service_id_here_trip ON here_trip (service_id);
+    CREATE INDEX idx_agency_id_here_trip ON here_trip (agency_id);
+
+    CREATE TABLE service_table AS SELECT * FROM service;
+    ALTER TABLE service_table DROP COLUMN id;
+    DROP MATERIALIZED VIEW service;
+    ALTER TABLE service_table RENAME TO service;
+
+    CREATE INDEX idx_service ON service (agency_id, service_id, day);
+
+    CREATE TABLE service_exception_table AS SELECT * FROM service_exception;
+    ALTER TABLE service_exception_table DROP COLUMN id;
+    DROP MATERIALIZED VIEW service_exception;
+    ALTER TABLE service_exception_table RENAME TO service_exception;
+
+    CREATE INDEX idx_service_exception ON service_exception (agency_id, service_id, exception_date);
+
+    DROP SEQUENCE here_trip_seq;
+    DROP SEQUENCE service_seq;
+    DROP SEQUENCE service_exception_seq;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- The last time busloader rebuilt the here tables of each agency. busapi
+-- checks it to know when to reload its here index, since it may not share
+-- a cache with busloader.
+
+CREATE TABLE here_load (
+    agency_id   TEXT NOT NULL PRIMARY KEY,
+    loaded_at   TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,170 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/partners/transit_realtime"
+)
+
+const (
+	// siriTimeFormat is how the Bus Time API writes times
+	siriTimeFormat = "2006-01-02T15:04:05.000-07:00"
+
+	// gtfsDateFormat is how GTFS writes dates
+	gtfsDateFormat = "20060102"
+)
+
+// ShiftSiri moves every time in the SIRI JSON response b so that its
+// ResponseTimestamp is now. Responses without one are unchanged.
+func ShiftSiri(b []byte, now time.Time) ([]byte, error) {
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		log.Println("can't decode siri fixture", err)
+		return nil, err
+	}
+
+	recorded, ok := siriTimestamp(v)
+	if !ok {
+		return b, nil
+	}
+
+	b, err = json.Marshal(shiftJSON(v, now.Sub(recorded)))
+	if err != nil {
+		log.Println("can't encode siri fixture", err)
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// siriTimestamp returns the ResponseTimestamp of the ServiceDelivery in
+// the decoded response v
+func siriTimestamp(v interface{}) (t time.Time, ok bool) {
+	for _, k := range []string{"Siri", "ServiceDelivery", "ResponseTimestamp"} {
+		m, isMap := v.(map[string]interface{})
+		if !isMap {
+			return
+		}
+		v = m[k]
+	}
+
+	s, isString := v.(string)
+	if !isString {
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return
+	}
+
+	return t, true
+}
+
+// shiftJSON returns v with every string that's a time moved by d
+func shiftJSON(v interface{}, d time.Duration) interface{} {
+	switch val := v.(type) {
+
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = shiftJSON(child, d)
+		}
+
+	case []interface{}:
+		for i, child := range val {
+			val[i] = shiftJSON(child, d)
+		}
+
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, val)
+		if err == nil {
+			return t.Add(d).Format(siriTimeFormat)
+		}
+	}
+
+	return v
+}
+
+// ShiftFeed moves every time in the GTFS-realtime feed b so that its
+// header timestamp is now. The start dates of trips are moved by the
+// same number of days.
+func ShiftFeed(b []byte, now time.Time) ([]byte, error) {
+	feed := &transit_realtime.FeedMessage{}
+	err := proto.Unmarshal(b, feed)
+	if err != nil {
+		log.Println("can't unmarshal feed fixture", err)
+		return nil, err
+	}
+
+	if feed.GetHeader().GetTimestamp() == 0 {
+		return b, nil
+	}
+
+	recorded := time.Unix(int64(feed.GetHeader().GetTimestamp()), 0)
+	secs := int64(now.Sub(recorded) / time.Second)
+
+	// days is the number of calendar days between when the feed was
+	// recorded and now, rounded since a day can be 23 or 25 hours
+	days := int(math.Floor(etc.BaseTime(now.In(time.Local)).Sub(etc.BaseTime(recorded.In(time.Local))).Hours()/24 + 0.5))
+
+	shift := func(ts *uint64) {
+		if ts != nil && *ts > 0 {
+			*ts = uint64(int64(*ts) + secs)
+		}
+	}
+	shiftEvent := func(e *transit_realtime.TripUpdate_StopTimeEvent) {
+		if e != nil && e.Time != nil && *e.Time > 0 {
+			*e.Time += secs
+		}
+	}
+	shiftTrip := func(trip *transit_realtime.TripDescriptor) {
+		if trip == nil || trip.StartDate == nil {
+			return
+		}
+
+		t, err := time.ParseInLocation(gtfsDateFormat, *trip.StartDate, time.Local)
+		if err != nil {
+			return
+		}
+
+		trip.StartDate = proto.String(t.AddDate(0, 0, days).Format(gtfsDateFormat))
+	}
+
+	shift(feed.Header.Timestamp)
+
+	for _, e := range feed.Entity {
+		if tu := e.TripUpdate; tu != nil {
+			shift(tu.Timestamp)
+			shiftTrip(tu.Trip)
+
+			for _, st := range tu.StopTimeUpdate {
+				shiftEvent(st.Arrival)
+				shiftEvent(st.Departure)
+			}
+		}
+
+		if vp := e.Vehicle; vp != nil {
+			shift(vp.Timestamp)
+			shiftTrip(vp.Trip)
+		}
+	}
+
+	b, err = proto.Marshal(feed)
+	if err != nil {
+		log.Println("can't marshal feed fixture", err)
+		return nil, err
+	}
+
+	return b, nil
+}
@@ -1,11 +1,15 @@
 package precache
 
 import (
+	"context"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/brnstz/bus/archive"
 	"github.com/brnstz/bus/internal/conf"
 	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/health"
 	"github.com/brnstz/bus/internal/models"
 	"github.com/brnstz/bus/internal/partners"
 )
@@ -24,6 +28,19 @@ var (
 
 	// size of each precacheRequest's channel
 	size = 50000
+
+	// archiver saves what we precache, if archiving is enabled
+	archiver archive.Archiver
+
+	// payloadTimes is when the payload at each key was last archived.
+	// Many routes share a key (e.g., subway routes in the same feed), so
+	// this prevents saving it more than once each time they're
+	// precached.
+	payloadTimes     = map[string]time.Time{}
+	payloadTimesLock sync.Mutex
+
+	// beat is marked whenever a route is precached
+	beat health.Beat
 )
 
 type precacheRequest struct {
@@ -34,11 +51,11 @@ type precacheRequest struct {
 	result      chan error
 }
 
-// routeWorker runs forever for this partner/agency/route/direction, sending
-// a new precacheRequest to the channel ch, delaying between each request.
-// The goal is to make a request from the partner before the TTL
+// routeWorker runs until ctx is done for this partner/agency/route/direction,
+// sending a new precacheRequest to the channel ch, delaying between each
+// request. The goal is to make a request from the partner before the TTL
 // runs out.
-func routeWorker(ch chan precacheRequest, p partners.P, agencyID string, routeID string, directionID int) {
+func routeWorker(ctx context.Context, ch chan precacheRequest, p partners.P, agencyID string, routeID string, directionID int) {
 	var err error
 
 	// Assume last success was now
@@ -47,7 +64,7 @@ func routeWorker(ch chan precacheRequest, p partners.P, agencyID string, routeID
 	// Convert RedisTTL to a duration
 	ttlDur := time.Duration(conf.Cache.RedisTTL) * time.Second
 
-	// Loop forever, constantly getting new updates
+	// Loop until we stop, constantly getting new updates
 	for {
 
 		// Create a request
@@ -60,10 +77,18 @@ func routeWorker(ch chan precacheRequest, p partners.P, agencyID string, routeID
 		}
 
 		// Send it to an agencyWorker
-		ch <- req
+		select {
+		case ch <- req:
+		case <-ctx.Done():
+			return
+		}
 
-		// Wait for the response
+		// Wait for the response. If we're stopping, a request that's
+		// in progress finishes and one that isn't is skipped.
 		err = <-req.result
+		if ctx.Err() != nil {
+			return
+		}
 
 		// Record current time and difference
 		now := time.Now()
@@ -77,33 +102,143 @@ func routeWorker(ch chan precacheRequest, p partners.P, agencyID string, routeID
 			)
 		}
 
+		wait := delay
 		if err != nil {
 			log.Println("error getting response", err)
-			time.Sleep(errDelay)
+			wait = errDelay
 		} else {
 			lastSuccess = now
-			time.Sleep(delay)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// agencyWorker calls Precache on each incoming request
-func agencyWorker(ch chan precacheRequest) {
+// agencyWorker calls Precache on each incoming request and archives the
+// result if archiving is enabled. Once ctx is done, requests that are
+// still waiting are skipped.
+func agencyWorker(ctx context.Context, ch chan precacheRequest) {
 	for req := range ch {
-		req.result <- req.partner.Precache(req.agencyID, req.routeID, req.directionID)
+		if ctx.Err() != nil {
+			req.result <- ctx.Err()
+			continue
+		}
+
+		err := req.partner.Precache(req.agencyID, req.routeID, req.directionID)
+		if err == nil {
+			beat.Mark()
+		}
+		if err == nil && archiver != nil {
+			archiveRoute(req)
+			archivePayload(req)
+		}
+
+		req.result <- err
 	}
 }
 
-func Precache() {
+// archiveRoute saves what was just precached for the request. Errors are
+// only logged, so that a problem with the archive doesn't stop live data.
+func archiveRoute(req precacheRequest) {
+	trips, vehicles, err := req.partner.Realtime(req.agencyID, req.routeID, req.directionID)
+	if err != nil {
+		log.Println("can't get realtime data to archive", err)
+		return
+	}
+
+	vobs, dobs := archive.Observations(trips, vehicles, time.Now())
+	if len(vobs) < 1 && len(dobs) < 1 {
+		return
+	}
+
+	err = archiver.Save(vobs, dobs)
+	if err != nil {
+		log.Println("can't archive", req.agencyID, req.routeID, err)
+	}
+}
+
+// archivePayload saves the payload that was just precached for the
+// request, unless another route with the same key saved it less than half
+// of delay ago. It's saved even when it hasn't changed, since replay only
+// reads payloads saved within the TTL of the cache, like redis. Like
+// archiveRoute, errors are only logged.
+func archivePayload(req precacheRequest) {
+	k := req.partner.Key(req.agencyID, req.routeID, req.directionID)
+	if len(k) < 1 {
+		return
+	}
+
+	now := time.Now()
+
+	payloadTimesLock.Lock()
+	recent := now.Sub(payloadTimes[k]) < delay/2
+	if !recent {
+		payloadTimes[k] = now
+	}
+	payloadTimesLock.Unlock()
+
+	if recent {
+		return
+	}
+
+	b, err := etc.Cache.Get(k)
+	if err != nil {
+		log.Println("can't get payload to archive", err)
+		return
+	}
+
+	err = archiver.SavePayload(k, now, b)
+	if err != nil {
+		log.Println("can't archive payload", k, err)
+	}
+}
+
+// Precache saves live data from partners for every route of the
+// agencies in conf.Partner.AgencyIDs until ctx is done. It then waits
+// for requests that have started to finish and returns. /readyz fails if
+// nothing is precached for conf.Cache.RedisTTL seconds.
+func Precache(ctx context.Context) {
+	var (
+		err error
+
+		// routeWorkers and agencyWorkers are every worker we start
+		routeWorkers  sync.WaitGroup
+		agencyWorkers sync.WaitGroup
+	)
+
+	// Create an archiver if archiving is enabled
+	if len(conf.Archive.Kind) > 0 {
+		archiver, err = archive.New(conf.Archive.Kind, conf.Archive.Dir)
+		if err != nil {
+			log.Fatal("can't create archive ", err)
+		}
+	}
+
+	// Give the workers a chance to precache before we're not ready
+	beat.Mark()
+	health.Add("precache", beat.Check(time.Duration(conf.Cache.RedisTTL)*time.Second))
+
+	// Each agency's channel, which is closed when we stop
+	var chans []chan precacheRequest
+
 	// Go through each agency we support
 	for _, agencyID := range conf.Partner.AgencyIDs {
 
 		// Create a channel for this agency
 		ch := make(chan precacheRequest, size)
+		chans = append(chans, ch)
 
 		// Create a number of workers for this agency
 		for i := 0; i < maxWorkersAgency; i++ {
-			go agencyWorker(ch)
+			agencyWorkers.Add(1)
+			go func() {
+				defer agencyWorkers.Done()
+				agencyWorker(ctx, ch)
+			}()
 		}
 
 		// Get all the routes for this agency
@@ -135,11 +270,25 @@ func Precache() {
 
 				// FIXME: problem with this is... we'll never
 				// create new goroutines when they are updated in db
-				go routeWorker(ch, p, route.AgencyID, route.RouteID, dir)
+				routeWorkers.Add(1)
+				go func(agencyID, routeID string, dir int) {
+					defer routeWorkers.Done()
+					routeWorker(ctx, ch, p, agencyID, routeID, dir)
+				}(route.AgencyID, route.RouteID, dir)
 			}
 		}
 	}
 
-	// FIXME: wait forever
-	select {}
+	<-ctx.Done()
+	log.Println("stopping precache")
+
+	// Once no more requests can be sent, the agency workers finish
+	// the ones in progress and return
+	routeWorkers.Wait()
+	for _, ch := range chans {
+		close(ch)
+	}
+	agencyWorkers.Wait()
+
+	log.Println("stopped precache")
 }
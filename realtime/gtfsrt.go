@@ -0,0 +1,117 @@
+package realtime
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/partners/transit_realtime"
+)
+
+// gtfsRealtimeVersion is the version of the spec our feeds follow
+const gtfsRealtimeVersion = "1.0"
+
+// feed returns an empty FeedMessage with a header for the snapshot
+func (s *Snapshot) feed() *transit_realtime.FeedMessage {
+	return &transit_realtime.FeedMessage{
+		Header: &transit_realtime.FeedHeader{
+			GtfsRealtimeVersion: proto.String(gtfsRealtimeVersion),
+			Incrementality:      transit_realtime.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(s.Time.Unix())),
+		},
+	}
+}
+
+// tripDescriptor identifies a trip in a GTFS-realtime feed
+func tripDescriptor(routeID, tripID string, directionID null.Int) *transit_realtime.TripDescriptor {
+	td := &transit_realtime.TripDescriptor{
+		TripId:  proto.String(tripID),
+		RouteId: proto.String(routeID),
+	}
+	if directionID.Valid {
+		td.DirectionId = proto.Uint32(uint32(directionID.Int64))
+	}
+
+	return td
+}
+
+// TripUpdatesFeed returns a GTFS-realtime feed of the trip updates for
+// agencyID, or for every agency if agencyID is empty
+func (s *Snapshot) TripUpdatesFeed(agencyID string) *transit_realtime.FeedMessage {
+	fm := s.feed()
+
+	for _, t := range s.Trips {
+		if len(agencyID) > 0 && t.AgencyID != agencyID {
+			continue
+		}
+
+		tu := &transit_realtime.TripUpdate{
+			Trip: tripDescriptor(t.RouteID, t.TripID, t.DirectionID),
+		}
+
+		for _, st := range t.Stops {
+			stu := &transit_realtime.TripUpdate_StopTimeUpdate{
+				StopId: proto.String(st.StopID),
+			}
+			if !st.Arrival.IsZero() {
+				stu.Arrival = &transit_realtime.TripUpdate_StopTimeEvent{
+					Time: proto.Int64(st.Arrival.Unix()),
+				}
+			}
+			if !st.Departure.IsZero() {
+				stu.Departure = &transit_realtime.TripUpdate_StopTimeEvent{
+					Time: proto.Int64(st.Departure.Unix()),
+				}
+			}
+
+			tu.StopTimeUpdate = append(tu.StopTimeUpdate, stu)
+		}
+
+		fm.Entity = append(fm.Entity, &transit_realtime.FeedEntity{
+			Id:         proto.String(t.AgencyID + "|" + t.TripID),
+			TripUpdate: tu,
+		})
+	}
+
+	return fm
+}
+
+// VehiclePositionsFeed returns a GTFS-realtime feed of the vehicle
+// positions for agencyID, or for every agency if agencyID is empty
+func (s *Snapshot) VehiclePositionsFeed(agencyID string) *transit_realtime.FeedMessage {
+	fm := s.feed()
+
+	for _, v := range s.Vehicles {
+		if len(agencyID) > 0 && v.AgencyID != agencyID {
+			continue
+		}
+
+		vp := &transit_realtime.VehiclePosition{
+			Trip: tripDescriptor(v.RouteID, v.TripID, v.DirectionID),
+			Position: &transit_realtime.Position{
+				Latitude:  proto.Float32(float32(v.Lat)),
+				Longitude: proto.Float32(float32(v.Lon)),
+			},
+		}
+		if len(v.StopID) > 0 {
+			vp.StopId = proto.String(v.StopID)
+		}
+		if !v.Timestamp.IsZero() {
+			vp.Timestamp = proto.Uint64(uint64(v.Timestamp.Unix()))
+		}
+
+		// Our occupancy values are the enum names in lower case
+		status, exists := transit_realtime.VehiclePosition_OccupancyStatus_value[strings.ToUpper(v.Occupancy.String)]
+		if v.Occupancy.Valid && exists {
+			vp.OccupancyStatus = transit_realtime.VehiclePosition_OccupancyStatus(status).Enum()
+		}
+
+		fm.Entity = append(fm.Entity, &transit_realtime.FeedEntity{
+			Id:      proto.String(v.AgencyID + "|" + v.TripID),
+			Vehicle: vp,
+		})
+	}
+
+	return fm
+}
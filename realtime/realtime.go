@@ -0,0 +1,128 @@
+// Package realtime republishes the live data that precache saves in the
+// cache as GTFS-realtime and SIRI feeds. Data from every partner is
+// normalized into partners.TripUpdate and partners.VehiclePosition values
+// first, so each feed format is created the same way for all agencies.
+package realtime
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brnstz/bus/internal/conf"
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+	"github.com/brnstz/bus/internal/partners"
+)
+
+var (
+	// ttl is how long a snapshot is reused before we read the cache again
+	ttl = time.Duration(15) * time.Second
+
+	// maxWorkers is the number of routes we read at the same time
+	maxWorkers = 10
+
+	mu      sync.Mutex
+	current *Snapshot
+)
+
+// Snapshot is all of the live data we have at one time
+type Snapshot struct {
+	Time     time.Time
+	Trips    []*partners.TripUpdate
+	Vehicles []*partners.VehiclePosition
+}
+
+type routeRequest struct {
+	partner     partners.P
+	agencyID    string
+	routeID     string
+	directionID int
+}
+
+// Get returns a recent Snapshot, creating a new one if the last is
+// older than ttl
+func Get() (*Snapshot, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if current != nil && time.Since(current.Time) < ttl {
+		return current, nil
+	}
+
+	s, err := build()
+	if err != nil {
+		return nil, err
+	}
+	current = s
+
+	return current, nil
+}
+
+// build reads the live data of every route of our agencies
+func build() (*Snapshot, error) {
+	var reqs []routeRequest
+
+	for _, agencyID := range conf.Partner.AgencyIDs {
+		routes, err := models.GetAllRoutes(etc.DBConn, agencyID)
+		if err != nil {
+			log.Println("can't get routes", err)
+			return nil, err
+		}
+
+		for _, route := range routes {
+			p, err := partners.Find(*route)
+			if err != nil || !p.IsLive() {
+				continue
+			}
+
+			for dir := 0; dir <= 1; dir++ {
+				reqs = append(reqs, routeRequest{
+					partner:     p,
+					agencyID:    route.AgencyID,
+					routeID:     route.RouteID,
+					directionID: dir,
+				})
+			}
+		}
+	}
+
+	s := &Snapshot{Time: etc.Now()}
+
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		ch     = make(chan routeRequest, len(reqs))
+		worker = func() {
+			defer wg.Done()
+
+			for req := range ch {
+				t, v, err := req.partner.Realtime(req.agencyID, req.routeID, req.directionID)
+				if err != nil {
+					// A single route that's missing shouldn't stop
+					// the rest of the feed
+					log.Println("can't get realtime data", req.agencyID, req.routeID, err)
+					continue
+				}
+
+				lock.Lock()
+				s.Trips = append(s.Trips, t...)
+				s.Vehicles = append(s.Vehicles, v...)
+				lock.Unlock()
+			}
+		}
+	)
+
+	for _, req := range reqs {
+		ch <- req
+	}
+	close(ch)
+
+	for i := 0; i < maxWorkers; i++ {
+		wg.Add(1)
+		go worker()
+	}
+	wg.Wait()
+
+	return s, nil
+}
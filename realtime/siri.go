@@ -0,0 +1,267 @@
+package realtime
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/brnstz/bus/internal/partners"
+)
+
+// SIRI types, see: http://bustime.mta.info/wiki/Developers/SIRIIntro. We
+// use the same JSON form as the MTA's Bus Time API. References to lines,
+// stops and trips are prefixed by the agency ID, e.g., "MTA NYCT_B63".
+
+// Siri is the response of VehicleMonitoring and StopMonitoring
+type Siri struct {
+	Siri struct {
+		ServiceDelivery ServiceDelivery
+	}
+}
+
+// ServiceDelivery has one VehicleMonitoringDelivery or one
+// StopMonitoringDelivery
+type ServiceDelivery struct {
+	ResponseTimestamp         time.Time
+	VehicleMonitoringDelivery []VehicleMonitoringDelivery `json:",omitempty"`
+	StopMonitoringDelivery    []StopMonitoringDelivery    `json:",omitempty"`
+}
+
+type VehicleMonitoringDelivery struct {
+	ResponseTimestamp time.Time
+	VehicleActivity   []VehicleActivity
+}
+
+type StopMonitoringDelivery struct {
+	ResponseTimestamp  time.Time
+	MonitoredStopVisit []MonitoredStopVisit
+}
+
+type VehicleActivity struct {
+	RecordedAtTime          time.Time
+	MonitoredVehicleJourney MonitoredVehicleJourney
+}
+
+type MonitoredStopVisit struct {
+	RecordedAtTime          time.Time
+	MonitoringRef           string
+	MonitoredVehicleJourney MonitoredVehicleJourney
+}
+
+type MonitoredVehicleJourney struct {
+	LineRef                 string
+	DirectionRef            string `json:",omitempty"`
+	FramedVehicleJourneyRef FramedVehicleJourneyRef
+	VehicleLocation         *VehicleLocation `json:",omitempty"`
+	Occupancy               string           `json:",omitempty"`
+	MonitoredCall           *MonitoredCall   `json:",omitempty"`
+}
+
+type FramedVehicleJourneyRef struct {
+	DatedVehicleJourneyRef string
+}
+
+type VehicleLocation struct {
+	Latitude  float64
+	Longitude float64
+}
+
+type MonitoredCall struct {
+	StopPointRef          string
+	ExpectedArrivalTime   *time.Time `json:",omitempty"`
+	ExpectedDepartureTime *time.Time `json:",omitempty"`
+}
+
+// siriOccupancy converts our occupancy values to SIRI Occupancy, which
+// only has three levels
+var siriOccupancy = map[string]string{
+	"empty":                      "seatsAvailable",
+	"many_seats_available":       "seatsAvailable",
+	"few_seats_available":        "seatsAvailable",
+	"standing_room_only":         "standingAvailable",
+	"crushed_standing_room_only": "full",
+	"full":                       "full",
+	"not_accepting_passengers":   "full",
+}
+
+// siriRef returns the SIRI reference of id
+func siriRef(agencyID, id string) string {
+	return agencyID + "_" + id
+}
+
+// timeOrNil returns a pointer to t, or nil if t is zero
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// monitoredCall returns the call of trip at stopID, or nil if there
+// isn't one
+func monitoredCall(trip *partners.TripUpdate, stopID string) *MonitoredCall {
+	if trip == nil {
+		return nil
+	}
+
+	for _, st := range trip.Stops {
+		if st.StopID == stopID {
+			return &MonitoredCall{
+				StopPointRef:          siriRef(trip.AgencyID, st.StopID),
+				ExpectedArrivalTime:   timeOrNil(st.Arrival),
+				ExpectedDepartureTime: timeOrNil(st.Departure),
+			}
+		}
+	}
+
+	return nil
+}
+
+// journey returns the MonitoredVehicleJourney of a trip. The vehicle is
+// optional.
+func journey(agencyID, routeID, tripID string, v *partners.VehiclePosition) MonitoredVehicleJourney {
+	mvj := MonitoredVehicleJourney{
+		LineRef: siriRef(agencyID, routeID),
+		FramedVehicleJourneyRef: FramedVehicleJourneyRef{
+			DatedVehicleJourneyRef: siriRef(agencyID, tripID),
+		},
+	}
+
+	if v != nil {
+		if v.DirectionID.Valid {
+			mvj.DirectionRef = strconv.FormatInt(v.DirectionID.Int64, 10)
+		}
+		mvj.VehicleLocation = &VehicleLocation{Latitude: v.Lat, Longitude: v.Lon}
+		mvj.Occupancy = siriOccupancy[v.Occupancy.String]
+	}
+
+	return mvj
+}
+
+// newSiri returns an empty response for the snapshot
+func (s *Snapshot) newSiri() *Siri {
+	resp := &Siri{}
+	resp.Siri.ServiceDelivery.ResponseTimestamp = s.Time
+
+	return resp
+}
+
+// tripsByKey indexes the snapshot's trip updates by agency and trip ID
+func (s *Snapshot) tripsByKey() map[string]*partners.TripUpdate {
+	trips := map[string]*partners.TripUpdate{}
+	for _, t := range s.Trips {
+		trips[t.AgencyID+"|"+t.TripID] = t
+	}
+
+	return trips
+}
+
+// vehiclesByKey indexes the snapshot's vehicles by agency and trip ID
+func (s *Snapshot) vehiclesByKey() map[string]*partners.VehiclePosition {
+	vehicles := map[string]*partners.VehiclePosition{}
+	for _, v := range s.Vehicles {
+		vehicles[v.AgencyID+"|"+v.TripID] = v
+	}
+
+	return vehicles
+}
+
+// VehicleMonitoring returns every vehicle on the line with the reference
+// lineRef, or every vehicle if lineRef is empty. The MonitoredCall of each
+// vehicle is its next stop.
+func (s *Snapshot) VehicleMonitoring(lineRef string) *Siri {
+	resp := s.newSiri()
+	trips := s.tripsByKey()
+
+	vmd := VehicleMonitoringDelivery{ResponseTimestamp: s.Time}
+	for _, v := range s.Vehicles {
+		if len(lineRef) > 0 && siriRef(v.AgencyID, v.RouteID) != lineRef {
+			continue
+		}
+
+		mvj := journey(v.AgencyID, v.RouteID, v.TripID, v)
+		mvj.MonitoredCall = monitoredCall(trips[v.AgencyID+"|"+v.TripID], v.StopID)
+
+		vmd.VehicleActivity = append(vmd.VehicleActivity, VehicleActivity{
+			RecordedAtTime:          v.Timestamp,
+			MonitoredVehicleJourney: mvj,
+		})
+	}
+
+	resp.Siri.ServiceDelivery.VehicleMonitoringDelivery = []VehicleMonitoringDelivery{vmd}
+
+	return resp
+}
+
+// StopMonitoring returns each trip expected at the stop with the reference
+// monitoringRef, ordered by the expected time
+func (s *Snapshot) StopMonitoring(monitoringRef string) *Siri {
+	resp := s.newSiri()
+	vehicles := s.vehiclesByKey()
+
+	// expected is the time of each visit that we sort by
+	var expected []time.Time
+
+	smd := StopMonitoringDelivery{ResponseTimestamp: s.Time}
+	for _, t := range s.Trips {
+		for _, st := range t.Stops {
+			if siriRef(t.AgencyID, st.StopID) != monitoringRef {
+				continue
+			}
+
+			when := st.Arrival
+			if when.IsZero() {
+				when = st.Departure
+			}
+			if when.IsZero() || when.Before(s.Time) {
+				continue
+			}
+
+			v := vehicles[t.AgencyID+"|"+t.TripID]
+			mvj := journey(t.AgencyID, t.RouteID, t.TripID, v)
+			if len(mvj.DirectionRef) < 1 && t.DirectionID.Valid {
+				mvj.DirectionRef = strconv.FormatInt(t.DirectionID.Int64, 10)
+			}
+			mvj.MonitoredCall = monitoredCall(t, st.StopID)
+
+			msv := MonitoredStopVisit{
+				RecordedAtTime:          s.Time,
+				MonitoringRef:           monitoringRef,
+				MonitoredVehicleJourney: mvj,
+			}
+			if v != nil {
+				msv.RecordedAtTime = v.Timestamp
+			}
+
+			smd.MonitoredStopVisit = append(smd.MonitoredStopVisit, msv)
+			expected = append(expected, when)
+			break
+		}
+	}
+
+	sort.Sort(byExpected{smd.MonitoredStopVisit, expected})
+
+	resp.Siri.ServiceDelivery.StopMonitoringDelivery = []StopMonitoringDelivery{smd}
+
+	return resp
+}
+
+// byExpected sorts visits by their expected times
+type byExpected struct {
+	visits []MonitoredStopVisit
+	times  []time.Time
+}
+
+func (b byExpected) Len() int {
+	return len(b.visits)
+}
+
+func (b byExpected) Less(i, j int) bool {
+	return b.times[i].Before(b.times[j])
+}
+
+func (b byExpected) Swap(i, j int) {
+	b.visits[i], b.visits[j] = b.visits[j], b.visits[i]
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+}
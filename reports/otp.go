@@ -0,0 +1,437 @@
+// Package reports measures how reliable service was by matching the live
+// departures archived by busprecache against the schedule.
+package reports
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	null "gopkg.in/guregu/null.v3"
+
+	"github.com/brnstz/bus/internal/etc"
+	"github.com/brnstz/bus/internal/models"
+)
+
+var (
+	// DefaultGroupBy is what results are grouped by when Params.GroupBy
+	// is empty
+	DefaultGroupBy = []string{"route", "direction", "stop", "hour"}
+
+	// ErrBadGroupBy is returned for an unknown value in Params.GroupBy
+	ErrBadGroupBy = errors.New("group_by must be route, direction, stop or hour")
+
+	// groupNames are the values of Params.GroupBy
+	groupNames = map[string]bool{
+		"route":     true,
+		"direction": true,
+		"stop":      true,
+		"hour":      true,
+	}
+)
+
+const (
+	// DefaultEarly and DefaultLate are the number of seconds a departure
+	// can be before or after its scheduled time and still be on time
+	DefaultEarly = 60
+	DefaultLate  = 300
+
+	// freshness is how long before a departure its last prediction must
+	// have been observed for us to consider it the actual time. Older
+	// predictions are from trips that we stopped observing (e.g., because
+	// precache was restarted).
+	freshness = "5 minutes"
+)
+
+// otpQuery returns the departures of a report. The last prediction of
+// each trip at each stop is taken as its actual time, and is matched to
+// the scheduled departure of the same trip (or a trip whose ID ends with
+// the live trip ID, for partners that use partial IDs) that's closest to
+// it. Both times are in the time zone of the schedule.
+//
+// Parameters are: $1 agency_id, $2 route_id (or empty for all routes),
+// $3 time zone of the schedule, $4 start, $5 end.
+const otpQuery = `
+	WITH latest AS (
+		SELECT DISTINCT ON (agency_id, trip_id, stop_id, (COALESCE(departure_time, arrival_time) AT TIME ZONE $3::text)::date)
+			agency_id,
+			route_id,
+			trip_id,
+			stop_id,
+			COALESCE(departure_time, arrival_time) AT TIME ZONE $3::text AS actual,
+			observed_at AT TIME ZONE $3::text AS observed
+		FROM departure_observation
+		WHERE agency_id = $1 AND
+		      ($2::text = '' OR route_id = $2) AND
+		      observed_at >= $4 AND
+		      observed_at <  $5 AND
+		      COALESCE(departure_time, arrival_time) IS NOT NULL
+		ORDER BY agency_id, trip_id, stop_id, (COALESCE(departure_time, arrival_time) AT TIME ZONE $3::text)::date, observed_at DESC
+	),
+
+	candidates AS (
+		SELECT
+			latest.agency_id,
+			latest.route_id,
+			latest.trip_id,
+			latest.stop_id,
+			latest.actual,
+			trip.direction_id,
+
+			-- The service day starts at midnight before the trip, which
+			-- may be more than 24 hours before its later departures
+			(latest.actual - sst.departure_sec * interval '1 second' + interval '12 hours')::date +
+				sst.departure_sec * interval '1 second' AS scheduled
+
+		FROM latest
+
+		-- The live trip ID is escaped, since IDs like the subway's have
+		-- underscores, which LIKE matches to any character
+		INNER JOIN scheduled_stop_time sst ON
+			sst.agency_id = latest.agency_id AND
+			sst.route_id  = latest.route_id  AND
+			sst.stop_id   = latest.stop_id   AND
+			(sst.trip_id = latest.trip_id OR
+			 sst.trip_id LIKE '%' || replace(replace(replace(latest.trip_id, '\', '\\'), '%', '\%'), '_', '\_') ESCAPE '\')
+
+		INNER JOIN trip ON
+			trip.agency_id = sst.agency_id AND
+			trip.route_id  = sst.route_id  AND
+			trip.trip_id   = sst.trip_id
+
+		WHERE latest.actual - latest.observed < interval '` + freshness + `'
+	)
+
+	SELECT DISTINCT ON (agency_id, trip_id, stop_id, actual)
+		agency_id, route_id, direction_id, stop_id, actual, scheduled
+	FROM candidates
+	ORDER BY agency_id, trip_id, stop_id, actual, abs(extract(epoch FROM actual - scheduled))
+`
+
+// Params are the values a report is created from
+type Params struct {
+	AgencyID string
+
+	// RouteID limits the report to a single route if it's not empty
+	RouteID string
+
+	// Start and End are the range of observations to include
+	Start time.Time
+	End   time.Time
+
+	// GroupBy is which of "route", "direction", "stop" and "hour" the
+	// results are grouped by. Defaults to DefaultGroupBy if empty.
+	GroupBy []string
+
+	// Early and Late are the number of seconds before and after the
+	// schedule that a departure is on time
+	Early int
+	Late  int
+}
+
+// OTP is the on-time performance and headway regularity of a group of
+// departures. Values that aren't part of the group are null.
+type OTP struct {
+	AgencyID    string      `json:"agency_id" db:"agency_id"`
+	RouteID     null.String `json:"route_id" db:"route_id"`
+	DirectionID null.Int    `json:"direction_id" db:"direction_id"`
+	StopID      null.String `json:"stop_id" db:"stop_id"`
+
+	// Hour is the hour of the day of the scheduled departures
+	Hour null.Int `json:"hour" db:"hour"`
+
+	// Departures is how many departures were observed
+	Departures int `json:"departures" db:"departures"`
+
+	// OnTimePct is the percentage of departures that were on time
+	OnTimePct float64 `json:"on_time_pct" db:"on_time_pct"`
+
+	// AvgDelay is the average number of seconds departures were late
+	// (negative when early)
+	AvgDelay float64 `json:"avg_delay" db:"avg_delay"`
+
+	// ExcessWait is the number of seconds of excess wait time, which is
+	// null if there weren't enough departures to compare headways
+	ExcessWait null.Float `json:"excess_wait" db:"excess_wait"`
+}
+
+// departure is an observed departure matched to its schedule. Times are
+// in the time zone of the schedule, but they're read as UTC since
+// postgres doesn't return the zone, so only their clock values are used.
+type departure struct {
+	AgencyID    string    `db:"agency_id"`
+	RouteID     string    `db:"route_id"`
+	DirectionID int       `db:"direction_id"`
+	StopID      string    `db:"stop_id"`
+	Actual      time.Time `db:"actual"`
+	Scheduled   time.Time `db:"scheduled"`
+
+	// headway and scheduledHeadway are the seconds since the last
+	// departure at the same stop on the same day, or 0 for the first
+	headway          float64
+	scheduledHeadway float64
+}
+
+// delay returns the number of seconds d was late (negative when early)
+func (d *departure) delay() float64 {
+	return d.Actual.Sub(d.Scheduled).Seconds()
+}
+
+// onTime returns true if a departure delay seconds late is no more than
+// early seconds early and late seconds late
+func onTime(delay float64, early, late int) bool {
+	return delay >= float64(-early) && delay <= float64(late)
+}
+
+// excessWait returns how many more seconds riders who arrive at random
+// wait with headways than they would with scheduledHeadways. It's null if
+// there are no headways.
+func excessWait(headways, scheduledHeadways []float64) null.Float {
+	wait := func(hs []float64) (float64, bool) {
+		var sum, squares float64
+		for _, h := range hs {
+			sum += h
+			squares += h * h
+		}
+		if sum == 0 {
+			return 0, false
+		}
+		return squares / (2 * sum), true
+	}
+
+	actual, ok := wait(headways)
+	if !ok {
+		return null.Float{}
+	}
+
+	scheduled, ok := wait(scheduledHeadways)
+	if !ok {
+		return null.Float{}
+	}
+
+	return null.FloatFrom(actual - scheduled)
+}
+
+// setHeadways sets the headways of each departure. They're sorted by the
+// stop and the time they departed.
+func setHeadways(deps []*departure) {
+	sort.Sort(byStopTime(deps))
+
+	for i, d := range deps {
+		d.headway, d.scheduledHeadway = 0, 0
+		if i < 1 {
+			continue
+		}
+
+		last := deps[i-1]
+		if last.AgencyID != d.AgencyID || last.RouteID != d.RouteID ||
+			last.DirectionID != d.DirectionID || last.StopID != d.StopID ||
+			last.Actual.Format(etc.DateFormat) != d.Actual.Format(etc.DateFormat) {
+			continue
+		}
+
+		d.headway = d.Actual.Sub(last.Actual).Seconds()
+		d.scheduledHeadway = d.Scheduled.Sub(last.Scheduled).Seconds()
+	}
+}
+
+type byStopTime []*departure
+
+func (b byStopTime) Len() int      { return len(b) }
+func (b byStopTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byStopTime) Less(i, j int) bool {
+	switch {
+	case b[i].AgencyID != b[j].AgencyID:
+		return b[i].AgencyID < b[j].AgencyID
+	case b[i].RouteID != b[j].RouteID:
+		return b[i].RouteID < b[j].RouteID
+	case b[i].DirectionID != b[j].DirectionID:
+		return b[i].DirectionID < b[j].DirectionID
+	case b[i].StopID != b[j].StopID:
+		return b[i].StopID < b[j].StopID
+	default:
+		return b[i].Actual.Before(b[j].Actual)
+	}
+}
+
+// summarize returns the OTP of deps in each group of groupBy, worst first
+func summarize(deps []*departure, groupBy []string, early, late int) (results []*OTP) {
+	grouped := map[string]bool{}
+	for _, g := range groupBy {
+		grouped[g] = true
+	}
+
+	setHeadways(deps)
+
+	// The OTP of each group, along with its headways
+	type group struct {
+		otp               *OTP
+		onTime            int
+		headways          []float64
+		scheduledHeadways []float64
+	}
+	groups := map[OTP]*group{}
+
+	for _, d := range deps {
+		k := OTP{AgencyID: d.AgencyID}
+		if grouped["route"] {
+			k.RouteID = null.StringFrom(d.RouteID)
+		}
+		if grouped["direction"] {
+			k.DirectionID = null.IntFrom(int64(d.DirectionID))
+		}
+		if grouped["stop"] {
+			k.StopID = null.StringFrom(d.StopID)
+		}
+		if grouped["hour"] {
+			k.Hour = null.IntFrom(int64(d.Scheduled.Hour()))
+		}
+
+		g, exists := groups[k]
+		if !exists {
+			otp := k
+			g = &group{otp: &otp}
+			groups[k] = g
+			results = append(results, g.otp)
+		}
+
+		delay := d.delay()
+		g.otp.Departures++
+		g.otp.AvgDelay += delay
+		if onTime(delay, early, late) {
+			g.onTime++
+		}
+
+		// Only headways where both the actual and scheduled values are
+		// positive can be compared
+		if d.headway > 0 && d.scheduledHeadway > 0 {
+			g.headways = append(g.headways, d.headway)
+			g.scheduledHeadways = append(g.scheduledHeadways, d.scheduledHeadway)
+		}
+	}
+
+	for _, g := range groups {
+		g.otp.OnTimePct = 100 * float64(g.onTime) / float64(g.otp.Departures)
+		g.otp.AvgDelay /= float64(g.otp.Departures)
+		g.otp.ExcessWait = excessWait(g.headways, g.scheduledHeadways)
+	}
+
+	sort.Stable(byWorst(results))
+
+	return
+}
+
+type byWorst []*OTP
+
+func (b byWorst) Len() int      { return len(b) }
+func (b byWorst) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byWorst) Less(i, j int) bool {
+	if b[i].OnTimePct != b[j].OnTimePct {
+		return b[i].OnTimePct < b[j].OnTimePct
+	}
+	return b[i].Departures > b[j].Departures
+}
+
+// GetOTP returns the on-time performance of the departures in p, worst
+// first
+func GetOTP(db sqlx.Ext, p Params) (results []*OTP, err error) {
+	if etc.SQLite() {
+		err = models.ErrUnsupported
+		return
+	}
+
+	groupBy := p.GroupBy
+	if len(groupBy) < 1 {
+		groupBy = DefaultGroupBy
+	}
+
+	for _, g := range groupBy {
+		if !groupNames[g] {
+			err = ErrBadGroupBy
+			return
+		}
+	}
+
+	var deps []*departure
+	err = sqlx.Select(db, &deps, otpQuery,
+		p.AgencyID, p.RouteID, time.Local.String(), p.Start, p.End,
+	)
+	if err != nil {
+		log.Println("can't get otp report", err)
+		return
+	}
+
+	results = summarize(deps, groupBy, p.Early, p.Late)
+
+	return
+}
+
+// ParseDates returns the range from the start of the day start up to the
+// start of the day end, with both dates like 2016-06-12 in the local time
+// zone. The range includes the day end, so equal dates are a single day.
+// An empty start is yesterday and an empty end is the same as start.
+func ParseDates(start, end string) (s, e time.Time, err error) {
+	if len(start) < 1 {
+		y := time.Now().AddDate(0, 0, -1)
+		s = time.Date(y.Year(), y.Month(), y.Day(), 0, 0, 0, 0, time.Local)
+	} else {
+		s, err = time.ParseInLocation("2006-01-02", start, time.Local)
+		if err != nil {
+			log.Println("bad start date", start, err)
+			return
+		}
+	}
+
+	if len(end) < 1 {
+		e = s
+	} else {
+		e, err = time.ParseInLocation("2006-01-02", end, time.Local)
+		if err != nil {
+			log.Println("bad end date", end, err)
+			return
+		}
+	}
+
+	e = e.AddDate(0, 0, 1)
+
+	return
+}
+
+// WriteText writes results as a table to w
+func WriteText(w io.Writer, results []*OTP) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "agency\troute\tdir\tstop\thour\tdepartures\ton time\tavg delay\texcess wait")
+
+	str := func(s null.String) string {
+		if !s.Valid {
+			return "*"
+		}
+		return s.String
+	}
+	num := func(i null.Int) string {
+		if !i.Valid {
+			return "*"
+		}
+		return fmt.Sprint(i.Int64)
+	}
+
+	for _, r := range results {
+		ewt := "-"
+		if r.ExcessWait.Valid {
+			ewt = fmt.Sprintf("%.0fs", r.ExcessWait.Float64)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%.1f%%\t%.0fs\t%s\n",
+			r.AgencyID, str(r.RouteID), num(r.DirectionID), str(r.StopID),
+			num(r.Hour), r.Departures, r.OnTimePct, r.AvgDelay, ewt,
+		)
+	}
+
+	return tw.Flush()
+}
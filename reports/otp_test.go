@@ -0,0 +1,205 @@
+package reports
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	null "gopkg.in/guregu/null.v3"
+)
+
+// at returns a time on the day of our departures
+func at(hour, min, sec int) time.Time {
+	return time.Date(2016, 6, 12, hour, min, sec, 0, time.UTC)
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		actual    time.Time
+		scheduled time.Time
+		expected  float64
+	}{
+		{at(8, 0, 0), at(8, 0, 0), 0},
+		{at(8, 2, 30), at(8, 0, 0), 150},
+		{at(7, 59, 0), at(8, 0, 0), -60},
+
+		// A departure after midnight that was scheduled before
+		{at(24, 1, 0), at(23, 58, 0), 180},
+	}
+
+	for _, test := range tests {
+		d := &departure{Actual: test.actual, Scheduled: test.scheduled}
+		if d.delay() != test.expected {
+			t.Errorf("expected delay of %v at %v but got %v", test.expected, test.actual, d.delay())
+		}
+	}
+}
+
+func TestOnTime(t *testing.T) {
+	tests := []struct {
+		delay    float64
+		early    int
+		late     int
+		expected bool
+	}{
+		{0, DefaultEarly, DefaultLate, true},
+		{-60, DefaultEarly, DefaultLate, true},
+		{-61, DefaultEarly, DefaultLate, false},
+		{300, DefaultEarly, DefaultLate, true},
+		{301, DefaultEarly, DefaultLate, false},
+		{-1, 0, 0, false},
+		{1, 0, 0, false},
+		{0, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		actual := onTime(test.delay, test.early, test.late)
+		if actual != test.expected {
+			t.Errorf("expected %v for delay %v between -%v and %v but got %v",
+				test.expected, test.delay, test.early, test.late, actual,
+			)
+		}
+	}
+}
+
+func TestExcessWait(t *testing.T) {
+	tests := []struct {
+		name              string
+		headways          []float64
+		scheduledHeadways []float64
+		expected          null.Float
+	}{
+		{
+			name:              "as scheduled",
+			headways:          []float64{600, 600},
+			scheduledHeadways: []float64{600, 600},
+			expected:          null.FloatFrom(0),
+		},
+		{
+			// Average waits are 500s bunched vs. 300s as scheduled
+			name:              "bunched",
+			headways:          []float64{100, 900},
+			scheduledHeadways: []float64{500, 500},
+			expected:          null.FloatFrom(160),
+		},
+		{
+			name:              "evenly spaced when scheduled to bunch",
+			headways:          []float64{500, 500},
+			scheduledHeadways: []float64{100, 900},
+			expected:          null.FloatFrom(-160),
+		},
+		{
+			name:     "no headways",
+			expected: null.Float{},
+		},
+	}
+
+	for _, test := range tests {
+		actual := excessWait(test.headways, test.scheduledHeadways)
+		if actual != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	deps := []*departure{
+		// Route 1 at S1 is on time
+		{AgencyID: "A", RouteID: "1", StopID: "S1", Actual: at(8, 0, 0), Scheduled: at(8, 0, 0)},
+		{AgencyID: "A", RouteID: "1", StopID: "S1", Actual: at(8, 10, 0), Scheduled: at(8, 10, 0)},
+
+		// Route 1 at S2 is bunched, and one departure is late. They're
+		// not in order.
+		{AgencyID: "A", RouteID: "1", StopID: "S2", Actual: at(8, 19, 0), Scheduled: at(8, 10, 0)},
+		{AgencyID: "A", RouteID: "1", StopID: "S2", Actual: at(8, 5, 0), Scheduled: at(8, 0, 0)},
+		{AgencyID: "A", RouteID: "1", StopID: "S2", Actual: at(8, 21, 0), Scheduled: at(8, 20, 0)},
+
+		// The first departure of the next day has no headway
+		{AgencyID: "A", RouteID: "1", StopID: "S2", Actual: at(32, 0, 0), Scheduled: at(32, 0, 0)},
+	}
+
+	expected := []*OTP{
+		{
+			AgencyID:   "A",
+			RouteID:    null.StringFrom("1"),
+			StopID:     null.StringFrom("S2"),
+			Departures: 4,
+			OnTimePct:  75,
+			AvgDelay:   (300 + 540 + 60 + 0) / 4.0,
+			// Headways of 840s and 120s vs. 600s and 600s
+			ExcessWait: null.FloatFrom((840*840+120*120)/(2*960.0) - 300),
+		},
+		{
+			AgencyID:   "A",
+			RouteID:    null.StringFrom("1"),
+			StopID:     null.StringFrom("S1"),
+			Departures: 2,
+			OnTimePct:  100,
+			ExcessWait: null.FloatFrom(0),
+		},
+	}
+
+	actual := summarize(deps, []string{"route", "stop"}, DefaultEarly, DefaultLate)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v results but got %v", len(expected), len(actual))
+		for i := range actual {
+			t.Errorf("result %v: %+v", i, actual[i])
+		}
+	}
+
+	// Every departure in one group, by hour
+	actual = summarize(deps, []string{"hour"}, DefaultEarly, DefaultLate)
+	if len(actual) != 1 || actual[0].RouteID.Valid || !actual[0].Hour.Valid ||
+		actual[0].Hour.Int64 != 8 || actual[0].Departures != 6 {
+
+		t.Errorf("unexpected results by hour %+v", actual)
+	}
+}
+
+func TestParseDates(t *testing.T) {
+	today := time.Now()
+	yesterday := time.Date(today.Year(), today.Month(), today.Day()-1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		start string
+		end   string
+		s     time.Time
+		e     time.Time
+		err   bool
+	}{
+		{
+			start: "2016-06-12",
+			end:   "2016-06-14",
+			s:     time.Date(2016, 6, 12, 0, 0, 0, 0, time.Local),
+			e:     time.Date(2016, 6, 15, 0, 0, 0, 0, time.Local),
+		},
+		{
+			// Only the start day
+			start: "2016-06-12",
+			s:     time.Date(2016, 6, 12, 0, 0, 0, 0, time.Local),
+			e:     time.Date(2016, 6, 13, 0, 0, 0, 0, time.Local),
+		},
+		{
+			// Yesterday
+			s: yesterday,
+			e: yesterday.AddDate(0, 0, 1),
+		},
+		{start: "06/12/2016", err: true},
+		{start: "2016-06-12", end: "tomorrow", err: true},
+	}
+
+	for _, test := range tests {
+		s, e, err := ParseDates(test.start, test.end)
+		if (err != nil) != test.err {
+			t.Errorf("%v-%v: expected error %v but got %v", test.start, test.end, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if !s.Equal(test.s) || !e.Equal(test.e) {
+			t.Errorf("%v-%v: expected %v-%v but got %v-%v", test.start, test.end, test.s, test.e, s, e)
+		}
+	}
+}
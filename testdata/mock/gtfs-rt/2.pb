@@ -0,0 +1,55 @@
+
+
+1.0
+046850_L..N
+3>
+0L 0748+ RPY/8AV
+046850_L..N20160612*L>
+11"L10N>
+11"L08N>
+11"L06N>
+11"L05N>
+11"L03NU
+046850_L..Nv"E
+3>
+0L 0748+ RPY/8AV
+046850_L..N20160612*L(:L10NH
+047400_L..N
+3>
+0L 0754+ RPY/8AV
+047400_L..N20160612*L>
+11ڠ"L10N>
+11ܡ"L08N>
+11ޢ"L06N>
+11"L05N>
+11"L03NU
+047400_L..Nv"E
+3>
+0L 0754+ RPY/8AV
+047400_L..N20160612*L(:L10NH
+047050_L..S
+3>
+0L 0750+ 8AV/RPY
+047050_L..S20160612*L>
+11֞"L03S>
+11؟"L05S>
+11ڠ"L06S>
+11ܡ"L08S>
+11ޢ"L10SU
+047050_L..Sv"E
+3>
+0L 0750+ 8AV/RPY
+047050_L..S20160612*L(:L03SH
+047650_L..S
+3>
+0L 0756+ 8AV/RPY
+047650_L..S20160612*L>
+11ȡܡ"L03S>
+11ʢޢ"L05S>
+11̣"L06S>
+11Τ"L08S>
+11Х"L10SU
+047650_L..Sv"E
+3>
+0L 0756+ 8AV/RPY
+047650_L..S20160612*L(:L03SH
\ No newline at end of file
@@ -103,6 +103,16 @@ Stop.prototype.createDepartures = function() {
     if (departures != null) {
         for (var i = 0; i < departures.length; i++) {
             text += " " + self.timeFormat(departures[i].time);
+
+            // Show how far away the next vehicle is, e.g., "1 stop away"
+            if (i == 0 && departures[i].presentable_distance) {
+                text += " (" + departures[i].presentable_distance + ")";
+            }
+
+            // Show how crowded the vehicle is, e.g., "standing room only"
+            if (departures[i].occupancy) {
+                text += " [" + departures[i].occupancy.replace(/_/g, " ") + "]";
+            }
         }
     }
 